@@ -5,6 +5,7 @@ import (
 	"math/big"
 	"reflect"
 
+	ma "gx/ipfs/QmNTCey11oxhb1AxDnQBRHtdhap6Ctud872NjAYPYYXPuc/go-multiaddr"
 	"gx/ipfs/QmSKyB5faguXT4NqbrXpnRXqaVj5DhSm7x9BtzFydBY1UK/go-leb128"
 	"gx/ipfs/QmTu65MVbemtUxJEWgsTtzv9Zv9P8rvmqNA4eG9TrTRGYc/go-libp2p-peer"
 	cbor "gx/ipfs/QmcZLyosDwMKdB6NLRsiss9HXzDPhVhhRtPy67JFKTDQDX/go-ipld-cbor"
@@ -32,7 +33,9 @@ const (
 	ChannelID
 	// BlockHeight is a *types.BlockHeight
 	BlockHeight
-	// Integer is a *big.Int
+	// Integer is a *big.Int. Non-negative integers are encoded as their
+	// big-endian bytes; negative integers as a zero byte followed by the
+	// big-endian bytes of their absolute value.
 	Integer
 	// Bytes is a []byte
 	Bytes
@@ -46,6 +49,8 @@ const (
 	SectorID
 	// CommitmentsMap is a map of stringified sector id (uint64) to commitments
 	CommitmentsMap
+	// Multiaddrs is a list of libp2p multiaddrs
+	Multiaddrs
 )
 
 func (t Type) String() string {
@@ -76,6 +81,8 @@ func (t Type) String() string {
 		return "uint64"
 	case CommitmentsMap:
 		return "map[string]Commitments"
+	case Multiaddrs:
+		return "[]ma.Multiaddr"
 	default:
 		return "<unknown type>"
 	}
@@ -115,6 +122,8 @@ func (av *Value) String() string {
 		return fmt.Sprint(av.Val.(uint64))
 	case CommitmentsMap:
 		return fmt.Sprint(av.Val.(map[string]types.Commitments))
+	case Multiaddrs:
+		return fmt.Sprint(av.Val.([]ma.Multiaddr))
 	default:
 		return "<unknown type>"
 	}
@@ -172,6 +181,9 @@ func (av *Value) Serialize() ([]byte, error) {
 		if !ok {
 			return nil, &typeError{&big.Int{}, av.Val}
 		}
+		if intgr.Sign() < 0 {
+			return append([]byte{0}, intgr.Bytes()...), nil
+		}
 		return intgr.Bytes(), nil
 	case Bytes:
 		b, ok := av.Val.([]byte)
@@ -214,6 +226,17 @@ func (av *Value) Serialize() ([]byte, error) {
 		}
 
 		return cbor.DumpObject(m)
+	case Multiaddrs:
+		addrs, ok := av.Val.([]ma.Multiaddr)
+		if !ok {
+			return nil, &typeError{[]ma.Multiaddr{}, av.Val}
+		}
+
+		raw := make([][]byte, len(addrs))
+		for i, a := range addrs {
+			raw[i] = a.Bytes()
+		}
+		return cbor.DumpObject(raw)
 	default:
 		return nil, fmt.Errorf("unrecognized Type: %d", av.Type)
 	}
@@ -253,6 +276,8 @@ func ToValues(i []interface{}) ([]*Value, error) {
 			out = append(out, &Value{Type: SectorID, Val: v})
 		case map[string]types.Commitments:
 			out = append(out, &Value{Type: CommitmentsMap, Val: v})
+		case []ma.Multiaddr:
+			out = append(out, &Value{Type: Multiaddrs, Val: v})
 		default:
 			return nil, fmt.Errorf("unsupported type: %T", v)
 		}
@@ -314,6 +339,12 @@ func Deserialize(data []byte, t Type) (*Value, error) {
 			Val:  types.NewBlockHeightFromBytes(data),
 		}, nil
 	case Integer:
+		if len(data) > 0 && data[0] == 0 {
+			return &Value{
+				Type: t,
+				Val:  big.NewInt(0).Neg(big.NewInt(0).SetBytes(data[1:])),
+			}, nil
+		}
 		return &Value{
 			Type: t,
 			Val:  big.NewInt(0).SetBytes(data),
@@ -357,6 +388,23 @@ func Deserialize(data []byte, t Type) (*Value, error) {
 			Type: t,
 			Val:  m,
 		}, nil
+	case Multiaddrs:
+		var raw [][]byte
+		if err := cbor.DecodeInto(data, &raw); err != nil {
+			return nil, err
+		}
+		addrs := make([]ma.Multiaddr, len(raw))
+		for i, b := range raw {
+			a, err := ma.NewMultiaddrBytes(b)
+			if err != nil {
+				return nil, err
+			}
+			addrs[i] = a
+		}
+		return &Value{
+			Type: t,
+			Val:  addrs,
+		}, nil
 	case Invalid:
 		return nil, ErrInvalidType
 	default:
@@ -377,6 +425,7 @@ var typeTable = map[Type]reflect.Type{
 	PeerID:         reflect.TypeOf(peer.ID("")),
 	SectorID:       reflect.TypeOf(uint64(0)),
 	CommitmentsMap: reflect.TypeOf(map[string]types.Commitments{}),
+	Multiaddrs:     reflect.TypeOf([]ma.Multiaddr{}),
 }
 
 // TypeMatches returns whether or not 'val' is the go type expected for the given ABI type
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/filecoin-project/go-filecoin/address"
+	ma "gx/ipfs/QmNTCey11oxhb1AxDnQBRHtdhap6Ctud872NjAYPYYXPuc/go-multiaddr"
 	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/assert"
 )
 
@@ -18,6 +19,7 @@ func TestBasicEncodingRoundTrip(t *testing.T) {
 	cases := map[string][]interface{}{
 		"empty":      nil,
 		"one-int":    {big.NewInt(579)},
+		"negative":   {big.NewInt(-579)},
 		"one addr":   {addrGetter()},
 		"two addrs":  {addrGetter(), addrGetter()},
 		"one []byte": {[]byte("foo")},
@@ -25,6 +27,7 @@ func TestBasicEncodingRoundTrip(t *testing.T) {
 		"a string":   {"flugzeug"},
 		"mixed":      {big.NewInt(17), []byte("beep"), "mr rogers", addrGetter()},
 		"sector ids": {uint64(1234), uint64(0)},
+		"multiaddrs": {[]ma.Multiaddr{mustMultiaddr("/ip4/127.0.0.1/tcp/6000"), mustMultiaddr("/ip6/::1/tcp/443")}},
 	}
 
 	for tname, tcase := range cases {
@@ -50,6 +53,14 @@ func TestBasicEncodingRoundTrip(t *testing.T) {
 	}
 }
 
+func mustMultiaddr(s string) ma.Multiaddr {
+	a, err := ma.NewMultiaddr(s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
 type fooTestStruct struct {
 	Bar string
 	Baz uint64
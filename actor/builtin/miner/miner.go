@@ -1,10 +1,13 @@
 package miner
 
 import (
+	"context"
+	"crypto/sha256"
 	"math/big"
 	"os"
-	"strconv"
+	"sort"
 
+	multiaddr "gx/ipfs/QmNTCey11oxhb1AxDnQBRHtdhap6Ctud872NjAYPYYXPuc/go-multiaddr"
 	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
 	"gx/ipfs/QmTu65MVbemtUxJEWgsTtzv9Zv9P8rvmqNA4eG9TrTRGYc/go-libp2p-peer"
 	xerrors "gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
@@ -28,6 +31,9 @@ func init() {
 // MaximumPublicKeySize is a limit on how big a public key can be.
 const MaximumPublicKeySize = 100
 
+// MaximumMultiaddrs is a limit on how many multiaddrs a miner can advertise.
+const MaximumMultiaddrs = 16
+
 // PoStProofLength is the length of a single proof-of-spacetime proof (in bytes).
 const PoStProofLength = 192
 
@@ -42,6 +48,14 @@ var ProvingPeriodBlocks = types.NewBlockHeight(20000)
 // See https://github.com/filecoin-project/go-filecoin/issues/1887
 var GracePeriodBlocks = types.NewBlockHeight(100)
 
+// WorkerChangeDelayBlocks is the number of blocks after which a new worker
+// set with ChangeWorker takes over from the current one, giving proofs already
+// in flight from the old worker time to land.
+var WorkerChangeDelayBlocks = types.NewBlockHeight(100)
+
+// MinimumCollateralPerSector is the minimum amount of collateral required per sector
+var MinimumCollateralPerSector, _ = types.NewAttoFILFromFILString("0.001")
+
 const (
 	// ErrPublicKeyTooBig indicates an invalid public key.
 	ErrPublicKeyTooBig = 33
@@ -61,6 +75,21 @@ const (
 	ErrAskNotFound = 40
 	// ErrInvalidSealProof signals that the passed in seal proof was invalid.
 	ErrInvalidSealProof = 41
+	// ErrNoStorageFault signals that a miner could not be slashed because it
+	// has not missed a proving period.
+	ErrNoStorageFault = 42
+	// ErrInsufficientCollateral signals that the miner's collateral would not
+	// cover its pledge or its committed sectors.
+	ErrInsufficientCollateral = 43
+	// ErrTooManyMultiaddrs signals that a miner tried to advertise more than
+	// MaximumMultiaddrs multiaddrs.
+	ErrTooManyMultiaddrs = 44
+	// ErrPieceNotIncluded signals that a piece is not stored in a live sector
+	// of the miner.
+	ErrPieceNotIncluded = 45
+	// ErrInvalidPoStChallenge signals that a PoSt answered the challenge of
+	// another proving period than the miner's current one.
+	ErrInvalidPoStChallenge = 46
 )
 
 // Errors map error codes to revert errors this actor may return.
@@ -74,6 +103,11 @@ var Errors = map[uint8]error{
 	ErrInvalidPoSt:             errors.NewCodedRevertErrorf(ErrInvalidPoSt, "PoSt proof did not validate"),
 	ErrAskNotFound:             errors.NewCodedRevertErrorf(ErrAskNotFound, "no ask was found"),
 	ErrInvalidSealProof:        errors.NewCodedRevertErrorf(ErrInvalidSealProof, "seal proof was invalid"),
+	ErrNoStorageFault:          errors.NewCodedRevertErrorf(ErrNoStorageFault, "miner has not missed a proving period"),
+	ErrInsufficientCollateral:  errors.NewCodedRevertErrorf(ErrInsufficientCollateral, "collateral must be more than %s FIL per sector", MinimumCollateralPerSector),
+	ErrTooManyMultiaddrs:       errors.NewCodedRevertErrorf(ErrTooManyMultiaddrs, "miners may advertise at most %d multiaddrs", MaximumMultiaddrs),
+	ErrPieceNotIncluded:        errors.NewCodedRevertErrorf(ErrPieceNotIncluded, "piece is not stored in a live sector"),
+	ErrInvalidPoStChallenge:    errors.NewCodedRevertErrorf(ErrInvalidPoStChallenge, "PoSt challenge height is not the start of the proving period"),
 }
 
 // Actor is the miner actor.
@@ -86,8 +120,13 @@ var Errors = map[uint8]error{
 // The `Bootstrap` field must be set to `true` if the miner was created in the
 // genesis block. If the miner was created in any other block, `Bootstrap` must
 // be false.
+//
+// `PoStVerifier` verifies the proofs-of-spacetime the miner submits. It is the
+// rust verifier if nil, and is only set by tests, which can not generate
+// proofs for a given challenge.
 type Actor struct {
-	Bootstrap bool
+	Bootstrap    bool
+	PoStVerifier proofs.Verifier
 }
 
 // Ask is a price advertisement by the miner
@@ -101,9 +140,22 @@ type Ask struct {
 type State struct {
 	Owner address.Address
 
+	// Worker is the address allowed to commit sectors and submit PoSts in
+	// addition to the owner, so that the machine doing so need not hold the
+	// owner's key. Miners created before workers were introduced have none.
+	Worker address.Address
+
+	// NextWorker replaces Worker from NextWorkerHeight on.
+	NextWorker       address.Address
+	NextWorkerHeight *types.BlockHeight
+
 	// PeerID references the libp2p identity that the miner is operating.
 	PeerID peer.ID
 
+	// Multiaddrs are the encoded multiaddrs the miner can be dialed on, so
+	// that clients need not find them through the DHT.
+	Multiaddrs [][]byte
+
 	// PublicKey is used to validate blocks generated by the miner this actor represents.
 	PublicKey []byte
 
@@ -118,18 +170,37 @@ type State struct {
 	Asks      []*Ask
 	NextAskID *big.Int
 
-	// SectorCommitments maps sector id to commitments, for all sectors this
-	// miner has committed. Due to a bug in refmt, the sector id-keys need to be
-	// stringified.
+	// Sectors is the root of a lookup from sector id to commitments, for all
+	// sectors this miner has committed. Due to a bug in refmt, the sector
+	// id-keys need to be stringified.
 	//
 	// See also: https://github.com/polydawn/refmt/issues/35
-	SectorCommitments map[string]types.Commitments
+	Sectors cid.Cid `refmt:",omitempty"`
+
+	// SectorIndex is the root of a lookup from the order in which sectors were
+	// committed to their sector id, used to page through sectors.
+	SectorIndex cid.Cid `refmt:",omitempty"`
+
+	// SectorCount is the number of sectors this miner has committed.
+	SectorCount uint64
+
+	// SectorCommitments holds the commitments of miners created before
+	// sectors were kept in the Sectors lookup. They are moved into the lookup
+	// the next time the miner's sectors are accessed.
+	SectorCommitments map[string]types.Commitments `refmt:",omitempty"`
 
 	LastUsedSectorID uint64
 
 	ProvingPeriodStart *types.BlockHeight
 	LastPoSt           *types.BlockHeight
 
+	// Faults are the sectors declared faulty in the miner's most recent PoSt.
+	Faults []uint64
+
+	// SlashedAt is the block height at which the miner last lost its power for
+	// missing a proving period.
+	SlashedAt *types.BlockHeight
+
 	Power *big.Int
 }
 
@@ -141,14 +212,14 @@ func NewActor() *actor.Actor {
 // NewState creates a miner state struct
 func NewState(owner address.Address, key []byte, pledge *big.Int, pid peer.ID, collateral *types.AttoFIL) *State {
 	return &State{
-		Owner:             owner,
-		PeerID:            pid,
-		PublicKey:         key,
-		PledgeSectors:     pledge,
-		Collateral:        collateral,
-		SectorCommitments: make(map[string]types.Commitments),
-		Power:             big.NewInt(0),
-		NextAskID:         big.NewInt(0),
+		Owner:         owner,
+		Worker:        owner,
+		PeerID:        pid,
+		PublicKey:     key,
+		PledgeSectors: pledge,
+		Collateral:    collateral,
+		Power:         big.NewInt(0),
+		NextAskID:     big.NewInt(0),
 	}
 }
 
@@ -193,16 +264,36 @@ var minerExports = exec.Exports{
 		Params: []abi.Type{abi.Integer},
 		Return: []abi.Type{abi.Bytes},
 	},
+	"removeAsk": &exec.FunctionSignature{
+		Params: []abi.Type{abi.Integer},
+		Return: []abi.Type{},
+	},
 	"getOwner": &exec.FunctionSignature{
 		Params: nil,
 		Return: []abi.Type{abi.Address},
 	},
+	"getWorker": &exec.FunctionSignature{
+		Params: nil,
+		Return: []abi.Type{abi.Address},
+	},
+	"changeWorker": &exec.FunctionSignature{
+		Params: []abi.Type{abi.Address},
+		Return: []abi.Type{},
+	},
+	"changeOwner": &exec.FunctionSignature{
+		Params: []abi.Type{abi.Address},
+		Return: []abi.Type{},
+	},
 	"getLastUsedSectorID": &exec.FunctionSignature{
 		Params: nil,
 		Return: []abi.Type{abi.SectorID},
 	},
 	"commitSector": &exec.FunctionSignature{
-		Params: []abi.Type{abi.SectorID, abi.Bytes, abi.Bytes, abi.Bytes, abi.Bytes},
+		Params: []abi.Type{abi.SectorID, abi.Bytes, abi.Bytes, abi.Bytes, abi.Bytes, abi.UintArray},
+		Return: []abi.Type{},
+	},
+	"terminateSectors": &exec.FunctionSignature{
+		Params: []abi.Type{abi.UintArray},
 		Return: []abi.Type{},
 	},
 	"getKey": &exec.FunctionSignature{
@@ -217,16 +308,40 @@ var minerExports = exec.Exports{
 		Params: []abi.Type{abi.PeerID},
 		Return: []abi.Type{},
 	},
+	"getMultiaddrs": &exec.FunctionSignature{
+		Params: []abi.Type{},
+		Return: []abi.Type{abi.Multiaddrs},
+	},
+	"updateMultiaddrs": &exec.FunctionSignature{
+		Params: []abi.Type{abi.Multiaddrs},
+		Return: []abi.Type{},
+	},
 	"getPledge": &exec.FunctionSignature{
 		Params: []abi.Type{},
 		Return: []abi.Type{abi.Integer},
 	},
+	"addCollateral": &exec.FunctionSignature{
+		Params: []abi.Type{},
+		Return: []abi.Type{},
+	},
+	"increasePledge": &exec.FunctionSignature{
+		Params: []abi.Type{abi.Integer},
+		Return: []abi.Type{},
+	},
+	"withdrawBalance": &exec.FunctionSignature{
+		Params: []abi.Type{abi.AttoFIL},
+		Return: []abi.Type{},
+	},
 	"getPower": &exec.FunctionSignature{
 		Params: []abi.Type{},
 		Return: []abi.Type{abi.Integer},
 	},
 	"submitPoSt": &exec.FunctionSignature{
-		Params: []abi.Type{abi.Bytes},
+		Params: []abi.Type{abi.Bytes, abi.UintArray, abi.BlockHeight},
+		Return: []abi.Type{},
+	},
+	"slashStorageFault": &exec.FunctionSignature{
+		Params: []abi.Type{},
 		Return: []abi.Type{},
 	},
 	"getProvingPeriodStart": &exec.FunctionSignature{
@@ -237,6 +352,22 @@ var minerExports = exec.Exports{
 		Params: nil,
 		Return: []abi.Type{abi.CommitmentsMap},
 	},
+	"getSectorCommitmentsPage": &exec.FunctionSignature{
+		Params: []abi.Type{abi.Integer, abi.Integer},
+		Return: []abi.Type{abi.CommitmentsMap},
+	},
+	"getSectorsPage": &exec.FunctionSignature{
+		Params: []abi.Type{abi.Integer, abi.Integer},
+		Return: []abi.Type{abi.Bytes},
+	},
+	"getSectorCount": &exec.FunctionSignature{
+		Params: nil,
+		Return: []abi.Type{abi.Integer},
+	},
+	"verifyPieceInclusion": &exec.FunctionSignature{
+		Params: []abi.Type{abi.Bytes, abi.BlockHeight, abi.Integer},
+		Return: nil,
+	},
 }
 
 // Exports returns the miner actors exported functions.
@@ -260,14 +391,7 @@ func (ma *Actor) AddAsk(ctx exec.VMContext, price *types.AttoFIL, expiry *big.In
 		id := big.NewInt(0).Set(state.NextAskID)
 		state.NextAskID = state.NextAskID.Add(state.NextAskID, big.NewInt(1))
 
-		// filter out expired asks
-		asks := state.Asks
-		state.Asks = state.Asks[:0]
-		for _, a := range asks {
-			if ctx.BlockHeight().LessThan(a.Expiry) {
-				state.Asks = append(state.Asks, a)
-			}
-		}
+		state.pruneExpiredAsks(ctx.BlockHeight())
 
 		if !expiry.IsUint64() {
 			return nil, errors.NewRevertError("expiry was invalid")
@@ -302,8 +426,12 @@ func (ma *Actor) GetAsks(ctx exec.VMContext) ([]uint64, uint8, error) {
 	}
 	var state State
 	out, err := actor.WithState(ctx, &state, func() (interface{}, error) {
+		// expired asks are left out, but only pruned by methods changing asks
 		var askids []uint64
 		for _, ask := range state.Asks {
+			if ask.expired(ctx.BlockHeight()) {
+				continue
+			}
 			if !ask.ID.IsUint64() {
 				return nil, errors.NewFaultErrorf("miner ask has invalid ID (bad invariant)")
 			}
@@ -363,6 +491,54 @@ func (ma *Actor) GetAsk(ctx exec.VMContext, askid *big.Int) ([]byte, uint8, erro
 	return ask, 0, nil
 }
 
+// RemoveAsk withdraws one of the miner's asks before it expires.
+func (ma *Actor) RemoveAsk(ctx exec.VMContext, askid *big.Int) (uint8, error) {
+	if err := ctx.Charge(100); err != nil {
+		return exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	var state State
+	_, err := actor.WithState(ctx, &state, func() (interface{}, error) {
+		if ctx.Message().From != state.Owner {
+			return nil, Errors[ErrCallerUnauthorized]
+		}
+
+		state.pruneExpiredAsks(ctx.BlockHeight())
+
+		for i, a := range state.Asks {
+			if a.ID.Cmp(askid) == 0 {
+				state.Asks = append(state.Asks[:i], state.Asks[i+1:]...)
+				return nil, nil
+			}
+		}
+
+		return nil, Errors[ErrAskNotFound]
+	})
+	if err != nil {
+		return errors.CodeError(err), err
+	}
+
+	return 0, nil
+}
+
+// expired returns whether the ask has expired by the given block height.
+// Queries run without a block height see no ask as expired.
+func (ask *Ask) expired(height *types.BlockHeight) bool {
+	return height != nil && !height.LessThan(ask.Expiry)
+}
+
+// pruneExpiredAsks drops the asks that have expired by the given block
+// height.
+func (state *State) pruneExpiredAsks(height *types.BlockHeight) {
+	asks := state.Asks
+	state.Asks = state.Asks[:0]
+	for _, a := range asks {
+		if !a.expired(height) {
+			state.Asks = append(state.Asks, a)
+		}
+	}
+}
+
 // GetOwner returns the miners owner.
 func (ma *Actor) GetOwner(ctx exec.VMContext) (address.Address, uint8, error) {
 	if err := ctx.Charge(100); err != nil {
@@ -385,6 +561,100 @@ func (ma *Actor) GetOwner(ctx exec.VMContext) (address.Address, uint8, error) {
 	return a, 0, nil
 }
 
+// GetWorker returns the address currently allowed to commit sectors and submit
+// PoSts for the miner.
+func (ma *Actor) GetWorker(ctx exec.VMContext) (address.Address, uint8, error) {
+	if err := ctx.Charge(100); err != nil {
+		return address.Address{}, exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	var state State
+	out, err := actor.WithState(ctx, &state, func() (interface{}, error) {
+		return state.worker(ctx.BlockHeight()), nil
+	})
+	if err != nil {
+		return address.Address{}, errors.CodeError(err), err
+	}
+
+	a, ok := out.(address.Address)
+	if !ok {
+		return address.Address{}, 1, errors.NewFaultErrorf("expected an Address return value from call, but got %T instead", out)
+	}
+
+	return a, 0, nil
+}
+
+// ChangeWorker replaces the miner's worker. The new worker takes over after
+// WorkerChangeDelayBlocks; until then the current worker remains in place.
+func (ma *Actor) ChangeWorker(ctx exec.VMContext, worker address.Address) (uint8, error) {
+	if err := ctx.Charge(100); err != nil {
+		return exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	var state State
+	_, err := actor.WithState(ctx, &state, func() (interface{}, error) {
+		if ctx.Message().From != state.Owner {
+			return nil, Errors[ErrCallerUnauthorized]
+		}
+
+		state.Worker = state.worker(ctx.BlockHeight())
+		state.NextWorker = worker
+		state.NextWorkerHeight = ctx.BlockHeight().Add(WorkerChangeDelayBlocks)
+		return nil, nil
+	})
+	if err != nil {
+		return errors.CodeError(err), err
+	}
+
+	return 0, nil
+}
+
+// ChangeOwner transfers control of the miner to a new owner, effective
+// immediately.
+func (ma *Actor) ChangeOwner(ctx exec.VMContext, owner address.Address) (uint8, error) {
+	if err := ctx.Charge(100); err != nil {
+		return exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	if owner.Empty() {
+		return 1, errors.NewRevertError("owner must not be empty")
+	}
+
+	var state State
+	_, err := actor.WithState(ctx, &state, func() (interface{}, error) {
+		if ctx.Message().From != state.Owner {
+			return nil, Errors[ErrCallerUnauthorized]
+		}
+
+		state.Owner = owner
+		return nil, nil
+	})
+	if err != nil {
+		return errors.CodeError(err), err
+	}
+
+	return 0, nil
+}
+
+// worker returns the miner's worker at the given block height. Queries made
+// without a block height see the current worker.
+func (state *State) worker(height *types.BlockHeight) address.Address {
+	if state.NextWorkerHeight != nil && height != nil && height.GreaterEqual(state.NextWorkerHeight) {
+		return state.NextWorker
+	}
+	return state.Worker
+}
+
+// isOwnerOrWorker returns true if addr may commit sectors and submit PoSts
+// for the miner at the given block height.
+func (state *State) isOwnerOrWorker(addr address.Address, height *types.BlockHeight) bool {
+	if addr == state.Owner {
+		return true
+	}
+	worker := state.worker(height)
+	return !worker.Empty() && addr == worker
+}
+
 // GetLastUsedSectorID returns the last used sector id.
 func (ma *Actor) GetLastUsedSectorID(ctx exec.VMContext) (uint64, uint8, error) {
 	if err := ctx.Charge(100); err != nil {
@@ -407,6 +677,8 @@ func (ma *Actor) GetLastUsedSectorID(ctx exec.VMContext) (uint64, uint8, error)
 }
 
 // GetSectorCommitments returns all sector commitments posted by this miner.
+// This loads every sector; callers that can should use
+// GetSectorCommitmentsPage instead.
 func (ma *Actor) GetSectorCommitments(ctx exec.VMContext) (map[string]types.Commitments, uint8, error) {
 	if err := ctx.Charge(100); err != nil {
 		return nil, exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
@@ -414,7 +686,15 @@ func (ma *Actor) GetSectorCommitments(ctx exec.VMContext) (map[string]types.Comm
 
 	var state State
 	out, err := actor.WithState(ctx, &state, func() (interface{}, error) {
-		return state.SectorCommitments, nil
+		sectors, err := loadSectorSet(context.Background(), ctx.Storage(), &state)
+		if err != nil {
+			return nil, err
+		}
+		all, err := sectors.All(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		return commitmentsMap(all), nil
 	})
 	if err != nil {
 		return map[string]types.Commitments{}, errors.CodeError(err), err
@@ -428,132 +708,380 @@ func (ma *Actor) GetSectorCommitments(ctx exec.VMContext) (map[string]types.Comm
 	return a, 0, nil
 }
 
-// CommitSector adds a commitment to the specified sector. The sector must not
-// already be committed.
-func (ma *Actor) CommitSector(ctx exec.VMContext, sectorID uint64, commD, commR, commRStar, proof []byte) (uint8, error) {
+// GetSectorCommitmentsPage returns the commitments of at most limit sectors,
+// starting at the given position in this miner's sector index. Sectors are
+// indexed in the order they were committed, except that when a sector is
+// removed the last sector in the index takes its place. At most
+// MaximumSectorPageSize sectors are returned.
+func (ma *Actor) GetSectorCommitmentsPage(ctx exec.VMContext, offset, limit *big.Int) (map[string]types.Commitments, uint8, error) {
 	if err := ctx.Charge(100); err != nil {
-		return exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+		return nil, exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
 	}
-	if len(commD) != int(proofs.CommitmentBytesLen) {
-		return 1, errors.NewRevertError("invalid sized commD")
+
+	if offset.Sign() < 0 || !offset.IsUint64() {
+		return nil, 1, errors.NewRevertError("offset was invalid")
 	}
-	if len(commR) != int(proofs.CommitmentBytesLen) {
-		return 1, errors.NewRevertError("invalid sized commR")
+	if limit.Sign() < 0 || !limit.IsUint64() {
+		return nil, 1, errors.NewRevertError("limit was invalid")
 	}
-	if len(commRStar) != int(proofs.CommitmentBytesLen) {
-		return 1, errors.NewRevertError("invalid sized commRStar")
+	n := limit.Uint64()
+	if n > MaximumSectorPageSize {
+		n = MaximumSectorPageSize
 	}
 
-	if !ma.Bootstrap {
-		// This unfortunate environment variable-checking needs to happen because
-		// the PoRep verification operation needs to know some things (e.g. size)
-		// about the sector for which the proof was generated in order to verify.
-		//
-		// It is undefined behavior for a miner in "Live" mode to verify a proof
-		// created by a miner in "ProofsTest" mode (and vice-versa).
-		//
-		sectorStoreType := proofs.Live
-		if os.Getenv("FIL_USE_SMALL_SECTORS") == "true" {
-			sectorStoreType = proofs.Test
-		}
-
-		req := proofs.VerifySealRequest{}
-		copy(req.CommD[:], commD)
-		copy(req.CommR[:], commR)
-		copy(req.CommRStar[:], commRStar)
-		copy(req.Proof[:], proof)
-		req.ProverID = sectorbuilder.AddressToProverID(ctx.Message().To)
-		req.SectorID = sectorbuilder.SectorIDToBytes(sectorID)
-		req.StoreType = sectorStoreType
-
-		res, err := (&proofs.RustVerifier{}).VerifySeal(req)
+	var state State
+	out, err := actor.WithState(ctx, &state, func() (interface{}, error) {
+		sectors, err := loadSectorSet(context.Background(), ctx.Storage(), &state)
 		if err != nil {
-			return 1, errors.RevertErrorWrap(err, "failed to verify seal proof")
+			return nil, err
 		}
-		if !res.IsValid {
-			return ErrInvalidSealProof, Errors[ErrInvalidSealProof]
+		page, err := sectors.Page(context.Background(), offset.Uint64(), n)
+		if err != nil {
+			return nil, err
 		}
+		return commitmentsMap(page), nil
+	})
+	if err != nil {
+		return map[string]types.Commitments{}, errors.CodeError(err), err
 	}
 
-	// TODO: use uint64 instead of this abomination, once refmt is fixed
-	// https://github.com/polydawn/refmt/issues/35
-	sectorIDstr := strconv.FormatUint(sectorID, 10)
+	a, ok := out.(map[string]types.Commitments)
+	if !ok {
+		return map[string]types.Commitments{}, 1, errors.NewFaultErrorf("expected a map[string]types.Commitments, but got %T instead", out)
+	}
 
-	var state State
-	_, err := actor.WithState(ctx, &state, func() (interface{}, error) {
-		// verify that the caller is authorized to perform update
-		if ctx.Message().From != state.Owner {
-			return nil, Errors[ErrCallerUnauthorized]
-		}
+	return a, 0, nil
+}
 
-		_, ok := state.SectorCommitments[sectorIDstr]
-		if ok {
-			return nil, Errors[ErrSectorCommitted]
-		}
+// GetSectorsPage is like GetSectorCommitmentsPage, but returns the
+// cbor-encoded Sectors, including their expiration.
+func (ma *Actor) GetSectorsPage(ctx exec.VMContext, offset, limit *big.Int) ([]byte, uint8, error) {
+	if err := ctx.Charge(100); err != nil {
+		return nil, exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
 
-		if state.Power.Cmp(big.NewInt(0)) == 0 {
-			state.ProvingPeriodStart = ctx.BlockHeight()
-		}
-		inc := big.NewInt(1)
-		state.Power = state.Power.Add(state.Power, inc)
-		comms := types.Commitments{
-			CommD:     proofs.CommD{},
-			CommR:     proofs.CommR{},
-			CommRStar: proofs.CommRStar{},
-		}
-		copy(comms.CommD[:], commD)
-		copy(comms.CommR[:], commR)
-		copy(comms.CommRStar[:], commRStar)
-		state.LastUsedSectorID = sectorID
-		state.SectorCommitments[sectorIDstr] = comms
-		_, ret, err := ctx.Send(address.StorageMarketAddress, "updatePower", nil, []interface{}{inc})
+	if offset.Sign() < 0 || !offset.IsUint64() {
+		return nil, 1, errors.NewRevertError("offset was invalid")
+	}
+	if limit.Sign() < 0 || !limit.IsUint64() {
+		return nil, 1, errors.NewRevertError("limit was invalid")
+	}
+	n := limit.Uint64()
+	if n > MaximumSectorPageSize {
+		n = MaximumSectorPageSize
+	}
+
+	var state State
+	out, err := actor.WithState(ctx, &state, func() (interface{}, error) {
+		sectors, err := loadSectorSet(context.Background(), ctx.Storage(), &state)
 		if err != nil {
 			return nil, err
 		}
-		if ret != 0 {
-			return nil, Errors[ErrStoragemarketCallFailed]
+		page, err := sectors.Page(context.Background(), offset.Uint64(), n)
+		if err != nil {
+			return nil, err
 		}
-		return nil, nil
+		return cbor.DumpObject(page)
 	})
 	if err != nil {
-		return errors.CodeError(err), err
+		return nil, errors.CodeError(err), err
 	}
 
-	return 0, nil
+	page, ok := out.([]byte)
+	if !ok {
+		return nil, 1, errors.NewFaultErrorf("expected a Bytes return value from call, but got %T instead", out)
+	}
+
+	return page, 0, nil
 }
 
-// GetKey returns the public key for this miner.
-func (ma *Actor) GetKey(ctx exec.VMContext) ([]byte, uint8, error) {
+// GetSectorCount returns the number of sectors this miner has committed.
+func (ma *Actor) GetSectorCount(ctx exec.VMContext) (*big.Int, uint8, error) {
 	if err := ctx.Charge(100); err != nil {
 		return nil, exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
 	}
 
 	var state State
 	out, err := actor.WithState(ctx, &state, func() (interface{}, error) {
-		return state.PublicKey, nil
+		sectors, err := loadSectorSet(context.Background(), ctx.Storage(), &state)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetUint64(sectors.count), nil
 	})
 	if err != nil {
 		return nil, errors.CodeError(err), err
 	}
 
-	validOut, ok := out.([]byte)
+	count, ok := out.(*big.Int)
 	if !ok {
-		return nil, 1, errors.NewRevertError("expected a byte slice")
+		return nil, 1, errors.NewFaultErrorf("expected *big.Int to be returned, but got %T instead", out)
 	}
 
-	return validOut, 0, nil
+	return count, 0, nil
 }
 
-// GetPeerID returns the libp2p peer ID that this miner can be reached at.
-func (ma *Actor) GetPeerID(ctx exec.VMContext) (peer.ID, uint8, error) {
+// VerifyPieceInclusion succeeds if the piece with the given cid is held, as
+// part of the storage market deal with the given id, in a live sector of the
+// miner, and has been since validAt. A sector is live if it is committed, has
+// not expired and was not declared faulty in the miner's most recent PoSt.
+// Clients make it the condition of the payment vouchers they give miners, so
+// that they only pay for storage that is proven.
+func (ma *Actor) VerifyPieceInclusion(ctx exec.VMContext, pieceRef []byte, validAt *types.BlockHeight, dealID *big.Int) (uint8, error) {
 	if err := ctx.Charge(100); err != nil {
-		return peer.ID(""), exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+		return exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
 	}
 
-	var state State
-
-	chunk, err := ctx.ReadStorage()
-	if err != nil {
+	ret, code, err := ctx.Send(address.StorageMarketAddress, "getDealSector", nil, []interface{}{dealID, pieceRef, validAt})
+	if errors.IsFault(err) {
+		return 1, err
+	}
+	if err != nil || code != 0 {
+		return ErrPieceNotIncluded, Errors[ErrPieceNotIncluded]
+	}
+	val, err := abi.Deserialize(ret[0], abi.SectorID)
+	if err != nil {
+		return 1, errors.FaultErrorWrap(err, "storage market returned an invalid sector id")
+	}
+	sectorID, ok := val.Val.(uint64)
+	if !ok {
+		return 1, errors.NewFaultErrorf("expected a uint64 sector id, but got %T instead", val.Val)
+	}
+
+	var state State
+	_, err = actor.WithState(ctx, &state, func() (interface{}, error) {
+		sectors, err := loadSectorSet(context.Background(), ctx.Storage(), &state)
+		if err != nil {
+			return nil, err
+		}
+
+		committed, err := sectors.Has(context.Background(), sectorID)
+		if err != nil {
+			return nil, err
+		}
+		if !committed {
+			return nil, Errors[ErrPieceNotIncluded]
+		}
+		sector, err := sectors.get(context.Background(), sectorID)
+		if err != nil {
+			return nil, err
+		}
+		if sector.Expired(ctx.BlockHeight()) {
+			return nil, Errors[ErrPieceNotIncluded]
+		}
+		for _, faulty := range state.Faults {
+			if faulty == sectorID {
+				return nil, Errors[ErrPieceNotIncluded]
+			}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return errors.CodeError(err), err
+	}
+
+	return 0, nil
+}
+
+// CommitSector adds a commitment to the specified sector. The sector must not
+// already be committed. The storage market deals in dealIDs, whose pieces the
+// sector holds, start once it is committed and are paid for with every PoSt
+// proving the sector. The sector must be proven until the last of its deals
+// ends, after which it expires and no longer counts toward the miner's power;
+// a sector holding no deals does not expire.
+func (ma *Actor) CommitSector(ctx exec.VMContext, sectorID uint64, commD, commR, commRStar, proof []byte, dealIDs []uint64) (uint8, error) {
+	if err := ctx.Charge(100); err != nil {
+		return exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+	if len(commD) != int(proofs.CommitmentBytesLen) {
+		return 1, errors.NewRevertError("invalid sized commD")
+	}
+	if len(commR) != int(proofs.CommitmentBytesLen) {
+		return 1, errors.NewRevertError("invalid sized commR")
+	}
+	if len(commRStar) != int(proofs.CommitmentBytesLen) {
+		return 1, errors.NewRevertError("invalid sized commRStar")
+	}
+
+	if !ma.Bootstrap {
+		// This unfortunate environment variable-checking needs to happen because
+		// the PoRep verification operation needs to know some things (e.g. size)
+		// about the sector for which the proof was generated in order to verify.
+		//
+		// It is undefined behavior for a miner in "Live" mode to verify a proof
+		// created by a miner in "ProofsTest" mode (and vice-versa).
+		//
+		sectorStoreType := proofs.Live
+		if os.Getenv("FIL_USE_SMALL_SECTORS") == "true" {
+			sectorStoreType = proofs.Test
+		}
+
+		req := proofs.VerifySealRequest{}
+		copy(req.CommD[:], commD)
+		copy(req.CommR[:], commR)
+		copy(req.CommRStar[:], commRStar)
+		copy(req.Proof[:], proof)
+		req.ProverID = sectorbuilder.AddressToProverID(ctx.Message().To)
+		req.SectorID = sectorbuilder.SectorIDToBytes(sectorID)
+		req.StoreType = sectorStoreType
+
+		res, err := (&proofs.RustVerifier{}).VerifySeal(req)
+		if err != nil {
+			return 1, errors.RevertErrorWrap(err, "failed to verify seal proof")
+		}
+		if !res.IsValid {
+			return ErrInvalidSealProof, Errors[ErrInvalidSealProof]
+		}
+	}
+
+	var state State
+	_, err := actor.WithState(ctx, &state, func() (interface{}, error) {
+		// verify that the caller is authorized to perform update
+		if !state.isOwnerOrWorker(ctx.Message().From, ctx.BlockHeight()) {
+			return nil, Errors[ErrCallerUnauthorized]
+		}
+
+		sectors, err := loadSectorSet(context.Background(), ctx.Storage(), &state)
+		if err != nil {
+			return nil, err
+		}
+
+		committed, err := sectors.Has(context.Background(), sectorID)
+		if err != nil {
+			return nil, err
+		}
+		if committed {
+			return nil, Errors[ErrSectorCommitted]
+		}
+
+		if state.Power.Cmp(big.NewInt(0)) == 0 {
+			state.ProvingPeriodStart = ctx.BlockHeight()
+		}
+		comms := types.Commitments{
+			CommD:     proofs.CommD{},
+			CommR:     proofs.CommR{},
+			CommRStar: proofs.CommRStar{},
+		}
+		copy(comms.CommD[:], commD)
+		copy(comms.CommR[:], commR)
+		copy(comms.CommRStar[:], commRStar)
+		var expiration *types.BlockHeight
+		if len(dealIDs) > 0 {
+			expiration, err = activateDeals(ctx, sectorID, dealIDs)
+			if err != nil {
+				return nil, err
+			}
+		}
+		state.LastUsedSectorID = sectorID
+		if err := sectors.Add(context.Background(), sectorID, comms, expiration, dealIDs); err != nil {
+			return nil, err
+		}
+		if err := sectors.Commit(context.Background(), &state); err != nil {
+			return nil, err
+		}
+		return nil, setPower(ctx, &state, new(big.Int).Add(state.Power, big.NewInt(1)))
+	})
+	if err != nil {
+		return errors.CodeError(err), err
+	}
+
+	return 0, nil
+}
+
+// TerminateSectors removes the given sectors from the miner. Terminated
+// sectors no longer need to be proven and no longer count toward the miner's
+// power. Their storage market deals end early: the clients get back the rest
+// of the price along with the miner's collateral.
+func (ma *Actor) TerminateSectors(ctx exec.VMContext, sectorIDs []uint64) (uint8, error) {
+	if err := ctx.Charge(100); err != nil {
+		return exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	var state State
+	_, err := actor.WithState(ctx, &state, func() (interface{}, error) {
+		// verify that the caller is authorized to perform update
+		if ctx.Message().From != state.Owner {
+			return nil, Errors[ErrCallerUnauthorized]
+		}
+
+		sectors, err := loadSectorSet(context.Background(), ctx.Storage(), &state)
+		if err != nil {
+			return nil, err
+		}
+
+		terminated, err := validateSectorIDs(context.Background(), sectors, sectorIDs)
+		if err != nil {
+			return nil, err
+		}
+		terminatedDeals := []uint64{}
+		for _, sectorID := range terminated {
+			sector, err := sectors.get(context.Background(), sectorID)
+			if err != nil {
+				return nil, err
+			}
+			terminatedDeals = append(terminatedDeals, sector.Deals...)
+			if err := sectors.Remove(context.Background(), sectorID); err != nil {
+				return nil, err
+			}
+		}
+		if err := sectors.Commit(context.Background(), &state); err != nil {
+			return nil, err
+		}
+		if len(terminatedDeals) > 0 {
+			if err := callStorageMarket(ctx, "terminateDeals", terminatedDeals); err != nil {
+				return nil, err
+			}
+		}
+
+		// faulty sectors did not count toward power to begin with
+		lost := uint64(len(terminated) - len(intersect(terminated, state.Faults)))
+		state.Faults = subtract(state.Faults, terminated)
+
+		power := new(big.Int).Sub(state.Power, new(big.Int).SetUint64(lost))
+		if power.Sign() < 0 {
+			power = big.NewInt(0)
+		}
+		return nil, setPower(ctx, &state, power)
+	})
+	if err != nil {
+		return errors.CodeError(err), err
+	}
+
+	return 0, nil
+}
+
+// GetKey returns the public key for this miner.
+func (ma *Actor) GetKey(ctx exec.VMContext) ([]byte, uint8, error) {
+	if err := ctx.Charge(100); err != nil {
+		return nil, exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	var state State
+	out, err := actor.WithState(ctx, &state, func() (interface{}, error) {
+		return state.PublicKey, nil
+	})
+	if err != nil {
+		return nil, errors.CodeError(err), err
+	}
+
+	validOut, ok := out.([]byte)
+	if !ok {
+		return nil, 1, errors.NewRevertError("expected a byte slice")
+	}
+
+	return validOut, 0, nil
+}
+
+// GetPeerID returns the libp2p peer ID that this miner can be reached at.
+func (ma *Actor) GetPeerID(ctx exec.VMContext) (peer.ID, uint8, error) {
+	if err := ctx.Charge(100); err != nil {
+		return peer.ID(""), exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	var state State
+
+	chunk, err := ctx.ReadStorage()
+	if err != nil {
 		return peer.ID(""), errors.CodeError(err), err
 	}
 
@@ -579,7 +1107,62 @@ func (ma *Actor) UpdatePeerID(ctx exec.VMContext, pid peer.ID) (uint8, error) {
 
 		storage.PeerID = pid
 
-		return nil, nil
+		// keep the storage market's miner registry in sync
+		return nil, callStorageMarket(ctx, "updateMinerPeerID", pid)
+	})
+	if err != nil {
+		return errors.CodeError(err), err
+	}
+
+	return 0, nil
+}
+
+// GetMultiaddrs returns the multiaddrs this miner can be dialed on.
+func (ma *Actor) GetMultiaddrs(ctx exec.VMContext) ([]multiaddr.Multiaddr, uint8, error) {
+	if err := ctx.Charge(100); err != nil {
+		return nil, exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	var state State
+	ret, err := actor.WithState(ctx, &state, func() (interface{}, error) {
+		return decodeMultiaddrs(state.Multiaddrs)
+	})
+	if err != nil {
+		return nil, errors.CodeError(err), err
+	}
+
+	addrs, ok := ret.([]multiaddr.Multiaddr)
+	if !ok {
+		return nil, 1, errors.NewFaultErrorf("expected []multiaddr.Multiaddr to be returned, but got %T instead", ret)
+	}
+
+	return addrs, 0, nil
+}
+
+// UpdateMultiaddrs replaces the multiaddrs this miner advertises. Only the
+// owner may update them.
+func (ma *Actor) UpdateMultiaddrs(ctx exec.VMContext, addrs []multiaddr.Multiaddr) (uint8, error) {
+	if err := ctx.Charge(100); err != nil {
+		return exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	if len(addrs) > MaximumMultiaddrs {
+		return ErrTooManyMultiaddrs, Errors[ErrTooManyMultiaddrs]
+	}
+
+	var state State
+	_, err := actor.WithState(ctx, &state, func() (interface{}, error) {
+		if ctx.Message().From != state.Owner {
+			return nil, Errors[ErrCallerUnauthorized]
+		}
+
+		state.Multiaddrs = make([][]byte, len(addrs))
+		for i, addr := range addrs {
+			state.Multiaddrs[i] = addr.Bytes()
+		}
+
+		// keep the storage market's miner registry in sync
+		return nil, callStorageMarket(ctx, "updateMinerMultiaddrs", addrs)
 	})
 	if err != nil {
 		return errors.CodeError(err), err
@@ -610,7 +1193,115 @@ func (ma *Actor) GetPledge(ctx exec.VMContext) (*big.Int, uint8, error) {
 	return pledgeSectors, 0, nil
 }
 
-// GetPower returns the amount of proven sectors for this miner.
+// AddCollateral adds the value of the message to the miner's collateral.
+func (ma *Actor) AddCollateral(ctx exec.VMContext) (uint8, error) {
+	if err := ctx.Charge(100); err != nil {
+		return exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	var state State
+	_, err := actor.WithState(ctx, &state, func() (interface{}, error) {
+		if ctx.Message().From != state.Owner {
+			return nil, Errors[ErrCallerUnauthorized]
+		}
+
+		state.Collateral = state.Collateral.Add(ctx.Message().Value)
+		return nil, nil
+	})
+	if err != nil {
+		return errors.CodeError(err), err
+	}
+
+	return 0, nil
+}
+
+// IncreasePledge pledges the given number of additional sectors. The value of
+// the message is added to the miner's collateral, which must then cover the
+// whole pledge.
+func (ma *Actor) IncreasePledge(ctx exec.VMContext, sectors *big.Int) (uint8, error) {
+	if err := ctx.Charge(100); err != nil {
+		return exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	if sectors.Sign() <= 0 {
+		return 1, errors.NewRevertError("pledge increase must be positive")
+	}
+
+	var state State
+	_, err := actor.WithState(ctx, &state, func() (interface{}, error) {
+		if ctx.Message().From != state.Owner {
+			return nil, Errors[ErrCallerUnauthorized]
+		}
+
+		pledge := new(big.Int).Add(state.PledgeSectors, sectors)
+		collateral := state.Collateral.Add(ctx.Message().Value)
+		if collateral.LessThan(MinimumCollateral(pledge)) {
+			return nil, Errors[ErrInsufficientCollateral]
+		}
+
+		state.PledgeSectors = pledge
+		state.Collateral = collateral
+		return nil, nil
+	})
+	if err != nil {
+		return errors.CodeError(err), err
+	}
+
+	return 0, nil
+}
+
+// WithdrawBalance sends amount from the miner's collateral to its owner. The
+// collateral left must still cover the sectors the miner has committed.
+func (ma *Actor) WithdrawBalance(ctx exec.VMContext, amount *types.AttoFIL) (uint8, error) {
+	if err := ctx.Charge(100); err != nil {
+		return exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	if amount.IsNegative() {
+		return 1, errors.NewRevertError("withdrawal amount must not be negative")
+	}
+
+	var state State
+	_, err := actor.WithState(ctx, &state, func() (interface{}, error) {
+		if ctx.Message().From != state.Owner {
+			return nil, Errors[ErrCallerUnauthorized]
+		}
+
+		if amount.GreaterThan(state.Collateral) {
+			return nil, Errors[ErrInsufficientCollateral]
+		}
+		collateral := state.Collateral.Sub(amount)
+		if collateral.LessThan(MinimumCollateral(new(big.Int).SetUint64(state.SectorCount))) {
+			return nil, Errors[ErrInsufficientCollateral]
+		}
+		state.Collateral = collateral
+
+		_, ret, err := ctx.Send(state.Owner, "", amount, nil)
+		if err != nil {
+			return nil, err
+		}
+		if ret != 0 {
+			return nil, errors.NewRevertError("failed to send balance to owner")
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return errors.CodeError(err), err
+	}
+
+	return 0, nil
+}
+
+// MinimumCollateral returns the minimum required amount of collateral for a given pledge
+func MinimumCollateral(sectors *big.Int) *types.AttoFIL {
+	return MinimumCollateralPerSector.MulBigInt(sectors)
+}
+
+// GetPower returns the amount of proven sectors for this miner. A miner that
+// missed its proving period has no power once the grace period has passed,
+// whether or not anyone slashed it yet, so that it can not win elections with
+// storage it no longer proves. Bootstrap miners, whose bogus commitments can
+// not be proven, keep their power.
 func (ma *Actor) GetPower(ctx exec.VMContext) (*big.Int, uint8, error) {
 	if err := ctx.Charge(100); err != nil {
 		return nil, exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
@@ -618,6 +1309,9 @@ func (ma *Actor) GetPower(ctx exec.VMContext) (*big.Int, uint8, error) {
 
 	var state State
 	ret, err := actor.WithState(ctx, &state, func() (interface{}, error) {
+		if !ma.Bootstrap && ctx.BlockHeight() != nil && missedProvingPeriod(&state, ctx.BlockHeight()) {
+			return big.NewInt(0), nil
+		}
 		return state.Power, nil
 	})
 	if err != nil {
@@ -633,8 +1327,19 @@ func (ma *Actor) GetPower(ctx exec.VMContext) (*big.Int, uint8, error) {
 }
 
 // SubmitPoSt is used to submit a coalesced PoST to the chain to convince the chain
-// that you have been actually storing the files you claim to be.
-func (ma *Actor) SubmitPoSt(ctx exec.VMContext, proof []byte) (uint8, error) {
+// that you have been actually storing the files you claim to be. Sectors listed
+// in faults are declared faulty: they are not covered by the proof and do not
+// count toward the miner's power until a later PoSt proves them again.
+//
+// A PoSt submitted after the end of the proving period but within
+// GracePeriodBlocks is accepted, at the cost of a fee taken from the miner's
+// collateral (see LatePoStFee). Once the grace period has passed the miner's
+// power is slashed, and a PoSt submitted then only restarts its proving period.
+//
+// The proof answers the challenge sampled from the chain randomness at
+// challengeHeight, which must be the start of the proving period (see
+// PoStChallengeSeed).
+func (ma *Actor) SubmitPoSt(ctx exec.VMContext, proof []byte, faults []uint64, challengeHeight *types.BlockHeight) (uint8, error) {
 	if err := ctx.Charge(100); err != nil {
 		return exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
 	}
@@ -646,14 +1351,36 @@ func (ma *Actor) SubmitPoSt(ctx exec.VMContext, proof []byte) (uint8, error) {
 	var state State
 	_, err := actor.WithState(ctx, &state, func() (interface{}, error) {
 		// verify that the caller is authorized to perform update
-		if ctx.Message().From != state.Owner {
+		if !state.isOwnerOrWorker(ctx.Message().From, ctx.BlockHeight()) {
 			return nil, Errors[ErrCallerUnauthorized]
 		}
 
+		if missedProvingPeriod(&state, ctx.BlockHeight()) {
+			return nil, slashPower(ctx, &state)
+		}
+
 		// reach in to actor storage to grab comm-r for each committed sector
-		var commRs []proofs.CommR
-		for _, v := range state.SectorCommitments {
-			commRs = append(commRs, v.CommR)
+		sectors, err := loadSectorSet(context.Background(), ctx.Storage(), &state)
+		if err != nil {
+			return nil, err
+		}
+		faulty, err := validateSectorIDs(context.Background(), sectors, faults)
+		if err != nil {
+			return nil, err
+		}
+		all, err := sectors.All(context.Background())
+		if err != nil {
+			return nil, err
+		}
+
+		if state.ProvingPeriodStart == nil || !state.ProvingPeriodStart.Equal(challengeHeight) {
+			return nil, Errors[ErrInvalidPoStChallenge]
+		}
+		// a proving period starting with a null round is challenged with
+		// the randomness of the tipset before it
+		randomness, err := ctx.Rand(challengeHeight)
+		if err != nil {
+			return nil, errors.RevertErrorWrap(err, "failed to sample PoSt challenge")
 		}
 
 		// copy message-bytes into PoStProof slice
@@ -671,14 +1398,14 @@ func (ma *Actor) SubmitPoSt(ctx exec.VMContext, proof []byte) (uint8, error) {
 		}
 
 		req := proofs.VerifyPoSTRequest{
-			ChallengeSeed: proofs.PoStChallengeSeed{},
-			CommRs:        commRs,
-			Faults:        []uint64{},
+			ChallengeSeed: PoStChallengeSeed(randomness),
+			CommRs:        commRs(all),
+			Faults:        faulty,
 			Proof:         postProof,
 			StoreType:     sectorStoreType,
 		}
 
-		res, err := (&proofs.RustVerifier{}).VerifyPoST(req)
+		res, err := ma.postVerifier().VerifyPoST(req)
 		if err != nil {
 			return nil, errors.RevertErrorWrap(err, "failed to verify PoSt")
 		}
@@ -686,19 +1413,65 @@ func (ma *Actor) SubmitPoSt(ctx exec.VMContext, proof []byte) (uint8, error) {
 			return nil, Errors[ErrInvalidPoSt]
 		}
 
-		// Check if we submitted it in time
+		// Charge a penalty if we did not submit it in time
 		provingPeriodEnd := state.ProvingPeriodStart.Add(ProvingPeriodBlocks)
+		if ctx.BlockHeight().GreaterThan(provingPeriodEnd) {
+			fee := LatePoStFee(state.Collateral, ctx.BlockHeight().Sub(provingPeriodEnd))
+			if err := burnCollateral(ctx, &state, fee); err != nil {
+				return nil, err
+			}
+		}
 
-		if ctx.BlockHeight().LessEqual(provingPeriodEnd) {
-			state.ProvingPeriodStart = provingPeriodEnd
-			state.LastPoSt = ctx.BlockHeight()
-		} else {
-			// Not great.
-			// TODO: charge penalty
-			return nil, errors.NewRevertErrorf("submitted PoSt late, need to pay a fee")
+		state.ProvingPeriodStart = provingPeriodEnd
+		state.LastPoSt = ctx.BlockHeight()
+
+		// the client pays for the deals in the sectors that were proven, and
+		// nothing for the deals in the faulty ones
+		isFaulty := make(map[uint64]bool, len(faulty))
+		for _, sectorID := range faulty {
+			isFaulty[sectorID] = true
+		}
+		var proven, unproven []uint64
+		for _, sector := range all {
+			if isFaulty[sector.ID] {
+				unproven = append(unproven, sector.Deals...)
+			} else {
+				proven = append(proven, sector.Deals...)
+			}
+		}
+		if len(proven) > 0 || len(unproven) > 0 {
+			if err := callStorageMarket(ctx, "settleDeals", proven, unproven); err != nil {
+				return nil, err
+			}
 		}
 
-		return nil, nil
+		// expired sectors no longer need to be proven, and the deals they
+		// still hold end with them
+		var expired, expiredDeals []uint64
+		for _, sector := range all {
+			if sector.Expired(ctx.BlockHeight()) {
+				expired = append(expired, sector.ID)
+				expiredDeals = append(expiredDeals, sector.Deals...)
+				if err := sectors.Remove(context.Background(), sector.ID); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if len(expired) > 0 {
+			if err := sectors.Commit(context.Background(), &state); err != nil {
+				return nil, err
+			}
+		}
+		if len(expiredDeals) > 0 {
+			if err := callStorageMarket(ctx, "terminateDeals", expiredDeals); err != nil {
+				return nil, err
+			}
+		}
+		state.Faults = subtract(faulty, expired)
+
+		// only sectors that were proven count toward power
+		power := new(big.Int).SetUint64(sectors.count - uint64(len(state.Faults)))
+		return nil, setPower(ctx, &state, power)
 	})
 	if err != nil {
 		return errors.CodeError(err), err
@@ -707,6 +1480,195 @@ func (ma *Actor) SubmitPoSt(ctx exec.VMContext, proof []byte) (uint8, error) {
 	return 0, nil
 }
 
+// SlashStorageFault removes the power of a miner that has not submitted a PoSt
+// for its proving period within the grace period. Anyone may call it, so power
+// is removed from a miner that stops submitting PoSts altogether.
+func (ma *Actor) SlashStorageFault(ctx exec.VMContext) (uint8, error) {
+	if err := ctx.Charge(100); err != nil {
+		return exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	var state State
+	_, err := actor.WithState(ctx, &state, func() (interface{}, error) {
+		if !missedProvingPeriod(&state, ctx.BlockHeight()) {
+			return nil, Errors[ErrNoStorageFault]
+		}
+
+		return nil, slashPower(ctx, &state)
+	})
+	if err != nil {
+		return errors.CodeError(err), err
+	}
+
+	return 0, nil
+}
+
+// postVerifier returns the verifier for the miner's proofs-of-spacetime.
+func (ma *Actor) postVerifier() proofs.Verifier {
+	if ma.PoStVerifier == nil {
+		return &proofs.RustVerifier{}
+	}
+	return ma.PoStVerifier
+}
+
+// LatePoStFee returns the fee charged against a miner's collateral for a PoSt
+// submitted lateness blocks after the end of its proving period. The fee grows
+// linearly with lateness, reaching the whole collateral at the end of the grace
+// period.
+func LatePoStFee(collateral *types.AttoFIL, lateness *types.BlockHeight) *types.AttoFIL {
+	if lateness.GreaterEqual(GracePeriodBlocks) {
+		return collateral
+	}
+
+	return collateral.MulBigInt(lateness.AsBigInt()).DivCeil(types.NewAttoFIL(GracePeriodBlocks.AsBigInt()))
+}
+
+// PoStChallengeSeed derives the challenge of a proving period from the chain
+// randomness sampled at its start. Miners generate their PoSts for it.
+func PoStChallengeSeed(randomness []byte) proofs.PoStChallengeSeed {
+	return proofs.PoStChallengeSeed(sha256.Sum256(randomness))
+}
+
+// missedProvingPeriod returns true if the miner has power but has not
+// submitted a PoSt for its proving period by the end of the grace period.
+func missedProvingPeriod(state *State, height *types.BlockHeight) bool {
+	if state.Power.Sign() == 0 || state.ProvingPeriodStart == nil {
+		return false
+	}
+
+	deadline := state.ProvingPeriodStart.Add(ProvingPeriodBlocks).Add(GracePeriodBlocks)
+	return height.GreaterThan(deadline)
+}
+
+// slashPower takes away all of a miner's power and restarts its proving period
+// at the current block height. The miner is not paid for the deals in its
+// sectors for the time it did not prove them.
+func slashPower(ctx exec.VMContext, state *State) error {
+	sectors, err := loadSectorSet(context.Background(), ctx.Storage(), state)
+	if err != nil {
+		return err
+	}
+	all, err := sectors.All(context.Background())
+	if err != nil {
+		return err
+	}
+	var unproven []uint64
+	for _, sector := range all {
+		unproven = append(unproven, sector.Deals...)
+	}
+	if len(unproven) > 0 {
+		if err := callStorageMarket(ctx, "settleDeals", []uint64{}, unproven); err != nil {
+			return err
+		}
+	}
+
+	state.SlashedAt = ctx.BlockHeight()
+	state.ProvingPeriodStart = ctx.BlockHeight()
+	return setPower(ctx, state, big.NewInt(0))
+}
+
+// setPower sets the miner's power and reports the change to the storage market.
+func setPower(ctx exec.VMContext, state *State, power *big.Int) error {
+	delta := new(big.Int).Sub(power, state.Power)
+	state.Power = power
+	if delta.Sign() == 0 {
+		return nil
+	}
+
+	return callStorageMarket(ctx, "updatePower", delta)
+}
+
+// decodeMultiaddrs parses multiaddrs stored in the miner state.
+func decodeMultiaddrs(raw [][]byte) ([]multiaddr.Multiaddr, error) {
+	addrs := make([]multiaddr.Multiaddr, len(raw))
+	for i, b := range raw {
+		addr, err := multiaddr.NewMultiaddrBytes(b)
+		if err != nil {
+			return nil, errors.FaultErrorWrap(err, "invalid multiaddr in miner state")
+		}
+		addrs[i] = addr
+	}
+	return addrs, nil
+}
+
+// callStorageMarket calls the given method of the storage market.
+func callStorageMarket(ctx exec.VMContext, method string, params ...interface{}) error {
+	_, ret, err := ctx.Send(address.StorageMarketAddress, method, nil, params)
+	if err != nil {
+		return err
+	}
+	if ret != 0 {
+		return Errors[ErrStoragemarketCallFailed]
+	}
+	return nil
+}
+
+// activateDeals starts the storage market deals held by the sector and returns
+// the block height at which the last of them ends.
+func activateDeals(ctx exec.VMContext, sectorID uint64, dealIDs []uint64) (*types.BlockHeight, error) {
+	ret, code, err := ctx.Send(address.StorageMarketAddress, "activateDeals", nil, []interface{}{sectorID, dealIDs})
+	if err != nil {
+		return nil, err
+	}
+	if code != 0 {
+		return nil, Errors[ErrStoragemarketCallFailed]
+	}
+	val, err := abi.Deserialize(ret[0], abi.BlockHeight)
+	if err != nil {
+		return nil, errors.FaultErrorWrap(err, "storage market returned an invalid expiration")
+	}
+	expiration, ok := val.Val.(*types.BlockHeight)
+	if !ok {
+		return nil, errors.NewFaultErrorf("expected a *types.BlockHeight expiration, but got %T instead", val.Val)
+	}
+	return expiration, nil
+}
+
+// burnCollateral takes fee, or as much of it as is left, from the miner's
+// collateral and sends it to the network.
+func burnCollateral(ctx exec.VMContext, state *State, fee *types.AttoFIL) error {
+	if fee.GreaterThan(state.Collateral) {
+		fee = state.Collateral
+	}
+	if fee.IsZero() {
+		return nil
+	}
+
+	state.Collateral = state.Collateral.Sub(fee)
+	_, ret, err := ctx.Send(address.NetworkAddress, "", fee, nil)
+	if err != nil {
+		return err
+	}
+	if ret != 0 {
+		return errors.NewRevertError("failed to burn collateral")
+	}
+	return nil
+}
+
+// validateSectorIDs checks that every sector id refers to a committed sector
+// and returns the ids sorted and without duplicates.
+func validateSectorIDs(ctx context.Context, sectors *sectorSet, sectorIDs []uint64) ([]uint64, error) {
+	seen := make(map[uint64]bool, len(sectorIDs))
+	out := []uint64{}
+	for _, sectorID := range sectorIDs {
+		if seen[sectorID] {
+			continue
+		}
+		seen[sectorID] = true
+
+		committed, err := sectors.Has(ctx, sectorID)
+		if err != nil {
+			return nil, err
+		}
+		if !committed {
+			return nil, Errors[ErrInvalidSector]
+		}
+		out = append(out, sectorID)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out, nil
+}
+
 // GetProvingPeriodStart returns the current ProvingPeriodStart value.
 func (ma *Actor) GetProvingPeriodStart(ctx exec.VMContext) (*types.BlockHeight, uint8, error) {
 	if err := ctx.Charge(100); err != nil {
@@ -725,3 +1687,33 @@ func (ma *Actor) GetProvingPeriodStart(ctx exec.VMContext) (*types.BlockHeight,
 
 	return state.ProvingPeriodStart, 0, nil
 }
+
+// intersect returns the sector ids in a that are also in b.
+func intersect(a, b []uint64) []uint64 {
+	inB := make(map[uint64]bool, len(b))
+	for _, id := range b {
+		inB[id] = true
+	}
+	out := []uint64{}
+	for _, id := range a {
+		if inB[id] {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// subtract returns the sector ids in a that are not in b.
+func subtract(a, b []uint64) []uint64 {
+	inB := make(map[uint64]bool, len(b))
+	for _, id := range b {
+		inB[id] = true
+	}
+	out := []uint64{}
+	for _, id := range a {
+		if !inB[id] {
+			out = append(out, id)
+		}
+	}
+	return out
+}
@@ -1,18 +1,26 @@
 package miner_test
 
 import (
+	"bytes"
 	"context"
 	"math/big"
 	"testing"
 
+	ma "gx/ipfs/QmNTCey11oxhb1AxDnQBRHtdhap6Ctud872NjAYPYYXPuc/go-multiaddr"
+	"gx/ipfs/QmNf3wujpV2Y7Lnj2hy2UrmuX8bhMDStRHbnSLh7Ypf36h/go-hamt-ipld"
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	"gx/ipfs/QmRu7tiRnFk9mMPpVECQTBQJqXtmG132jJxA1w9A7TtpBz/go-ipfs-blockstore"
 	peer "gx/ipfs/QmTu65MVbemtUxJEWgsTtzv9Zv9P8rvmqNA4eG9TrTRGYc/go-libp2p-peer"
+	"gx/ipfs/QmUadX5EcvrBmxAV9sE7wUWtWSqxns5K84qKJBixmcT1w9/go-datastore"
 
+	"github.com/filecoin-project/go-filecoin/abi"
 	"github.com/filecoin-project/go-filecoin/actor"
 	"github.com/filecoin-project/go-filecoin/actor/builtin"
 	. "github.com/filecoin-project/go-filecoin/actor/builtin/miner"
 	"github.com/filecoin-project/go-filecoin/address"
 	"github.com/filecoin-project/go-filecoin/consensus"
 	"github.com/filecoin-project/go-filecoin/core"
+	"github.com/filecoin-project/go-filecoin/exec"
 	"github.com/filecoin-project/go-filecoin/proofs"
 	"github.com/filecoin-project/go-filecoin/state"
 	th "github.com/filecoin-project/go-filecoin/testhelpers"
@@ -120,6 +128,81 @@ func TestAskFunctions(t *testing.T) {
 	assert.Len(askids, 2)
 }
 
+func TestAskExpiryAndRemoval(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	st, vms := core.CreateStorages(ctx, t)
+
+	minerAddr := createTestMiner(assert, st, vms, address.TestAddress, []byte{}, th.RequireRandomPeerID())
+
+	getAsks := func(height uint64) []uint64 {
+		nonce := core.MustGetNonce(st, address.TestAddress)
+		msg := types.NewMessage(address.TestAddress, minerAddr, nonce, types.NewZeroAttoFIL(), "getAsks", nil)
+		result, err := th.ApplyTestMessage(st, vms, msg, types.NewBlockHeight(height))
+		require.NoError(err)
+		require.NoError(result.ExecutionError)
+
+		var askids []uint64
+		require.NoError(actor.UnmarshalStorage(result.Receipt.Return[0], &askids))
+		return askids
+	}
+
+	// ask 0 expires at 11, ask 1 at 101 and ask 2 at 201
+	for _, expiry := range []int64{10, 100, 200} {
+		result, err := th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 1, "addAsk", types.NewAttoFILFromFIL(5), big.NewInt(expiry))
+		require.NoError(err)
+		require.NoError(result.ExecutionError)
+	}
+	assert.Equal([]uint64{0, 1, 2}, getAsks(10))
+	assert.Equal([]uint64{1, 2}, getAsks(11))
+
+	readAsks := func() []*Ask {
+		var minerStorage State
+		builtin.RequireReadState(t, vms, minerAddr, state.MustGetActor(st, minerAddr), &minerStorage)
+		return minerStorage.Asks
+	}
+
+	t.Run("querying asks leaves expired asks in the state", func(t *testing.T) {
+		assert.Len(readAsks(), 3)
+	})
+
+	t.Run("only the owner can remove an ask", func(t *testing.T) {
+		pdata := actor.MustConvertParams(big.NewInt(1))
+		msg := types.NewMessage(address.TestAddress2, minerAddr, core.MustGetNonce(st, address.TestAddress2), types.NewZeroAttoFIL(), "removeAsk", pdata)
+		result, err := th.ApplyTestMessage(st, vms, msg, types.NewBlockHeight(12))
+		require.NoError(err)
+		assert.Equal(Errors[ErrCallerUnauthorized], result.ExecutionError)
+	})
+
+	t.Run("the owner removes an ask", func(t *testing.T) {
+		result, err := th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 12, "removeAsk", big.NewInt(1))
+		require.NoError(err)
+		require.NoError(result.ExecutionError)
+		assert.Equal([]uint64{2}, getAsks(12))
+
+		// changing the asks prunes the expired ones from the state
+		asks := readAsks()
+		require.Len(asks, 1)
+		assert.Equal(uint64(2), asks[0].ID.Uint64())
+
+		result, err = th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 12, "removeAsk", big.NewInt(1))
+		require.NoError(err)
+		assert.Equal(Errors[ErrAskNotFound], result.ExecutionError)
+	})
+
+	t.Run("expired asks cannot be removed", func(t *testing.T) {
+		result, err := th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 201, "removeAsk", big.NewInt(2))
+		require.NoError(err)
+		assert.Equal(Errors[ErrAskNotFound], result.ExecutionError)
+		assert.Empty(getAsks(201))
+	})
+}
+
 func TestGetKey(t *testing.T) {
 	assert := assert.New(t)
 	ctx, cancel := context.WithCancel(context.Background())
@@ -139,10 +222,12 @@ func TestCBOREncodeState(t *testing.T) {
 	assert := assert.New(t)
 	state := NewState(address.TestAddress, []byte{}, big.NewInt(1), th.RequireRandomPeerID(), types.NewZeroAttoFIL())
 
-	state.SectorCommitments["1"] = types.Commitments{
-		CommD:     proofs.CommD{},
-		CommR:     proofs.CommR{},
-		CommRStar: proofs.CommRStar{},
+	state.SectorCommitments = map[string]types.Commitments{
+		"1": {
+			CommD:     proofs.CommD{},
+			CommR:     proofs.CommR{},
+			CommRStar: proofs.CommRStar{},
+		},
 	}
 
 	_, err := actor.MarshalStorage(state)
@@ -206,6 +291,52 @@ func TestPeerIdGetterAndSetter(t *testing.T) {
 	})
 }
 
+func TestMinerMultiaddrs(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx := context.Background()
+
+	st, vms := core.CreateStorages(ctx, t)
+	minerAddr := createTestMiner(assert, st, vms, address.TestAddress, []byte("my public key"), th.RequireRandomPeerID())
+
+	getMultiaddrs := func() []ma.Multiaddr {
+		ret := callQueryMethodSuccess("getMultiaddrs", ctx, t, st, vms, address.TestAddress, minerAddr)
+		val, err := abi.Deserialize(ret[0], abi.Multiaddrs)
+		require.NoError(err)
+		return val.Val.([]ma.Multiaddr)
+	}
+	update := func(from address.Address, addrs []ma.Multiaddr) *consensus.ApplicationResult {
+		msg := types.NewMessage(from, minerAddr, core.MustGetNonce(st, from), nil, "updateMultiaddrs", actor.MustConvertParams(addrs))
+		res, err := th.ApplyTestMessage(st, vms, msg, types.NewBlockHeight(0))
+		require.NoError(err)
+		return res
+	}
+
+	assert.Empty(getMultiaddrs())
+
+	addr1, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/6000")
+	require.NoError(err)
+	addr2, err := ma.NewMultiaddr("/ip4/10.0.0.1/tcp/6001")
+	require.NoError(err)
+
+	require.NoError(update(address.TestAddress, []ma.Multiaddr{addr1, addr2}).ExecutionError)
+	assert.Equal([]ma.Multiaddr{addr1, addr2}, getMultiaddrs())
+
+	// only the owner may update the multiaddrs
+	res := update(address.TestAddress2, []ma.Multiaddr{addr1})
+	assert.Equal(Errors[ErrCallerUnauthorized], res.ExecutionError)
+
+	tooMany := make([]ma.Multiaddr, MaximumMultiaddrs+1)
+	for i := range tooMany {
+		tooMany[i] = addr1
+	}
+	res = update(address.TestAddress, tooMany)
+	assert.Equal(Errors[ErrTooManyMultiaddrs], res.ExecutionError)
+
+	assert.Equal([]ma.Multiaddr{addr1, addr2}, getMultiaddrs())
+}
+
 func TestMinerGetPledge(t *testing.T) {
 	t.Parallel()
 	require := require.New(t)
@@ -286,7 +417,7 @@ func TestMinerCommitSector(t *testing.T) {
 	commRStar := th.MakeCommitment()
 	commD := th.MakeCommitment()
 
-	res, err := th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 3, "commitSector", uint64(1), commD, commR, commRStar, th.MakeRandomBytes(int(proofs.SealBytesLen)))
+	res, err := th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 3, "commitSector", uint64(1), commD, commR, commRStar, th.MakeRandomBytes(int(proofs.SealBytesLen)), []uint64{})
 	require.NoError(err)
 	require.NoError(res.ExecutionError)
 	require.Equal(uint8(0), res.Receipt.ExitCode)
@@ -299,7 +430,7 @@ func TestMinerCommitSector(t *testing.T) {
 	require.Equal(types.NewBlockHeight(3), types.NewBlockHeightFromBytes(res.Receipt.Return[0]))
 
 	// fail because commR already exists
-	res, err = th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 4, "commitSector", uint64(1), commD, commR, commRStar, th.MakeRandomBytes(int(proofs.SealBytesLen)))
+	res, err = th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 4, "commitSector", uint64(1), commD, commR, commRStar, th.MakeRandomBytes(int(proofs.SealBytesLen)), []uint64{})
 	require.NoError(err)
 	require.EqualError(res.ExecutionError, "sector already committed")
 	require.Equal(uint8(0x23), res.Receipt.ExitCode)
@@ -314,21 +445,19 @@ func TestMinerSubmitPoSt(t *testing.T) {
 	minerAddr := createTestMiner(assert.New(t), st, vms, address.TestAddress, []byte("my public key"), origPid)
 
 	// add a sector
-	res, err := th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 3, "commitSector", uint64(1), th.MakeCommitment(), th.MakeCommitment(), th.MakeCommitment(), th.MakeRandomBytes(int(proofs.SealBytesLen)))
+	res, err := th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 3, "commitSector", uint64(1), th.MakeCommitment(), th.MakeCommitment(), th.MakeCommitment(), th.MakeRandomBytes(int(proofs.SealBytesLen)), []uint64{})
 	require.NoError(err)
 	require.NoError(res.ExecutionError)
 	require.Equal(uint8(0), res.Receipt.ExitCode)
 
 	// add another sector
-	res, err = th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 4, "commitSector", uint64(2), th.MakeCommitment(), th.MakeCommitment(), th.MakeCommitment(), th.MakeRandomBytes(int(proofs.SealBytesLen)))
+	res, err = th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 4, "commitSector", uint64(2), th.MakeCommitment(), th.MakeCommitment(), th.MakeCommitment(), th.MakeRandomBytes(int(proofs.SealBytesLen)), []uint64{})
 	require.NoError(err)
 	require.NoError(res.ExecutionError)
 	require.Equal(uint8(0), res.Receipt.ExitCode)
 
 	// submit post
-	proof := th.MakeRandomPoSTProofForTest()
-	res, err = th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 8, "submitPoSt", proof[:])
-	require.NoError(err)
+	res = submitPoSt(require, st, vms, address.TestAddress, minerAddr, 8, 3, []uint64{})
 	require.NoError(res.ExecutionError)
 	require.Equal(uint8(0), res.Receipt.ExitCode)
 
@@ -338,9 +467,531 @@ func TestMinerSubmitPoSt(t *testing.T) {
 	require.NoError(res.ExecutionError)
 	require.Equal(types.NewBlockHeightFromBytes(res.Receipt.Return[0]), types.NewBlockHeight(20003))
 
-	// fail to submit inside the proving period
-	proof = th.MakeRandomPoSTProofForTest()
-	res, err = th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 40008, "submitPoSt", proof[:])
+	// submit late, inside the grace period, and pay a fee from collateral
+	res = submitPoSt(require, st, vms, address.TestAddress, minerAddr, 40008, 20003, []uint64{})
+	require.NoError(res.ExecutionError)
+
+	fee := LatePoStFee(types.NewAttoFILFromFIL(100), types.NewBlockHeight(5))
+	require.Equal(types.NewAttoFILFromFIL(5), fee)
+
+	minerActor, err := st.GetActor(ctx, minerAddr)
+	require.NoError(err)
+	require.Equal(types.NewAttoFILFromFIL(95), minerActor.Balance)
+	require.Equal(types.NewAttoFILFromFIL(95), requireMinerState(require, vms, minerAddr, minerActor).Collateral)
+
+	res, err = th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 40009, "getProvingPeriodStart")
+	require.NoError(err)
+	require.Equal(types.NewBlockHeight(40003), types.NewBlockHeightFromBytes(res.Receipt.Return[0]))
+}
+
+func TestMinerSubmitPoStChallenge(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx := context.Background()
+	// accept only proofs that were generated for the expected challenge seed
+	st, vms := createStoragesWithMinerActor(ctx, t, &Actor{PoStVerifier: &seedVerifier{}})
+
+	minerAddr := createTestMiner(assert, st, vms, address.TestAddress, []byte("my public key"), th.RequireRandomPeerID())
+	res, err := th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 3, "commitSector", uint64(1), th.MakeCommitment(), th.MakeCommitment(), th.MakeCommitment(), th.MakeRandomBytes(int(proofs.SealBytesLen)), []uint64{})
+	require.NoError(err)
+	require.NoError(res.ExecutionError)
+
+	submitAt := func(height, challengeHeight uint64, ancestors []types.TipSet, seed proofs.PoStChallengeSeed) *consensus.ApplicationResult {
+		var proof proofs.PoStProof
+		copy(proof[:], seed[:])
+		msg := types.NewMessage(address.TestAddress, minerAddr, core.MustGetNonce(st, address.TestAddress), nil, "submitPoSt", actor.MustConvertParams(proof[:], []uint64{}, types.NewBlockHeight(challengeHeight)))
+		res, err := th.ApplyTestMessageWithAncestors(st, vms, msg, types.NewBlockHeight(height), ancestors)
+		require.NoError(err)
+		return res
+	}
+	submit := func(challengeHeight uint64, ancestors []types.TipSet, seed proofs.PoStChallengeSeed) *consensus.ApplicationResult {
+		return submitAt(8, challengeHeight, ancestors, seed)
+	}
+	challengeSeed := func(ancestors []types.TipSet, challengeHeight uint64) proofs.PoStChallengeSeed {
+		randomness, err := vm.NewVMContext(vm.NewContextParams{Ancestors: ancestors, LookBack: consensus.LookBackParameter}).Rand(types.NewBlockHeight(challengeHeight))
+		require.NoError(err)
+		return PoStChallengeSeed(randomness)
+	}
+
+	ancestors := th.RequireRandomnessAncestors(require, 3)
+	seed := challengeSeed(ancestors, 3)
+
+	// the challenge must be sampled at the start of the proving period
+	assert.Equal(Errors[ErrInvalidPoStChallenge], submit(4, th.RequireRandomnessAncestors(require, 4), seed).ExecutionError)
+
+	// the challenge can not be sampled before its tipsets are in the chain
+	res = submit(3, nil, seed)
+	require.Error(res.ExecutionError)
+	assert.Contains(res.ExecutionError.Error(), "failed to sample PoSt challenge")
+
+	// a proof generated for another seed does not verify
+	assert.Equal(Errors[ErrInvalidPoSt], submit(3, ancestors, proofs.PoStChallengeSeed{}).ExecutionError)
+	otherSeed := challengeSeed(th.RequireRandomnessAncestors(require, 4), 4)
+	assert.Equal(Errors[ErrInvalidPoSt], submit(3, ancestors, otherSeed).ExecutionError)
+
+	// a proof for the chain's challenge does
+	require.NoError(submit(3, ancestors, seed).ExecutionError)
+
+	// a proving period starting with a null round is challenged with the
+	// randomness of the tipset before it
+	nullRoundAncestors := th.RequireTipSetsAtHeights(require, 20007, 20006, 20005, 20004, 20002)
+	nullRoundSeed := challengeSeed(nullRoundAncestors, 20003)
+	assert.Equal(challengeSeed(nullRoundAncestors, 20002), nullRoundSeed)
+	require.NoError(submitAt(20008, 20003, nullRoundAncestors, nullRoundSeed).ExecutionError)
+}
+
+func TestMinerSubmitPoStFaults(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx := context.Background()
+	st, vms := core.CreateStorages(ctx, t)
+
+	minerAddr := createTestMiner(assert, st, vms, address.TestAddress, []byte("my public key"), th.RequireRandomPeerID())
+	for _, sectorID := range []uint64{1, 2} {
+		res, err := th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 3, "commitSector", sectorID, th.MakeCommitment(), th.MakeCommitment(), th.MakeCommitment(), th.MakeRandomBytes(int(proofs.SealBytesLen)), []uint64{})
+		require.NoError(err)
+		require.NoError(res.ExecutionError)
+	}
+	assert.Equal(uint64(2), requirePower(ctx, t, st, vms, minerAddr))
+
+	// faults must be committed sectors
+	res := submitPoSt(require, st, vms, address.TestAddress, minerAddr, 8, 3, []uint64{7})
+	assert.Equal(Errors[ErrInvalidSector], res.ExecutionError)
+
+	// a faulty sector loses its power, duplicates are only counted once
+	res = submitPoSt(require, st, vms, address.TestAddress, minerAddr, 8, 3, []uint64{2, 2})
+	require.NoError(res.ExecutionError)
+	assert.Equal(uint64(1), requirePower(ctx, t, st, vms, minerAddr))
+	assert.Equal(uint64(1), requireTotalStorage(ctx, t, st, vms))
+
+	// and regains it once it is proven again
+	res = submitPoSt(require, st, vms, address.TestAddress, minerAddr, 20008, 20003, []uint64{})
+	require.NoError(res.ExecutionError)
+	assert.Equal(uint64(2), requirePower(ctx, t, st, vms, minerAddr))
+	assert.Equal(uint64(2), requireTotalStorage(ctx, t, st, vms))
+}
+
+func TestMinerSlashStorageFault(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx := context.Background()
+	st, vms := core.CreateStorages(ctx, t)
+
+	minerAddr := createTestMiner(assert, st, vms, address.TestAddress, []byte("my public key"), th.RequireRandomPeerID())
+	res, err := th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 3, "commitSector", uint64(1), th.MakeCommitment(), th.MakeCommitment(), th.MakeCommitment(), th.MakeRandomBytes(int(proofs.SealBytesLen)), []uint64{})
+	require.NoError(err)
+	require.NoError(res.ExecutionError)
+
+	// the proving period ends at 20003 and the grace period at 20103
+	slash := func(height uint64) *consensus.ApplicationResult {
+		msg := types.NewMessage(address.TestAddress2, minerAddr, core.MustGetNonce(st, address.TestAddress2), nil, "slashStorageFault", nil)
+		res, err := th.ApplyTestMessage(st, vms, msg, types.NewBlockHeight(height))
+		require.NoError(err)
+		return res
+	}
+
+	// the miner has no power once the grace period has passed, even before
+	// it is slashed, but the total storage only drops once it is
+	assert.Equal(uint64(1), requirePowerAt(ctx, t, st, vms, minerAddr, 20103))
+	assert.Equal(uint64(0), requirePowerAt(ctx, t, st, vms, minerAddr, 20104))
+	assert.Equal(uint64(1), requireTotalStorageAt(ctx, t, st, vms, 20104))
+
+	res = slash(20103)
+	assert.Equal(Errors[ErrNoStorageFault], res.ExecutionError)
+	assert.Equal(uint64(1), requirePower(ctx, t, st, vms, minerAddr))
+
+	// anyone can slash the miner once the grace period has passed
+	res = slash(20104)
+	require.NoError(res.ExecutionError)
+	assert.Equal(uint64(0), requirePower(ctx, t, st, vms, minerAddr))
+	assert.Equal(uint64(0), requireTotalStorage(ctx, t, st, vms))
+
+	minerActor, err := st.GetActor(ctx, minerAddr)
+	require.NoError(err)
+	assert.Equal(types.NewBlockHeight(20104), requireMinerState(require, vms, minerAddr, minerActor).SlashedAt)
+
+	// the slashed miner's proving period restarted, so it can recover its power
+	res = submitPoSt(require, st, vms, address.TestAddress, minerAddr, 20200, 20104, []uint64{})
+	require.NoError(res.ExecutionError)
+	assert.Equal(uint64(1), requirePower(ctx, t, st, vms, minerAddr))
+	assert.Equal(uint64(1), requireTotalStorage(ctx, t, st, vms))
+}
+
+func TestMinerSectorExpiration(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx := context.Background()
+	st, vms := core.CreateStorages(ctx, t)
+
+	minerAddr := createTestMiner(assert, st, vms, address.TestAddress, []byte("my public key"), th.RequireRandomPeerID())
+
+	res, err := th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 3, "commitSector", uint64(1), th.MakeCommitment(), th.MakeCommitment(), th.MakeCommitment(), th.MakeRandomBytes(int(proofs.SealBytesLen)), []uint64{})
+	require.NoError(err)
+	require.NoError(res.ExecutionError)
+
+	// a sector holding no deals never expires
+	res = submitPoSt(require, st, vms, address.TestAddress, minerAddr, 20008, 20003, []uint64{})
+	require.NoError(res.ExecutionError)
+	assert.Equal(uint64(1), requirePower(ctx, t, st, vms, minerAddr))
+
+	minerActor, err := st.GetActor(ctx, minerAddr)
+	require.NoError(err)
+	assert.Equal(uint64(1), requireMinerState(require, vms, minerAddr, minerActor).SectorCount)
+}
+
+func TestMinerTerminateSectors(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx := context.Background()
+	st, vms := core.CreateStorages(ctx, t)
+
+	minerAddr := createTestMiner(assert, st, vms, address.TestAddress, []byte("my public key"), th.RequireRandomPeerID())
+	for _, sectorID := range []uint64{1, 2, 3} {
+		res, err := th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 3, "commitSector", sectorID, th.MakeCommitment(), th.MakeCommitment(), th.MakeCommitment(), th.MakeRandomBytes(int(proofs.SealBytesLen)), []uint64{})
+		require.NoError(err)
+		require.NoError(res.ExecutionError)
+	}
+
+	// declare sector 3 faulty, leaving a power of 2
+	res := submitPoSt(require, st, vms, address.TestAddress, minerAddr, 8, 3, []uint64{3})
+	require.NoError(res.ExecutionError)
+	assert.Equal(uint64(2), requirePower(ctx, t, st, vms, minerAddr))
+
+	t.Run("only the owner can terminate sectors", func(t *testing.T) {
+		msg := types.NewMessage(address.TestAddress2, minerAddr, core.MustGetNonce(st, address.TestAddress2), nil, "terminateSectors", actor.MustConvertParams([]uint64{1}))
+		res, err := th.ApplyTestMessage(st, vms, msg, types.NewBlockHeight(9))
+		require.NoError(err)
+		assert.Equal(Errors[ErrCallerUnauthorized], res.ExecutionError)
+	})
+
+	t.Run("terminating an unknown sector fails", func(t *testing.T) {
+		res, err := th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 9, "terminateSectors", []uint64{1, 7})
+		require.NoError(err)
+		assert.Equal(Errors[ErrInvalidSector], res.ExecutionError)
+		assert.Equal(uint64(2), requirePower(ctx, t, st, vms, minerAddr))
+	})
+
+	t.Run("terminating sectors removes their power", func(t *testing.T) {
+		res, err := th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 9, "terminateSectors", []uint64{1, 3})
+		require.NoError(err)
+		require.NoError(res.ExecutionError)
+
+		// the faulty sector had no power to lose
+		assert.Equal(uint64(1), requirePower(ctx, t, st, vms, minerAddr))
+		assert.Equal(uint64(1), requireTotalStorage(ctx, t, st, vms))
+
+		minerActor, err := st.GetActor(ctx, minerAddr)
+		require.NoError(err)
+		state := requireMinerState(require, vms, minerAddr, minerActor)
+		assert.Equal(uint64(1), state.SectorCount)
+		assert.Empty(state.Faults)
+	})
+}
+
+func TestMinerCollateral(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx := context.Background()
+	st, vms := core.CreateStorages(ctx, t)
+
+	minerAddr := createTestMinerWith(10, 1, assert, st, vms, address.TestAddress, []byte("my public key"), th.RequireRandomPeerID())
+
+	requireCollateral := func() *types.AttoFIL {
+		minerActor, err := st.GetActor(ctx, minerAddr)
+		require.NoError(err)
+		return requireMinerState(require, vms, minerAddr, minerActor).Collateral
+	}
+
+	t.Run("adding collateral", func(t *testing.T) {
+		res, err := th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 2, 1, "addCollateral")
+		require.NoError(err)
+		require.NoError(res.ExecutionError)
+		assert.Equal(types.NewAttoFILFromFIL(3), requireCollateral())
+	})
+
+	t.Run("increasing the pledge", func(t *testing.T) {
+		// 4010 sectors require 4.01 FIL of collateral
+		res, err := th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 2, "increasePledge", big.NewInt(4000))
+		require.NoError(err)
+		assert.Equal(Errors[ErrInsufficientCollateral], res.ExecutionError)
+
+		res, err = th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 2, 2, "increasePledge", big.NewInt(4000))
+		require.NoError(err)
+		require.NoError(res.ExecutionError)
+		assert.Equal(types.NewAttoFILFromFIL(5), requireCollateral())
+
+		result := callQueryMethodSuccess("getPledge", ctx, t, st, vms, address.TestAddress, minerAddr)
+		assert.Equal(big.NewInt(4010), big.NewInt(0).SetBytes(result[0]))
+	})
+
+	for _, sectorID := range []uint64{1, 2} {
+		res, err := th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 3, "commitSector", sectorID, th.MakeCommitment(), th.MakeCommitment(), th.MakeCommitment(), th.MakeRandomBytes(int(proofs.SealBytesLen)), []uint64{})
+		require.NoError(err)
+		require.NoError(res.ExecutionError)
+	}
+
+	t.Run("only the owner can withdraw", func(t *testing.T) {
+		msg := types.NewMessage(address.TestAddress2, minerAddr, core.MustGetNonce(st, address.TestAddress2), nil, "withdrawBalance", actor.MustConvertParams(types.NewAttoFILFromFIL(1)))
+		res, err := th.ApplyTestMessage(st, vms, msg, types.NewBlockHeight(4))
+		require.NoError(err)
+		assert.Equal(Errors[ErrCallerUnauthorized], res.ExecutionError)
+	})
+
+	t.Run("withdrawals are bounded by the collateral for committed sectors", func(t *testing.T) {
+		// 2 committed sectors require 0.002 FIL of collateral
+		res, err := th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 4, "withdrawBalance", types.NewAttoFILFromFIL(5))
+		require.NoError(err)
+		assert.Equal(Errors[ErrInsufficientCollateral], res.ExecutionError)
+
+		ownerBefore, err := st.GetActor(ctx, address.TestAddress)
+		require.NoError(err)
+
+		amount, _ := types.NewAttoFILFromFILString("4.998")
+		res, err = th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 4, "withdrawBalance", amount)
+		require.NoError(err)
+		require.NoError(res.ExecutionError)
+
+		remaining, _ := types.NewAttoFILFromFILString("0.002")
+		assert.Equal(remaining, requireCollateral())
+
+		ownerAfter, err := st.GetActor(ctx, address.TestAddress)
+		require.NoError(err)
+		assert.Equal(ownerBefore.Balance.Add(amount), ownerAfter.Balance)
+	})
+}
+
+func TestMinerWorker(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx := context.Background()
+	st, vms := core.CreateStorages(ctx, t)
+
+	minerAddr := createTestMiner(assert, st, vms, address.TestAddress, []byte("my public key"), th.RequireRandomPeerID())
+
+	getWorker := func(height uint64) address.Address {
+		res, code, err := consensus.CallQueryMethod(ctx, st, vms, minerAddr, "getWorker", []byte{}, address.TestAddress, types.NewBlockHeight(height))
+		require.NoError(err)
+		require.Equal(uint8(0), code)
+		addr, err := address.NewFromBytes(res[0])
+		require.NoError(err)
+		return addr
+	}
+	sendFrom := func(from address.Address, height uint64, method string, params ...interface{}) *consensus.ApplicationResult {
+		msg := types.NewMessage(from, minerAddr, core.MustGetNonce(st, from), nil, method, actor.MustConvertParams(params...))
+		res, err := th.ApplyTestMessage(st, vms, msg, types.NewBlockHeight(height))
+		require.NoError(err)
+		return res
+	}
+	commitSector := func(from address.Address, height, sectorID uint64) *consensus.ApplicationResult {
+		return sendFrom(from, height, "commitSector", sectorID, th.MakeCommitment(), th.MakeCommitment(), th.MakeCommitment(), th.MakeRandomBytes(int(proofs.SealBytesLen)), []uint64{})
+	}
+
+	// the owner is the initial worker
+	assert.Equal(address.TestAddress, getWorker(1))
+	assert.Equal(Errors[ErrCallerUnauthorized], commitSector(address.TestAddress2, 1, 1).ExecutionError)
+
+	// only the owner can change the worker
+	assert.Equal(Errors[ErrCallerUnauthorized], sendFrom(address.TestAddress2, 1, "changeWorker", address.TestAddress2).ExecutionError)
+	require.NoError(sendFrom(address.TestAddress, 1, "changeWorker", address.TestAddress2).ExecutionError)
+
+	// the new worker takes over after the delay
+	assert.Equal(address.TestAddress, getWorker(100))
+	assert.Equal(Errors[ErrCallerUnauthorized], commitSector(address.TestAddress2, 100, 1).ExecutionError)
+	assert.Equal(address.TestAddress2, getWorker(101))
+	require.NoError(commitSector(address.TestAddress2, 101, 1).ExecutionError)
+
+	require.NoError(submitPoSt(require, st, vms, address.TestAddress2, minerAddr, 110, 101, []uint64{}).ExecutionError)
+
+	// the owner can still commit sectors itself
+	require.NoError(commitSector(address.TestAddress, 111, 2).ExecutionError)
+
+	// but the worker can not manage the miner
+	assert.Equal(Errors[ErrCallerUnauthorized], sendFrom(address.TestAddress2, 111, "withdrawBalance", types.NewAttoFILFromFIL(1)).ExecutionError)
+
+	// changing the owner takes effect immediately
+	assert.Equal(Errors[ErrCallerUnauthorized], sendFrom(address.TestAddress2, 112, "changeOwner", address.TestAddress2).ExecutionError)
+	res := sendFrom(address.TestAddress, 112, "changeOwner", address.Address{})
+	require.Error(res.ExecutionError)
+	assert.Contains(res.ExecutionError.Error(), "owner must not be empty")
+	assert.Equal(uint8(1), res.Receipt.ExitCode)
+	require.NoError(sendFrom(address.TestAddress, 112, "changeOwner", address.TestAddress2).ExecutionError)
+	result := callQueryMethodSuccess("getOwner", ctx, t, st, vms, address.TestAddress, minerAddr)
+	assert.Equal(address.TestAddress2.Bytes(), result[0])
+	assert.Equal(Errors[ErrCallerUnauthorized], sendFrom(address.TestAddress, 113, "changeWorker", address.TestAddress).ExecutionError)
+}
+
+func requirePower(ctx context.Context, t *testing.T, st state.Tree, vms vm.StorageMap, minerAddr address.Address) uint64 {
+	result := callQueryMethodSuccess("getPower", ctx, t, st, vms, address.TestAddress, minerAddr)
+	return big.NewInt(0).SetBytes(result[0]).Uint64()
+}
+
+func requirePowerAt(ctx context.Context, t *testing.T, st state.Tree, vms vm.StorageMap, minerAddr address.Address, height uint64) uint64 {
+	res, code, err := consensus.CallQueryMethod(ctx, st, vms, minerAddr, "getPower", []byte{}, address.TestAddress, types.NewBlockHeight(height))
+	require.NoError(t, err)
+	require.Equal(t, uint8(0), code)
+	return big.NewInt(0).SetBytes(res[0]).Uint64()
+}
+
+func requireTotalStorage(ctx context.Context, t *testing.T, st state.Tree, vms vm.StorageMap) uint64 {
+	res, code, err := consensus.CallQueryMethod(ctx, st, vms, address.StorageMarketAddress, "getTotalStorage", []byte{}, address.TestAddress, nil)
+	require.NoError(t, err)
+	require.Equal(t, uint8(0), code)
+	return big.NewInt(0).SetBytes(res[0]).Uint64()
+}
+
+func requireTotalStorageAt(ctx context.Context, t *testing.T, st state.Tree, vms vm.StorageMap, height uint64) uint64 {
+	res, code, err := consensus.CallQueryMethod(ctx, st, vms, address.StorageMarketAddress, "getTotalStorage", []byte{}, address.TestAddress, types.NewBlockHeight(height))
+	require.NoError(t, err)
+	require.Equal(t, uint8(0), code)
+	return big.NewInt(0).SetBytes(res[0]).Uint64()
+}
+
+// submitPoSt submits a PoSt from the address at the given height, answering
+// the challenge sampled at challengeHeight.
+func submitPoSt(require *require.Assertions, st state.Tree, vms vm.StorageMap, from, minerAddr address.Address, height, challengeHeight uint64, faults []uint64) *consensus.ApplicationResult {
+	proof := th.MakeRandomPoSTProofForTest()
+	params := actor.MustConvertParams(proof[:], faults, types.NewBlockHeight(challengeHeight))
+	msg := types.NewMessage(from, minerAddr, core.MustGetNonce(st, from), nil, "submitPoSt", params)
+	res, err := th.ApplyTestMessageWithAncestors(st, vms, msg, types.NewBlockHeight(height), th.RequireRandomnessAncestors(require, challengeHeight))
 	require.NoError(err)
-	require.EqualError(res.ExecutionError, "submitted PoSt late, need to pay a fee")
+	return res
+}
+
+// createStoragesWithMinerActor creates storages like core.CreateStorages, in
+// which miner actors are run by the given actor.
+func createStoragesWithMinerActor(ctx context.Context, t *testing.T, minerActor *Actor) (state.Tree, vm.StorageMap) {
+	cst := hamt.NewCborStore()
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	blk, err := consensus.DefaultGenesis(cst, bs)
+	require.NoError(t, err)
+
+	actors := map[cid.Cid]exec.ExecutableActor{}
+	for code, a := range builtin.Actors {
+		actors[code] = a
+	}
+	actors[types.MinerActorCodeCid] = minerActor
+
+	st, err := state.LoadStateTree(ctx, cst, blk.StateRoot, actors)
+	require.NoError(t, err)
+
+	return st, vm.NewStorageMap(bs)
+}
+
+// seedVerifier accepts the proofs-of-spacetime that start with their
+// challenge seed, standing in for proofs generated for that challenge.
+type seedVerifier struct{}
+
+var _ proofs.Verifier = &seedVerifier{}
+
+func (sv *seedVerifier) VerifyPoST(req proofs.VerifyPoSTRequest) (proofs.VerifyPoSTResponse, error) {
+	return proofs.VerifyPoSTResponse{IsValid: bytes.Equal(req.Proof[:len(req.ChallengeSeed)], req.ChallengeSeed[:])}, nil
+}
+
+func (sv *seedVerifier) VerifySeal(req proofs.VerifySealRequest) (proofs.VerifySealResponse, error) {
+	return proofs.VerifySealResponse{IsValid: true}, nil
+}
+
+func TestMinerSectorCommitmentsPaging(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx := context.Background()
+	st, vms := core.CreateStorages(ctx, t)
+
+	minerAddr := createTestMiner(assert, st, vms, address.TestAddress, []byte("my public key"), th.RequireRandomPeerID())
+
+	sectorIDs := []uint64{5, 2, 9}
+	for i, sectorID := range sectorIDs {
+		res, err := th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, uint64(3+i), "commitSector", sectorID, th.MakeCommitment(), th.MakeCommitment(), th.MakeCommitment(), th.MakeRandomBytes(int(proofs.SealBytesLen)), []uint64{})
+		require.NoError(err)
+		require.NoError(res.ExecutionError)
+	}
+
+	result := callQueryMethodSuccess("getSectorCount", ctx, t, st, vms, address.TestAddress, minerAddr)
+	assert.Equal(uint64(3), big.NewInt(0).SetBytes(result[0]).Uint64())
+
+	// pages follow the order in which sectors were committed
+	page := getSectorCommitmentsPage(ctx, t, st, vms, minerAddr, 0, 2)
+	assert.Len(page, 2)
+	assert.Contains(page, "5")
+	assert.Contains(page, "2")
+
+	page = getSectorCommitmentsPage(ctx, t, st, vms, minerAddr, 2, 2)
+	assert.Len(page, 1)
+	assert.Contains(page, "9")
+
+	page = getSectorCommitmentsPage(ctx, t, st, vms, minerAddr, 3, 2)
+	assert.Len(page, 0)
+
+	result = callQueryMethodSuccess("getSectorCommitments", ctx, t, st, vms, address.TestAddress, minerAddr)
+	all, err := abi.Deserialize(result[0], abi.CommitmentsMap)
+	require.NoError(err)
+	assert.Len(all.Val, 3)
+}
+
+func TestMinerSectorCommitmentsMigration(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx := context.Background()
+	st, vms := core.CreateStorages(ctx, t)
+
+	minerAddr := createTestMiner(assert, st, vms, address.TestAddress, []byte("my public key"), th.RequireRandomPeerID())
+
+	// rewrite the miner's state the way it was stored before sectors were moved
+	// into a lookup
+	legacy := map[string]types.Commitments{
+		"1": {CommR: proofs.CommR{1}},
+		"3": {CommR: proofs.CommR{3}},
+	}
+	minerActor, err := st.GetActor(ctx, minerAddr)
+	require.NoError(err)
+	minerState := requireMinerState(require, vms, minerAddr, minerActor)
+	minerState.SectorCommitments = legacy
+	storage := vms.NewStorage(minerAddr, minerActor)
+	head, err := storage.Put(minerState)
+	require.NoError(err)
+	require.NoError(storage.Commit(head, minerActor.Head))
+	require.NoError(st.SetActor(ctx, minerAddr, minerActor))
+
+	result := callQueryMethodSuccess("getSectorCount", ctx, t, st, vms, address.TestAddress, minerAddr)
+	assert.Equal(uint64(2), big.NewInt(0).SetBytes(result[0]).Uint64())
+
+	page := getSectorCommitmentsPage(ctx, t, st, vms, minerAddr, 0, 10)
+	assert.Equal(legacy, page)
+
+	// legacy sectors cannot be committed again
+	res, err := th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 3, "commitSector", uint64(3), th.MakeCommitment(), th.MakeCommitment(), th.MakeCommitment(), th.MakeRandomBytes(int(proofs.SealBytesLen)), []uint64{})
+	require.NoError(err)
+	assert.Equal(Errors[ErrSectorCommitted], res.ExecutionError)
+
+	res, err = th.CreateAndApplyTestMessage(t, st, vms, minerAddr, 0, 4, "commitSector", uint64(4), th.MakeCommitment(), th.MakeCommitment(), th.MakeCommitment(), th.MakeRandomBytes(int(proofs.SealBytesLen)), []uint64{})
+	require.NoError(err)
+	require.NoError(res.ExecutionError)
+
+	// the write migrated the legacy sectors out of the actor state
+	minerActor, err = st.GetActor(ctx, minerAddr)
+	require.NoError(err)
+	minerState = requireMinerState(require, vms, minerAddr, minerActor)
+	assert.Nil(minerState.SectorCommitments)
+	assert.Equal(uint64(3), minerState.SectorCount)
+	assert.True(minerState.Sectors.Defined())
+}
+
+func getSectorCommitmentsPage(ctx context.Context, t *testing.T, st state.Tree, vms vm.StorageMap, minerAddr address.Address, offset, limit int64) map[string]types.Commitments {
+	params := actor.MustConvertParams(big.NewInt(offset), big.NewInt(limit))
+	res, code, err := consensus.CallQueryMethod(ctx, st, vms, minerAddr, "getSectorCommitmentsPage", params, address.TestAddress, nil)
+	require.NoError(t, err)
+	require.Equal(t, uint8(0), code)
+
+	val, err := abi.Deserialize(res[0], abi.CommitmentsMap)
+	require.NoError(t, err)
+	return val.Val.(map[string]types.Commitments)
+}
+
+func requireMinerState(require *require.Assertions, vms vm.StorageMap, minerAddr address.Address, minerActor *actor.Actor) *State {
+	chunk, err := vms.NewStorage(minerAddr, minerActor).Get(minerActor.Head)
+	require.NoError(err)
+
+	var minerState State
+	require.NoError(actor.UnmarshalStorage(chunk, &minerState))
+	return &minerState
 }
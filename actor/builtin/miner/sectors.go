@@ -0,0 +1,278 @@
+package miner
+
+import (
+	"context"
+	"sort"
+	"strconv"
+
+	"gx/ipfs/QmNf3wujpV2Y7Lnj2hy2UrmuX8bhMDStRHbnSLh7Ypf36h/go-hamt-ipld"
+	cbor "gx/ipfs/QmcZLyosDwMKdB6NLRsiss9HXzDPhVhhRtPy67JFKTDQDX/go-ipld-cbor"
+
+	"github.com/filecoin-project/go-filecoin/actor"
+	"github.com/filecoin-project/go-filecoin/exec"
+	"github.com/filecoin-project/go-filecoin/proofs"
+	"github.com/filecoin-project/go-filecoin/types"
+	"github.com/filecoin-project/go-filecoin/vm/errors"
+)
+
+func init() {
+	cbor.RegisterCborType(Sector{})
+}
+
+// MaximumSectorPageSize is the largest number of sectors returned by a single
+// call to getSectorCommitmentsPage or getSectorsPage.
+const MaximumSectorPageSize = 1000
+
+// Sector is a sector committed by a miner.
+type Sector struct {
+	ID          uint64
+	Commitments types.Commitments
+
+	// Expiration is the block height at which the miner no longer needs to
+	// prove the sector, or nil if the sector does not expire.
+	Expiration *types.BlockHeight
+
+	// Index is the position of the sector in the miner's sector index.
+	Index uint64
+
+	// Deals are the ids of the storage market deals whose pieces the sector
+	// holds.
+	Deals []uint64
+}
+
+// Expired returns true if the sector no longer needs to be proven at the
+// given block height.
+func (s *Sector) Expired(height *types.BlockHeight) bool {
+	return s.Expiration != nil && height.GreaterEqual(s.Expiration)
+}
+
+// sectorSet provides access to the sectors a miner has committed. Sectors are
+// kept in two lookups: one from sector id to Sector, and an index from
+// position to sector id, which lets callers page through sectors without
+// loading all of them.
+type sectorSet struct {
+	byID  exec.Lookup
+	index exec.Lookup
+	count uint64
+}
+
+// loadSectorSet loads the sectors of the miner with the given state. Miners
+// created before sectors were moved out of the actor state still carry their
+// commitments in State.SectorCommitments; these are moved into the lookups,
+// and the state updated, the first time they are loaded.
+func loadSectorSet(ctx context.Context, storage exec.Storage, state *State) (*sectorSet, error) {
+	byID, err := actor.LoadTypedLookup(ctx, storage, state.Sectors, Sector{})
+	if err != nil {
+		return nil, errors.FaultErrorWrapf(err, "could not load sector lookup with CID: %s", state.Sectors)
+	}
+
+	index, err := actor.LoadTypedLookup(ctx, storage, state.SectorIndex, uint64(0))
+	if err != nil {
+		return nil, errors.FaultErrorWrapf(err, "could not load sector index with CID: %s", state.SectorIndex)
+	}
+
+	set := &sectorSet{
+		byID:  byID,
+		index: index,
+		count: state.SectorCount,
+	}
+
+	if len(state.SectorCommitments) > 0 {
+		if err := set.migrate(ctx, state); err != nil {
+			return nil, err
+		}
+	}
+
+	return set, nil
+}
+
+// migrate moves commitments stored inline in the state into the lookups.
+// Legacy sectors are indexed in ascending sector id order and do not expire.
+func (s *sectorSet) migrate(ctx context.Context, state *State) error {
+	ids := make([]uint64, 0, len(state.SectorCommitments))
+	for k := range state.SectorCommitments {
+		id, err := strconv.ParseUint(k, 10, 64)
+		if err != nil {
+			return errors.FaultErrorWrapf(err, "invalid sector id %q in miner state", k)
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		if err := s.Add(ctx, id, state.SectorCommitments[sectorKey(id)], nil, nil); err != nil {
+			return err
+		}
+	}
+
+	state.SectorCommitments = nil
+	return s.Commit(ctx, state)
+}
+
+// Has returns true if a sector with the given id has been committed.
+func (s *sectorSet) Has(ctx context.Context, sectorID uint64) (bool, error) {
+	_, err := s.byID.Find(ctx, sectorKey(sectorID))
+	if err == hamt.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.FaultErrorWrapf(err, "could not look up sector %d", sectorID)
+	}
+	return true, nil
+}
+
+// Add records a newly committed sector.
+func (s *sectorSet) Add(ctx context.Context, sectorID uint64, comms types.Commitments, expiration *types.BlockHeight, deals []uint64) error {
+	sector := &Sector{
+		ID:          sectorID,
+		Commitments: comms,
+		Expiration:  expiration,
+		Index:       s.count,
+		Deals:       deals,
+	}
+	if err := s.put(ctx, sector); err != nil {
+		return err
+	}
+	s.count++
+	return nil
+}
+
+// Remove deletes a sector. The sector with the highest index takes the
+// removed sector's place in the index.
+func (s *sectorSet) Remove(ctx context.Context, sectorID uint64) error {
+	sector, err := s.get(ctx, sectorID)
+	if err != nil {
+		return err
+	}
+
+	last, err := s.at(ctx, s.count-1)
+	if err != nil {
+		return err
+	}
+	if last.ID != sector.ID {
+		last.Index = sector.Index
+		if err := s.put(ctx, last); err != nil {
+			return err
+		}
+	}
+
+	if err := s.index.Delete(ctx, strconv.FormatUint(s.count-1, 10)); err != nil {
+		return errors.FaultErrorWrapf(err, "could not remove sector %d from index", sectorID)
+	}
+	if err := s.byID.Delete(ctx, sectorKey(sectorID)); err != nil {
+		return errors.FaultErrorWrapf(err, "could not remove sector %d", sectorID)
+	}
+	s.count--
+	return nil
+}
+
+// Page returns at most limit sectors, starting at the given index.
+func (s *sectorSet) Page(ctx context.Context, offset, limit uint64) ([]*Sector, error) {
+	page := []*Sector{}
+	for i := offset; i < s.count && i-offset < limit; i++ {
+		sector, err := s.at(ctx, i)
+		if err != nil {
+			return nil, err
+		}
+		page = append(page, sector)
+	}
+	return page, nil
+}
+
+// All returns every committed sector ordered by ascending sector id.
+func (s *sectorSet) All(ctx context.Context) ([]*Sector, error) {
+	kvs, err := s.byID.Values(ctx)
+	if err != nil {
+		return nil, errors.FaultErrorWrap(err, "could not load sectors")
+	}
+
+	all := make([]*Sector, 0, len(kvs))
+	for _, kv := range kvs {
+		sector, ok := kv.Value.(Sector)
+		if !ok {
+			return nil, errors.NewFaultErrorf("expected sector lookup to hold Sector, but got %T instead", kv.Value)
+		}
+		all = append(all, &sector)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].ID < all[j].ID })
+	return all, nil
+}
+
+// Commit flushes the lookups and records their roots in the state.
+func (s *sectorSet) Commit(ctx context.Context, state *State) error {
+	byIDCid, err := s.byID.Commit(ctx)
+	if err != nil {
+		return errors.FaultErrorWrap(err, "could not commit sector lookup")
+	}
+	indexCid, err := s.index.Commit(ctx)
+	if err != nil {
+		return errors.FaultErrorWrap(err, "could not commit sector index")
+	}
+
+	state.Sectors = byIDCid
+	state.SectorIndex = indexCid
+	state.SectorCount = s.count
+	return nil
+}
+
+func (s *sectorSet) put(ctx context.Context, sector *Sector) error {
+	if err := s.byID.Set(ctx, sectorKey(sector.ID), sector); err != nil {
+		return errors.FaultErrorWrapf(err, "could not store sector %d", sector.ID)
+	}
+	if err := s.index.Set(ctx, strconv.FormatUint(sector.Index, 10), sector.ID); err != nil {
+		return errors.FaultErrorWrapf(err, "could not index sector %d", sector.ID)
+	}
+	return nil
+}
+
+func (s *sectorSet) get(ctx context.Context, sectorID uint64) (*Sector, error) {
+	val, err := s.byID.Find(ctx, sectorKey(sectorID))
+	if err != nil {
+		return nil, errors.FaultErrorWrapf(err, "could not find sector %d", sectorID)
+	}
+	sector, ok := val.(Sector)
+	if !ok {
+		return nil, errors.NewFaultErrorf("expected sector lookup to hold Sector, but got %T instead", val)
+	}
+	return &sector, nil
+}
+
+func (s *sectorSet) at(ctx context.Context, i uint64) (*Sector, error) {
+	val, err := s.index.Find(ctx, strconv.FormatUint(i, 10))
+	if err != nil {
+		return nil, errors.FaultErrorWrapf(err, "could not find sector at index %d", i)
+	}
+	sectorID, ok := val.(uint64)
+	if !ok {
+		return nil, errors.NewFaultErrorf("expected sector index to hold uint64, but got %T instead", val)
+	}
+	return s.get(ctx, sectorID)
+}
+
+// sectorKey returns the lookup key for a sector id.
+// TODO: use uint64 instead of this abomination, once refmt is fixed
+// https://github.com/polydawn/refmt/issues/35
+func sectorKey(sectorID uint64) string {
+	return strconv.FormatUint(sectorID, 10)
+}
+
+// commitmentsMap returns the commitments of the given sectors keyed by
+// stringified sector id.
+func commitmentsMap(sectors []*Sector) map[string]types.Commitments {
+	comms := make(map[string]types.Commitments, len(sectors))
+	for _, sector := range sectors {
+		comms[sectorKey(sector.ID)] = sector.Commitments
+	}
+	return comms
+}
+
+// commRs returns the replica commitments of the given sectors, which must be
+// ordered by ascending sector id. Provers and verifiers must agree on this
+// order.
+func commRs(sectors []*Sector) []proofs.CommR {
+	out := make([]proofs.CommR, len(sectors))
+	for i, sector := range sectors {
+		out[i] = sector.Commitments.CommR
+	}
+	return out
+}
@@ -1,27 +1,97 @@
 package paymentbroker
 
 import (
+	"errors"
+	"math/big"
+
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
 	cbor "gx/ipfs/QmcZLyosDwMKdB6NLRsiss9HXzDPhVhhRtPy67JFKTDQDX/go-ipld-cbor"
 	"gx/ipfs/QmekxXDhCxCJRNuzmHreuaT3BsuJcsjcXWNrtV9C8DRHtd/go-multibase"
 
+	"github.com/filecoin-project/go-filecoin/abi"
 	"github.com/filecoin-project/go-filecoin/address"
 	"github.com/filecoin-project/go-filecoin/types"
 )
 
 func init() {
 	cbor.RegisterCborType(PaymentVoucher{})
+	cbor.RegisterCborType(Merge{})
+	cbor.RegisterCborType(Condition{})
+	cbor.RegisterCborType(Redemption{})
 }
 
 // PaymentVoucher is a voucher for a payment channel that can be transferred off-chain but guarantees a future payment.
+//
+// Vouchers are issued on lanes, so that one channel can back several independent streams of payments. The Amount of
+// a voucher is the total paid on its lane so far, plus whatever was redeemed on the lanes it merges. Within a lane,
+// a voucher with a higher nonce supersedes the ones before it.
+//
+// A voucher with a Condition can only be redeemed if the call it describes succeeds.
 type PaymentVoucher struct {
 	Channel   types.ChannelID   `json:"channel"`
 	Payer     address.Address   `json:"payer"`
 	Target    address.Address   `json:"target"`
 	Amount    types.AttoFIL     `json:"amount"`
 	ValidAt   types.BlockHeight `json:"valid_at"`
+	Lane      uint64            `json:"lane"`
+	Nonce     uint64            `json:"nonce"`
+	Merges    []Merge           `json:"merges"`
+	Condition *Condition        `json:"condition"`
 	Signature types.Signature   `json:"signature"`
 }
 
+// Merge folds another lane of the channel into the lane of the voucher carrying it. The amount redeemed on the
+// merged lane counts towards the voucher's amount, and vouchers on the merged lane with a nonce lower than Nonce
+// can no longer be redeemed.
+type Merge struct {
+	Lane  uint64 `json:"lane"`
+	Nonce uint64 `json:"nonce"`
+}
+
+// Condition is a call the payment broker makes when a voucher is redeemed, for instance to a miner actor to verify
+// that the piece being paid for is stored in a live sector. The voucher is redeemed only if the call succeeds.
+type Condition struct {
+	To     address.Address `json:"to"`
+	Method string          `json:"method"`
+
+	// Params are the abi encoded leading parameters of the call. The redeemer supplies the remaining ones, such as
+	// the sector or deal holding the piece, which the payer does not know when issuing the voucher.
+	Params []byte `json:"params"`
+}
+
+// Redemption is a voucher redeemed by redeemMany, along with the abi encoded parameters that complete the call of
+// its condition, if it has one.
+type Redemption struct {
+	Voucher         PaymentVoucher `json:"voucher"`
+	ConditionParams []byte         `json:"condition_params"`
+}
+
+// NewRedemption creates a redemption of the voucher. The conditionParams are appended to the parameters of the
+// voucher's condition, if it has one.
+func NewRedemption(voucher *PaymentVoucher, conditionParams ...interface{}) (*Redemption, error) {
+	supplied, err := abi.ToEncodedValues(conditionParams...)
+	if err != nil {
+		return nil, err
+	}
+	return &Redemption{Voucher: *voucher, ConditionParams: supplied}, nil
+}
+
+// NewCondition creates a condition calling method on the actor at to with the given leading parameters.
+func NewCondition(to address.Address, method string, params ...interface{}) (*Condition, error) {
+	encoded, err := abi.ToEncodedValues(params...)
+	if err != nil {
+		return nil, err
+	}
+	return &Condition{To: to, Method: method, Params: encoded}, nil
+}
+
+// NewPieceInclusionCondition creates a condition verifying that the miner actor at miner holds the piece with the
+// given cid in a live sector since validAt. The redeemer supplies the id of the storage market deal the piece is
+// stored under.
+func NewPieceInclusionCondition(miner address.Address, pieceRef cid.Cid, validAt *types.BlockHeight) (*Condition, error) {
+	return NewCondition(miner, "verifyPieceInclusion", pieceRef.Bytes(), validAt)
+}
+
 // DecodeVoucher creates a *PaymentVoucher from a base58, Cbor-encoded one
 func DecodeVoucher(voucherRaw string) (*PaymentVoucher, error) {
 	_, cborVoucher, err := multibase.Decode(voucherRaw)
@@ -47,3 +117,110 @@ func (voucher *PaymentVoucher) Encode() (string, error) {
 
 	return multibase.Encode(multibase.Base58BTC, cborVoucher)
 }
+
+// RedeemParams returns the parameters of a redeem or close message for the voucher. The conditionParams are
+// appended to the parameters of the voucher's condition, if it has one.
+func (voucher *PaymentVoucher) RedeemParams(conditionParams ...interface{}) ([]interface{}, error) {
+	merges, err := EncodeMerges(voucher.Merges)
+	if err != nil {
+		return nil, err
+	}
+	condition, err := EncodeCondition(voucher.Condition)
+	if err != nil {
+		return nil, err
+	}
+	supplied, err := abi.ToEncodedValues(conditionParams...)
+	if err != nil {
+		return nil, err
+	}
+
+	return []interface{}{
+		voucher.Payer,
+		&voucher.Channel,
+		&voucher.Amount,
+		&voucher.ValidAt,
+		new(big.Int).SetUint64(voucher.Lane),
+		new(big.Int).SetUint64(voucher.Nonce),
+		merges,
+		condition,
+		supplied,
+		[]byte(voucher.Signature),
+	}, nil
+}
+
+// EncodeMerges encodes merges to be passed to the payment broker.
+func EncodeMerges(merges []Merge) ([]byte, error) {
+	if len(merges) == 0 {
+		return []byte{}, nil
+	}
+	return cbor.DumpObject(merges)
+}
+
+// DecodeMerges decodes merges passed to the payment broker.
+func DecodeMerges(data []byte) ([]Merge, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	var merges []Merge
+	if err := cbor.DecodeInto(data, &merges); err != nil {
+		return nil, err
+	}
+	return merges, nil
+}
+
+// EncodeRedemptions encodes redemptions to be passed to redeemMany.
+func EncodeRedemptions(redemptions []*Redemption) ([]byte, error) {
+	return cbor.DumpObject(redemptions)
+}
+
+// EncodeVoucherRedemptions decodes the given base58, Cbor-encoded vouchers and encodes their redemptions to be
+// passed to redeemMany. No parameters are supplied to the conditions of the vouchers.
+func EncodeVoucherRedemptions(vouchersRaw []string) ([]byte, error) {
+	redemptions := make([]*Redemption, len(vouchersRaw))
+	for i, voucherRaw := range vouchersRaw {
+		voucher, err := DecodeVoucher(voucherRaw)
+		if err != nil {
+			return nil, err
+		}
+		if redemptions[i], err = NewRedemption(voucher); err != nil {
+			return nil, err
+		}
+	}
+	return EncodeRedemptions(redemptions)
+}
+
+// DecodeRedemptions decodes redemptions passed to redeemMany.
+func DecodeRedemptions(data []byte) ([]*Redemption, error) {
+	var redemptions []*Redemption
+	if err := cbor.DecodeInto(data, &redemptions); err != nil {
+		return nil, err
+	}
+	for _, redemption := range redemptions {
+		if redemption == nil {
+			return nil, errors.New("missing redemption")
+		}
+	}
+	return redemptions, nil
+}
+
+// EncodeCondition encodes a condition to be passed to the payment broker.
+func EncodeCondition(condition *Condition) ([]byte, error) {
+	if condition == nil {
+		return []byte{}, nil
+	}
+	return cbor.DumpObject(condition)
+}
+
+// DecodeCondition decodes a condition passed to the payment broker.
+func DecodeCondition(data []byte) (*Condition, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	var condition Condition
+	if err := cbor.DecodeInto(data, &condition); err != nil {
+		return nil, err
+	}
+	return &condition, nil
+}
@@ -2,6 +2,9 @@ package paymentbroker
 
 import (
 	"context"
+	"encoding/binary"
+	"math/big"
+	"strconv"
 
 	"gx/ipfs/QmNf3wujpV2Y7Lnj2hy2UrmuX8bhMDStRHbnSLh7Ypf36h/go-hamt-ipld"
 	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
@@ -38,6 +41,12 @@ const (
 	ErrInvalidSignature = 42
 	//ErrTooEarly indicates that the block height is too low to satisfy a voucher
 	ErrTooEarly = 43
+	// ErrStaleNonce indicates a voucher or merge whose nonce has been superseded on its lane.
+	ErrStaleNonce = 44
+	// ErrInvalidMerge indicates a voucher merging its own lane, or merging a lane twice.
+	ErrInvalidMerge = 45
+	// ErrConditionFailed indicates that the call made to check the condition of a voucher failed.
+	ErrConditionFailed = 46
 )
 
 // Errors map error codes to revert errors this actor may return.
@@ -53,10 +62,14 @@ var Errors = map[uint8]error{
 	ErrExpired:                  errors.NewCodedRevertError(ErrExpired, "block height has exceeded channel's end of life"),
 	ErrAlreadyWithdrawn:         errors.NewCodedRevertError(ErrAlreadyWithdrawn, "update amount has already been redeemed"),
 	ErrInvalidSignature:         errors.NewCodedRevertErrorf(ErrInvalidSignature, "signature failed to validate"),
+	ErrStaleNonce:               errors.NewCodedRevertError(ErrStaleNonce, "voucher nonce has been superseded on its lane"),
+	ErrInvalidMerge:             errors.NewCodedRevertError(ErrInvalidMerge, "voucher merges its own lane or merges a lane twice"),
+	ErrConditionFailed:          errors.NewCodedRevertError(ErrConditionFailed, "voucher condition is not met"),
 }
 
 func init() {
 	cbor.RegisterCborType(PaymentChannel{})
+	cbor.RegisterCborType(LaneState{})
 }
 
 // PaymentChannel records the intent to pay funds to a target account.
@@ -65,6 +78,38 @@ type PaymentChannel struct {
 	Amount         *types.AttoFIL     `json:"amount"`
 	AmountRedeemed *types.AttoFIL     `json:"amount_redeemed"`
 	Eol            *types.BlockHeight `json:"eol"`
+
+	// Lanes holds the state of every lane vouchers have been redeemed on,
+	// keyed by stringified lane number. AmountRedeemed is the sum of their
+	// redeemed amounts.
+	Lanes map[string]*LaneState `json:"lanes"`
+}
+
+// LaneState is what a payment channel records about one of its lanes.
+type LaneState struct {
+	// Redeemed is the amount redeemed on the lane.
+	Redeemed *types.AttoFIL `json:"redeemed"`
+
+	// Nonce is the lowest nonce a voucher on the lane may still carry.
+	Nonce uint64 `json:"nonce"`
+}
+
+// Lane returns the state of the given lane. Channels redeemed before lanes
+// were introduced have everything they redeemed on lane 0.
+func (pc *PaymentChannel) Lane(lane uint64) *LaneState {
+	if pc.Lanes == nil {
+		pc.Lanes = map[string]*LaneState{}
+		if pc.AmountRedeemed.GreaterThan(types.ZeroAttoFIL) {
+			pc.Lanes[laneKey(0)] = &LaneState{Redeemed: pc.AmountRedeemed}
+		}
+	}
+
+	state, ok := pc.Lanes[laneKey(lane)]
+	if !ok {
+		state = &LaneState{Redeemed: types.NewZeroAttoFIL()}
+		pc.Lanes[laneKey(lane)] = state
+	}
+	return state
 }
 
 // Actor provides a mechanism for off chain payments.
@@ -87,8 +132,12 @@ func (pb *Actor) Exports() exec.Exports {
 var _ exec.ExecutableActor = (*Actor)(nil)
 
 var paymentBrokerExports = exec.Exports{
+	"addFunds": &exec.FunctionSignature{
+		Params: []abi.Type{abi.ChannelID},
+		Return: nil,
+	},
 	"close": &exec.FunctionSignature{
-		Params: []abi.Type{abi.Address, abi.ChannelID, abi.AttoFIL, abi.BlockHeight, abi.Bytes},
+		Params: []abi.Type{abi.Address, abi.ChannelID, abi.AttoFIL, abi.BlockHeight, abi.Integer, abi.Integer, abi.Bytes, abi.Bytes, abi.Bytes, abi.Bytes},
 		Return: nil,
 	},
 	"createChannel": &exec.FunctionSignature{
@@ -108,11 +157,15 @@ var paymentBrokerExports = exec.Exports{
 		Return: nil,
 	},
 	"redeem": &exec.FunctionSignature{
-		Params: []abi.Type{abi.Address, abi.ChannelID, abi.AttoFIL, abi.BlockHeight, abi.Bytes},
+		Params: []abi.Type{abi.Address, abi.ChannelID, abi.AttoFIL, abi.BlockHeight, abi.Integer, abi.Integer, abi.Bytes, abi.Bytes, abi.Bytes, abi.Bytes},
 		Return: nil,
 	},
+	"redeemMany": &exec.FunctionSignature{
+		Params: []abi.Type{abi.Bytes},
+		Return: []abi.Type{abi.Bytes},
+	},
 	"voucher": &exec.FunctionSignature{
-		Params: []abi.Type{abi.ChannelID, abi.AttoFIL, abi.BlockHeight},
+		Params: []abi.Type{abi.ChannelID, abi.AttoFIL, abi.BlockHeight, abi.Integer, abi.Integer, abi.Bytes, abi.Bytes},
 		Return: []abi.Type{abi.Bytes},
 	},
 }
@@ -182,19 +235,83 @@ func (pb *Actor) CreateChannel(vmctx exec.VMContext, target address.Address, eol
 // target Redeem(200)          -> Payer: 1000, Target: 200, Channel: 800
 // target Close(500)           -> Payer: 1500, Target: 500, Channel: 0
 //
-func (pb *Actor) Redeem(vmctx exec.VMContext, payer address.Address, chid *types.ChannelID, amt *types.AttoFIL, validAt *types.BlockHeight, sig []byte) (uint8, error) {
+// Amounts are tracked per lane: the amt of a voucher is the total authorized on
+// its lane, including what was redeemed on the lanes it merges. Its nonce must
+// not be lower than that of the last voucher redeemed on, or merge into, the lane.
+//
+// If the voucher has a condition, conditionParams are appended to its params
+// and the call it describes must succeed for the voucher to be redeemed.
+func (pb *Actor) Redeem(vmctx exec.VMContext, payer address.Address, chid *types.ChannelID, amt *types.AttoFIL, validAt *types.BlockHeight, lane *big.Int, nonce *big.Int, merges []byte, condition []byte, conditionParams []byte, sig []byte) (uint8, error) {
 	if err := vmctx.Charge(100); err != nil {
 		return exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
 	}
 
-	if !VerifyVoucherSignature(payer, chid, amt, validAt, sig) {
-		return errors.CodeError(Errors[ErrInvalidSignature]), Errors[ErrInvalidSignature]
+	voucher, err := redeemedVoucher(payer, chid, amt, validAt, lane, nonce, merges, condition, sig)
+	if err != nil {
+		return errors.CodeError(err), err
+	}
+
+	if err := redeemVoucher(vmctx, voucher, conditionParams); err != nil {
+		return errors.CodeError(err), err
+	}
+
+	return 0, nil
+}
+
+// RedeemMany redeems several vouchers, possibly from different payers and
+// channels, in a single message. The redemptions are cbor encoded
+// Redemptions, and every voucher must be signed by its payer and target the
+// caller. Vouchers that cannot be redeemed are skipped: the returned bytes are
+// the cbor encoded exit codes of the redemptions, in order, zero for those that
+// succeeded.
+func (pb *Actor) RedeemMany(vmctx exec.VMContext, redemptions []byte) ([]byte, uint8, error) {
+	if err := vmctx.Charge(100); err != nil {
+		return nil, exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	decoded, err := DecodeRedemptions(redemptions)
+	if err != nil {
+		return nil, 1, errors.NewRevertErrorf("invalid redemptions: %s", err)
+	}
+
+	codes := make([]uint8, len(decoded))
+	for i, redemption := range decoded {
+		// each redemption costs a fraction of a redeem message
+		if err := vmctx.Charge(20); err != nil {
+			return nil, exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+		}
+
+		voucher := redemption.Voucher
+		if !VerifyVoucherSignature(&voucher) {
+			codes[i] = ErrInvalidSignature
+			continue
+		}
+
+		err := redeemVoucher(vmctx, &voucher, redemption.ConditionParams)
+		if errors.IsFault(err) {
+			return nil, errors.CodeError(err), err
+		}
+		if err != nil {
+			codes[i] = errors.CodeError(err)
+		}
+	}
+
+	out, err := cbor.DumpObject(codes)
+	if err != nil {
+		return nil, 1, errors.FaultErrorWrap(err, "Error marshalling redemption results")
 	}
 
+	return out, 0, nil
+}
+
+// redeemVoucher pays the caller, who must be the target of the voucher's
+// channel, what the voucher adds to the amount redeemed on its lane.
+func redeemVoucher(vmctx exec.VMContext, voucher *PaymentVoucher, conditionParams []byte) error {
 	ctx := context.Background()
 	storage := vmctx.Storage()
+	chid := &voucher.Channel
 
-	err := withPayerChannels(ctx, storage, payer, func(byChannelID exec.Lookup) error {
+	err := withPayerChannels(ctx, storage, voucher.Payer, func(byChannelID exec.Lookup) error {
 		var channel *PaymentChannel
 
 		chInt, err := byChannelID.Find(ctx, chid.KeyString())
@@ -211,7 +328,7 @@ func (pb *Actor) Redeem(vmctx exec.VMContext, payer address.Address, chid *types
 		}
 
 		// validate the amount can be sent to the target and send payment to that address.
-		err = updateChannel(vmctx, vmctx.Message().From, channel, amt, validAt)
+		err = updateChannel(vmctx, vmctx.Message().From, channel, voucher, conditionParams)
 		if err != nil {
 			return err
 		}
@@ -219,32 +336,29 @@ func (pb *Actor) Redeem(vmctx exec.VMContext, payer address.Address, chid *types
 		return byChannelID.Set(ctx, chid.KeyString(), channel)
 	})
 
-	if err != nil {
-		// ensure error is properly wrapped
-		if !errors.IsFault(err) && !errors.ShouldRevert(err) {
-			return 1, errors.FaultErrorWrap(err, "Error redeeming payment channel")
-		}
-		return errors.CodeError(err), err
+	// ensure error is properly wrapped
+	if err != nil && !errors.IsFault(err) && !errors.ShouldRevert(err) {
+		return errors.FaultErrorWrap(err, "Error redeeming payment channel")
 	}
-
-	return 0, nil
+	return err
 }
 
 // Close first executes the logic performed in the the Update method, then returns all
 // funds remaining in the channel to the payer account and deletes the channel.
-func (pb *Actor) Close(vmctx exec.VMContext, payer address.Address, chid *types.ChannelID, amt *types.AttoFIL, validAt *types.BlockHeight, sig []byte) (uint8, error) {
+func (pb *Actor) Close(vmctx exec.VMContext, payer address.Address, chid *types.ChannelID, amt *types.AttoFIL, validAt *types.BlockHeight, lane *big.Int, nonce *big.Int, merges []byte, condition []byte, conditionParams []byte, sig []byte) (uint8, error) {
 	if err := vmctx.Charge(100); err != nil {
 		return exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
 	}
 
-	if !VerifyVoucherSignature(payer, chid, amt, validAt, sig) {
-		return errors.CodeError(Errors[ErrInvalidSignature]), Errors[ErrInvalidSignature]
+	voucher, err := redeemedVoucher(payer, chid, amt, validAt, lane, nonce, merges, condition, sig)
+	if err != nil {
+		return errors.CodeError(err), err
 	}
 
 	ctx := context.Background()
 	storage := vmctx.Storage()
 
-	err := withPayerChannels(ctx, storage, payer, func(byChannelID exec.Lookup) error {
+	err = withPayerChannels(ctx, storage, payer, func(byChannelID exec.Lookup) error {
 		chInt, err := byChannelID.Find(ctx, chid.KeyString())
 		if err != nil {
 			if err == hamt.ErrNotFound {
@@ -259,7 +373,7 @@ func (pb *Actor) Close(vmctx exec.VMContext, payer address.Address, chid *types.
 		}
 
 		// validate the amount can be sent to the target and send payment to that address.
-		err = updateChannel(vmctx, vmctx.Message().From, channel, amt, validAt)
+		err = updateChannel(vmctx, vmctx.Message().From, channel, voucher, conditionParams)
 		if err != nil {
 			return err
 		}
@@ -334,6 +448,52 @@ func (pb *Actor) Extend(vmctx exec.VMContext, chid *types.ChannelID, eol *types.
 	return 0, nil
 }
 
+// AddFunds can be used by the owner of a channel to add the value of the
+// message to the funds of the channel, without changing its eol.
+func (pb *Actor) AddFunds(vmctx exec.VMContext, chid *types.ChannelID) (uint8, error) {
+	if err := vmctx.Charge(100); err != nil {
+		return exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	ctx := context.Background()
+	storage := vmctx.Storage()
+	payerAddress := vmctx.Message().From
+
+	err := withPayerChannels(ctx, storage, payerAddress, func(byChannelID exec.Lookup) error {
+		chInt, err := byChannelID.Find(ctx, chid.KeyString())
+		if err != nil {
+			if err == hamt.ErrNotFound {
+				return Errors[ErrUnknownChannel]
+			}
+			return errors.FaultErrorWrapf(err, "Could not retrieve payment channel with ID: %s", chid)
+		}
+
+		channel, ok := chInt.(*PaymentChannel)
+		if !ok {
+			return errors.NewFaultError("Expected PaymentChannel from channels lookup")
+		}
+
+		// funds added to an expired channel could only be reclaimed
+		if vmctx.BlockHeight().GreaterEqual(channel.Eol) {
+			return Errors[ErrExpired]
+		}
+
+		channel.Amount = channel.Amount.Add(vmctx.Message().Value)
+
+		return byChannelID.Set(ctx, chid.KeyString(), channel)
+	})
+
+	if err != nil {
+		// ensure error is properly wrapped
+		if !errors.IsFault(err) && !errors.ShouldRevert(err) {
+			return 1, errors.FaultErrorWrap(err, "Error adding funds to channel")
+		}
+		return errors.CodeError(err), err
+	}
+
+	return 0, nil
+}
+
 // Reclaim is used by the owner of a channel to reclaim unspent funds in timed
 // out payment Channels they own.
 func (pb *Actor) Reclaim(vmctx exec.VMContext, chid *types.ChannelID) (uint8, error) {
@@ -381,20 +541,30 @@ func (pb *Actor) Reclaim(vmctx exec.VMContext, chid *types.ChannelID) (uint8, er
 
 // Voucher takes a channel id and amount creates a new unsigned PaymentVoucher
 // against the given channel.  It also takes a block height parameter "validAt"
-// enforcing that the voucher is not reclaimed until the given block height
+// enforcing that the voucher is not reclaimed until the given block height,
+// and the lane, nonce, merges and condition of the voucher.
 // Voucher errors if the channel doesn't exist or contains less than request
 // amount.
-func (pb *Actor) Voucher(vmctx exec.VMContext, chid *types.ChannelID, amount *types.AttoFIL, validAt *types.BlockHeight) ([]byte, uint8, error) {
+func (pb *Actor) Voucher(vmctx exec.VMContext, chid *types.ChannelID, amount *types.AttoFIL, validAt *types.BlockHeight, lane *big.Int, nonce *big.Int, merges []byte, condition []byte) ([]byte, uint8, error) {
 	if err := vmctx.Charge(100); err != nil {
 		return []byte{}, exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
 	}
 
+	voucherMerges, err := DecodeMerges(merges)
+	if err != nil {
+		return nil, 1, errors.NewRevertErrorf("invalid merges: %s", err)
+	}
+	voucherCondition, err := DecodeCondition(condition)
+	if err != nil {
+		return nil, 1, errors.NewRevertErrorf("invalid condition: %s", err)
+	}
+
 	ctx := context.Background()
 	storage := vmctx.Storage()
 	payerAddress := vmctx.Message().From
 	var voucher PaymentVoucher
 
-	err := withPayerChannelsForReading(ctx, storage, payerAddress, func(byChannelID exec.Lookup) error {
+	err = withPayerChannelsForReading(ctx, storage, payerAddress, func(byChannelID exec.Lookup) error {
 		var channel *PaymentChannel
 
 		chInt, err := byChannelID.Find(ctx, chid.KeyString())
@@ -417,11 +587,15 @@ func (pb *Actor) Voucher(vmctx exec.VMContext, chid *types.ChannelID, amount *ty
 
 		// set voucher
 		voucher = PaymentVoucher{
-			Channel: *chid,
-			Payer:   vmctx.Message().From,
-			Target:  channel.Target,
-			Amount:  *amount,
-			ValidAt: *validAt,
+			Channel:   *chid,
+			Payer:     vmctx.Message().From,
+			Target:    channel.Target,
+			Amount:    *amount,
+			ValidAt:   *validAt,
+			Lane:      lane.Uint64(),
+			Nonce:     nonce.Uint64(),
+			Merges:    voucherMerges,
+			Condition: voucherCondition,
 		}
 
 		return nil
@@ -487,12 +661,60 @@ func (pb *Actor) Ls(vmctx exec.VMContext, payer address.Address) ([]byte, uint8,
 	return channelsBytes, 0, nil
 }
 
-func updateChannel(ctx exec.VMContext, target address.Address, channel *PaymentChannel, amt *types.AttoFIL, validAt *types.BlockHeight) error {
+// AllChannels returns every payment channel held in the given payment broker
+// storage, keyed by payer address and then by channel id. It is used to
+// inspect the broker's state from outside of the VM and does not modify storage.
+func AllChannels(ctx context.Context, storage exec.Storage) (map[string]map[string]*PaymentChannel, error) {
+	channels := map[string]map[string]*PaymentChannel{}
+
+	err := actor.WithLookupForReading(ctx, storage, storage.Head(), func(byPayer exec.Lookup) error {
+		payers, err := byPayer.Values(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, payer := range payers {
+			byChannelCID, ok := payer.Value.(cid.Cid)
+			if !ok {
+				return errors.NewFaultError("Paymentbroker payer is not a Cid")
+			}
+
+			byChannelID, err := actor.LoadTypedLookup(ctx, storage, byChannelCID, &PaymentChannel{})
+			if err != nil {
+				return err
+			}
+
+			kvs, err := byChannelID.Values(ctx)
+			if err != nil {
+				return err
+			}
+
+			payerChannels := map[string]*PaymentChannel{}
+			for _, kv := range kvs {
+				pc, ok := kv.Value.(*PaymentChannel)
+				if !ok {
+					return errors.NewFaultError("Expected PaymentChannel from channel lookup")
+				}
+				payerChannels[kv.Key] = pc
+			}
+			channels[payer.Key] = payerChannels
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return channels, nil
+}
+
+func updateChannel(ctx exec.VMContext, target address.Address, channel *PaymentChannel, voucher *PaymentVoucher, conditionParams []byte) error {
 	if target != channel.Target {
 		return Errors[ErrWrongTarget]
 	}
 
-	if ctx.BlockHeight().LessThan(validAt) {
+	if ctx.BlockHeight().LessThan(&voucher.ValidAt) {
 		return Errors[ErrTooEarly]
 	}
 
@@ -500,23 +722,53 @@ func updateChannel(ctx exec.VMContext, target address.Address, channel *PaymentC
 		return Errors[ErrExpired]
 	}
 
-	if amt.GreaterThan(channel.Amount) {
-		return Errors[ErrInsufficientChannelFunds]
+	if err := checkCondition(ctx, voucher.Condition, conditionParams); err != nil {
+		return err
+	}
+
+	lane := channel.Lane(voucher.Lane)
+	if voucher.Nonce < lane.Nonce {
+		return Errors[ErrStaleNonce]
 	}
 
-	if amt.LessEqual(channel.AmountRedeemed) {
+	// the amounts redeemed on merged lanes count towards the voucher amount
+	redeemed := lane.Redeemed
+	merged := map[uint64]*LaneState{}
+	for _, merge := range voucher.Merges {
+		if _, ok := merged[merge.Lane]; ok || merge.Lane == voucher.Lane {
+			return Errors[ErrInvalidMerge]
+		}
+		mergedLane := channel.Lane(merge.Lane)
+		if merge.Nonce <= mergedLane.Nonce {
+			return Errors[ErrStaleNonce]
+		}
+		merged[merge.Lane] = mergedLane
+		redeemed = redeemed.Add(mergedLane.Redeemed)
+	}
+
+	if voucher.Amount.LessEqual(redeemed) {
 		return Errors[ErrAlreadyWithdrawn]
 	}
 
+	updateAmount := voucher.Amount.Sub(redeemed)
+	if channel.AmountRedeemed.Add(updateAmount).GreaterThan(channel.Amount) {
+		return Errors[ErrInsufficientChannelFunds]
+	}
+
 	// transfer funds to sender
-	updateAmount := amt.Sub(channel.AmountRedeemed)
 	_, _, err := ctx.Send(ctx.Message().From, "", updateAmount, nil)
 	if err != nil {
 		return err
 	}
 
-	// update amount redeemed from this channel
-	channel.AmountRedeemed = amt
+	// update the lanes and the amount redeemed from this channel
+	for _, merge := range voucher.Merges {
+		merged[merge.Lane].Redeemed = types.NewZeroAttoFIL()
+		merged[merge.Lane].Nonce = merge.Nonce
+	}
+	lane.Redeemed = &voucher.Amount
+	lane.Nonce = voucher.Nonce
+	channel.AmountRedeemed = channel.AmountRedeemed.Add(updateAmount)
 
 	return nil
 }
@@ -546,25 +798,118 @@ func reclaim(ctx context.Context, vmctx exec.VMContext, byChannelID exec.Lookup,
 // voucher signature.
 const separator = 0x0
 
-// SignVoucher creates the signature for the given combination of
-// channel, amount, validAt (earliest block height for redeem) and from address.
-// It does so by signing the following bytes: (channelID | 0x0 | amount | 0x0 | validAt)
-func SignVoucher(channelID *types.ChannelID, amount *types.AttoFIL, validAt *types.BlockHeight, addr address.Address, signer types.Signer) (types.Signature, error) {
-	data := createVoucherSignatureData(channelID, amount, validAt)
-	return signer.SignBytes(data, addr)
+// SignVoucher creates the payer's signature over the voucher. It does so by
+// signing the following bytes:
+// (channelID | 0x0 | amount | 0x0 | validAt | 0x0 | lane | nonce | merges...)
+// where lane, nonce and every merged lane and nonce are 8 bytes big-endian,
+// followed by (0x0 | to | 0x0 | method | 0x0 | params) if the voucher has a
+// condition.
+func SignVoucher(voucher *PaymentVoucher, signer types.Signer) (types.Signature, error) {
+	data := createVoucherSignatureData(voucher)
+	return signer.SignBytes(data, voucher.Payer)
 }
 
 // VerifyVoucherSignature returns whether the voucher's signature is valid
-func VerifyVoucherSignature(payer address.Address, chid *types.ChannelID, amt *types.AttoFIL, validAt *types.BlockHeight, sig []byte) bool {
-	data := createVoucherSignatureData(chid, amt, validAt)
-	return types.IsValidSignature(data, payer, sig)
+func VerifyVoucherSignature(voucher *PaymentVoucher) bool {
+	data := createVoucherSignatureData(voucher)
+	return types.IsValidSignature(data, voucher.Payer, voucher.Signature)
 }
 
-func createVoucherSignatureData(channelID *types.ChannelID, amount *types.AttoFIL, validAt *types.BlockHeight) []byte {
-	data := append(channelID.Bytes(), separator)
-	data = append(data, amount.Bytes()...)
+func createVoucherSignatureData(voucher *PaymentVoucher) []byte {
+	data := append(voucher.Channel.Bytes(), separator)
+	data = append(data, voucher.Amount.Bytes()...)
 	data = append(data, separator)
-	return append(data, validAt.Bytes()...)
+	data = append(data, voucher.ValidAt.Bytes()...)
+	data = append(data, separator)
+	data = appendUint64(data, voucher.Lane)
+	data = appendUint64(data, voucher.Nonce)
+	for _, merge := range voucher.Merges {
+		data = appendUint64(data, merge.Lane)
+		data = appendUint64(data, merge.Nonce)
+	}
+	if voucher.Condition != nil {
+		data = append(data, separator)
+		data = append(data, voucher.Condition.To.Bytes()...)
+		data = append(data, separator)
+		data = append(data, voucher.Condition.Method...)
+		data = append(data, separator)
+		data = append(data, voucher.Condition.Params...)
+	}
+	return data
+}
+
+func appendUint64(data []byte, n uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], n)
+	return append(data, buf[:]...)
+}
+
+// redeemedVoucher reassembles the voucher passed to redeem or close and
+// checks its signature.
+func redeemedVoucher(payer address.Address, chid *types.ChannelID, amt *types.AttoFIL, validAt *types.BlockHeight, lane *big.Int, nonce *big.Int, merges []byte, condition []byte, sig []byte) (*PaymentVoucher, error) {
+	voucherMerges, err := DecodeMerges(merges)
+	if err != nil {
+		return nil, errors.NewRevertErrorf("invalid merges: %s", err)
+	}
+	voucherCondition, err := DecodeCondition(condition)
+	if err != nil {
+		return nil, errors.NewRevertErrorf("invalid condition: %s", err)
+	}
+
+	voucher := &PaymentVoucher{
+		Channel:   *chid,
+		Payer:     payer,
+		Amount:    *amt,
+		ValidAt:   *validAt,
+		Lane:      lane.Uint64(),
+		Nonce:     nonce.Uint64(),
+		Merges:    voucherMerges,
+		Condition: voucherCondition,
+		Signature: sig,
+	}
+	if !VerifyVoucherSignature(voucher) {
+		return nil, Errors[ErrInvalidSignature]
+	}
+	return voucher, nil
+}
+
+// checkCondition makes the call described by the condition of a voucher, with
+// the params of the condition followed by those supplied by the redeemer. It
+// returns an error if the call fails.
+func checkCondition(ctx exec.VMContext, condition *Condition, suppliedParams []byte) error {
+	if condition == nil {
+		return nil
+	}
+
+	// Params are passed on as the serialized abi values they were encoded
+	// from: Send serializes Bytes values as is, and the callee deserializes
+	// them according to its own signature.
+	var params []interface{}
+	for _, encoded := range [][]byte{condition.Params, suppliedParams} {
+		if len(encoded) == 0 {
+			continue
+		}
+		var values [][]byte
+		if err := cbor.DecodeInto(encoded, &values); err != nil {
+			return errors.NewRevertErrorf("invalid condition params: %s", err)
+		}
+		for _, value := range values {
+			params = append(params, value)
+		}
+	}
+
+	_, code, err := ctx.Send(condition.To, condition.Method, nil, params)
+	if errors.IsFault(err) {
+		return err
+	}
+	if err != nil || code != 0 {
+		return Errors[ErrConditionFailed]
+	}
+	return nil
+}
+
+func laneKey(lane uint64) string {
+	return strconv.FormatUint(lane, 10)
 }
 
 func withPayerChannels(ctx context.Context, storage exec.Storage, payer address.Address, f func(exec.Lookup) error) error {
@@ -280,7 +280,7 @@ func TestPaymentBrokerCloseInvalidSig(t *testing.T) {
 	signature[0] = 0
 	signature[1] = 1
 
-	pdata := core.MustConvertParams(sys.payer, sys.channelID, amt, sys.defaultValidAt, signature)
+	pdata := core.MustConvertParams(sys.payer, sys.channelID, amt, sys.defaultValidAt, big.NewInt(0), big.NewInt(0), []byte{}, []byte{}, []byte{}, signature)
 	msg := types.NewMessage(sys.target, address.PaymentBrokerAddress, 0, types.NewAttoFILFromFIL(0), "close", pdata)
 	res, err := sys.ApplyMessage(msg, 0)
 	require.EqualError(res.ExecutionError, Errors[ErrInvalidSignature].Error())
@@ -298,13 +298,211 @@ func TestPaymentBrokerRedeemInvalidSig(t *testing.T) {
 	signature[0] = 0
 	signature[1] = 1
 
-	pdata := core.MustConvertParams(sys.payer, sys.channelID, amt, sys.defaultValidAt, signature)
+	pdata := core.MustConvertParams(sys.payer, sys.channelID, amt, sys.defaultValidAt, big.NewInt(0), big.NewInt(0), []byte{}, []byte{}, []byte{}, signature)
 	msg := types.NewMessage(sys.target, address.PaymentBrokerAddress, 0, types.NewAttoFILFromFIL(0), "redeem", pdata)
 	res, err := sys.ApplyMessage(msg, 0)
 	require.EqualError(res.ExecutionError, Errors[ErrInvalidSignature].Error())
 	require.NoError(err)
 }
 
+func TestPaymentBrokerRedeemLanes(t *testing.T) {
+	fil := types.NewAttoFILFromFIL
+	validAt := types.NewBlockHeight(0)
+
+	requireRedeem := func(t *testing.T, sys system, voucher *PaymentVoucher, nonce uint64) {
+		result, err := sys.ApplyVoucherMessage(voucher, nonce, "redeem", 0)
+		require.NoError(t, err)
+		require.NoError(t, result.ExecutionError)
+	}
+
+	t.Run("lanes are redeemed independently", func(t *testing.T) {
+		assert := assert.New(t)
+		sys := setup(t)
+
+		requireRedeem(t, sys, sys.Voucher(fil(100), validAt, 0, 0), 0)
+		requireRedeem(t, sys, sys.Voucher(fil(50), validAt, 1, 0), 1)
+		requireRedeem(t, sys, sys.Voucher(fil(150), validAt, 0, 1), 2)
+
+		assert.Equal(fil(200), state.MustGetActor(sys.st, sys.target).Balance)
+
+		channel := sys.retrieveChannel(state.MustGetActor(sys.st, address.PaymentBrokerAddress))
+		assert.Equal(fil(200), channel.AmountRedeemed)
+		assert.Equal(fil(150), channel.Lane(0).Redeemed)
+		assert.Equal(uint64(1), channel.Lane(0).Nonce)
+		assert.Equal(fil(50), channel.Lane(1).Redeemed)
+	})
+
+	t.Run("vouchers with a stale nonce are rejected", func(t *testing.T) {
+		sys := setup(t)
+
+		requireRedeem(t, sys, sys.Voucher(fil(100), validAt, 0, 5), 0)
+
+		result, err := sys.ApplyVoucherMessage(sys.Voucher(fil(200), validAt, 0, 4), 1, "redeem", 0)
+		require.NoError(t, err)
+		assert.EqualError(t, result.ExecutionError, Errors[ErrStaleNonce].Error())
+	})
+
+	t.Run("merges count the merged lane towards the voucher and close it", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+		sys := setup(t)
+
+		requireRedeem(t, sys, sys.Voucher(fil(100), validAt, 0, 0), 0)
+		requireRedeem(t, sys, sys.Voucher(fil(50), validAt, 1, 0), 1)
+
+		// 150 is already redeemed across both lanes, so only 100 more is paid
+		requireRedeem(t, sys, sys.Voucher(fil(250), validAt, 1, 1, Merge{Lane: 0, Nonce: 1}), 2)
+		assert.Equal(fil(250), state.MustGetActor(sys.st, sys.target).Balance)
+
+		channel := sys.retrieveChannel(state.MustGetActor(sys.st, address.PaymentBrokerAddress))
+		assert.Equal(fil(250), channel.AmountRedeemed)
+		assert.Equal(fil(0), channel.Lane(0).Redeemed)
+		assert.Equal(uint64(1), channel.Lane(0).Nonce)
+		assert.Equal(fil(250), channel.Lane(1).Redeemed)
+
+		// vouchers on the merged lane below the merge nonce can no longer be redeemed
+		result, err := sys.ApplyVoucherMessage(sys.Voucher(fil(200), validAt, 0, 0), 3, "redeem", 0)
+		require.NoError(err)
+		assert.EqualError(result.ExecutionError, Errors[ErrStaleNonce].Error())
+
+		// and a lane may not be merged again at the same nonce
+		result, err = sys.ApplyVoucherMessage(sys.Voucher(fil(300), validAt, 1, 2, Merge{Lane: 0, Nonce: 1}), 4, "redeem", 0)
+		require.NoError(err)
+		assert.EqualError(result.ExecutionError, Errors[ErrStaleNonce].Error())
+	})
+
+	t.Run("merging the voucher's own lane or a lane twice is rejected", func(t *testing.T) {
+		require := require.New(t)
+		sys := setup(t)
+
+		result, err := sys.ApplyVoucherMessage(sys.Voucher(fil(100), validAt, 0, 0, Merge{Lane: 0, Nonce: 1}), 0, "redeem", 0)
+		require.NoError(err)
+		require.EqualError(result.ExecutionError, Errors[ErrInvalidMerge].Error())
+
+		result, err = sys.ApplyVoucherMessage(sys.Voucher(fil(100), validAt, 0, 0, Merge{Lane: 1, Nonce: 1}, Merge{Lane: 1, Nonce: 2}), 1, "redeem", 0)
+		require.NoError(err)
+		require.EqualError(result.ExecutionError, Errors[ErrInvalidMerge].Error())
+	})
+
+	t.Run("lanes may not redeem more than the channel holds", func(t *testing.T) {
+		sys := setup(t)
+
+		requireRedeem(t, sys, sys.Voucher(fil(600), validAt, 0, 0), 0)
+
+		result, err := sys.ApplyVoucherMessage(sys.Voucher(fil(600), validAt, 1, 0), 1, "redeem", 0)
+		require.NoError(t, err)
+		assert.EqualError(t, result.ExecutionError, Errors[ErrInsufficientChannelFunds].Error())
+	})
+
+	t.Run("the signature covers the lane", func(t *testing.T) {
+		sys := setup(t)
+
+		voucher := sys.Voucher(fil(100), validAt, 0, 0)
+		voucher.Lane = 1
+
+		result, err := sys.ApplyVoucherMessage(voucher, 0, "redeem", 0)
+		require.NoError(t, err)
+		assert.EqualError(t, result.ExecutionError, Errors[ErrInvalidSignature].Error())
+	})
+}
+
+func TestPaymentBrokerRedeemWithCondition(t *testing.T) {
+	validAt := types.NewBlockHeight(0)
+
+	t.Run("redeems when the condition is met", func(t *testing.T) {
+		require := require.New(t)
+		sys := setup(t)
+
+		voucher := sys.Voucher(types.NewAttoFILFromFIL(100), validAt, 0, 0)
+		condition, err := NewCondition(address.StorageMarketAddress, "getEscrow", sys.payer)
+		require.NoError(err)
+		voucher.Condition = condition
+		sys.Sign(voucher)
+
+		result, err := sys.ApplyVoucherMessage(voucher, 0, "redeem", 0)
+		require.NoError(err)
+		require.NoError(result.ExecutionError)
+
+		assert.Equal(t, types.NewAttoFILFromFIL(100), state.MustGetActor(sys.st, sys.target).Balance)
+	})
+
+	t.Run("passes the params supplied by the redeemer and fails when the call does", func(t *testing.T) {
+		require := require.New(t)
+		sys := setup(t)
+
+		voucher := sys.Voucher(types.NewAttoFILFromFIL(100), validAt, 0, 0)
+		voucher.Condition = &Condition{To: address.StorageMarketAddress, Method: "getDeal"}
+		sys.Sign(voucher)
+
+		// there is no deal 7 for the storage market to return
+		result, err := sys.ApplyVoucherMessage(voucher, 0, "redeem", 0, big.NewInt(7))
+		require.NoError(err)
+		require.EqualError(result.ExecutionError, Errors[ErrConditionFailed].Error())
+
+		assert.Equal(t, types.NewAttoFILFromFIL(0), state.MustGetActor(sys.st, sys.target).Balance)
+	})
+
+	t.Run("the signature covers the condition", func(t *testing.T) {
+		require := require.New(t)
+		sys := setup(t)
+
+		voucher := sys.Voucher(types.NewAttoFILFromFIL(100), validAt, 0, 0)
+		voucher.Condition = &Condition{To: address.StorageMarketAddress, Method: "getDeal"}
+		sys.Sign(voucher)
+		voucher.Condition = nil
+
+		result, err := sys.ApplyVoucherMessage(voucher, 0, "redeem", 0)
+		require.NoError(err)
+		require.EqualError(result.ExecutionError, Errors[ErrInvalidSignature].Error())
+	})
+}
+
+func TestPaymentBrokerRedeemMany(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+	fil := types.NewAttoFILFromFIL
+	validAt := types.NewBlockHeight(0)
+	sys := setup(t)
+
+	otherChannel := establishChannel(sys.ctx, sys.st, sys.vms, sys.payer, sys.target, 1, fil(500), types.NewBlockHeight(10))
+	onOtherChannel := sys.Voucher(fil(200), validAt, 0, 0)
+	onOtherChannel.Channel = *otherChannel
+	sys.Sign(onOtherChannel)
+
+	badSignature := sys.Voucher(fil(300), validAt, 1, 0)
+	badSignature.Amount = *fil(400)
+
+	var redemptions []*Redemption
+	for _, voucher := range []*PaymentVoucher{
+		sys.Voucher(fil(100), validAt, 0, 0),
+		onOtherChannel,
+		badSignature,
+		sys.Voucher(fil(50), validAt, 0, 0),
+	} {
+		redemption, err := NewRedemption(voucher)
+		require.NoError(err)
+		redemptions = append(redemptions, redemption)
+	}
+	encoded, err := EncodeRedemptions(redemptions)
+	require.NoError(err)
+
+	pdata := core.MustConvertParams(encoded)
+	msg := types.NewMessage(sys.target, address.PaymentBrokerAddress, 0, fil(0), "redeemMany", pdata)
+	result, err := sys.ApplyMessage(msg, 0)
+	require.NoError(err)
+	require.NoError(result.ExecutionError)
+	assert.Equal(uint8(0), result.Receipt.ExitCode)
+
+	// vouchers that cannot be redeemed are skipped
+	var codes []uint8
+	require.NoError(cbor.DecodeInto(result.Receipt.Return[0], &codes))
+	assert.Equal([]uint8{0, 0, ErrInvalidSignature, ErrAlreadyWithdrawn}, codes)
+
+	assert.Equal(fil(300), state.MustGetActor(sys.st, sys.target).Balance)
+	assert.Equal(fil(100), sys.retrieveChannel(state.MustGetActor(sys.st, address.PaymentBrokerAddress)).AmountRedeemed)
+	assert.Equal(fil(200), requireGetPaymentChannel(t, sys.ctx, sys.st, sys.vms, sys.payer, otherChannel).AmountRedeemed)
+}
+
 func TestPaymentBrokerReclaim(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
@@ -381,6 +579,48 @@ func TestPaymentBrokerExtend(t *testing.T) {
 	assert.Equal(types.NewBlockHeight(20), channel.Eol)
 }
 
+func TestPaymentBrokerAddFunds(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+	sys := setup(t)
+
+	pdata := core.MustConvertParams(sys.channelID)
+	msg := types.NewMessage(sys.payer, address.PaymentBrokerAddress, 1, types.NewAttoFILFromFIL(500), "addFunds", pdata)
+	result, err := sys.ApplyMessage(msg, 9)
+	require.NoError(err)
+	require.NoError(result.ExecutionError)
+	assert.Equal(uint8(0), result.Receipt.ExitCode)
+
+	// the added funds can be redeemed
+	result, err = sys.ApplyRedeemMessageWithBlockHeight(sys.target, 1200, 0, 9)
+	require.NoError(err)
+	require.NoError(result.ExecutionError)
+
+	channel := sys.retrieveChannel(state.MustGetActor(sys.st, address.PaymentBrokerAddress))
+	assert.Equal(types.NewAttoFILFromFIL(1500), channel.Amount)
+	assert.Equal(types.NewBlockHeight(10), channel.Eol)
+
+	t.Run("fails once the channel expired", func(t *testing.T) {
+		sys := setup(t)
+
+		pdata := core.MustConvertParams(sys.channelID)
+		msg := types.NewMessage(sys.payer, address.PaymentBrokerAddress, 1, types.NewAttoFILFromFIL(500), "addFunds", pdata)
+		result, err := sys.ApplyMessage(msg, 10)
+		require.NoError(err)
+		assert.EqualError(result.ExecutionError, Errors[ErrExpired].Error())
+	})
+
+	t.Run("fails with an unknown channel", func(t *testing.T) {
+		sys := setup(t)
+
+		pdata := core.MustConvertParams(types.NewChannelID(383))
+		msg := types.NewMessage(sys.payer, address.PaymentBrokerAddress, 1, types.NewAttoFILFromFIL(500), "addFunds", pdata)
+		result, err := sys.ApplyMessage(msg, 9)
+		require.NoError(err)
+		assert.EqualError(result.ExecutionError, Errors[ErrUnknownChannel].Error())
+	})
+}
+
 func TestPaymentBrokerExtendFailsWithNonExistentChannel(t *testing.T) {
 	require := require.New(t)
 	assert := assert.New(t)
@@ -492,7 +732,9 @@ func TestNewPaymentBrokerVoucher(t *testing.T) {
 
 		// create voucher
 		voucherAmount := types.NewAttoFILFromFIL(100)
-		pdata := core.MustConvertParams(sys.channelID, voucherAmount, sys.defaultValidAt)
+		merges, err := EncodeMerges([]Merge{{Lane: 0, Nonce: 1}})
+		require.NoError(err)
+		pdata := core.MustConvertParams(sys.channelID, voucherAmount, sys.defaultValidAt, big.NewInt(2), big.NewInt(3), merges, []byte{})
 		msg := types.NewMessage(sys.payer, address.PaymentBrokerAddress, 1, nil, "voucher", pdata)
 		res, err := sys.ApplyMessage(msg, 9)
 		assert.NoError(err)
@@ -507,6 +749,9 @@ func TestNewPaymentBrokerVoucher(t *testing.T) {
 		assert.Equal(sys.payer, voucher.Payer)
 		assert.Equal(sys.target, voucher.Target)
 		assert.Equal(*voucherAmount, voucher.Amount)
+		assert.Equal(uint64(2), voucher.Lane)
+		assert.Equal(uint64(3), voucher.Nonce)
+		assert.Equal([]Merge{{Lane: 0, Nonce: 1}}, voucher.Merges)
 	})
 
 	t.Run("Errors when channel does not exist", func(t *testing.T) {
@@ -516,7 +761,7 @@ func TestNewPaymentBrokerVoucher(t *testing.T) {
 
 		// create voucher
 		voucherAmount := types.NewAttoFILFromFIL(100)
-		_, exitCode, err := sys.CallQueryMethod("voucher", 9, notChannelID, voucherAmount, sys.defaultValidAt)
+		_, exitCode, err := sys.CallQueryMethod("voucher", 9, notChannelID, voucherAmount, sys.defaultValidAt, big.NewInt(0), big.NewInt(0), []byte{}, []byte{})
 		assert.NotEqual(uint8(0), exitCode)
 		assert.Contains(fmt.Sprintf("%v", err), "unknown")
 	})
@@ -526,7 +771,7 @@ func TestNewPaymentBrokerVoucher(t *testing.T) {
 
 		// create voucher
 		voucherAmount := types.NewAttoFILFromFIL(2000)
-		args := core.MustConvertParams(sys.channelID, voucherAmount, sys.defaultValidAt)
+		args := core.MustConvertParams(sys.channelID, voucherAmount, sys.defaultValidAt, big.NewInt(0), big.NewInt(0), []byte{}, []byte{})
 
 		msg := types.NewMessage(sys.payer, address.PaymentBrokerAddress, 1, nil, "voucher", args)
 		res, err := sys.ApplyMessage(msg, 9)
@@ -616,11 +861,48 @@ func setup(t *testing.T) system {
 }
 
 func (sys *system) Signature(amt *types.AttoFIL, validAt *types.BlockHeight) ([]byte, error) {
-	sig, err := SignVoucher(sys.channelID, amt, validAt, sys.payer, mockSigner)
-	if err != nil {
-		return nil, err
+	voucher := sys.Voucher(amt, validAt, 0, 0)
+	return ([]byte)(voucher.Signature), nil
+}
+
+// Voucher returns a voucher for the channel on the given lane, signed by the payer.
+func (sys *system) Voucher(amt *types.AttoFIL, validAt *types.BlockHeight, lane, nonce uint64, merges ...Merge) *PaymentVoucher {
+	sys.t.Helper()
+
+	voucher := &PaymentVoucher{
+		Channel: *sys.channelID,
+		Payer:   sys.payer,
+		Target:  sys.target,
+		Amount:  *amt,
+		ValidAt: *validAt,
+		Lane:    lane,
+		Nonce:   nonce,
+		Merges:  merges,
 	}
-	return ([]byte)(sig), nil
+	sys.Sign(voucher)
+	return voucher
+}
+
+// Sign sets the payer's signature on the voucher.
+func (sys *system) Sign(voucher *PaymentVoucher) {
+	sys.t.Helper()
+
+	sig, err := SignVoucher(voucher, mockSigner)
+	require.NoError(sys.t, err)
+	voucher.Signature = sig
+}
+
+// ApplyVoucherMessage redeems or closes with the given voucher.
+func (sys *system) ApplyVoucherMessage(voucher *PaymentVoucher, nonce uint64, method string, height uint64, conditionParams ...interface{}) (*consensus.ApplicationResult, error) {
+	sys.t.Helper()
+
+	params, err := voucher.RedeemParams(conditionParams...)
+	require.NoError(sys.t, err)
+
+	pdata := core.MustConvertParams(params...)
+	msg := types.NewMessage(sys.target, address.PaymentBrokerAddress, nonce, types.NewAttoFILFromFIL(0), method, pdata)
+
+	return sys.ApplyMessage(msg, height)
 }
 
 func (sys *system) CallQueryMethod(method string, height uint64, params ...interface{}) ([][]byte, uint8, error) {
@@ -683,13 +965,11 @@ func (sys *system) retrieveChannel(paymentBroker *actor.Actor) *PaymentChannel {
 func (sys *system) applySignatureMessage(target address.Address, amtInt uint64, validAt *types.BlockHeight, nonce uint64, method string, height uint64) (*consensus.ApplicationResult, error) {
 	sys.t.Helper()
 
-	require := require.New(sys.t)
-
-	amt := types.NewAttoFILFromFIL(amtInt)
-	signature, err := sys.Signature(amt, validAt)
-	require.NoError(err)
+	voucher := sys.Voucher(types.NewAttoFILFromFIL(amtInt), validAt, 0, 0)
+	params, err := voucher.RedeemParams()
+	require.NoError(sys.t, err)
 
-	pdata := core.MustConvertParams(sys.payer, sys.channelID, amt, validAt, signature)
+	pdata := core.MustConvertParams(params...)
 	msg := types.NewMessage(target, address.PaymentBrokerAddress, nonce, types.NewAttoFILFromFIL(0), method, pdata)
 
 	return sys.ApplyMessage(msg, height)
@@ -0,0 +1,343 @@
+package storagemarket
+
+import (
+	"context"
+	"math/big"
+	"strconv"
+
+	"gx/ipfs/QmNf3wujpV2Y7Lnj2hy2UrmuX8bhMDStRHbnSLh7Ypf36h/go-hamt-ipld"
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	cbor "gx/ipfs/QmcZLyosDwMKdB6NLRsiss9HXzDPhVhhRtPy67JFKTDQDX/go-ipld-cbor"
+
+	"github.com/filecoin-project/go-filecoin/actor"
+	"github.com/filecoin-project/go-filecoin/address"
+	"github.com/filecoin-project/go-filecoin/exec"
+	"github.com/filecoin-project/go-filecoin/types"
+	"github.com/filecoin-project/go-filecoin/vm/errors"
+)
+
+func init() {
+	cbor.RegisterCborType(DealProposal{})
+	cbor.RegisterCborType(Deal{})
+	cbor.RegisterCborType(Escrow{})
+}
+
+// DealProposal is the part of a storage deal the client signs and the miner
+// publishes to the storage market.
+type DealProposal struct {
+	// PieceRef is the cid of the piece being stored.
+	PieceRef cid.Cid
+
+	// Size is the number of bytes being stored.
+	Size *types.BytesAmount
+
+	// Client is the address that pays for the deal from its escrow.
+	Client address.Address
+
+	// Miner is the address of the miner actor storing the piece.
+	Miner address.Address
+
+	// Price is the total amount the client pays over the life of the deal.
+	Price *types.AttoFIL
+
+	// Collateral is the amount of the miner's escrow locked for the life of
+	// the deal.
+	Collateral *types.AttoFIL
+
+	// Duration is the number of blocks the piece is stored for, counted from
+	// the commitment of the sector holding it.
+	Duration uint64
+}
+
+// Marshal returns the encoding of the proposal that is signed by the client
+// and passed to publishDeal.
+func (dp *DealProposal) Marshal() ([]byte, error) {
+	return cbor.DumpObject(dp)
+}
+
+// Cid returns the content id of the proposal.
+func (dp *DealProposal) Cid() (cid.Cid, error) {
+	obj, err := cbor.WrapObject(dp, types.DefaultHashFunction, -1)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return obj.Cid(), nil
+}
+
+// SignDealProposal creates the client's signature over the proposal.
+func SignDealProposal(proposal *DealProposal, signer types.Signer) (types.Signature, error) {
+	data, err := proposal.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return signer.SignBytes(data, proposal.Client)
+}
+
+// VerifyDealProposalSignature returns whether sig is the client's signature
+// over the proposal.
+func VerifyDealProposalSignature(proposal *DealProposal, sig types.Signature) bool {
+	data, err := proposal.Marshal()
+	if err != nil {
+		return false
+	}
+	return types.IsValidSignature(data, proposal.Client, sig)
+}
+
+// Deal is a storage deal published to the storage market.
+type Deal struct {
+	ID       uint64
+	Proposal DealProposal
+
+	// PublishedAt is the block height at which the deal was published.
+	PublishedAt *types.BlockHeight
+
+	// Canceled is true if the deal was canceled because its miner did not
+	// activate it by its start-by deadline.
+	Canceled bool
+
+	// SectorID is the sector the miner committed the deal's piece in. It is
+	// only meaningful once the deal is active.
+	SectorID uint64
+
+	// ActivatedAt is the block height at which the sector holding the deal
+	// was committed, or nil if it has not been yet.
+	ActivatedAt *types.BlockHeight
+
+	// TerminatedAt is the block height at which the sector holding the deal
+	// was removed before the deal ended, or nil if it was not.
+	TerminatedAt *types.BlockHeight
+
+	// PaidUntil is the block height up to which the deal has been settled,
+	// whether the miner was paid for that time or forfeited it.
+	PaidUntil *types.BlockHeight
+
+	// Paid is the amount paid to the miner so far.
+	Paid *types.AttoFIL
+}
+
+// Active returns true if the deal's sector has been committed.
+func (d *Deal) Active() bool {
+	return d.ActivatedAt != nil
+}
+
+// StartBy returns the block height after which the deal can no longer be
+// activated.
+func (d *Deal) StartBy() *types.BlockHeight {
+	return d.PublishedAt.Add(DealStartBlocks)
+}
+
+// Expiration returns the block height at which the deal ends, or nil if the
+// deal is not active. A terminated deal ends when it was terminated.
+func (d *Deal) Expiration() *types.BlockHeight {
+	if !d.Active() {
+		return nil
+	}
+	if d.TerminatedAt != nil {
+		return d.TerminatedAt
+	}
+	return d.ActivatedAt.Add(types.NewBlockHeight(d.Proposal.Duration))
+}
+
+// Completed returns true if the whole deal has been settled.
+func (d *Deal) Completed() bool {
+	return d.Active() && d.PaidUntil.GreaterEqual(d.Expiration())
+}
+
+// amountDue returns the amount owed to the miner for storing the piece from
+// the last settlement until the given block height.
+func (d *Deal) amountDue(height *types.BlockHeight) *types.AttoFIL {
+	return d.accrued(height).Sub(d.accrued(d.PaidUntil))
+}
+
+// accrued returns the part of the price earned by storing the piece from the
+// start of the deal until the given block height.
+func (d *Deal) accrued(height *types.BlockHeight) *types.AttoFIL {
+	end := height
+	if end.GreaterThan(d.Expiration()) {
+		end = d.Expiration()
+	}
+
+	elapsed := end.Sub(d.ActivatedAt).AsBigInt()
+	duration := types.NewAttoFIL(new(big.Int).SetUint64(d.Proposal.Duration))
+	return d.Proposal.Price.MulBigInt(elapsed).DivCeil(duration)
+}
+
+// Escrow is the balance an address holds in the storage market. Available
+// funds may be withdrawn or locked into new deals; locked funds pay for, or
+// are held as collateral against, published deals.
+type Escrow struct {
+	Available *types.AttoFIL
+	Locked    *types.AttoFIL
+}
+
+// market gives access to the deals and escrows kept by the storage market.
+type market struct {
+	deals     exec.Lookup
+	proposals exec.Lookup
+	escrows   exec.Lookup
+}
+
+func loadMarket(ctx context.Context, storage exec.Storage, state *State) (*market, error) {
+	deals, err := actor.LoadTypedLookup(ctx, storage, state.Deals, Deal{})
+	if err != nil {
+		return nil, errors.FaultErrorWrapf(err, "could not load deal lookup with CID: %s", state.Deals)
+	}
+	proposals, err := actor.LoadTypedLookup(ctx, storage, state.Proposals, uint64(0))
+	if err != nil {
+		return nil, errors.FaultErrorWrapf(err, "could not load proposal lookup with CID: %s", state.Proposals)
+	}
+	escrows, err := actor.LoadTypedLookup(ctx, storage, state.Escrows, Escrow{})
+	if err != nil {
+		return nil, errors.FaultErrorWrapf(err, "could not load escrow lookup with CID: %s", state.Escrows)
+	}
+	return &market{deals: deals, proposals: proposals, escrows: escrows}, nil
+}
+
+// commit flushes the lookups and records their roots in the state.
+func (m *market) commit(ctx context.Context, state *State) error {
+	var err error
+	if state.Deals, err = m.deals.Commit(ctx); err != nil {
+		return errors.FaultErrorWrap(err, "could not commit deal lookup")
+	}
+	if state.Proposals, err = m.proposals.Commit(ctx); err != nil {
+		return errors.FaultErrorWrap(err, "could not commit proposal lookup")
+	}
+	if state.Escrows, err = m.escrows.Commit(ctx); err != nil {
+		return errors.FaultErrorWrap(err, "could not commit escrow lookup")
+	}
+	return nil
+}
+
+func (m *market) getDeal(ctx context.Context, dealID uint64) (*Deal, error) {
+	val, err := m.deals.Find(ctx, dealKey(dealID))
+	if err == hamt.ErrNotFound {
+		return nil, Errors[ErrUnknownDeal]
+	}
+	if err != nil {
+		return nil, errors.FaultErrorWrapf(err, "could not look up deal %d", dealID)
+	}
+	deal, ok := val.(Deal)
+	if !ok {
+		return nil, errors.NewFaultErrorf("expected deal lookup to hold Deal, but got %T instead", val)
+	}
+	return &deal, nil
+}
+
+func (m *market) putDeal(ctx context.Context, deal *Deal) error {
+	if err := m.deals.Set(ctx, dealKey(deal.ID), deal); err != nil {
+		return errors.FaultErrorWrapf(err, "could not store deal %d", deal.ID)
+	}
+	return nil
+}
+
+// published returns true if the proposal with the given cid has been
+// published before.
+func (m *market) published(ctx context.Context, proposalCid cid.Cid) (bool, error) {
+	_, err := m.proposals.Find(ctx, proposalCid.KeyString())
+	if err == hamt.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.FaultErrorWrapf(err, "could not look up proposal %s", proposalCid)
+	}
+	return true, nil
+}
+
+func (m *market) getEscrow(ctx context.Context, addr address.Address) (*Escrow, error) {
+	val, err := m.escrows.Find(ctx, addr.String())
+	if err == hamt.ErrNotFound {
+		return &Escrow{Available: types.NewZeroAttoFIL(), Locked: types.NewZeroAttoFIL()}, nil
+	}
+	if err != nil {
+		return nil, errors.FaultErrorWrapf(err, "could not look up escrow of %s", addr)
+	}
+	escrow, ok := val.(Escrow)
+	if !ok {
+		return nil, errors.NewFaultErrorf("expected escrow lookup to hold Escrow, but got %T instead", val)
+	}
+	return &escrow, nil
+}
+
+func (m *market) putEscrow(ctx context.Context, addr address.Address, escrow *Escrow) error {
+	if err := m.escrows.Set(ctx, addr.String(), escrow); err != nil {
+		return errors.FaultErrorWrapf(err, "could not store escrow of %s", addr)
+	}
+	return nil
+}
+
+// lock moves amount from the available to the locked balance of addr.
+func (m *market) lock(ctx context.Context, addr address.Address, amount *types.AttoFIL) error {
+	escrow, err := m.getEscrow(ctx, addr)
+	if err != nil {
+		return err
+	}
+	if escrow.Available.LessThan(amount) {
+		return Errors[ErrInsufficientEscrow]
+	}
+	escrow.Available = escrow.Available.Sub(amount)
+	escrow.Locked = escrow.Locked.Add(amount)
+	return m.putEscrow(ctx, addr, escrow)
+}
+
+// transfer moves amount from the locked balance of from to the available
+// balance of to.
+func (m *market) transfer(ctx context.Context, from, to address.Address, amount *types.AttoFIL) error {
+	fromEscrow, err := m.getEscrow(ctx, from)
+	if err != nil {
+		return err
+	}
+	if fromEscrow.Locked.LessThan(amount) {
+		return errors.NewFaultErrorf("locked escrow of %s does not cover %s", from, amount)
+	}
+	fromEscrow.Locked = fromEscrow.Locked.Sub(amount)
+	if err := m.putEscrow(ctx, from, fromEscrow); err != nil {
+		return err
+	}
+
+	toEscrow, err := m.getEscrow(ctx, to)
+	if err != nil {
+		return err
+	}
+	toEscrow.Available = toEscrow.Available.Add(amount)
+	return m.putEscrow(ctx, to, toEscrow)
+}
+
+// settleDeal settles the active deal up to the given block height. The miner
+// is paid for that time if it proved the deal's sector, and forfeits it
+// otherwise. Once the deal ends, the client gets back what the miner forfeited
+// and the miner its collateral, unless the deal was terminated early, in which
+// case the collateral goes to the client.
+func (m *market) settleDeal(ctx context.Context, deal *Deal, height *types.BlockHeight, proven bool) error {
+	due := deal.amountDue(height)
+	if proven && due.IsPositive() {
+		if err := m.transfer(ctx, deal.Proposal.Client, deal.Proposal.Miner, due); err != nil {
+			return err
+		}
+		deal.Paid = deal.Paid.Add(due)
+	}
+
+	deal.PaidUntil = height
+	if deal.PaidUntil.GreaterThan(deal.Expiration()) {
+		deal.PaidUntil = deal.Expiration()
+	}
+	if deal.Completed() {
+		if refund := deal.Proposal.Price.Sub(deal.Paid); refund.IsPositive() {
+			if err := m.transfer(ctx, deal.Proposal.Client, deal.Proposal.Client, refund); err != nil {
+				return err
+			}
+		}
+		collateralTo := deal.Proposal.Miner
+		if deal.TerminatedAt != nil {
+			collateralTo = deal.Proposal.Client
+		}
+		if err := m.transfer(ctx, deal.Proposal.Miner, collateralTo, deal.Proposal.Collateral); err != nil {
+			return err
+		}
+	}
+
+	return m.putDeal(ctx, deal)
+}
+
+func dealKey(dealID uint64) string {
+	return strconv.FormatUint(dealID, 10)
+}
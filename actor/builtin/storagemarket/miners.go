@@ -0,0 +1,188 @@
+package storagemarket
+
+import (
+	"context"
+	"math/big"
+	"strconv"
+
+	"gx/ipfs/QmNf3wujpV2Y7Lnj2hy2UrmuX8bhMDStRHbnSLh7Ypf36h/go-hamt-ipld"
+	"gx/ipfs/QmTu65MVbemtUxJEWgsTtzv9Zv9P8rvmqNA4eG9TrTRGYc/go-libp2p-peer"
+	cbor "gx/ipfs/QmcZLyosDwMKdB6NLRsiss9HXzDPhVhhRtPy67JFKTDQDX/go-ipld-cbor"
+
+	"github.com/filecoin-project/go-filecoin/actor"
+	"github.com/filecoin-project/go-filecoin/address"
+	"github.com/filecoin-project/go-filecoin/exec"
+	"github.com/filecoin-project/go-filecoin/types"
+	"github.com/filecoin-project/go-filecoin/vm/errors"
+)
+
+func init() {
+	cbor.RegisterCborType(MinerInfo{})
+}
+
+// MaximumMinerPageSize is the largest number of miners returned by a single
+// call to getMiners.
+const MaximumMinerPageSize = 1000
+
+// MinerInfo is what the storage market records about each miner it created,
+// so that clients can find miners without scanning every actor.
+type MinerInfo struct {
+	Address address.Address
+
+	// PeerID is the libp2p identity the miner operates. It is kept in sync
+	// with the miner actor's peer ID.
+	PeerID peer.ID
+
+	// Multiaddrs are the encoded multiaddrs the miner can be dialed on.
+	Multiaddrs [][]byte
+
+	// SectorSize is the number of bytes the miner declared it stores per
+	// sector, or nil if it has not declared one.
+	SectorSize *types.BytesAmount
+
+	// Power is the number of sectors the miner has proven.
+	Power *big.Int
+
+	// Index is the position of the miner in the registry's index.
+	Index uint64
+}
+
+// minerRegistry provides access to the MinerInfo of every miner. Like a
+// miner's sectors, the infos are kept in a lookup from address to MinerInfo
+// and an index from position to address that getMiners pages through.
+type minerRegistry struct {
+	infos exec.Lookup
+	index exec.Lookup
+	count uint64
+}
+
+func loadMinerRegistry(ctx context.Context, storage exec.Storage, state *State) (*minerRegistry, error) {
+	infos, err := actor.LoadTypedLookup(ctx, storage, state.MinerInfos, MinerInfo{})
+	if err != nil {
+		return nil, errors.FaultErrorWrapf(err, "could not load miner info lookup with CID: %s", state.MinerInfos)
+	}
+	index, err := actor.LoadTypedLookup(ctx, storage, state.MinerIndex, "")
+	if err != nil {
+		return nil, errors.FaultErrorWrapf(err, "could not load miner index with CID: %s", state.MinerIndex)
+	}
+	return &minerRegistry{infos: infos, index: index, count: state.MinerCount}, nil
+}
+
+// commit flushes the lookups and records their roots in the state.
+func (r *minerRegistry) commit(ctx context.Context, state *State) error {
+	var err error
+	if state.MinerInfos, err = r.infos.Commit(ctx); err != nil {
+		return errors.FaultErrorWrap(err, "could not commit miner info lookup")
+	}
+	if state.MinerIndex, err = r.index.Commit(ctx); err != nil {
+		return errors.FaultErrorWrap(err, "could not commit miner index")
+	}
+	state.MinerCount = r.count
+	return nil
+}
+
+// get returns the info of the miner at minerAddr, or nil if the registry
+// has none.
+func (r *minerRegistry) get(ctx context.Context, minerAddr address.Address) (*MinerInfo, error) {
+	val, err := r.infos.Find(ctx, minerAddr.String())
+	if err == hamt.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.FaultErrorWrapf(err, "could not look up info of miner %s", minerAddr)
+	}
+	info, ok := val.(MinerInfo)
+	if !ok {
+		return nil, errors.NewFaultErrorf("expected miner info lookup to hold MinerInfo, but got %T instead", val)
+	}
+	return &info, nil
+}
+
+// getOrAdd returns the info of the miner at minerAddr, adding an empty one
+// to the registry if there is none. Miners created before the registry
+// existed are added this way the first time they update their info.
+func (r *minerRegistry) getOrAdd(ctx context.Context, minerAddr address.Address) (*MinerInfo, error) {
+	info, err := r.get(ctx, minerAddr)
+	if err != nil || info != nil {
+		return info, err
+	}
+
+	info = &MinerInfo{
+		Address: minerAddr,
+		Power:   big.NewInt(0),
+		Index:   r.count,
+	}
+	if err := r.index.Set(ctx, strconv.FormatUint(info.Index, 10), minerAddr.String()); err != nil {
+		return nil, errors.FaultErrorWrapf(err, "could not index miner %s", minerAddr)
+	}
+	r.count++
+	return info, nil
+}
+
+func (r *minerRegistry) put(ctx context.Context, info *MinerInfo) error {
+	if err := r.infos.Set(ctx, info.Address.String(), info); err != nil {
+		return errors.FaultErrorWrapf(err, "could not store info of miner %s", info.Address)
+	}
+	return nil
+}
+
+// page returns the infos of at most limit miners, starting at the given
+// index.
+func (r *minerRegistry) page(ctx context.Context, offset, limit uint64) ([]*MinerInfo, error) {
+	page := []*MinerInfo{}
+	for i := offset; i < r.count && i-offset < limit; i++ {
+		val, err := r.index.Find(ctx, strconv.FormatUint(i, 10))
+		if err != nil {
+			return nil, errors.FaultErrorWrapf(err, "could not find miner at index %d", i)
+		}
+		encoded, ok := val.(string)
+		if !ok {
+			return nil, errors.NewFaultErrorf("expected miner index to hold string, but got %T instead", val)
+		}
+		minerAddr, err := address.NewFromString(encoded)
+		if err != nil {
+			return nil, errors.FaultErrorWrapf(err, "invalid miner address %q in index", encoded)
+		}
+
+		info, err := r.get(ctx, minerAddr)
+		if err != nil {
+			return nil, err
+		}
+		if info == nil {
+			return nil, errors.NewFaultErrorf("miner %s is indexed but has no info", minerAddr)
+		}
+		page = append(page, info)
+	}
+	return page, nil
+}
+
+// updateMinerInfo applies update to the registry info of the registered
+// miner at minerAddr.
+func updateMinerInfo(vmctx exec.VMContext, state *State, minerAddr address.Address, update func(*MinerInfo)) error {
+	ctx := context.Background()
+
+	miners, err := actor.LoadLookup(ctx, vmctx.Storage(), state.Miners)
+	if err != nil {
+		return errors.FaultErrorWrapf(err, "could not load lookup for miner with CID: %s", state.Miners)
+	}
+	if _, err := miners.Find(ctx, minerAddr.String()); err != nil {
+		if err == hamt.ErrNotFound {
+			return Errors[ErrUnknownMiner]
+		}
+		return errors.FaultErrorWrapf(err, "could not load lookup for miner with address: %s", minerAddr)
+	}
+
+	registry, err := loadMinerRegistry(ctx, vmctx.Storage(), state)
+	if err != nil {
+		return err
+	}
+	info, err := registry.getOrAdd(ctx, minerAddr)
+	if err != nil {
+		return err
+	}
+	update(info)
+	if err := registry.put(ctx, info); err != nil {
+		return err
+	}
+	return registry.commit(ctx, state)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math/big"
 
+	ma "gx/ipfs/QmNTCey11oxhb1AxDnQBRHtdhap6Ctud872NjAYPYYXPuc/go-multiaddr"
 	"gx/ipfs/QmNf3wujpV2Y7Lnj2hy2UrmuX8bhMDStRHbnSLh7Ypf36h/go-hamt-ipld"
 	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
 	"gx/ipfs/QmTu65MVbemtUxJEWgsTtzv9Zv9P8rvmqNA4eG9TrTRGYc/go-libp2p-peer"
@@ -22,8 +23,13 @@ import (
 // MinimumPledge is the minimum amount of sectors a user can pledge.
 var MinimumPledge = big.NewInt(10)
 
+// DealStartBlocks is the number of blocks after a deal is published within
+// which its miner must commit the sector holding the piece. Once it has passed,
+// anyone can cancel the deal to unlock its escrow.
+var DealStartBlocks = types.NewBlockHeight(10000)
+
 // MinimumCollateralPerSector is the minimum amount of collateral required per sector
-var MinimumCollateralPerSector, _ = types.NewAttoFILFromFILString("0.001")
+var MinimumCollateralPerSector = miner.MinimumCollateralPerSector
 
 const (
 	// ErrPledgeTooLow is the error code for a pledge under the MinimumPledge.
@@ -32,6 +38,32 @@ const (
 	ErrUnknownMiner = 34
 	// ErrInsufficientCollateral indicates the collateral is too low.
 	ErrInsufficientCollateral = 43
+	// ErrUnknownDeal indicates that no deal was found with the given id.
+	ErrUnknownDeal = 44
+	// ErrInsufficientEscrow indicates that an escrow balance is too low.
+	ErrInsufficientEscrow = 45
+	// ErrInvalidDealSignature indicates that a deal proposal was not signed
+	// by its client.
+	ErrInvalidDealSignature = 46
+	// ErrDealPublished indicates that a deal proposal has already been
+	// published.
+	ErrDealPublished = 47
+	// ErrDealActive indicates that a deal has already been committed to a
+	// sector.
+	ErrDealActive = 48
+	// ErrCallerUnauthorized signals an unauthorized caller.
+	ErrCallerUnauthorized = 49
+	// ErrInvalidDeal indicates that a deal proposal is malformed.
+	ErrInvalidDeal = 50
+	// ErrDealNotActive indicates that a deal was not active at a block
+	// height, or does not store a piece.
+	ErrDealNotActive = 51
+	// ErrDealExpired indicates that a deal was not activated before its
+	// start-by deadline.
+	ErrDealExpired = 52
+	// ErrDealPending indicates that a deal can still be activated, so it can
+	// not be canceled.
+	ErrDealPending = 53
 )
 
 // Errors map error codes to revert errors this actor may return.
@@ -39,6 +71,16 @@ var Errors = map[uint8]error{
 	ErrPledgeTooLow:           errors.NewCodedRevertErrorf(ErrPledgeTooLow, "pledge must be at least %s sectors", MinimumPledge),
 	ErrUnknownMiner:           errors.NewCodedRevertErrorf(ErrUnknownMiner, "unknown miner"),
 	ErrInsufficientCollateral: errors.NewCodedRevertErrorf(ErrInsufficientCollateral, "collateral must be more than %s FIL per sector", MinimumCollateralPerSector),
+	ErrUnknownDeal:            errors.NewCodedRevertErrorf(ErrUnknownDeal, "unknown deal"),
+	ErrInsufficientEscrow:     errors.NewCodedRevertErrorf(ErrInsufficientEscrow, "insufficient escrow balance"),
+	ErrInvalidDealSignature:   errors.NewCodedRevertErrorf(ErrInvalidDealSignature, "deal proposal not signed by client"),
+	ErrDealPublished:          errors.NewCodedRevertErrorf(ErrDealPublished, "deal proposal already published"),
+	ErrDealActive:             errors.NewCodedRevertErrorf(ErrDealActive, "deal already committed to a sector"),
+	ErrCallerUnauthorized:     errors.NewCodedRevertErrorf(ErrCallerUnauthorized, "not authorized to call the method"),
+	ErrInvalidDeal:            errors.NewCodedRevertErrorf(ErrInvalidDeal, "invalid deal proposal"),
+	ErrDealNotActive:          errors.NewCodedRevertErrorf(ErrDealNotActive, "deal does not store the piece at the given block height"),
+	ErrDealExpired:            errors.NewCodedRevertErrorf(ErrDealExpired, "deal was not activated before its start-by deadline"),
+	ErrDealPending:            errors.NewCodedRevertErrorf(ErrDealPending, "deal can still be activated"),
 }
 
 func init() {
@@ -57,6 +99,24 @@ type State struct {
 	// TotalCommitedStorage is the number of sectors that are currently committed
 	// in the whole network.
 	TotalCommittedStorage *big.Int
+
+	// Deals is a lookup from deal id to every Deal published to the market.
+	Deals      cid.Cid `refmt:",omitempty"`
+	NextDealID uint64
+
+	// Proposals holds the cids of published deal proposals, so that a signed
+	// proposal can not be published twice.
+	Proposals cid.Cid `refmt:",omitempty"`
+
+	// Escrows is a lookup from address to the Escrow held for it.
+	Escrows cid.Cid `refmt:",omitempty"`
+
+	// MinerInfos is a lookup from miner address to MinerInfo, and MinerIndex
+	// a lookup from position to miner address over the first MinerCount
+	// positions.
+	MinerInfos cid.Cid `refmt:",omitempty"`
+	MinerIndex cid.Cid `refmt:",omitempty"`
+	MinerCount uint64
 }
 
 // NewActor returns a new storage market actor.
@@ -102,6 +162,70 @@ var storageMarketExports = exec.Exports{
 		Params: []abi.Type{},
 		Return: []abi.Type{abi.Integer},
 	},
+	"addBalance": &exec.FunctionSignature{
+		Params: []abi.Type{abi.Address},
+		Return: nil,
+	},
+	"withdrawBalance": &exec.FunctionSignature{
+		Params: []abi.Type{abi.Address, abi.AttoFIL},
+		Return: nil,
+	},
+	"getEscrow": &exec.FunctionSignature{
+		Params: []abi.Type{abi.Address},
+		Return: []abi.Type{abi.Bytes},
+	},
+	"publishDeal": &exec.FunctionSignature{
+		Params: []abi.Type{abi.Bytes, abi.Bytes},
+		Return: []abi.Type{abi.Integer},
+	},
+	"activateDeals": &exec.FunctionSignature{
+		Params: []abi.Type{abi.SectorID, abi.UintArray},
+		Return: []abi.Type{abi.BlockHeight},
+	},
+	"settleDeals": &exec.FunctionSignature{
+		Params: []abi.Type{abi.UintArray, abi.UintArray},
+		Return: nil,
+	},
+	"terminateDeals": &exec.FunctionSignature{
+		Params: []abi.Type{abi.UintArray},
+		Return: nil,
+	},
+	"cancelDeal": &exec.FunctionSignature{
+		Params: []abi.Type{abi.Integer},
+		Return: nil,
+	},
+	"getDeal": &exec.FunctionSignature{
+		Params: []abi.Type{abi.Integer},
+		Return: []abi.Type{abi.Bytes},
+	},
+	"getDealSector": &exec.FunctionSignature{
+		Params: []abi.Type{abi.Integer, abi.Bytes, abi.BlockHeight},
+		Return: []abi.Type{abi.SectorID},
+	},
+	"getMiners": &exec.FunctionSignature{
+		Params: []abi.Type{abi.Integer, abi.Integer},
+		Return: []abi.Type{abi.Bytes},
+	},
+	"getMinerCount": &exec.FunctionSignature{
+		Params: []abi.Type{},
+		Return: []abi.Type{abi.Integer},
+	},
+	"getMinerInfo": &exec.FunctionSignature{
+		Params: []abi.Type{abi.Address},
+		Return: []abi.Type{abi.Bytes},
+	},
+	"updateMinerPeerID": &exec.FunctionSignature{
+		Params: []abi.Type{abi.PeerID},
+		Return: nil,
+	},
+	"updateMinerMultiaddrs": &exec.FunctionSignature{
+		Params: []abi.Type{abi.Multiaddrs},
+		Return: nil,
+	},
+	"declareSectorSize": &exec.FunctionSignature{
+		Params: []abi.Type{abi.Address, abi.BytesAmount},
+		Return: nil,
+	},
 }
 
 // CreateMiner creates a new miner with the a pledge of the given amount of sectors. The
@@ -150,6 +274,13 @@ func (sma *Actor) CreateMiner(vmctx exec.VMContext, pledge *big.Int, publicKey [
 			return nil, errors.FaultErrorWrapf(err, "could not set miner key value for lookup with CID: %s", state.Miners)
 		}
 
+		err = updateMinerInfo(vmctx, &state, addr, func(info *MinerInfo) {
+			info.PeerID = pid
+		})
+		if err != nil {
+			return nil, err
+		}
+
 		return addr, nil
 	})
 	if err != nil {
@@ -169,20 +300,11 @@ func (sma *Actor) UpdatePower(vmctx exec.VMContext, delta *big.Int) (uint8, erro
 
 	var state State
 	_, err := actor.WithState(vmctx, &state, func() (interface{}, error) {
-		miner := vmctx.Message().From
-		ctx := context.Background()
-
-		miners, err := actor.LoadLookup(ctx, vmctx.Storage(), state.Miners)
+		err := updateMinerInfo(vmctx, &state, vmctx.Message().From, func(info *MinerInfo) {
+			info.Power = new(big.Int).Add(info.Power, delta)
+		})
 		if err != nil {
-			return nil, errors.FaultErrorWrapf(err, "could not load lookup for miner with CID: %s", state.Miners)
-		}
-
-		_, err = miners.Find(ctx, miner.String())
-		if err != nil {
-			if err == hamt.ErrNotFound {
-				return nil, Errors[ErrUnknownMiner]
-			}
-			return nil, errors.FaultErrorWrapf(err, "could not load lookup for miner with address: %s", miner)
+			return nil, err
 		}
 
 		state.TotalCommittedStorage = state.TotalCommittedStorage.Add(state.TotalCommittedStorage, delta)
@@ -197,6 +319,9 @@ func (sma *Actor) UpdatePower(vmctx exec.VMContext, delta *big.Int) (uint8, erro
 }
 
 // GetTotalStorage returns the total amount of proven storage in the system.
+// A miner that missed its proving period stops counting toward the total once
+// it is slashed, or submits a late PoSt, which lowers the total through
+// UpdatePower.
 func (sma *Actor) GetTotalStorage(vmctx exec.VMContext) (*big.Int, uint8, error) {
 	if err := vmctx.Charge(100); err != nil {
 		return nil, exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
@@ -220,5 +345,758 @@ func (sma *Actor) GetTotalStorage(vmctx exec.VMContext) (*big.Int, uint8, error)
 
 // MinimumCollateral returns the minimum required amount of collateral for a given pledge
 func MinimumCollateral(sectors *big.Int) *types.AttoFIL {
-	return MinimumCollateralPerSector.MulBigInt(sectors)
+	return miner.MinimumCollateral(sectors)
+}
+
+// AddBalance adds the value of the message to the available escrow balance of
+// addr, from which addr can pay for deals or, if it is a miner, back them with
+// collateral.
+func (sma *Actor) AddBalance(vmctx exec.VMContext, addr address.Address) (uint8, error) {
+	if err := vmctx.Charge(100); err != nil {
+		return exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	var state State
+	_, err := actor.WithState(vmctx, &state, func() (interface{}, error) {
+		ctx := context.Background()
+
+		m, err := loadMarket(ctx, vmctx.Storage(), &state)
+		if err != nil {
+			return nil, err
+		}
+
+		escrow, err := m.getEscrow(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		escrow.Available = escrow.Available.Add(vmctx.Message().Value)
+		if err := m.putEscrow(ctx, addr, escrow); err != nil {
+			return nil, err
+		}
+
+		return nil, m.commit(ctx, &state)
+	})
+	if err != nil {
+		return errors.CodeError(err), err
+	}
+
+	return 0, nil
+}
+
+// WithdrawBalance sends amount from the available escrow balance of addr to
+// the caller. The caller must be addr itself or, if addr is a miner, its owner.
+func (sma *Actor) WithdrawBalance(vmctx exec.VMContext, addr address.Address, amount *types.AttoFIL) (uint8, error) {
+	if err := vmctx.Charge(100); err != nil {
+		return exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	if amount.IsNegative() {
+		return 1, errors.NewRevertError("withdrawal amount must not be negative")
+	}
+
+	var state State
+	_, err := actor.WithState(vmctx, &state, func() (interface{}, error) {
+		ctx := context.Background()
+		caller := vmctx.Message().From
+
+		if caller != addr {
+			owner, err := minerOwner(vmctx, &state, addr)
+			if err == Errors[ErrUnknownMiner] {
+				return nil, Errors[ErrCallerUnauthorized]
+			}
+			if err != nil {
+				return nil, err
+			}
+			if caller != owner {
+				return nil, Errors[ErrCallerUnauthorized]
+			}
+		}
+
+		m, err := loadMarket(ctx, vmctx.Storage(), &state)
+		if err != nil {
+			return nil, err
+		}
+
+		escrow, err := m.getEscrow(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		if escrow.Available.LessThan(amount) {
+			return nil, Errors[ErrInsufficientEscrow]
+		}
+		escrow.Available = escrow.Available.Sub(amount)
+		if err := m.putEscrow(ctx, addr, escrow); err != nil {
+			return nil, err
+		}
+		if err := m.commit(ctx, &state); err != nil {
+			return nil, err
+		}
+
+		_, ret, err := vmctx.Send(caller, "", amount, nil)
+		if err != nil {
+			return nil, err
+		}
+		if ret != 0 {
+			return nil, errors.NewRevertError("failed to send escrow balance")
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return errors.CodeError(err), err
+	}
+
+	return 0, nil
+}
+
+// GetEscrow returns the cbor encoded Escrow held for addr.
+func (sma *Actor) GetEscrow(vmctx exec.VMContext, addr address.Address) ([]byte, uint8, error) {
+	if err := vmctx.Charge(100); err != nil {
+		return nil, exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	var state State
+	out, err := actor.WithState(vmctx, &state, func() (interface{}, error) {
+		ctx := context.Background()
+
+		m, err := loadMarket(ctx, vmctx.Storage(), &state)
+		if err != nil {
+			return nil, err
+		}
+
+		escrow, err := m.getEscrow(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		return cbor.DumpObject(escrow)
+	})
+	if err != nil {
+		return nil, errors.CodeError(err), err
+	}
+
+	escrow, ok := out.([]byte)
+	if !ok {
+		return nil, 1, errors.NewRevertErrorf("expected a Bytes return value from call, but got %T instead", out)
+	}
+
+	return escrow, 0, nil
+}
+
+// PublishDeal records a deal between the client and the miner of the given
+// proposal and returns its id. The proposal must be signed by the client, and
+// the deal is accepted by the miner's owner or worker publishing it. The price
+// of the deal is locked in the client's escrow and the collateral in the
+// miner's, until the miner is paid for storing the piece or the deal is
+// canceled because the miner did not activate it by its start-by deadline.
+func (sma *Actor) PublishDeal(vmctx exec.VMContext, proposalBytes []byte, signature []byte) (*big.Int, uint8, error) {
+	if err := vmctx.Charge(100); err != nil {
+		return nil, exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	var proposal DealProposal
+	if err := cbor.DecodeInto(proposalBytes, &proposal); err != nil {
+		return nil, ErrInvalidDeal, Errors[ErrInvalidDeal]
+	}
+	if proposal.Duration == 0 || proposal.Price == nil || proposal.Price.IsNegative() ||
+		proposal.Collateral == nil || proposal.Collateral.IsNegative() {
+		return nil, ErrInvalidDeal, Errors[ErrInvalidDeal]
+	}
+
+	var state State
+	out, err := actor.WithState(vmctx, &state, func() (interface{}, error) {
+		ctx := context.Background()
+
+		accepted, err := isMinerOperator(vmctx, &state, proposal.Miner, vmctx.Message().From)
+		if err != nil {
+			return nil, err
+		}
+		if !accepted {
+			return nil, Errors[ErrCallerUnauthorized]
+		}
+
+		if !VerifyDealProposalSignature(&proposal, signature) {
+			return nil, Errors[ErrInvalidDealSignature]
+		}
+
+		m, err := loadMarket(ctx, vmctx.Storage(), &state)
+		if err != nil {
+			return nil, err
+		}
+
+		proposalCid, err := proposal.Cid()
+		if err != nil {
+			return nil, errors.FaultErrorWrap(err, "could not compute proposal cid")
+		}
+		published, err := m.published(ctx, proposalCid)
+		if err != nil {
+			return nil, err
+		}
+		if published {
+			return nil, Errors[ErrDealPublished]
+		}
+
+		if err := m.lock(ctx, proposal.Client, proposal.Price); err != nil {
+			return nil, err
+		}
+		if err := m.lock(ctx, proposal.Miner, proposal.Collateral); err != nil {
+			return nil, err
+		}
+
+		deal := &Deal{
+			ID:          state.NextDealID,
+			Proposal:    proposal,
+			PublishedAt: vmctx.BlockHeight(),
+			Paid:        types.NewZeroAttoFIL(),
+		}
+		if err := m.putDeal(ctx, deal); err != nil {
+			return nil, err
+		}
+		if err := m.proposals.Set(ctx, proposalCid.KeyString(), deal.ID); err != nil {
+			return nil, errors.FaultErrorWrapf(err, "could not record proposal %s", proposalCid)
+		}
+		if err := m.commit(ctx, &state); err != nil {
+			return nil, err
+		}
+		state.NextDealID++
+
+		return new(big.Int).SetUint64(deal.ID), nil
+	})
+	if err != nil {
+		return nil, errors.CodeError(err), err
+	}
+
+	dealID, ok := out.(*big.Int)
+	if !ok {
+		return nil, 1, errors.NewFaultErrorf("expected *big.Int to be returned, but got %T instead", out)
+	}
+
+	return dealID, 0, nil
+}
+
+// ActivateDeals is called by a miner when it commits a sector holding the
+// pieces of the given deals. The deals start at the current block height, which
+// must not be past their start-by deadline. It returns the block height at
+// which the last of the deals ends, when the sector holding them expires.
+func (sma *Actor) ActivateDeals(vmctx exec.VMContext, sectorID uint64, dealIDs []uint64) (*types.BlockHeight, uint8, error) {
+	if err := vmctx.Charge(100); err != nil {
+		return nil, exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	var state State
+	out, err := actor.WithState(vmctx, &state, func() (interface{}, error) {
+		ctx := context.Background()
+
+		m, err := loadMarket(ctx, vmctx.Storage(), &state)
+		if err != nil {
+			return nil, err
+		}
+
+		expiration := vmctx.BlockHeight()
+		for _, dealID := range dealIDs {
+			deal, err := m.getDeal(ctx, dealID)
+			if err != nil {
+				return nil, err
+			}
+			if deal.Proposal.Miner != vmctx.Message().From {
+				return nil, Errors[ErrCallerUnauthorized]
+			}
+			if deal.Active() {
+				return nil, Errors[ErrDealActive]
+			}
+			if deal.Canceled || vmctx.BlockHeight().GreaterThan(deal.StartBy()) {
+				return nil, Errors[ErrDealExpired]
+			}
+
+			deal.SectorID = sectorID
+			deal.ActivatedAt = vmctx.BlockHeight()
+			deal.PaidUntil = vmctx.BlockHeight()
+			if err := m.putDeal(ctx, deal); err != nil {
+				return nil, err
+			}
+			if deal.Expiration().GreaterThan(expiration) {
+				expiration = deal.Expiration()
+			}
+		}
+
+		return expiration, m.commit(ctx, &state)
+	})
+	if err != nil {
+		return nil, errors.CodeError(err), err
+	}
+
+	expiration, ok := out.(*types.BlockHeight)
+	if !ok {
+		return nil, 1, errors.NewFaultErrorf("expected *types.BlockHeight to be returned, but got %T instead", out)
+	}
+
+	return expiration, 0, nil
+}
+
+// SettleDeals is called by a miner after each PoSt, with the deals in the
+// sectors it proved and the deals in the sectors it did not. It pays the miner
+// from the client's escrow for storing the proven deals since they were last
+// settled. The miner earns nothing for that time of the faulty deals; their
+// part of the price is returned to the client when the deal ends, along with
+// the miner's collateral.
+func (sma *Actor) SettleDeals(vmctx exec.VMContext, provenDealIDs []uint64, faultyDealIDs []uint64) (uint8, error) {
+	if err := vmctx.Charge(100); err != nil {
+		return exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	var state State
+	_, err := actor.WithState(vmctx, &state, func() (interface{}, error) {
+		ctx := context.Background()
+
+		m, err := loadMarket(ctx, vmctx.Storage(), &state)
+		if err != nil {
+			return nil, err
+		}
+
+		settle := func(dealIDs []uint64, proven bool) error {
+			for _, dealID := range dealIDs {
+				deal, err := m.getDeal(ctx, dealID)
+				if err != nil {
+					return err
+				}
+				if deal.Proposal.Miner != vmctx.Message().From {
+					return Errors[ErrCallerUnauthorized]
+				}
+				if !deal.Active() || deal.Completed() {
+					continue
+				}
+				if err := m.settleDeal(ctx, deal, vmctx.BlockHeight(), proven); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if err := settle(provenDealIDs, true); err != nil {
+			return nil, err
+		}
+		if err := settle(faultyDealIDs, false); err != nil {
+			return nil, err
+		}
+
+		return nil, m.commit(ctx, &state)
+	})
+	if err != nil {
+		return errors.CodeError(err), err
+	}
+
+	return 0, nil
+}
+
+// TerminateDeals is called by a miner when the sectors holding the given deals
+// are removed before the deals end. The miner is not paid for the time since
+// the deals were last settled, and the client gets back the rest of the price
+// along with the miner's collateral.
+func (sma *Actor) TerminateDeals(vmctx exec.VMContext, dealIDs []uint64) (uint8, error) {
+	if err := vmctx.Charge(100); err != nil {
+		return exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	var state State
+	_, err := actor.WithState(vmctx, &state, func() (interface{}, error) {
+		ctx := context.Background()
+
+		m, err := loadMarket(ctx, vmctx.Storage(), &state)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, dealID := range dealIDs {
+			deal, err := m.getDeal(ctx, dealID)
+			if err != nil {
+				return nil, err
+			}
+			if deal.Proposal.Miner != vmctx.Message().From {
+				return nil, Errors[ErrCallerUnauthorized]
+			}
+			if !deal.Active() || deal.Completed() {
+				continue
+			}
+
+			if vmctx.BlockHeight().LessThan(deal.Expiration()) {
+				deal.TerminatedAt = vmctx.BlockHeight()
+			}
+			if err := m.settleDeal(ctx, deal, vmctx.BlockHeight(), false); err != nil {
+				return nil, err
+			}
+		}
+
+		return nil, m.commit(ctx, &state)
+	})
+	if err != nil {
+		return errors.CodeError(err), err
+	}
+
+	return 0, nil
+}
+
+// CancelDeal cancels a deal its miner did not activate by its start-by
+// deadline, returning the price to the client's escrow and the collateral to
+// the miner's. Anyone can cancel such a deal.
+func (sma *Actor) CancelDeal(vmctx exec.VMContext, dealID *big.Int) (uint8, error) {
+	if err := vmctx.Charge(100); err != nil {
+		return exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	var state State
+	_, err := actor.WithState(vmctx, &state, func() (interface{}, error) {
+		ctx := context.Background()
+
+		if !dealID.IsUint64() {
+			return nil, Errors[ErrUnknownDeal]
+		}
+
+		m, err := loadMarket(ctx, vmctx.Storage(), &state)
+		if err != nil {
+			return nil, err
+		}
+
+		deal, err := m.getDeal(ctx, dealID.Uint64())
+		if err != nil {
+			return nil, err
+		}
+		if deal.Active() {
+			return nil, Errors[ErrDealActive]
+		}
+		if deal.Canceled {
+			return nil, Errors[ErrDealExpired]
+		}
+		if !vmctx.BlockHeight().GreaterThan(deal.StartBy()) {
+			return nil, Errors[ErrDealPending]
+		}
+
+		if err := m.transfer(ctx, deal.Proposal.Client, deal.Proposal.Client, deal.Proposal.Price); err != nil {
+			return nil, err
+		}
+		if err := m.transfer(ctx, deal.Proposal.Miner, deal.Proposal.Miner, deal.Proposal.Collateral); err != nil {
+			return nil, err
+		}
+		deal.Canceled = true
+		if err := m.putDeal(ctx, deal); err != nil {
+			return nil, err
+		}
+
+		return nil, m.commit(ctx, &state)
+	})
+	if err != nil {
+		return errors.CodeError(err), err
+	}
+
+	return 0, nil
+}
+
+// GetDeal returns the cbor encoded Deal with the given id.
+func (sma *Actor) GetDeal(vmctx exec.VMContext, dealID *big.Int) ([]byte, uint8, error) {
+	if err := vmctx.Charge(100); err != nil {
+		return nil, exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	var state State
+	out, err := actor.WithState(vmctx, &state, func() (interface{}, error) {
+		ctx := context.Background()
+
+		if !dealID.IsUint64() {
+			return nil, Errors[ErrUnknownDeal]
+		}
+
+		m, err := loadMarket(ctx, vmctx.Storage(), &state)
+		if err != nil {
+			return nil, err
+		}
+
+		deal, err := m.getDeal(ctx, dealID.Uint64())
+		if err != nil {
+			return nil, err
+		}
+
+		return cbor.DumpObject(deal)
+	})
+	if err != nil {
+		return nil, errors.CodeError(err), err
+	}
+
+	deal, ok := out.([]byte)
+	if !ok {
+		return nil, 1, errors.NewRevertErrorf("expected a Bytes return value from call, but got %T instead", out)
+	}
+
+	return deal, 0, nil
+}
+
+// GetDealSector is called by a miner to find the sector holding the piece of
+// one of its deals. It fails unless the deal stores the piece with the given
+// cid, and was active at validAt.
+func (sma *Actor) GetDealSector(vmctx exec.VMContext, dealID *big.Int, pieceRef []byte, validAt *types.BlockHeight) (uint64, uint8, error) {
+	if err := vmctx.Charge(100); err != nil {
+		return 0, exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	ref, err := cid.Cast(pieceRef)
+	if err != nil {
+		return 0, 1, errors.RevertErrorWrap(err, "invalid piece cid")
+	}
+
+	var state State
+	out, err := actor.WithState(vmctx, &state, func() (interface{}, error) {
+		ctx := context.Background()
+
+		if !dealID.IsUint64() {
+			return nil, Errors[ErrUnknownDeal]
+		}
+
+		m, err := loadMarket(ctx, vmctx.Storage(), &state)
+		if err != nil {
+			return nil, err
+		}
+
+		deal, err := m.getDeal(ctx, dealID.Uint64())
+		if err != nil {
+			return nil, err
+		}
+		if deal.Proposal.Miner != vmctx.Message().From {
+			return nil, Errors[ErrCallerUnauthorized]
+		}
+		if !deal.Proposal.PieceRef.Equals(ref) || !deal.Active() {
+			return nil, Errors[ErrDealNotActive]
+		}
+		if validAt.LessThan(deal.ActivatedAt) || validAt.GreaterEqual(deal.Expiration()) {
+			return nil, Errors[ErrDealNotActive]
+		}
+
+		return deal.SectorID, nil
+	})
+	if err != nil {
+		return 0, errors.CodeError(err), err
+	}
+
+	sectorID, ok := out.(uint64)
+	if !ok {
+		return 0, 1, errors.NewFaultErrorf("expected a uint64 sector id, but got %T instead", out)
+	}
+
+	return sectorID, 0, nil
+}
+
+// GetMiners returns the registry info of at most limit miners, starting at the
+// given position in the registry.
+func (sma *Actor) GetMiners(vmctx exec.VMContext, offset, limit *big.Int) ([]byte, uint8, error) {
+	if err := vmctx.Charge(100); err != nil {
+		return nil, exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	var state State
+	out, err := actor.WithState(vmctx, &state, func() (interface{}, error) {
+		if !offset.IsUint64() || !limit.IsUint64() || limit.Uint64() > MaximumMinerPageSize {
+			return nil, errors.NewRevertErrorf("page must be at most %d miners", MaximumMinerPageSize)
+		}
+
+		ctx := context.Background()
+		registry, err := loadMinerRegistry(ctx, vmctx.Storage(), &state)
+		if err != nil {
+			return nil, err
+		}
+
+		page, err := registry.page(ctx, offset.Uint64(), limit.Uint64())
+		if err != nil {
+			return nil, err
+		}
+
+		return cbor.DumpObject(page)
+	})
+	if err != nil {
+		return nil, errors.CodeError(err), err
+	}
+
+	miners, ok := out.([]byte)
+	if !ok {
+		return nil, 1, errors.NewRevertErrorf("expected a Bytes return value from call, but got %T instead", out)
+	}
+
+	return miners, 0, nil
+}
+
+// GetMinerCount returns the number of miners in the registry.
+func (sma *Actor) GetMinerCount(vmctx exec.VMContext) (*big.Int, uint8, error) {
+	if err := vmctx.Charge(100); err != nil {
+		return nil, exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	var state State
+	out, err := actor.WithState(vmctx, &state, func() (interface{}, error) {
+		return new(big.Int).SetUint64(state.MinerCount), nil
+	})
+	if err != nil {
+		return nil, errors.CodeError(err), err
+	}
+
+	count, ok := out.(*big.Int)
+	if !ok {
+		return nil, 1, errors.NewRevertErrorf("expected an Integer return value from call, but got %T instead", out)
+	}
+
+	return count, 0, nil
+}
+
+// GetMinerInfo returns the registry info of the miner at minerAddr.
+func (sma *Actor) GetMinerInfo(vmctx exec.VMContext, minerAddr address.Address) ([]byte, uint8, error) {
+	if err := vmctx.Charge(100); err != nil {
+		return nil, exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	var state State
+	out, err := actor.WithState(vmctx, &state, func() (interface{}, error) {
+		ctx := context.Background()
+		registry, err := loadMinerRegistry(ctx, vmctx.Storage(), &state)
+		if err != nil {
+			return nil, err
+		}
+
+		info, err := registry.get(ctx, minerAddr)
+		if err != nil {
+			return nil, err
+		}
+		if info == nil {
+			return nil, Errors[ErrUnknownMiner]
+		}
+
+		return cbor.DumpObject(info)
+	})
+	if err != nil {
+		return nil, errors.CodeError(err), err
+	}
+
+	info, ok := out.([]byte)
+	if !ok {
+		return nil, 1, errors.NewRevertErrorf("expected a Bytes return value from call, but got %T instead", out)
+	}
+
+	return info, 0, nil
+}
+
+// UpdateMinerPeerID records the new peer ID of the calling miner. Miners call
+// it whenever their peer ID changes.
+func (sma *Actor) UpdateMinerPeerID(vmctx exec.VMContext, pid peer.ID) (uint8, error) {
+	if err := vmctx.Charge(100); err != nil {
+		return exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	var state State
+	_, err := actor.WithState(vmctx, &state, func() (interface{}, error) {
+		return nil, updateMinerInfo(vmctx, &state, vmctx.Message().From, func(info *MinerInfo) {
+			info.PeerID = pid
+		})
+	})
+	if err != nil {
+		return errors.CodeError(err), err
+	}
+
+	return 0, nil
+}
+
+// UpdateMinerMultiaddrs records the new multiaddrs of the calling miner.
+// Miners call it whenever their multiaddrs change.
+func (sma *Actor) UpdateMinerMultiaddrs(vmctx exec.VMContext, addrs []ma.Multiaddr) (uint8, error) {
+	if err := vmctx.Charge(100); err != nil {
+		return exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	var state State
+	_, err := actor.WithState(vmctx, &state, func() (interface{}, error) {
+		return nil, updateMinerInfo(vmctx, &state, vmctx.Message().From, func(info *MinerInfo) {
+			info.Multiaddrs = make([][]byte, len(addrs))
+			for i, addr := range addrs {
+				info.Multiaddrs[i] = addr.Bytes()
+			}
+		})
+	})
+	if err != nil {
+		return errors.CodeError(err), err
+	}
+
+	return 0, nil
+}
+
+// DeclareSectorSize records the number of bytes the miner stores per sector.
+// Only the miner's owner may declare it.
+func (sma *Actor) DeclareSectorSize(vmctx exec.VMContext, minerAddr address.Address, size *types.BytesAmount) (uint8, error) {
+	if err := vmctx.Charge(100); err != nil {
+		return exec.ErrInsufficientGas, errors.RevertErrorWrap(err, "Insufficient gas")
+	}
+
+	var state State
+	_, err := actor.WithState(vmctx, &state, func() (interface{}, error) {
+		owner, err := minerOwner(vmctx, &state, minerAddr)
+		if err != nil {
+			return nil, err
+		}
+		if vmctx.Message().From != owner {
+			return nil, Errors[ErrCallerUnauthorized]
+		}
+
+		return nil, updateMinerInfo(vmctx, &state, minerAddr, func(info *MinerInfo) {
+			info.SectorSize = size
+		})
+	})
+	if err != nil {
+		return errors.CodeError(err), err
+	}
+
+	return 0, nil
+}
+
+// isMinerOperator returns true if addr is the owner or worker of the miner.
+func isMinerOperator(vmctx exec.VMContext, state *State, minerAddr, addr address.Address) (bool, error) {
+	owner, err := minerOwner(vmctx, state, minerAddr)
+	if err != nil {
+		return false, err
+	}
+	if addr == owner {
+		return true, nil
+	}
+
+	rets, ret, err := vmctx.Send(minerAddr, "getWorker", nil, nil)
+	if err != nil {
+		return false, err
+	}
+	if ret != 0 {
+		return false, errors.NewRevertErrorf("could not get worker of miner %s", minerAddr)
+	}
+	worker, err := address.NewFromBytes(rets[0])
+	if err != nil {
+		return false, errors.FaultErrorWrap(err, "could not decode worker address")
+	}
+	return addr == worker, nil
+}
+
+// minerOwner returns the owner of the miner created by the storage market at
+// minerAddr.
+func minerOwner(vmctx exec.VMContext, state *State, minerAddr address.Address) (address.Address, error) {
+	ctx := context.Background()
+
+	miners, err := actor.LoadLookup(ctx, vmctx.Storage(), state.Miners)
+	if err != nil {
+		return address.Address{}, errors.FaultErrorWrapf(err, "could not load lookup for miner with CID: %s", state.Miners)
+	}
+	if _, err := miners.Find(ctx, minerAddr.String()); err != nil {
+		if err == hamt.ErrNotFound {
+			return address.Address{}, Errors[ErrUnknownMiner]
+		}
+		return address.Address{}, errors.FaultErrorWrapf(err, "could not load lookup for miner with address: %s", minerAddr)
+	}
+
+	rets, ret, err := vmctx.Send(minerAddr, "getOwner", nil, nil)
+	if err != nil {
+		return address.Address{}, err
+	}
+	if ret != 0 {
+		return address.Address{}, errors.NewRevertErrorf("could not get owner of miner %s", minerAddr)
+	}
+	owner, err := address.NewFromBytes(rets[0])
+	if err != nil {
+		return address.Address{}, errors.FaultErrorWrap(err, "could not decode owner address")
+	}
+	return owner, nil
 }
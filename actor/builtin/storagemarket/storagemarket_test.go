@@ -10,13 +10,19 @@ import (
 	"github.com/filecoin-project/go-filecoin/actor"
 	"github.com/filecoin-project/go-filecoin/actor/builtin"
 	"github.com/filecoin-project/go-filecoin/actor/builtin/miner"
+	"github.com/filecoin-project/go-filecoin/actor/builtin/paymentbroker"
 	. "github.com/filecoin-project/go-filecoin/actor/builtin/storagemarket"
 	"github.com/filecoin-project/go-filecoin/address"
+	"github.com/filecoin-project/go-filecoin/consensus"
 	"github.com/filecoin-project/go-filecoin/core"
+	"github.com/filecoin-project/go-filecoin/proofs"
+	"github.com/filecoin-project/go-filecoin/state"
 	th "github.com/filecoin-project/go-filecoin/testhelpers"
 	"github.com/filecoin-project/go-filecoin/types"
+	ma "gx/ipfs/QmNTCey11oxhb1AxDnQBRHtdhap6Ctud872NjAYPYYXPuc/go-multiaddr"
 	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/assert"
 	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/require"
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
 )
 
 func TestStorageMarketCreateMiner(t *testing.T) {
@@ -150,6 +156,393 @@ func TestMinimumCollateral(t *testing.T) {
 // minerActor and sends some FIL. If that FIL creates an actor tha cannot be upgraded to a miner
 // actor, this action will block the other user. Another possibility is that the miner actor will
 // overwrite the account with the balance thereby obliterating the FIL.
+func TestStorageMarketDeals(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx := context.Background()
+	st, vms := core.CreateStorages(ctx, t)
+
+	send := func(from address.Address, height uint64, value *types.AttoFIL, method string, params ...interface{}) *consensus.ApplicationResult {
+		msg := types.NewMessage(from, address.StorageMarketAddress, core.MustGetNonce(st, from), value, method, actor.MustConvertParams(params...))
+		res, err := th.ApplyTestMessage(st, vms, msg, types.NewBlockHeight(height))
+		require.NoError(err)
+		return res
+	}
+	sendToMiner := func(minerAddr address.Address, height uint64, method string, params ...interface{}) *consensus.ApplicationResult {
+		msg := types.NewMessage(address.TestAddress, minerAddr, core.MustGetNonce(st, address.TestAddress), nil, method, actor.MustConvertParams(params...))
+		res, err := th.ApplyTestMessage(st, vms, msg, types.NewBlockHeight(height))
+		require.NoError(err)
+		require.NoError(res.ExecutionError)
+		return res
+	}
+	getEscrow := func(addr address.Address) Escrow {
+		res := send(address.TestAddress, 0, nil, "getEscrow", addr)
+		require.NoError(res.ExecutionError)
+		var escrow Escrow
+		require.NoError(actor.UnmarshalStorage(res.Receipt.Return[0], &escrow))
+		return escrow
+	}
+	assertEscrow := func(addr address.Address, available, locked uint64) {
+		escrow := getEscrow(addr)
+		assert.Equal(types.NewAttoFILFromFIL(available).String(), escrow.Available.String())
+		assert.Equal(types.NewAttoFILFromFIL(locked).String(), escrow.Locked.String())
+	}
+	getSectors := func(minerAddr address.Address, height uint64) []*miner.Sector {
+		res := sendToMiner(minerAddr, height, "getSectorsPage", big.NewInt(0), big.NewInt(10))
+		var sectors []*miner.Sector
+		require.NoError(actor.UnmarshalStorage(res.Receipt.Return[0], &sectors))
+		return sectors
+	}
+	getDeal := func(dealID uint64) Deal {
+		res := send(address.TestAddress, 0, nil, "getDeal", new(big.Int).SetUint64(dealID))
+		require.NoError(res.ExecutionError)
+		var deal Deal
+		require.NoError(actor.UnmarshalStorage(res.Receipt.Return[0], &deal))
+		return deal
+	}
+
+	res := send(address.TestAddress, 0, types.NewAttoFILFromFIL(100), "createMiner", big.NewInt(10), []byte{}, th.RequireRandomPeerID())
+	require.NoError(res.ExecutionError)
+	minerAddr, err := address.NewFromBytes(res.Receipt.Return[0])
+	require.NoError(err)
+
+	submitPoSt := func(height, challengeHeight uint64, faults []uint64) {
+		proof := th.MakeRandomPoSTProofForTest()
+		params := actor.MustConvertParams(proof[:], faults, types.NewBlockHeight(challengeHeight))
+		msg := types.NewMessage(address.TestAddress, minerAddr, core.MustGetNonce(st, address.TestAddress), nil, "submitPoSt", params)
+		res, err := th.ApplyTestMessageWithAncestors(st, vms, msg, types.NewBlockHeight(height), th.RequireRandomnessAncestors(require, challengeHeight))
+		require.NoError(err)
+		require.NoError(res.ExecutionError)
+	}
+
+	ki := types.MustGenerateKeyInfo(1, types.GenerateKeyInfoSeed())
+	signer := types.NewMockSigner(ki)
+	clientAddr, err := ki[0].Address()
+	require.NoError(err)
+
+	// anyone can fund an escrow
+	require.NoError(send(address.TestAddress, 1, types.NewAttoFILFromFIL(10), "addBalance", clientAddr).ExecutionError)
+	require.NoError(send(address.TestAddress, 1, types.NewAttoFILFromFIL(5), "addBalance", minerAddr).ExecutionError)
+	assert.Equal(types.NewAttoFILFromFIL(10), getEscrow(clientAddr).Available)
+
+	proposal := &DealProposal{
+		PieceRef:   types.SomeCid(),
+		Size:       types.NewBytesAmount(1024),
+		Client:     clientAddr,
+		Miner:      minerAddr,
+		Price:      types.NewAttoFILFromFIL(10),
+		Collateral: types.NewAttoFILFromFIL(5),
+		Duration:   100,
+	}
+	proposalBytes, err := proposal.Marshal()
+	require.NoError(err)
+	sig, err := SignDealProposal(proposal, signer)
+	require.NoError(err)
+
+	t.Run("publishing a deal", func(t *testing.T) {
+		// only the miner's owner or worker can accept the deal
+		res := send(address.TestAddress2, 2, nil, "publishDeal", proposalBytes, []byte(sig))
+		assert.Equal(Errors[ErrCallerUnauthorized], res.ExecutionError)
+
+		res = send(address.TestAddress, 2, nil, "publishDeal", proposalBytes, []byte("not a signature"))
+		assert.Equal(Errors[ErrInvalidDealSignature], res.ExecutionError)
+
+		res = send(address.TestAddress, 2, nil, "publishDeal", proposalBytes, []byte(sig))
+		require.NoError(res.ExecutionError)
+		assert.Equal(big.NewInt(0), big.NewInt(0).SetBytes(res.Receipt.Return[0]))
+
+		res = send(address.TestAddress, 2, nil, "publishDeal", proposalBytes, []byte(sig))
+		assert.Equal(Errors[ErrDealPublished], res.ExecutionError)
+
+		assertEscrow(clientAddr, 0, 10)
+		assertEscrow(minerAddr, 0, 5)
+	})
+
+	t.Run("committing the sector activates the deal", func(t *testing.T) {
+		sendToMiner(minerAddr, 10, "commitSector", uint64(1), th.MakeCommitment(), th.MakeCommitment(), th.MakeCommitment(), th.MakeRandomBytes(int(proofs.SealBytesLen)), []uint64{0})
+
+		deal := getDeal(0)
+		assert.Equal(types.NewBlockHeight(10), deal.ActivatedAt)
+		assert.Equal(uint64(1), deal.SectorID)
+		assert.Equal(types.NewBlockHeight(110), deal.Expiration())
+
+		// the sector expires with the last of its deals
+		sectors := getSectors(minerAddr, 10)
+		require.Len(sectors, 1)
+		assert.Equal(types.NewBlockHeight(110), sectors[0].Expiration)
+	})
+
+	t.Run("the miner verifies the piece is in a live sector", func(t *testing.T) {
+		verify := func(pieceRef cid.Cid, validAt uint64) error {
+			params := actor.MustConvertParams(pieceRef.Bytes(), types.NewBlockHeight(validAt), big.NewInt(0))
+			msg := types.NewMessage(address.TestAddress2, minerAddr, core.MustGetNonce(st, address.TestAddress2), nil, "verifyPieceInclusion", params)
+			res, err := th.ApplyTestMessage(st, vms, msg, types.NewBlockHeight(30))
+			require.NoError(err)
+			return res.ExecutionError
+		}
+
+		assert.NoError(verify(proposal.PieceRef, 20))
+		assert.Equal(miner.Errors[miner.ErrPieceNotIncluded], verify(proposal.PieceRef, 5))
+		assert.Equal(miner.Errors[miner.ErrPieceNotIncluded], verify(proposal.PieceRef, 110))
+		assert.Equal(miner.Errors[miner.ErrPieceNotIncluded], verify(types.NewCidForTestGetter()(), 20))
+
+		// only the deal's miner can look up the sector of a deal
+		res := send(address.TestAddress, 30, nil, "getDealSector", big.NewInt(0), proposal.PieceRef.Bytes(), types.NewBlockHeight(20))
+		assert.Equal(Errors[ErrCallerUnauthorized], res.ExecutionError)
+	})
+
+	t.Run("vouchers conditioned on the piece are redeemed with the deal id", func(t *testing.T) {
+		state.MustSetActor(st, clientAddr, th.RequireNewAccountActor(require, types.NewAttoFILFromFIL(100)))
+		msg := types.NewMessage(clientAddr, address.PaymentBrokerAddress, core.MustGetNonce(st, clientAddr), types.NewAttoFILFromFIL(100), "createChannel", actor.MustConvertParams(address.TestAddress, types.NewBlockHeight(1000)))
+		res, err := th.ApplyTestMessage(st, vms, msg, types.NewBlockHeight(30))
+		require.NoError(err)
+		require.NoError(res.ExecutionError)
+		channelID := types.NewChannelIDFromBytes(res.Receipt.Return[0])
+
+		voucherAt := func(validAt uint64) *paymentbroker.PaymentVoucher {
+			condition, err := paymentbroker.NewPieceInclusionCondition(minerAddr, proposal.PieceRef, types.NewBlockHeight(validAt))
+			require.NoError(err)
+			voucher := &paymentbroker.PaymentVoucher{
+				Channel:   *channelID,
+				Payer:     clientAddr,
+				Target:    address.TestAddress,
+				Amount:    *types.NewAttoFILFromFIL(10),
+				ValidAt:   *types.NewBlockHeight(validAt),
+				Condition: condition,
+			}
+			voucher.Signature, err = paymentbroker.SignVoucher(voucher, signer)
+			require.NoError(err)
+			return voucher
+		}
+		redeem := func(voucher *paymentbroker.PaymentVoucher, dealID int64) error {
+			params, err := voucher.RedeemParams(big.NewInt(dealID))
+			require.NoError(err)
+			msg := types.NewMessage(address.TestAddress, address.PaymentBrokerAddress, core.MustGetNonce(st, address.TestAddress), nil, "redeem", actor.MustConvertParams(params...))
+			res, err := th.ApplyTestMessage(st, vms, msg, types.NewBlockHeight(30))
+			require.NoError(err)
+			return res.ExecutionError
+		}
+
+		// the piece is not stored under another deal, nor before the deal was activated
+		assert.Equal(paymentbroker.Errors[paymentbroker.ErrConditionFailed], redeem(voucherAt(20), 1))
+		assert.Equal(paymentbroker.Errors[paymentbroker.ErrConditionFailed], redeem(voucherAt(5), 0))
+
+		assert.NoError(redeem(voucherAt(20), 0))
+	})
+
+	t.Run("the miner is paid with each PoSt", func(t *testing.T) {
+		submitPoSt(60, 10, []uint64{})
+
+		assertEscrow(clientAddr, 0, 5)
+		assertEscrow(minerAddr, 5, 5)
+
+		// and gets its collateral back once the deal is over
+		submitPoSt(20015, 20010, []uint64{})
+
+		assertEscrow(clientAddr, 0, 0)
+		assertEscrow(minerAddr, 15, 0)
+
+		deal := getDeal(0)
+		assert.True(deal.Completed())
+		assert.Equal(types.NewAttoFILFromFIL(10), deal.Paid)
+
+		// the expired sector no longer needs to be proven
+		assert.Empty(getSectors(minerAddr, 20015))
+	})
+
+	t.Run("the miner's owner withdraws its balance", func(t *testing.T) {
+		res := send(address.TestAddress2, 20016, nil, "withdrawBalance", minerAddr, types.NewAttoFILFromFIL(15))
+		assert.Equal(Errors[ErrCallerUnauthorized], res.ExecutionError)
+
+		res = send(address.TestAddress, 20016, nil, "withdrawBalance", minerAddr, types.NewAttoFILFromFIL(16))
+		assert.Equal(Errors[ErrInsufficientEscrow], res.ExecutionError)
+
+		before, err := st.GetActor(ctx, address.TestAddress)
+		require.NoError(err)
+		res = send(address.TestAddress, 20016, nil, "withdrawBalance", minerAddr, types.NewAttoFILFromFIL(15))
+		require.NoError(res.ExecutionError)
+		after, err := st.GetActor(ctx, address.TestAddress)
+		require.NoError(err)
+		assert.Equal(before.Balance.Add(types.NewAttoFILFromFIL(15)), after.Balance)
+	})
+
+	t.Run("the miner is not paid for faulty sectors", func(t *testing.T) {
+		require.NoError(send(address.TestAddress, 20020, types.NewAttoFILFromFIL(10), "addBalance", clientAddr).ExecutionError)
+		require.NoError(send(address.TestAddress, 20020, types.NewAttoFILFromFIL(5), "addBalance", minerAddr).ExecutionError)
+
+		faultyProposal := *proposal
+		faultyProposal.PieceRef = types.NewCidForTestGetter()()
+		faultyProposalBytes, err := faultyProposal.Marshal()
+		require.NoError(err)
+		faultySig, err := SignDealProposal(&faultyProposal, signer)
+		require.NoError(err)
+		require.NoError(send(address.TestAddress, 20020, nil, "publishDeal", faultyProposalBytes, []byte(faultySig)).ExecutionError)
+		sendToMiner(minerAddr, 20020, "commitSector", uint64(2), th.MakeCommitment(), th.MakeCommitment(), th.MakeCommitment(), th.MakeRandomBytes(int(proofs.SealBytesLen)), []uint64{1})
+
+		// the sector is declared faulty until after the deal ends
+		submitPoSt(40015, 40010, []uint64{2})
+
+		// so the client gets the price back, and the miner only its collateral
+		assertEscrow(clientAddr, 10, 0)
+		assertEscrow(minerAddr, 5, 0)
+
+		deal := getDeal(1)
+		assert.True(deal.Completed())
+		assert.True(deal.Paid.IsZero())
+	})
+
+	t.Run("a deal the miner does not activate is canceled", func(t *testing.T) {
+		lateProposal := *proposal
+		lateProposal.PieceRef = types.NewCidForTestGetter()()
+		lateProposal.Duration = 200
+		lateProposalBytes, err := lateProposal.Marshal()
+		require.NoError(err)
+		lateSig, err := SignDealProposal(&lateProposal, signer)
+		require.NoError(err)
+		require.NoError(send(address.TestAddress, 40020, nil, "publishDeal", lateProposalBytes, []byte(lateSig)).ExecutionError)
+		assertEscrow(clientAddr, 0, 10)
+		assertEscrow(minerAddr, 0, 5)
+
+		startBy := 40020 + DealStartBlocks.AsBigInt().Uint64()
+		res := send(address.TestAddress2, startBy, nil, "cancelDeal", big.NewInt(2))
+		assert.Equal(Errors[ErrDealPending], res.ExecutionError)
+
+		// the miner can no longer activate the deal after its start-by deadline
+		msg := types.NewMessage(address.TestAddress, minerAddr, core.MustGetNonce(st, address.TestAddress), nil, "commitSector", actor.MustConvertParams(uint64(3), th.MakeCommitment(), th.MakeCommitment(), th.MakeCommitment(), th.MakeRandomBytes(int(proofs.SealBytesLen)), []uint64{2}))
+		res, err = th.ApplyTestMessage(st, vms, msg, types.NewBlockHeight(startBy+1))
+		require.NoError(err)
+		assert.Error(res.ExecutionError)
+		assert.False(getDeal(2).Active())
+
+		// and anyone can cancel it to unlock the escrows
+		res = send(address.TestAddress2, startBy+1, nil, "cancelDeal", big.NewInt(2))
+		require.NoError(res.ExecutionError)
+		assertEscrow(clientAddr, 10, 0)
+		assertEscrow(minerAddr, 5, 0)
+		assert.True(getDeal(2).Canceled)
+
+		res = send(address.TestAddress2, startBy+1, nil, "cancelDeal", big.NewInt(2))
+		assert.Equal(Errors[ErrDealExpired], res.ExecutionError)
+	})
+
+	t.Run("terminating a sector ends its deals", func(t *testing.T) {
+		terminatedProposal := *proposal
+		terminatedProposal.PieceRef = types.NewCidForTestGetter()()
+		terminatedProposalBytes, err := terminatedProposal.Marshal()
+		require.NoError(err)
+		terminatedSig, err := SignDealProposal(&terminatedProposal, signer)
+		require.NoError(err)
+		require.NoError(send(address.TestAddress, 50000, nil, "publishDeal", terminatedProposalBytes, []byte(terminatedSig)).ExecutionError)
+		sendToMiner(minerAddr, 50000, "commitSector", uint64(4), th.MakeCommitment(), th.MakeCommitment(), th.MakeCommitment(), th.MakeRandomBytes(int(proofs.SealBytesLen)), []uint64{3})
+
+		sendToMiner(minerAddr, 50050, "terminateSectors", []uint64{4})
+
+		// the miner is not paid for the unproven time, and the client gets
+		// the whole price back along with the miner's collateral
+		assertEscrow(clientAddr, 15, 0)
+		assertEscrow(minerAddr, 0, 0)
+
+		deal := getDeal(3)
+		assert.True(deal.Completed())
+		assert.Equal(types.NewBlockHeight(50050), deal.Expiration())
+		assert.Empty(getSectors(minerAddr, 50050))
+	})
+}
+
+func TestStorageMarketMinerRegistry(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx := context.Background()
+	st, vms := core.CreateStorages(ctx, t)
+
+	send := func(from, to address.Address, value *types.AttoFIL, method string, params ...interface{}) *consensus.ApplicationResult {
+		msg := types.NewMessage(from, to, core.MustGetNonce(st, from), value, method, actor.MustConvertParams(params...))
+		res, err := th.ApplyTestMessage(st, vms, msg, types.NewBlockHeight(0))
+		require.NoError(err)
+		return res
+	}
+	getMiners := func(offset, limit int64) []*MinerInfo {
+		res := send(address.TestAddress, address.StorageMarketAddress, nil, "getMiners", big.NewInt(offset), big.NewInt(limit))
+		require.NoError(res.ExecutionError)
+		var miners []*MinerInfo
+		require.NoError(actor.UnmarshalStorage(res.Receipt.Return[0], &miners))
+		return miners
+	}
+	getMinerInfo := func(minerAddr address.Address) *MinerInfo {
+		res := send(address.TestAddress, address.StorageMarketAddress, nil, "getMinerInfo", minerAddr)
+		require.NoError(res.ExecutionError)
+		var info MinerInfo
+		require.NoError(actor.UnmarshalStorage(res.Receipt.Return[0], &info))
+		return &info
+	}
+
+	pid1, pid2 := th.RequireRandomPeerID(), th.RequireRandomPeerID()
+	res := send(address.TestAddress, address.StorageMarketAddress, types.NewAttoFILFromFIL(100), "createMiner", big.NewInt(10), []byte{}, pid1)
+	require.NoError(res.ExecutionError)
+	miner1, err := address.NewFromBytes(res.Receipt.Return[0])
+	require.NoError(err)
+	res = send(address.TestAddress2, address.StorageMarketAddress, types.NewAttoFILFromFIL(100), "createMiner", big.NewInt(10), []byte{}, pid2)
+	require.NoError(res.ExecutionError)
+	miner2, err := address.NewFromBytes(res.Receipt.Return[0])
+	require.NoError(err)
+
+	t.Run("miners are listed in the order they were created", func(t *testing.T) {
+		res := send(address.TestAddress, address.StorageMarketAddress, nil, "getMinerCount")
+		require.NoError(res.ExecutionError)
+		assert.Equal(big.NewInt(2), big.NewInt(0).SetBytes(res.Receipt.Return[0]))
+
+		miners := getMiners(0, MaximumMinerPageSize)
+		require.Len(miners, 2)
+		assert.Equal(miner1, miners[0].Address)
+		assert.Equal(pid1, miners[0].PeerID)
+		assert.Nil(miners[0].SectorSize)
+		assert.Equal(miner2, miners[1].Address)
+		assert.Equal(pid2, miners[1].PeerID)
+
+		miners = getMiners(1, 5)
+		require.Len(miners, 1)
+		assert.Equal(miner2, miners[0].Address)
+
+		assert.Empty(getMiners(2, 5))
+
+		res = send(address.TestAddress, address.StorageMarketAddress, nil, "getMiners", big.NewInt(0), big.NewInt(MaximumMinerPageSize+1))
+		assert.Error(res.ExecutionError)
+	})
+
+	t.Run("the registry follows peer ID, multiaddr and power changes", func(t *testing.T) {
+		newPid := th.RequireRandomPeerID()
+		require.NoError(send(address.TestAddress, miner1, nil, "updatePeerID", newPid).ExecutionError)
+		assert.Equal(newPid, getMinerInfo(miner1).PeerID)
+
+		addr, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/6000")
+		require.NoError(err)
+		require.NoError(send(address.TestAddress, miner1, nil, "updateMultiaddrs", []ma.Multiaddr{addr}).ExecutionError)
+		assert.Equal([][]byte{addr.Bytes()}, getMinerInfo(miner1).Multiaddrs)
+
+		require.NoError(send(address.TestAddress, miner1, nil, "commitSector", uint64(1), th.MakeCommitment(), th.MakeCommitment(), th.MakeCommitment(), th.MakeRandomBytes(int(proofs.SealBytesLen)), []uint64{}).ExecutionError)
+		assert.Equal("1", getMinerInfo(miner1).Power.String())
+		assert.Equal("0", getMinerInfo(miner2).Power.String())
+
+		// only miners can update their own peer ID
+		res := send(address.TestAddress, address.StorageMarketAddress, nil, "updateMinerPeerID", newPid)
+		assert.Equal(Errors[ErrUnknownMiner], res.ExecutionError)
+	})
+
+	t.Run("the miner's owner declares its sector size", func(t *testing.T) {
+		res := send(address.TestAddress2, address.StorageMarketAddress, nil, "declareSectorSize", miner1, types.NewBytesAmount(1024))
+		assert.Equal(Errors[ErrCallerUnauthorized], res.ExecutionError)
+
+		res = send(address.TestAddress, address.StorageMarketAddress, nil, "declareSectorSize", miner1, types.NewBytesAmount(1024))
+		require.NoError(res.ExecutionError)
+		assert.Equal("1024", getMinerInfo(miner1).SectorSize.String())
+	})
+
+	t.Run("unknown miners have no info", func(t *testing.T) {
+		res := send(address.TestAddress, address.StorageMarketAddress, nil, "getMinerInfo", address.TestAddress2)
+		assert.Equal(Errors[ErrUnknownMiner], res.ExecutionError)
+	})
+}
+
 func deriveMinerAddress(creator address.Address, nonce uint64) (address.Address, error) {
 	buf := new(bytes.Buffer)
 
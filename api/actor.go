@@ -5,6 +5,7 @@ import (
 
 	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
 
+	"github.com/filecoin-project/go-filecoin/address"
 	"github.com/filecoin-project/go-filecoin/types"
 )
 
@@ -19,6 +20,14 @@ type ActorView struct {
 	Head      cid.Cid         `json:"head,omitempty"`
 }
 
+// ActorDescription is a detailed view of a single actor. In addition to the
+// details of an ActorView it includes the actor's decoded storage, if the
+// actor's code is known.
+type ActorDescription struct {
+	ActorView
+	State interface{} `json:"state,omitempty"`
+}
+
 // ReadableFunctionSignature is a representation of an actors function signature,
 // such that it can be shown to the user.
 type ReadableFunctionSignature struct {
@@ -34,4 +43,5 @@ type ReadableExports map[string]*ReadableFunctionSignature
 // notion of smart contracts.
 type Actor interface {
 	Ls(ctx context.Context) ([]*ActorView, error)
+	Describe(ctx context.Context, addr address.Address) (*ActorDescription, error)
 }
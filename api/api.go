@@ -16,5 +16,6 @@ type API interface {
 	Ping() Ping
 	RetrievalClient() RetrievalClient
 	Swarm() Swarm
+	Transfers() Transfers
 	Version() Version
 }
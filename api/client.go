@@ -3,6 +3,7 @@ package api
 import (
 	"context"
 	"io"
+	"math/big"
 
 	cid "gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
 	uio "gx/ipfs/QmRDWTzVdbHXdtat7tVJ7YC7kRaW7rTZTEF79yykcLYa49/go-unixfs/io"
@@ -21,6 +22,10 @@ type Ask struct {
 	Expiry *types.BlockHeight
 	ID     uint64
 
+	// Power and FreeSectors describe the miner offering the ask.
+	Power       *big.Int
+	FreeSectors uint64
+
 	Error error
 }
 
@@ -28,8 +33,11 @@ type Ask struct {
 type Client interface {
 	Cat(ctx context.Context, c cid.Cid) (uio.DagReader, error)
 	ImportData(ctx context.Context, data io.Reader) (ipld.Node, error)
-	ProposeStorageDeal(ctx context.Context, data cid.Cid, miner address.Address, ask uint64, duration uint64, allowDuplicates bool) (*storage.DealResponse, error)
+	ProposeStorageDeal(ctx context.Context, data cid.Cid, miner address.Address, ask uint64, duration uint64, allowDuplicates, manualTransfer bool) (*storage.DealResponse, error)
 	QueryStorageDeal(ctx context.Context, prop cid.Cid) (*storage.DealResponse, error)
-	ListAsks(ctx context.Context) (<-chan Ask, error)
+	StoreData(ctx context.Context, data cid.Cid, replicas uint64, duration uint64, filter storage.AskFilter, manualTransfer bool) (*storage.StorageOrder, error)
+	StorageOrder(ctx context.Context, data cid.Cid) (*storage.StorageOrder, error)
+	DealHistory(ctx context.Context, prop cid.Cid) ([]*storage.DealEvent, error)
+	ListAsks(ctx context.Context, filter storage.AskFilter) (<-chan Ask, error)
 	Payments(ctx context.Context, dealCid cid.Cid) ([]*paymentbroker.PaymentVoucher, error)
 }
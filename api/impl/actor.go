@@ -5,16 +5,21 @@ import (
 	"reflect"
 	"strings"
 
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	"gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
+
 	"github.com/filecoin-project/go-filecoin/actor"
 	"github.com/filecoin-project/go-filecoin/actor/builtin/account"
 	"github.com/filecoin-project/go-filecoin/actor/builtin/miner"
 	"github.com/filecoin-project/go-filecoin/actor/builtin/paymentbroker"
 	"github.com/filecoin-project/go-filecoin/actor/builtin/storagemarket"
+	"github.com/filecoin-project/go-filecoin/address"
 	"github.com/filecoin-project/go-filecoin/api"
 	"github.com/filecoin-project/go-filecoin/exec"
 	"github.com/filecoin-project/go-filecoin/node"
 	"github.com/filecoin-project/go-filecoin/state"
 	"github.com/filecoin-project/go-filecoin/types"
+	"github.com/filecoin-project/go-filecoin/vm"
 )
 
 type nodeActor struct {
@@ -40,27 +45,90 @@ func ls(ctx context.Context, fcn *node.Node, actorGetter state.GetAllActorsFunc)
 	res := make([]*api.ActorView, len(actors))
 
 	for i, a := range actors {
-		switch {
-		case !a.Code.Defined(): // empty (balance only) actors have no Code.
-			res[i] = makeActorView(a, addrs[i], nil)
-		case a.Code.Equals(types.AccountActorCodeCid):
-			res[i] = makeActorView(a, addrs[i], &account.Actor{})
-		case a.Code.Equals(types.StorageMarketActorCodeCid):
-			res[i] = makeActorView(a, addrs[i], &storagemarket.Actor{})
-		case a.Code.Equals(types.PaymentBrokerActorCodeCid):
-			res[i] = makeActorView(a, addrs[i], &paymentbroker.Actor{})
-		case a.Code.Equals(types.MinerActorCodeCid):
-			res[i] = makeActorView(a, addrs[i], &miner.Actor{})
-		case a.Code.Equals(types.BootstrapMinerActorCodeCid):
-			res[i] = makeActorView(a, addrs[i], &miner.Actor{})
-		default:
-			res[i] = makeActorView(a, addrs[i], nil)
-		}
+		res[i] = makeActorView(a, addrs[i], executableActorForCode(a.Code))
 	}
 
 	return res, nil
 }
 
+// Describe returns a detailed view of the actor at the given address, including
+// its exported methods and decoded storage.
+func (api *nodeActor) Describe(ctx context.Context, addr address.Address) (*api.ActorDescription, error) {
+	return describe(ctx, api.api.node, addr)
+}
+
+func describe(ctx context.Context, fcn *node.Node, addr address.Address) (*api.ActorDescription, error) {
+	st, err := fcn.ChainReader.LatestState(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	act, err := st.GetActor(ctx, addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not find actor at address %s", addr)
+	}
+
+	actorState, err := decodeActorState(ctx, fcn, act)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not decode storage of actor at address %s", addr)
+	}
+
+	return &api.ActorDescription{
+		ActorView: *makeActorView(act, addr.String(), executableActorForCode(act.Code)),
+		State:     actorState,
+	}, nil
+}
+
+// executableActorForCode returns an instance of the builtin actor implementing
+// the given code, or nil if the code is undefined or unknown.
+func executableActorForCode(code cid.Cid) exec.ExecutableActor {
+	switch {
+	case !code.Defined(): // empty (balance only) actors have no Code.
+		return nil
+	case code.Equals(types.AccountActorCodeCid):
+		return &account.Actor{}
+	case code.Equals(types.StorageMarketActorCodeCid):
+		return &storagemarket.Actor{}
+	case code.Equals(types.PaymentBrokerActorCodeCid):
+		return &paymentbroker.Actor{}
+	case code.Equals(types.MinerActorCodeCid):
+		return &miner.Actor{}
+	case code.Equals(types.BootstrapMinerActorCodeCid):
+		return &miner.Actor{}
+	default:
+		return nil
+	}
+}
+
+// decodeActorState loads the storage of the given actor and decodes it into
+// the state struct of its actor type. Actors without storage, or whose storage
+// format is unknown, yield a nil state.
+func decodeActorState(ctx context.Context, fcn *node.Node, act *actor.Actor) (interface{}, error) {
+	switch {
+	case !act.Code.Defined():
+		return nil, nil
+	case act.Code.Equals(types.PaymentBrokerActorCodeCid):
+		// the payment broker's storage is a lookup of lookups rather than a single struct
+		return paymentbroker.AllChannels(ctx, vm.NewStorage(fcn.Blockstore, act))
+	case !act.Head.Defined():
+		return nil, nil
+	case act.Code.Equals(types.StorageMarketActorCodeCid):
+		var st storagemarket.State
+		if err := fcn.CborStore().Get(ctx, act.Head, &st); err != nil {
+			return nil, err
+		}
+		return &st, nil
+	case act.Code.Equals(types.MinerActorCodeCid), act.Code.Equals(types.BootstrapMinerActorCodeCid):
+		var st miner.State
+		if err := fcn.CborStore().Get(ctx, act.Head, &st); err != nil {
+			return nil, err
+		}
+		return &st, nil
+	default:
+		return nil, nil
+	}
+}
+
 func makeActorView(act *actor.Actor, addr string, actType exec.ExecutableActor) *api.ActorView {
 	var actorType string
 	var exports api.ReadableExports
@@ -15,7 +15,9 @@ import (
 	"github.com/filecoin-project/go-filecoin/actor"
 	"github.com/filecoin-project/go-filecoin/actor/builtin/account"
 	"github.com/filecoin-project/go-filecoin/actor/builtin/miner"
+	"github.com/filecoin-project/go-filecoin/actor/builtin/paymentbroker"
 	"github.com/filecoin-project/go-filecoin/actor/builtin/storagemarket"
+	"github.com/filecoin-project/go-filecoin/address"
 	"github.com/filecoin-project/go-filecoin/api"
 	"github.com/filecoin-project/go-filecoin/chain"
 	"github.com/filecoin-project/go-filecoin/consensus"
@@ -160,3 +162,67 @@ func TestPresentExports(t *testing.T) {
 		}
 	}
 }
+
+func TestActorDescribe(t *testing.T) {
+	t.Parallel()
+
+	t.Run("returns an error if no best block", func(t *testing.T) {
+		t.Parallel()
+		require := require.New(t)
+		ctx := context.Background()
+
+		nd := node.MakeOfflineNode(t)
+
+		_, err := describe(ctx, nd, address.StorageMarketAddress)
+		require.Error(err)
+	})
+
+	t.Run("describes exports and decoded storage of builtin actors", func(t *testing.T) {
+		t.Parallel()
+		assert := assert.New(t)
+		require := require.New(t)
+		ctx := context.Background()
+
+		nd := node.MakeOfflineNode(t)
+
+		genBlock, err := consensus.DefaultGenesis(nd.CborStore(), nd.Blockstore)
+		require.NoError(err)
+		b1 := types.NewBlockForTest(genBlock, 1)
+		ts := testhelpers.RequireNewTipSet(require, b1)
+		chainStore, ok := nd.ChainReader.(chain.Store)
+		require.True(ok)
+
+		err = chainStore.PutTipSetAndState(ctx, &chain.TipSetAndState{
+			TipSet:          ts,
+			TipSetStateRoot: genBlock.StateRoot,
+		})
+		require.NoError(err)
+		err = chainStore.SetHead(ctx, testhelpers.RequireNewTipSet(require, b1))
+		require.NoError(err)
+
+		assert.NoError(nd.Start(ctx))
+
+		desc, err := describe(ctx, nd, address.StorageMarketAddress)
+		require.NoError(err)
+
+		assert.Equal("StoragemarketActor", desc.ActorType)
+		assert.Equal(address.StorageMarketAddress.String(), desc.Address)
+		assert.Equal(len((&storagemarket.Actor{}).Exports()), len(desc.Exports))
+		assert.Contains(desc.Exports, "createMiner")
+
+		smState, ok := desc.State.(*storagemarket.State)
+		require.True(ok)
+		assert.NotNil(smState.TotalCommittedStorage)
+
+		desc, err = describe(ctx, nd, address.PaymentBrokerAddress)
+		require.NoError(err)
+
+		assert.Equal("PaymentbrokerActor", desc.ActorType)
+		channels, ok := desc.State.(map[string]map[string]*paymentbroker.PaymentChannel)
+		require.True(ok)
+		assert.Empty(channels)
+
+		_, err = describe(ctx, nd, address.NewForTestGetter()())
+		assert.Error(err)
+	})
+}
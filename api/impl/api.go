@@ -25,6 +25,7 @@ type nodeAPI struct {
 	ping            *nodePing
 	retrievalClient *nodeRetrievalClient
 	swarm           *nodeSwarm
+	transfers       *nodeTransfers
 	version         *nodeVersion
 }
 
@@ -55,6 +56,7 @@ func New(node *node.Node) api.API {
 	api.ping = newNodePing(api)
 	api.retrievalClient = newNodeRetrievalClient(api)
 	api.swarm = newNodeSwarm(api)
+	api.transfers = newNodeTransfers(api)
 	api.version = newNodeVersion(api)
 
 	return api
@@ -112,6 +114,10 @@ func (api *nodeAPI) Swarm() api.Swarm {
 	return api.swarm
 }
 
+func (api *nodeAPI) Transfers() api.Transfers {
+	return api.transfers
+}
+
 func (api *nodeAPI) Version() api.Version {
 	return api.version
 }
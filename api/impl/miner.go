@@ -2,6 +2,7 @@ package impl
 
 import (
 	"context"
+	"io"
 	"math/big"
 
 	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/filecoin-project/go-filecoin/address"
 	"github.com/filecoin-project/go-filecoin/porcelain"
+	"github.com/filecoin-project/go-filecoin/protocol/storage"
 	"github.com/filecoin-project/go-filecoin/types"
 )
 
@@ -129,3 +131,28 @@ func (nm *nodeMiner) GetTotalPower(ctx context.Context) (*big.Int, error) {
 
 	return power, nil
 }
+
+func (nm *nodeMiner) Payments(ctx context.Context) ([]*storage.ChannelPayments, error) {
+	if nm.api.node.StorageMiner == nil {
+		return nil, errors.New("storage miner is not running, start mining first")
+	}
+	return nm.api.node.StorageMiner.Payments(ctx)
+}
+
+func (nm *nodeMiner) DealHistory(ctx context.Context, prop cid.Cid) ([]*storage.DealEvent, error) {
+	if nm.api.node.StorageMiner == nil {
+		return nil, errors.New("storage miner is not running, start mining first")
+	}
+	return nm.api.node.StorageMiner.DealHistory(prop)
+}
+
+func (nm *nodeMiner) ImportDealData(ctx context.Context, prop cid.Cid, data io.Reader) error {
+	if nm.api.node.StorageMiner == nil {
+		return errors.New("storage miner is not running, start mining first")
+	}
+	nd, err := nm.api.client.ImportData(ctx, data)
+	if err != nil {
+		return err
+	}
+	return nm.api.node.StorageMiner.ImportDealData(prop, nd.Cid())
+}
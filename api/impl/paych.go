@@ -2,6 +2,7 @@ package impl
 
 import (
 	"context"
+	"math/big"
 
 	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
 	cbor "gx/ipfs/QmcZLyosDwMKdB6NLRsiss9HXzDPhVhhRtPy67JFKTDQDX/go-ipld-cbor"
@@ -52,19 +53,28 @@ func (np *nodePaych) Ls(ctx context.Context, fromAddr, payerAddr address.Address
 	return channels, nil
 }
 
-func (np *nodePaych) Voucher(ctx context.Context, fromAddr address.Address, channel *types.ChannelID, amount *types.AttoFIL, validAt *types.BlockHeight) (string, error) {
+func (np *nodePaych) Voucher(ctx context.Context, fromAddr address.Address, channel *types.ChannelID, amount *types.AttoFIL, validAt *types.BlockHeight, lane, nonce uint64, merges []paymentbroker.Merge, condition *paymentbroker.Condition) (string, error) {
 	nd := np.api.node
 
 	if err := setDefaultFromAddr(&fromAddr, nd); err != nil {
 		return "", err
 	}
 
+	encodedMerges, err := paymentbroker.EncodeMerges(merges)
+	if err != nil {
+		return "", err
+	}
+	encodedCondition, err := paymentbroker.EncodeCondition(condition)
+	if err != nil {
+		return "", err
+	}
+
 	values, _, err := np.porcelainAPI.MessageQuery(
 		ctx,
 		fromAddr,
 		address.PaymentBrokerAddress,
 		"voucher",
-		channel, amount, validAt,
+		channel, amount, validAt, new(big.Int).SetUint64(lane), new(big.Int).SetUint64(nonce), encodedMerges, encodedCondition,
 	)
 	if err != nil {
 		return "", err
@@ -75,7 +85,7 @@ func (np *nodePaych) Voucher(ctx context.Context, fromAddr address.Address, chan
 		return "", err
 	}
 
-	sig, err := paymentbroker.SignVoucher(channel, amount, validAt, fromAddr, nd.Wallet)
+	sig, err := paymentbroker.SignVoucher(&voucher, nd.Wallet)
 	if err != nil {
 		return "", err
 	}
@@ -84,11 +94,15 @@ func (np *nodePaych) Voucher(ctx context.Context, fromAddr address.Address, chan
 	return voucher.Encode()
 }
 
-func (np *nodePaych) Redeem(ctx context.Context, fromAddr address.Address, gasPrice types.AttoFIL, gasLimit types.GasUnits, voucherRaw string) (cid.Cid, error) {
+func (np *nodePaych) Redeem(ctx context.Context, fromAddr address.Address, gasPrice types.AttoFIL, gasLimit types.GasUnits, voucherRaw string, conditionParams ...interface{}) (cid.Cid, error) {
 	voucher, err := paymentbroker.DecodeVoucher(voucherRaw)
 	if err != nil {
 		return cid.Undef, err
 	}
+	params, err := voucher.RedeemParams(conditionParams...)
+	if err != nil {
+		return cid.Undef, err
+	}
 
 	return np.porcelainAPI.MessageSendWithDefaultAddress(
 		ctx,
@@ -98,15 +112,37 @@ func (np *nodePaych) Redeem(ctx context.Context, fromAddr address.Address, gasPr
 		gasPrice,
 		gasLimit,
 		"redeem",
-		voucher.Payer, &voucher.Channel, &voucher.Amount, &voucher.ValidAt, []byte(voucher.Signature),
+		params...,
 	)
 }
 
-func (np *nodePaych) Close(ctx context.Context, fromAddr address.Address, gasPrice types.AttoFIL, gasLimit types.GasUnits, voucherRaw string) (cid.Cid, error) {
+func (np *nodePaych) RedeemMany(ctx context.Context, fromAddr address.Address, gasPrice types.AttoFIL, gasLimit types.GasUnits, vouchersRaw []string) (cid.Cid, error) {
+	redemptions, err := paymentbroker.EncodeVoucherRedemptions(vouchersRaw)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	return np.porcelainAPI.MessageSendWithDefaultAddress(
+		ctx,
+		fromAddr,
+		address.PaymentBrokerAddress,
+		types.NewAttoFILFromFIL(0),
+		gasPrice,
+		gasLimit,
+		"redeemMany",
+		redemptions,
+	)
+}
+
+func (np *nodePaych) Close(ctx context.Context, fromAddr address.Address, gasPrice types.AttoFIL, gasLimit types.GasUnits, voucherRaw string, conditionParams ...interface{}) (cid.Cid, error) {
 	voucher, err := paymentbroker.DecodeVoucher(voucherRaw)
 	if err != nil {
 		return cid.Undef, err
 	}
+	params, err := voucher.RedeemParams(conditionParams...)
+	if err != nil {
+		return cid.Undef, err
+	}
 
 	return np.porcelainAPI.MessageSendWithDefaultAddress(
 		ctx,
@@ -116,6 +152,6 @@ func (np *nodePaych) Close(ctx context.Context, fromAddr address.Address, gasPri
 		gasPrice,
 		gasLimit,
 		"close",
-		voucher.Payer, &voucher.Channel, &voucher.Amount, &voucher.ValidAt, []byte(voucher.Signature),
+		params...,
 	)
 }
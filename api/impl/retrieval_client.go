@@ -18,10 +18,10 @@ func newNodeRetrievalClient(api *nodeAPI) *nodeRetrievalClient {
 }
 
 func (nrc *nodeRetrievalClient) RetrievePiece(ctx context.Context, pieceCID cid.Cid, minerAddr address.Address) (io.ReadCloser, error) {
-	minerPeerID, err := nrc.api.node.Lookup().GetPeerIDByMinerAddress(ctx, minerAddr)
+	minerPeer, err := nrc.api.node.Lookup().GetPeerInfoByMinerAddress(ctx, minerAddr)
 	if err != nil {
 		return nil, err
 	}
 
-	return nrc.api.node.RetrievalClient.RetrievePiece(ctx, minerPeerID, pieceCID)
+	return nrc.api.node.RetrievalClient.RetrievePiece(ctx, minerPeer, pieceCID)
 }
@@ -0,0 +1,29 @@
+package impl
+
+import (
+	"context"
+
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+
+	"github.com/filecoin-project/go-filecoin/protocol/transfer"
+)
+
+type nodeTransfers struct {
+	api *nodeAPI
+}
+
+func newNodeTransfers(api *nodeAPI) *nodeTransfers {
+	return &nodeTransfers{api: api}
+}
+
+func (nt *nodeTransfers) Ls(ctx context.Context) ([]*transfer.Progress, error) {
+	return nt.api.node.DataTransfer().Transfers(), nil
+}
+
+func (nt *nodeTransfers) Get(ctx context.Context, deal cid.Cid) (*transfer.Progress, error) {
+	prog, ok := nt.api.node.DataTransfer().Progress(deal)
+	if !ok {
+		return nil, nil
+	}
+	return prog, nil
+}
@@ -2,12 +2,14 @@ package api
 
 import (
 	"context"
+	"io"
 	"math/big"
 
 	cid "gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
 	"gx/ipfs/QmTu65MVbemtUxJEWgsTtzv9Zv9P8rvmqNA4eG9TrTRGYc/go-libp2p-peer"
 
 	"github.com/filecoin-project/go-filecoin/address"
+	"github.com/filecoin-project/go-filecoin/protocol/storage"
 	"github.com/filecoin-project/go-filecoin/types"
 )
 
@@ -20,4 +22,7 @@ type Miner interface {
 	GetPledge(ctx context.Context, minerAddr address.Address) (*big.Int, error)
 	GetPower(ctx context.Context, minerAddr address.Address) (*big.Int, error)
 	GetTotalPower(ctx context.Context) (*big.Int, error)
+	Payments(ctx context.Context) ([]*storage.ChannelPayments, error)
+	DealHistory(ctx context.Context, prop cid.Cid) ([]*storage.DealEvent, error)
+	ImportDealData(ctx context.Context, prop cid.Cid, data io.Reader) error
 }
@@ -0,0 +1,18 @@
+package api
+
+import (
+	"context"
+
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+
+	"github.com/filecoin-project/go-filecoin/protocol/transfer"
+)
+
+// Transfers is the interface that defines methods to inspect the transfers of
+// deal data between this node and other nodes.
+type Transfers interface {
+	Ls(ctx context.Context) ([]*transfer.Progress, error)
+	// Get returns the progress of the last transfer for the deal, nil if
+	// there was none.
+	Get(ctx context.Context, deal cid.Cid) (*transfer.Progress, error)
+}
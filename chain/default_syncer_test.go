@@ -162,7 +162,7 @@ func loadSyncerFromRepo(require *require.Assertions, r repo.Repo) (*chain.Defaul
 	bs := bstore.NewBlockstore(r.Datastore())
 	cst := hamt.NewCborStore()
 	verifier := proofs.NewFakeVerifier(true, nil)
-	con := consensus.NewExpected(cst, bs, testhelpers.NewTestProcessor(), powerTable, genCid, verifier)
+	con := consensus.NewExpected(bs, testhelpers.NewTestProcessor(), powerTable, genCid, verifier)
 	syncer, testchain, cst, _ := initSyncTest(require, con, initGenesis, cst, bs, r)
 	ctx := context.Background()
 	err := testchain.Load(ctx)
@@ -179,7 +179,7 @@ func initSyncTestDefault(require *require.Assertions) (*chain.DefaultSyncer, cha
 	bs := bstore.NewBlockstore(r.Datastore())
 	cst := hamt.NewCborStore()
 	verifier := proofs.NewFakeVerifier(true, nil)
-	con := consensus.NewExpected(cst, bs, processor, powerTable, genCid, verifier)
+	con := consensus.NewExpected(bs, processor, powerTable, genCid, verifier)
 	requireSetTestChain(require, con, false)
 	return initSyncTest(require, con, initGenesis, cst, bs, r)
 }
@@ -192,7 +192,7 @@ func initSyncTestWithPowerTable(require *require.Assertions, powerTable consensu
 	bs := bstore.NewBlockstore(r.Datastore())
 	cst := hamt.NewCborStore()
 	verifier := proofs.NewFakeVerifier(true, nil)
-	con := consensus.NewExpected(cst, bs, processor, powerTable, genCid, verifier)
+	con := consensus.NewExpected(bs, processor, powerTable, genCid, verifier)
 	requireSetTestChain(require, con, false)
 	sync, testchain, cst, _ := initSyncTest(require, con, initGenesis, cst, bs, r)
 	return sync, testchain, cst, con
@@ -658,15 +658,15 @@ func TestWidenChainAncestor(t *testing.T) {
 
 type powerTableForWidenTest struct{}
 
-func (pt *powerTableForWidenTest) Total(ctx context.Context, st state.Tree, bs bstore.Blockstore) (uint64, error) {
+func (pt *powerTableForWidenTest) Total(ctx context.Context, st state.Tree, bs bstore.Blockstore, bh *types.BlockHeight) (uint64, error) {
 	return uint64(100), nil
 }
 
-func (pt *powerTableForWidenTest) Miner(ctx context.Context, st state.Tree, bs bstore.Blockstore, mAddr address.Address) (uint64, error) {
+func (pt *powerTableForWidenTest) Miner(ctx context.Context, st state.Tree, bs bstore.Blockstore, mAddr address.Address, bh *types.BlockHeight) (uint64, error) {
 	return uint64(25), nil
 }
 
-func (pt *powerTableForWidenTest) HasPower(ctx context.Context, st state.Tree, bs bstore.Blockstore, mAddr address.Address) bool {
+func (pt *powerTableForWidenTest) HasPower(ctx context.Context, st state.Tree, bs bstore.Blockstore, mAddr address.Address, bh *types.BlockHeight) bool {
 	return true
 }
 
@@ -798,7 +798,7 @@ func TestTipSetWeightDeep(t *testing.T) {
 	chainStore := chain.NewDefaultStore(r.ChainDatastore(), cst, calcGenBlk.Cid())
 
 	verifier := proofs.NewFakeVerifier(true, nil)
-	con := consensus.NewExpected(cst, bs, testhelpers.NewTestProcessor(), &testhelpers.TestView{}, calcGenBlk.Cid(), verifier)
+	con := consensus.NewExpected(bs, testhelpers.NewTestProcessor(), &testhelpers.TestView{}, calcGenBlk.Cid(), verifier)
 
 	// Initialize stores to contain genesis block and state
 	calcGenTS := testhelpers.RequireNewTipSet(require, &calcGenBlk)
@@ -814,7 +814,7 @@ func TestTipSetWeightDeep(t *testing.T) {
 
 	// Now sync the chainStore with consensus using a MarketView.
 	verifier = proofs.NewFakeVerifier(true, nil)
-	con = consensus.NewExpected(cst, bs, testhelpers.NewTestProcessor(), &consensus.MarketView{}, calcGenBlk.Cid(), verifier)
+	con = consensus.NewExpected(bs, testhelpers.NewTestProcessor(), &consensus.MarketView{}, calcGenBlk.Cid(), verifier)
 	syncer := chain.NewDefaultSyncer(cst, cst, con, chainStore)
 	baseTS := chainStore.Head() // this is the last block of the bootstrapping chain creating miners
 	require.Equal(1, len(baseTS))
@@ -27,7 +27,7 @@ func TestTotal(t *testing.T) {
 	power := uint64(19)
 	bs, _, st := requireMinerWithPower(ctx, t, power)
 
-	actual, err := (&consensus.MarketView{}).Total(ctx, st, bs)
+	actual, err := (&consensus.MarketView{}).Total(ctx, st, bs, types.NewBlockHeight(1))
 	require.NoError(err)
 
 	assert.Equal(power, actual)
@@ -41,7 +41,7 @@ func TestMiner(t *testing.T) {
 	power := uint64(12)
 	bs, addr, st := requireMinerWithPower(ctx, t, power)
 
-	actual, err := (&consensus.MarketView{}).Miner(ctx, st, bs, addr)
+	actual, err := (&consensus.MarketView{}).Miner(ctx, st, bs, addr, types.NewBlockHeight(1))
 	require.NoError(err)
 
 	assert.Equal(power, actual)
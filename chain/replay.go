@@ -0,0 +1,415 @@
+package chain
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"gx/ipfs/QmNf3wujpV2Y7Lnj2hy2UrmuX8bhMDStRHbnSLh7Ypf36h/go-hamt-ipld"
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	"gx/ipfs/QmRu7tiRnFk9mMPpVECQTBQJqXtmG132jJxA1w9A7TtpBz/go-ipfs-blockstore"
+	"gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
+
+	"github.com/filecoin-project/go-filecoin/actor/builtin"
+	"github.com/filecoin-project/go-filecoin/consensus"
+	"github.com/filecoin-project/go-filecoin/state"
+	"github.com/filecoin-project/go-filecoin/types"
+	"github.com/filecoin-project/go-filecoin/vm"
+)
+
+// Replayer re-executes tipsets already present in a chain store and compares
+// the recomputed state roots and receipts with the stored ones.  It is a
+// debugging tool for tracking down consensus divergences: it never writes
+// tipsets to the store, only the state it recomputes to the blockstore.
+type Replayer struct {
+	store     ReadStore
+	cst       *hamt.CborIpldStore
+	bs        blockstore.Blockstore
+	consensus consensus.Protocol
+	processor *consensus.DefaultProcessor
+}
+
+// NewReplayer returns a Replayer that runs state transitions with con and
+// uses processor to analyze divergent blocks message by message.  The
+// processor should be the one used by con.
+func NewReplayer(store ReadStore, cst *hamt.CborIpldStore, bs blockstore.Blockstore, con consensus.Protocol, processor *consensus.DefaultProcessor) *Replayer {
+	return &Replayer{
+		store:     store,
+		cst:       cst,
+		bs:        bs,
+		consensus: con,
+		processor: processor,
+	}
+}
+
+// ReplayReport is the result of replaying a range of the chain.  Divergence
+// is nil if every replayed tipset reproduced its stored state root and the
+// receipts of its blocks.
+type ReplayReport struct {
+	From       uint64      `json:"from"`
+	To         uint64      `json:"to"`
+	Replayed   int         `json:"replayed"`
+	Divergence *Divergence `json:"divergence,omitempty"`
+}
+
+// Divergence describes the first tipset whose replay did not reproduce the
+// stored state or the receipts of its blocks.  ComputedStateRoot and StateDiff
+// are only set when the computed state root differs from the stored one, and
+// StateDiff only when both could be loaded.
+type Divergence struct {
+	Height            uint64             `json:"height"`
+	TipSet            string             `json:"tipset"`
+	Error             string             `json:"error,omitempty"`
+	ExpectedStateRoot cid.Cid            `json:"expectedStateRoot"`
+	ComputedStateRoot cid.Cid            `json:"computedStateRoot,omitempty"`
+	StateDiff         *state.TreeDiff    `json:"stateDiff,omitempty"`
+	StateDiffError    string             `json:"stateDiffError,omitempty"`
+	Blocks            []*BlockDivergence `json:"blocks"`
+}
+
+// BlockDivergence is the result of re-applying a single block of a divergent
+// tipset on top of the parent state, as block validation does.
+type BlockDivergence struct {
+	Block             cid.Cid             `json:"block"`
+	Error             string              `json:"error,omitempty"`
+	ExpectedStateRoot cid.Cid             `json:"expectedStateRoot"`
+	ComputedStateRoot cid.Cid             `json:"computedStateRoot,omitempty"`
+	ReceiptMismatches []*ReceiptMismatch  `json:"receiptMismatches,omitempty"`
+	Messages          []*MessageStateDiff `json:"messages,omitempty"`
+}
+
+// ReceiptMismatch records a receipt that differs from the one stored in the
+// block.  Either side is nil if the receipt is missing.
+type ReceiptMismatch struct {
+	Index    int                   `json:"index"`
+	Expected *types.MessageReceipt `json:"expected"`
+	Computed *types.MessageReceipt `json:"computed"`
+}
+
+// MessageStateDiff is the effect of applying a single message of a block.
+type MessageStateDiff struct {
+	Message   cid.Cid               `json:"message"`
+	Receipt   *types.MessageReceipt `json:"receipt,omitempty"`
+	Error     string                `json:"error,omitempty"`
+	StateRoot cid.Cid               `json:"stateRoot,omitempty"`
+	Diff      *state.TreeDiff       `json:"diff,omitempty"`
+}
+
+// Replay re-executes the tipsets of the current chain with heights in
+// [from, to] in ascending order.  It stops at the first tipset whose state
+// transition fails, whose computed state root differs from the stored one or
+// one of whose blocks' receipts differ from the recomputed ones, and reports
+// it in detail.  If dumpMessageDiffs is set the messages of the
+// divergent blocks are also applied one at a time and the state diff caused by
+// each is included in the report.  The genesis tipset cannot be replayed and
+// is skipped; to is capped at the height of the head.
+func (r *Replayer) Replay(ctx context.Context, from, to uint64, dumpMessageDiffs bool) (*ReplayReport, error) {
+	headHeight, err := r.store.Head().Height()
+	if err != nil {
+		return nil, err
+	}
+	if to > headHeight {
+		to = headHeight
+	}
+	if from == 0 {
+		from = 1
+	}
+	if from > to {
+		return nil, fmt.Errorf("invalid range: from %d is greater than to %d", from, to)
+	}
+
+	tipsets, err := r.collectRange(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ReplayReport{From: from, To: to}
+	for _, ts := range tipsets {
+		div, err := r.replayTipSet(ctx, ts, dumpMessageDiffs)
+		if err != nil {
+			return nil, err
+		}
+		report.Replayed++
+		if div != nil {
+			report.Divergence = div
+			break
+		}
+	}
+
+	return report, nil
+}
+
+// collectRange returns the tipsets of the current chain with heights in
+// [from, to], lowest first.
+func (r *Replayer) collectRange(ctx context.Context, from, to uint64) ([]types.TipSet, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var tipsets []types.TipSet
+	for raw := range r.store.BlockHistory(ctx, r.store.Head()) {
+		switch v := raw.(type) {
+		case error:
+			return nil, errors.Wrap(v, "failed to walk chain")
+		case types.TipSet:
+			h, err := v.Height()
+			if err != nil {
+				return nil, err
+			}
+			if h < from {
+				reverseTipSets(tipsets)
+				return tipsets, nil
+			}
+			if h <= to {
+				tipsets = append(tipsets, v)
+			}
+		default:
+			return nil, fmt.Errorf("unexpected type in block history: %T", raw)
+		}
+	}
+	reverseTipSets(tipsets)
+	return tipsets, nil
+}
+
+// replayTipSet runs the state transition of ts on its stored parent state and
+// returns a divergence report if the result does not match the stored state
+// or receipts.
+func (r *Replayer) replayTipSet(ctx context.Context, ts types.TipSet, dumpMessageDiffs bool) (*Divergence, error) {
+	h, err := ts.Height()
+	if err != nil {
+		return nil, err
+	}
+	tsas, err := r.store.GetTipSetAndState(ctx, ts.String())
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get state of tipset at height %d", h)
+	}
+	parent, ancestors, err := r.parentAndAncestors(ctx, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	pSt, err := state.LoadStateTree(ctx, r.cst, parent.TipSetStateRoot, builtin.Actors)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load parent state of tipset at height %d", h)
+	}
+
+	div := &Divergence{
+		Height:            h,
+		TipSet:            ts.String(),
+		ExpectedStateRoot: tsas.TipSetStateRoot,
+	}
+
+	diverged := false
+	st, err := r.consensus.RunStateTransition(ctx, ts, ancestors, pSt)
+	if err != nil {
+		div.Error = err.Error()
+		diverged = true
+	} else {
+		root, err := st.Flush(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !root.Equals(tsas.TipSetStateRoot) {
+			div.ComputedStateRoot = root
+			diverged = true
+
+			diff, err := state.Diff(ctx, r.cst, tsas.TipSetStateRoot, root, true)
+			if err != nil {
+				div.StateDiffError = err.Error()
+			} else {
+				div.StateDiff = diff
+			}
+		}
+	}
+
+	// The state transition only checks the number of receipts, so the
+	// receipts of every block are compared even if the state root matches.
+	for _, blk := range ts.ToSlice() {
+		bd, err := r.replayBlock(ctx, parent.TipSetStateRoot, blk, ancestors)
+		if err != nil {
+			return nil, err
+		}
+		if bd.Error != "" || len(bd.ReceiptMismatches) > 0 {
+			diverged = true
+		}
+		div.Blocks = append(div.Blocks, bd)
+	}
+	if !diverged {
+		return nil, nil
+	}
+
+	if dumpMessageDiffs {
+		for i, blk := range ts.ToSlice() {
+			div.Blocks[i].Messages, err = r.traceMessages(ctx, parent.TipSetStateRoot, blk, ancestors)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return div, nil
+}
+
+// parentAndAncestors returns the stored parent of ts and the ancestors needed
+// to run its state transition.
+func (r *Replayer) parentAndAncestors(ctx context.Context, ts types.TipSet) (*TipSetAndState, []types.TipSet, error) {
+	pIDs, err := ts.Parents()
+	if err != nil {
+		return nil, nil, err
+	}
+	parent, err := r.store.GetTipSetAndState(ctx, pIDs.String())
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to get parent tipset")
+	}
+	h, err := ts.Height()
+	if err != nil {
+		return nil, nil, err
+	}
+	ancestors, err := GetRecentAncestors(ctx, parent.TipSet, r.store, types.NewBlockHeight(h), consensus.AncestorRoundsNeeded, consensus.LookBackParameter)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to get ancestors")
+	}
+	return parent, ancestors, nil
+}
+
+// replayBlock applies blk alone to the parent state and compares the result
+// with the state root and receipts recorded in the block.  Processing errors
+// are recorded in the report rather than returned.
+func (r *Replayer) replayBlock(ctx context.Context, parentRoot cid.Cid, blk *types.Block, ancestors []types.TipSet) (*BlockDivergence, error) {
+	bd := &BlockDivergence{
+		Block:             blk.Cid(),
+		ExpectedStateRoot: blk.StateRoot,
+	}
+
+	st, err := state.LoadStateTree(ctx, r.cst, parentRoot, builtin.Actors)
+	if err != nil {
+		return nil, err
+	}
+	vms := vm.NewStorageMap(r.bs)
+
+	results, err := r.processor.ProcessBlock(ctx, st, vms, blk, ancestors)
+	if err != nil {
+		bd.Error = err.Error()
+	} else {
+		if err := vms.Flush(); err != nil {
+			return nil, err
+		}
+		bd.ComputedStateRoot, err = st.Flush(ctx)
+		if err != nil {
+			return nil, err
+		}
+		bd.ReceiptMismatches = compareReceipts(blk.MessageReceipts, results)
+	}
+
+	return bd, nil
+}
+
+// traceMessages applies the messages of blk one at a time to the parent
+// state, after paying the block reward, and diffs the state before and after
+// each message.
+func (r *Replayer) traceMessages(ctx context.Context, parentRoot cid.Cid, blk *types.Block, ancestors []types.TipSet) ([]*MessageStateDiff, error) {
+	st, err := state.LoadStateTree(ctx, r.cst, parentRoot, builtin.Actors)
+	if err != nil {
+		return nil, err
+	}
+	vms := vm.NewStorageMap(r.bs)
+	bh := types.NewBlockHeight(uint64(blk.Height))
+
+	minerOwnerAddr, err := consensus.MinerOwnerAddress(ctx, st, vms, blk.Miner)
+	if err != nil {
+		return nil, err
+	}
+	// Applying no messages only pays the block reward.
+	if _, err := r.processor.ApplyMessagesAndPayRewards(ctx, st, vms, nil, minerOwnerAddr, bh, ancestors); err != nil {
+		return nil, err
+	}
+	prev, err := st.Flush(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	gasTracker := vm.NewGasTracker()
+	var out []*MessageStateDiff
+	for _, msg := range blk.Messages {
+		mCid, err := msg.Cid()
+		if err != nil {
+			return nil, err
+		}
+		md := &MessageStateDiff{Message: mCid}
+
+		res, err := r.processor.ApplyMessage(ctx, st, vms, msg, minerOwnerAddr, bh, gasTracker, ancestors)
+		if err != nil {
+			md.Error = err.Error()
+		} else {
+			md.Receipt = res.Receipt
+			if res.ExecutionError != nil {
+				md.Error = res.ExecutionError.Error()
+			}
+		}
+
+		if err := vms.Flush(); err != nil {
+			return nil, err
+		}
+		root, err := st.Flush(ctx)
+		if err != nil {
+			return nil, err
+		}
+		md.StateRoot = root
+		md.Diff, err = state.Diff(ctx, r.cst, prev, root, true)
+		if err != nil {
+			return nil, err
+		}
+		prev = root
+
+		out = append(out, md)
+	}
+
+	return out, nil
+}
+
+// compareReceipts returns the receipts in computed that do not match the ones
+// in expected.
+func compareReceipts(expected []*types.MessageReceipt, computed []*consensus.ApplicationResult) []*ReceiptMismatch {
+	n := len(expected)
+	if len(computed) > n {
+		n = len(computed)
+	}
+
+	var mismatches []*ReceiptMismatch
+	for i := 0; i < n; i++ {
+		var exp, comp *types.MessageReceipt
+		if i < len(expected) {
+			exp = expected[i]
+		}
+		if i < len(computed) {
+			comp = computed[i].Receipt
+		}
+		if !receiptsEqual(exp, comp) {
+			mismatches = append(mismatches, &ReceiptMismatch{Index: i, Expected: exp, Computed: comp})
+		}
+	}
+	return mismatches
+}
+
+func receiptsEqual(a, b *types.MessageReceipt) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.ExitCode != b.ExitCode || len(a.Return) != len(b.Return) {
+		return false
+	}
+	for i := range a.Return {
+		if !bytes.Equal(a.Return[i], b.Return[i]) {
+			return false
+		}
+	}
+	if a.GasAttoFIL == nil || b.GasAttoFIL == nil {
+		return a.GasAttoFIL == b.GasAttoFIL
+	}
+	return a.GasAttoFIL.Equal(b.GasAttoFIL)
+}
+
+func reverseTipSets(tipsets []types.TipSet) {
+	for i, j := 0, len(tipsets)-1; i < j; i, j = i+1, j-1 {
+		tipsets[i], tipsets[j] = tipsets[j], tipsets[i]
+	}
+}
@@ -0,0 +1,176 @@
+package chain_test
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"gx/ipfs/QmNf3wujpV2Y7Lnj2hy2UrmuX8bhMDStRHbnSLh7Ypf36h/go-hamt-ipld"
+	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/assert"
+	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/require"
+	bstore "gx/ipfs/QmRu7tiRnFk9mMPpVECQTBQJqXtmG132jJxA1w9A7TtpBz/go-ipfs-blockstore"
+
+	"github.com/filecoin-project/go-filecoin/actor"
+	"github.com/filecoin-project/go-filecoin/actor/builtin"
+	"github.com/filecoin-project/go-filecoin/address"
+	"github.com/filecoin-project/go-filecoin/chain"
+	"github.com/filecoin-project/go-filecoin/consensus"
+	"github.com/filecoin-project/go-filecoin/proofs"
+	"github.com/filecoin-project/go-filecoin/repo"
+	"github.com/filecoin-project/go-filecoin/state"
+	"github.com/filecoin-project/go-filecoin/testhelpers"
+	"github.com/filecoin-project/go-filecoin/types"
+	"github.com/filecoin-project/go-filecoin/vm"
+)
+
+// initReplayTest syncs the test chain into a fresh store and returns it along
+// with a replayer over it.
+func initReplayTest(require *require.Assertions) (chain.Store, *hamt.CborIpldStore, bstore.Blockstore, *chain.Replayer) {
+	ctx := context.Background()
+	processor := testhelpers.NewTestProcessor()
+	r := repo.NewInMemoryRepo()
+	bs := bstore.NewBlockstore(r.Datastore())
+	cst := hamt.NewCborStore()
+	con := consensus.NewExpected(bs, processor, &testhelpers.TestView{}, genCid, proofs.NewFakeVerifier(true, nil))
+	requireSetTestChain(require, con, false)
+	syncer, chainStore, cst, _ := initSyncTest(require, con, initGenesis, cst, bs, r)
+
+	requirePutBlocks(require, cst, link1.ToSlice()...)
+	requirePutBlocks(require, cst, link2.ToSlice()...)
+	requirePutBlocks(require, cst, link3.ToSlice()...)
+	cids4 := requirePutBlocks(require, cst, link4.ToSlice()...)
+	require.NoError(syncer.HandleNewBlocks(ctx, cids4))
+	requireHead(require, chainStore, link4)
+
+	return chainStore, cst, bs, chain.NewReplayer(chainStore, cst, bs, con, processor)
+}
+
+func TestReplay(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("replays the whole chain without divergence", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+		_, _, _, replayer := initReplayTest(require)
+
+		report, err := replayer.Replay(ctx, 0, math.MaxUint64, false)
+		require.NoError(err)
+		assert.Nil(report.Divergence)
+		assert.Equal(4, report.Replayed)
+		assert.Equal(uint64(1), report.From)
+		assert.Equal(uint64(link4blk1.Height), report.To)
+	})
+
+	t.Run("replays only the requested range", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+		_, _, _, replayer := initReplayTest(require)
+
+		report, err := replayer.Replay(ctx, 2, 3, false)
+		require.NoError(err)
+		assert.Nil(report.Divergence)
+		assert.Equal(2, report.Replayed)
+
+		_, err = replayer.Replay(ctx, 3, 2, false)
+		assert.Error(err)
+	})
+
+	t.Run("stops at the first divergent tipset", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+		chainStore, cst, _, replayer := initReplayTest(require)
+
+		// Record a bogus state for link3: the genesis state with an extra actor.
+		st, err := state.LoadStateTree(ctx, cst, genStateRoot, builtin.Actors)
+		require.NoError(err)
+		extra := address.MakeTestAddress("extra")
+		require.NoError(st.SetActor(ctx, extra, actor.NewActor(types.AccountActorCodeCid, types.NewAttoFILFromFIL(1))))
+		badRoot, err := st.Flush(ctx)
+		require.NoError(err)
+		chain.RequirePutTsas(ctx, require, chainStore, &chain.TipSetAndState{
+			TipSet:          link3,
+			TipSetStateRoot: badRoot,
+		})
+
+		report, err := replayer.Replay(ctx, 1, math.MaxUint64, true)
+		require.NoError(err)
+		assert.Equal(3, report.Replayed)
+
+		div := report.Divergence
+		require.NotNil(div)
+		assert.Equal(uint64(link3blk1.Height), div.Height)
+		assert.Equal(link3.String(), div.TipSet)
+		assert.Empty(div.Error)
+		assert.Equal(badRoot, div.ExpectedStateRoot)
+		assert.Equal(link3State, div.ComputedStateRoot)
+
+		require.NotNil(div.StateDiff)
+		require.Len(div.StateDiff.Removed, 1)
+		assert.Equal(extra, div.StateDiff.Removed[0].Address)
+
+		require.Len(div.Blocks, 1)
+		assert.Equal(link3blk1.Cid(), div.Blocks[0].Block)
+		assert.Empty(div.Blocks[0].Error)
+		assert.Equal(link3blk1.StateRoot, div.Blocks[0].ComputedStateRoot)
+		assert.Empty(div.Blocks[0].ReceiptMismatches)
+	})
+
+	t.Run("reports receipts that diverge while the state root matches", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+		chainStore, cst, bs, replayer := initReplayTest(require)
+
+		// A block on top of the head whose single receipt is wrong.
+		blk := chain.RequireMkFakeChild(require,
+			chain.FakeChildParams{Parent: link4, GenesisCid: genCid, StateRoot: link4State, MinerAddr: minerAddress})
+		var err error
+		blk.Proof, blk.Ticket, err = chain.MakeProofAndWinningTicket(minerAddress, 25, 100)
+		require.NoError(err)
+		blk.Messages = []*types.SignedMessage{{
+			MeteredMessage: types.MeteredMessage{
+				Message:  *types.NewMessage(minerAddress, minerAddress, 0, types.ZeroAttoFIL, "getOwner", nil),
+				GasPrice: types.NewGasPrice(0),
+				GasLimit: types.NewGasUnits(300),
+			},
+		}}
+
+		st, err := state.LoadStateTree(ctx, cst, link4State, builtin.Actors)
+		require.NoError(err)
+		vms := vm.NewStorageMap(bs)
+		results, err := testhelpers.NewTestProcessor().ProcessBlock(ctx, st, vms, blk, nil)
+		require.NoError(err)
+		require.Len(results, 1)
+		require.NoError(vms.Flush())
+		blk.StateRoot, err = st.Flush(ctx)
+		require.NoError(err)
+		computed := results[0].Receipt
+		bogus := &types.MessageReceipt{ExitCode: 1, Return: computed.Return, GasAttoFIL: computed.GasAttoFIL}
+		blk.MessageReceipts = []*types.MessageReceipt{bogus}
+
+		link5 := testhelpers.RequireNewTipSet(require, blk)
+		requirePutBlocks(require, cst, blk)
+		chain.RequirePutTsas(ctx, require, chainStore, &chain.TipSetAndState{
+			TipSet:          link5,
+			TipSetStateRoot: blk.StateRoot,
+		})
+		require.NoError(chainStore.SetHead(ctx, link5))
+
+		report, err := replayer.Replay(ctx, 1, math.MaxUint64, false)
+		require.NoError(err)
+		assert.Equal(5, report.Replayed)
+
+		div := report.Divergence
+		require.NotNil(div)
+		assert.Equal(uint64(blk.Height), div.Height)
+		assert.Empty(div.Error)
+		assert.False(div.ComputedStateRoot.Defined())
+		assert.Nil(div.StateDiff)
+
+		require.Len(div.Blocks, 1)
+		assert.Equal(blk.StateRoot, div.Blocks[0].ComputedStateRoot)
+		require.Len(div.Blocks[0].ReceiptMismatches, 1)
+		assert.Equal(0, div.Blocks[0].ReceiptMismatches[0].Index)
+		assert.Equal(bogus, div.Blocks[0].ReceiptMismatches[0].Expected)
+		assert.Equal(computed, div.Blocks[0].ReceiptMismatches[0].Computed)
+	})
+}
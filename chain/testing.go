@@ -3,7 +3,6 @@ package chain
 import (
 	"context"
 	"errors"
-	"gx/ipfs/QmNf3wujpV2Y7Lnj2hy2UrmuX8bhMDStRHbnSLh7Ypf36h/go-hamt-ipld"
 	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
 	bstore "gx/ipfs/QmRu7tiRnFk9mMPpVECQTBQJqXtmG132jJxA1w9A7TtpBz/go-ipfs-blockstore"
 
@@ -46,10 +45,8 @@ func MkFakeChild(params FakeChildParams) (*types.Block, error) {
 
 	// Create consensus for reading the valid weight
 	bs := bstore.NewBlockstore(repo.NewInMemoryRepo().Datastore())
-	cst := hamt.NewCborStore()
 	powerTableView := &th.TestView{}
-	con := consensus.NewExpected(cst,
-		bs,
+	con := consensus.NewExpected(bs,
 		th.NewTestProcessor(),
 		powerTableView,
 		params.GenesisCid,
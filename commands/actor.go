@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"io"
 
+	"github.com/filecoin-project/go-filecoin/address"
 	"github.com/filecoin-project/go-filecoin/api"
 
 	"gx/ipfs/QmQtQrtNioesAWtrx8csBvfY37gTe94d6wQ3VikZUjxD39/go-ipfs-cmds"
@@ -15,7 +16,8 @@ var actorCmd = &cmds.Command{
 		Tagline: "Interact with actors. Actors are built-in smart contracts.",
 	},
 	Subcommands: map[string]*cmds.Command{
-		"ls": actorLsCmd,
+		"ls":       actorLsCmd,
+		"describe": actorDescribeCmd,
 	},
 }
 
@@ -49,3 +51,54 @@ var actorLsCmd = &cmds.Command{
 		}),
 	},
 }
+
+var actorDescribeCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Show the exported methods and current storage of an actor",
+		ShortDescription: `Given an actor address, output the actor's code, balance, nonce, the
+signatures of the methods it exports, and its decoded storage.`,
+	},
+	Arguments: []cmdkit.Argument{
+		cmdkit.StringArg("address", true, false, "The address of the actor"),
+	},
+	Run: func(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment) error {
+		addr, err := address.NewFromString(req.Arguments[0])
+		if err != nil {
+			return err
+		}
+
+		desc, err := GetAPI(env).Actor().Describe(req.Context, addr)
+		if err != nil {
+			return err
+		}
+
+		return re.Emit(desc)
+	},
+	Type: &api.ActorDescription{},
+	Encoders: cmds.EncoderMap{
+		cmds.JSON: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, a *api.ActorDescription) error {
+			marshaled, err := json.Marshal(a)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(marshaled)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write([]byte("\n"))
+			return err
+		}),
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, a *api.ActorDescription) error {
+			marshaled, err := json.MarshalIndent(a, "", "  ")
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(marshaled)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write([]byte("\n"))
+			return err
+		}),
+	},
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"testing"
 
+	"github.com/filecoin-project/go-filecoin/address"
 	"github.com/filecoin-project/go-filecoin/api"
 	th "github.com/filecoin-project/go-filecoin/testhelpers"
 
@@ -48,4 +49,32 @@ func TestActorDaemon(t *testing.T) {
 			}
 		}
 	})
+
+	t.Run("actor describe --enc json returns the exports and storage of an actor", func(t *testing.T) {
+		require := require.New(t)
+		assert := assert.New(t)
+
+		d := th.NewDaemon(t).Start()
+		defer d.ShutdownSuccess()
+
+		op := d.RunSuccess("actor", "describe", address.StorageMarketAddress.String(), "--enc", "json")
+
+		var desc struct {
+			api.ActorView
+			State map[string]interface{} `json:"state"`
+		}
+		require.NoError(json.Unmarshal([]byte(op.ReadStdoutTrimNewlines()), &desc))
+
+		assert.Equal("StoragemarketActor", desc.ActorType)
+		assert.Equal(address.StorageMarketAddress.String(), desc.Address)
+		assert.Contains(desc.Exports, "createMiner")
+		assert.Contains(desc.State, "TotalCommittedStorage")
+	})
+
+	t.Run("actor describe fails for an unknown address", func(t *testing.T) {
+		d := th.NewDaemon(t).Start()
+		defer d.ShutdownSuccess()
+
+		d.RunFail("actor not found", "actor", "describe", address.NewForTestGetter()().String())
+	})
 }
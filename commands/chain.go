@@ -4,6 +4,7 @@ package commands
 import (
 	"fmt"
 	"io"
+	"math"
 	"strconv"
 	"strings"
 
@@ -11,6 +12,8 @@ import (
 	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
 	"gx/ipfs/Qmde5VP1qUkyQXKCfmEUA7bP64V2HAptbJ7phuPp7jXWwg/go-ipfs-cmdkit"
 
+	"github.com/filecoin-project/go-filecoin/chain"
+	"github.com/filecoin-project/go-filecoin/node"
 	"github.com/filecoin-project/go-filecoin/types"
 )
 
@@ -19,8 +22,9 @@ var chainCmd = &cmds.Command{
 		Tagline: "Inspect the filecoin blockchain",
 	},
 	Subcommands: map[string]*cmds.Command{
-		"head": chainHeadCmd,
-		"ls":   chainLsCmd,
+		"head":   chainHeadCmd,
+		"ls":     chainLsCmd,
+		"replay": chainReplayCmd,
 	},
 }
 
@@ -95,3 +99,106 @@ var chainLsCmd = &cmds.Command{
 		}),
 	},
 }
+
+var chainReplayCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Re-execute tipsets and compare the results with the stored chain",
+		ShortDescription: `Replays the tipsets of the local chain between heights --from and --to by
+re-running their state transitions on the stored parent state. The recomputed
+state roots and message receipts are compared with the stored ones and replay
+stops at the first divergence, reporting the failing tipset, the per-block
+results and the difference between the stored and computed state.
+
+This command reads the repo directly and does not require a running daemon.
+Stop the daemon first, it holds the repo lock.`,
+	},
+	Options: []cmdkit.Option{
+		cmdkit.Uint64Option("from", "Height of the first tipset to replay").WithDefault(uint64(1)),
+		cmdkit.Uint64Option("to", "Height of the last tipset to replay, defaults to the head"),
+		cmdkit.BoolOption("dump-diffs", "Apply the messages of divergent blocks one at a time and show the state diff of each"),
+	},
+	Run: func(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment) error {
+		from, _ := req.Options["from"].(uint64)
+		to, ok := req.Options["to"].(uint64)
+		if !ok {
+			to = math.MaxUint64
+		}
+		dumpDiffs, _ := req.Options["dump-diffs"].(bool)
+
+		rep, err := getRepo(req)
+		if err != nil {
+			return err
+		}
+		defer rep.Close() // nolint: errcheck
+
+		replayer, err := node.LoadReplayer(req.Context, rep)
+		if err != nil {
+			return err
+		}
+
+		report, err := replayer.Replay(req.Context, from, to, dumpDiffs)
+		if err != nil {
+			return err
+		}
+
+		return re.Emit(report)
+	},
+	Type: chain.ReplayReport{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, report *chain.ReplayReport) error {
+			if report.Divergence == nil {
+				_, err := fmt.Fprintf(w, "replayed %d tipsets from height %d to %d, no divergence found\n", report.Replayed, report.From, report.To)
+				return err
+			}
+
+			var out strings.Builder
+			div := report.Divergence
+			fmt.Fprintf(&out, "divergence at height %d after replaying %d tipsets\n", div.Height, report.Replayed)
+			fmt.Fprintf(&out, "tipset: %s\n", div.TipSet)
+			if div.Error != "" {
+				fmt.Fprintf(&out, "state transition failed: %s\n", div.Error)
+			}
+			fmt.Fprintf(&out, "expected state root: %s\n", div.ExpectedStateRoot)
+			if div.ComputedStateRoot.Defined() {
+				fmt.Fprintf(&out, "computed state root: %s\n", div.ComputedStateRoot)
+			}
+			if div.StateDiffError != "" {
+				fmt.Fprintf(&out, "could not diff states: %s\n", div.StateDiffError)
+			}
+			if div.StateDiff != nil {
+				out.WriteString("state diff (expected -> computed):\n")
+				if err := writeTreeDiff(&out, div.StateDiff, "  "); err != nil {
+					return err
+				}
+			}
+
+			for _, bd := range div.Blocks {
+				fmt.Fprintf(&out, "block %s\n", bd.Block)
+				if bd.Error != "" {
+					fmt.Fprintf(&out, "  error: %s\n", bd.Error)
+				}
+				fmt.Fprintf(&out, "  expected state root: %s\n", bd.ExpectedStateRoot)
+				if bd.ComputedStateRoot.Defined() {
+					fmt.Fprintf(&out, "  computed state root: %s\n", bd.ComputedStateRoot)
+				}
+				for _, rm := range bd.ReceiptMismatches {
+					fmt.Fprintf(&out, "  receipt %d: expected %+v, computed %+v\n", rm.Index, rm.Expected, rm.Computed)
+				}
+				for _, md := range bd.Messages {
+					fmt.Fprintf(&out, "  message %s -> %s\n", md.Message, md.StateRoot)
+					if md.Error != "" {
+						fmt.Fprintf(&out, "    error: %s\n", md.Error)
+					}
+					if md.Diff != nil {
+						if err := writeTreeDiff(&out, md.Diff, "    "); err != nil {
+							return err
+						}
+					}
+				}
+			}
+
+			_, err := io.WriteString(w, out.String())
+			return err
+		}),
+	},
+}
@@ -3,7 +3,9 @@ package commands
 import (
 	"fmt"
 	"io"
+	"math/big"
 	"strconv"
+	"time"
 
 	"gx/ipfs/QmQmhotPUzVrMEWNK3x1R5jQ5ZHWyL7tVUrmRPjrBrvyCb/go-ipfs-files"
 	"gx/ipfs/QmQtQrtNioesAWtrx8csBvfY37gTe94d6wQ3VikZUjxD39/go-ipfs-cmds"
@@ -14,6 +16,8 @@ import (
 	"github.com/filecoin-project/go-filecoin/address"
 	"github.com/filecoin-project/go-filecoin/api"
 	"github.com/filecoin-project/go-filecoin/protocol/storage"
+	"github.com/filecoin-project/go-filecoin/protocol/transfer"
+	"github.com/filecoin-project/go-filecoin/types"
 )
 
 var clientCmd = &cmds.Command{
@@ -25,6 +29,9 @@ var clientCmd = &cmds.Command{
 		"import":               clientImportDataCmd,
 		"propose-storage-deal": clientProposeStorageDealCmd,
 		"query-storage-deal":   clientQueryStorageDealCmd,
+		"query-storage-order":  clientQueryStorageOrderCmd,
+		"store":                clientStoreCmd,
+		"deal-history":         clientDealHistoryCmd,
 		"list-asks":            clientListAsksCmd,
 		"payments":             paymentsCmd,
 	},
@@ -111,6 +118,10 @@ Duration should be specified with the number of blocks for which to store the
 data. New blocks are generated about every 30 seconds, so the time given should
 be represented as a count of 30 second intervals. For example, 1 minute would
 be 2, 1 hour would be 120, and 1 day would be 2880.
+
+With --manual-transfer the miner does not fetch the data from this node. The
+data has to be delivered to the miner out of band, e.g. on disks, and imported
+by the miner with the miner deals import command.
 `,
 	},
 	Arguments: []cmdkit.Argument{
@@ -121,9 +132,11 @@ be 2, 1 hour would be 120, and 1 day would be 2880.
 	},
 	Options: []cmdkit.Option{
 		cmdkit.BoolOption("allow-duplicates", "Allows duplicate proposals to be created. Unless this flag is set, you will not be able to make more than one deal per piece per miner. This protection exists to prevent erroneous duplicate deals."),
+		cmdkit.BoolOption("manual-transfer", "Deliver the data to the miner out of band instead of having the miner fetch it"),
 	},
 	Run: func(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment) error {
 		allowDuplicates, _ := req.Options["allow-duplicates"].(bool)
+		manualTransfer, _ := req.Options["manual-transfer"].(bool)
 
 		miner, err := address.NewFromString(req.Arguments[0])
 		if err != nil {
@@ -145,7 +158,7 @@ be 2, 1 hour would be 120, and 1 day would be 2880.
 			return err
 		}
 
-		resp, err := GetAPI(env).Client().ProposeStorageDeal(req.Context, data, miner, askid, duration, allowDuplicates)
+		resp, err := GetAPI(env).Client().ProposeStorageDeal(req.Context, data, miner, askid, duration, allowDuplicates, manualTransfer)
 		if err != nil {
 			return err
 		}
@@ -169,7 +182,8 @@ var clientQueryStorageDealCmd = &cmds.Command{
 		ShortDescription: `
 Checks the status of the storage deal proposal specified by the id. The deal
 status and deal message will be returned as a formatted string unless another
-format is specified with the --enc flag.
+format is specified with the --enc flag. While the miner pulls the data of the
+deal from this node, the progress of the transfer is shown too.
 `,
 	},
 	Arguments: []cmdkit.Argument{
@@ -186,36 +200,107 @@ format is specified with the --enc flag.
 			return err
 		}
 
-		return re.Emit(resp)
+		prog, err := GetAPI(env).Transfers().Get(req.Context, propcid)
+		if err != nil {
+			return err
+		}
+
+		return re.Emit(&storageDealStatus{DealResponse: resp, Transfer: prog})
 	},
-	Type: storage.DealResponse{},
+	Type: storageDealStatus{},
 	Encoders: cmds.EncoderMap{
-		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, resp *storage.DealResponse) error {
-			fmt.Fprintf(w, "Status: %s\n", resp.State.String()) // nolint: errcheck
-			fmt.Fprintf(w, "Message: %s\n", resp.Message)       // nolint: errcheck
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, status *storageDealStatus) error {
+			fmt.Fprintf(w, "Status: %s\n", status.State.String()) // nolint: errcheck
+			fmt.Fprintf(w, "Message: %s\n", status.Message)       // nolint: errcheck
+			if status.Transfer != nil {
+				fmt.Fprintf(w, "Transfer: %s\n", formatTransferProgress(status.Transfer)) // nolint: errcheck
+			}
 			return nil
 		}),
 	},
 }
 
+// storageDealStatus is the state of a deal along with the progress of the
+// transfer of its data.
+type storageDealStatus struct {
+	*storage.DealResponse
+	Transfer *transfer.Progress `json:",omitempty"`
+}
+
+var clientDealHistoryCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Show the state transitions of a storage deal",
+		ShortDescription: `
+Lists the states the storage deal specified by the id moved through, as last
+seen by this client when proposing or querying the deal, with the time of and
+reason for each transition.
+`,
+	},
+	Arguments: []cmdkit.Argument{
+		cmdkit.StringArg("id", true, false, "CID of deal to show the history of"),
+	},
+	Run: func(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment) error {
+		propcid, err := cid.Decode(req.Arguments[0])
+		if err != nil {
+			return err
+		}
+
+		history, err := GetAPI(env).Client().DealHistory(req.Context, propcid)
+		if err != nil {
+			return err
+		}
+
+		return re.Emit(history)
+	},
+	Type:     []*storage.DealEvent{},
+	Encoders: dealHistoryEncoders,
+}
+
+// dealHistoryEncoders print one line per transition of a deal.
+var dealHistoryEncoders = cmds.EncoderMap{
+	cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, history []*storage.DealEvent) error {
+		for _, e := range history {
+			at := time.Unix(e.Time, 0).UTC().Format(time.RFC3339)
+			if _, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", at, e.From, e.To, e.Reason); err != nil {
+				return err
+			}
+		}
+		return nil
+	}),
+}
+
 var clientListAsksCmd = &cmds.Command{
 	Helptext: cmdkit.HelpText{
 		Tagline: "List all asks in the storage market",
 		ShortDescription: `
-Lists all asks in the storage market. This command takes no arguments. Results
-will be returned as a space separated table with miner, id, price and expiration
-respectively.
+Lists all asks in the storage market. Results will be returned as a space
+separated table with miner, id, price and expiration respectively.
+`,
+		LongDescription: `
+Lists the open asks of every miner in the storage market, cheapest first.
+Results will be returned as a space separated table with miner, id, price and
+expiration respectively.
+
+Asks can be restricted to a maximum price (in FIL), to miners with at least a
+given storage power, or to miners with at least a given number of pledged
+sectors still free. --sort orders the asks by price, expiry or power.
 `,
 	},
+	Options: askFilterOptions,
 	Run: func(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment) error {
-		asksCh, err := GetAPI(env).Client().ListAsks(req.Context)
+		filter, err := askFilterFromOptions(req)
+		if err != nil {
+			return err
+		}
+
+		asksCh, err := GetAPI(env).Client().ListAsks(req.Context, filter)
 		if err != nil {
 			return err
 		}
 
 		for a := range asksCh {
 			if a.Error != nil {
-				return err
+				return a.Error
 			}
 			if err := re.Emit(a); err != nil {
 				return err
@@ -232,6 +317,146 @@ respectively.
 	},
 }
 
+// askFilterOptions select the asks of the storage market to use.
+var askFilterOptions = []cmdkit.Option{
+	cmdkit.StringOption("max-price", "Only use asks costing at most this much FIL"),
+	cmdkit.StringOption("min-power", "Only use asks of miners with at least this much storage power"),
+	cmdkit.Uint64Option("min-free-sectors", "Only use asks of miners with at least this many pledged sectors free"),
+	cmdkit.StringOption("sort", "Sort asks by price, expiry or power").WithDefault(storage.SortAsksByPrice),
+}
+
+// askFilterFromOptions reads the askFilterOptions of the request.
+func askFilterFromOptions(req *cmds.Request) (storage.AskFilter, error) {
+	var filter storage.AskFilter
+
+	if o, ok := req.Options["max-price"]; ok {
+		maxPrice, ok := types.NewAttoFILFromFILString(o.(string))
+		if !ok {
+			return filter, ErrInvalidPrice
+		}
+		filter.MaxPrice = maxPrice
+	}
+
+	if o, ok := req.Options["min-power"]; ok {
+		minPower, ok := new(big.Int).SetString(o.(string), 10)
+		if !ok {
+			return filter, fmt.Errorf("invalid minimum power: %s", o)
+		}
+		filter.MinPower = minPower
+	}
+
+	if o, ok := req.Options["min-free-sectors"]; ok {
+		filter.MinFreeSectors = o.(uint64)
+	}
+
+	filter.SortBy = req.Options["sort"].(string)
+	return filter, nil
+}
+
+var clientStoreCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Store data with several miners",
+		ShortDescription: `
+Stores data with as many independent miners as there are replicas, picking
+them from the asks in the storage market.
+`,
+		LongDescription: `
+Stores data with as many independent miners as there are replicas. Miners are
+picked from the asks in the storage market, cheapest first unless --sort says
+otherwise, and the asks can be filtered as with the client list-asks command.
+Deals are proposed to the miners in parallel, and a miner that rejects its
+deal is replaced by the next one. At most one deal is made per miner.
+
+The replicas are tracked as one storage order for the data, which can be shown
+with the client query-storage-order command. If not enough miners took a
+deal, storing the data again proposes the missing replicas to other miners.
+
+Duration should be specified with the number of blocks for which to store the
+data, see the client propose-storage-deal command.
+`,
+	},
+	Arguments: []cmdkit.Argument{
+		cmdkit.StringArg("data", true, false, "CID of the data to be stored"),
+		cmdkit.StringArg("duration", true, false, "Time in blocks (about 30 seconds per block) to store data"),
+	},
+	Options: append([]cmdkit.Option{
+		cmdkit.Uint64Option("replicas", "Number of miners to store the data with").WithDefault(uint64(1)),
+		cmdkit.BoolOption("manual-transfer", "Deliver the data to the miners out of band instead of having them fetch it"),
+	}, askFilterOptions...),
+	Run: func(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment) error {
+		replicas := req.Options["replicas"].(uint64)
+		manualTransfer, _ := req.Options["manual-transfer"].(bool)
+
+		data, err := cid.Decode(req.Arguments[0])
+		if err != nil {
+			return err
+		}
+
+		duration, err := strconv.ParseUint(req.Arguments[1], 10, 64)
+		if err != nil {
+			return err
+		}
+
+		filter, err := askFilterFromOptions(req)
+		if err != nil {
+			return err
+		}
+
+		order, err := GetAPI(env).Client().StoreData(req.Context, data, replicas, duration, filter, manualTransfer)
+		if err != nil {
+			return err
+		}
+
+		return re.Emit(order)
+	},
+	Type:     storage.StorageOrder{},
+	Encoders: storageOrderEncoders,
+}
+
+var clientQueryStorageOrderCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Show the replicas of stored data",
+		ShortDescription: `
+Shows the storage order made with the client store command for the data: the
+deal of each miner holding a replica, and the miners that rejected one. The
+state of each deal can be checked with the client query-storage-deal command.
+`,
+	},
+	Arguments: []cmdkit.Argument{
+		cmdkit.StringArg("data", true, false, "CID of the stored data"),
+	},
+	Run: func(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment) error {
+		data, err := cid.Decode(req.Arguments[0])
+		if err != nil {
+			return err
+		}
+
+		order, err := GetAPI(env).Client().StorageOrder(req.Context, data)
+		if err != nil {
+			return err
+		}
+
+		return re.Emit(order)
+	},
+	Type:     storage.StorageOrder{},
+	Encoders: storageOrderEncoders,
+}
+
+// storageOrderEncoders print the replicas of a storage order.
+var storageOrderEncoders = cmds.EncoderMap{
+	cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, order *storage.StorageOrder) error {
+		fmt.Fprintf(w, "Data:     %s\n", order.Data)                             // nolint: errcheck
+		fmt.Fprintf(w, "Replicas: %d of %d\n", len(order.Deals), order.Replicas) // nolint: errcheck
+		for _, d := range order.Deals {
+			fmt.Fprintf(w, "Deal:     %s %s\n", d.Miner, d.ProposalCid) // nolint: errcheck
+		}
+		for _, r := range order.Rejections {
+			fmt.Fprintf(w, "Rejected: %s %s\n", r.Miner, r.Reason) // nolint: errcheck
+		}
+		return nil
+	}),
+}
+
 var paymentsCmd = &cmds.Command{
 	Helptext: cmdkit.HelpText{
 		Tagline:          "List payments for a given deal",
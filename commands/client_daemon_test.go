@@ -4,11 +4,13 @@ import (
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/filecoin-project/go-filecoin/fixtures"
 	"github.com/filecoin-project/go-filecoin/protocol/storage"
 	th "github.com/filecoin-project/go-filecoin/testhelpers"
 	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/assert"
+	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/require"
 )
 
 func TestListAsks(t *testing.T) {
@@ -25,8 +27,21 @@ func TestListAsks(t *testing.T) {
 	minerDaemon.RunSuccess("mining start")
 	minerDaemon.MinerSetPrice(fixtures.TestMiners[0], fixtures.TestAddresses[0], "20", "10")
 
-	listAsksOutput := minerDaemon.RunSuccess("client", "list-asks").ReadStdoutTrimNewlines()
+	// the ask index picks the ask up in the background
+	var listAsksOutput string
+	assert.NoError(th.WaitForIt(100, 100*time.Millisecond, func() (bool, error) {
+		listAsksOutput = minerDaemon.RunSuccess("client", "list-asks").ReadStdoutTrimNewlines()
+		return listAsksOutput != "", nil
+	}))
 	assert.Equal(fixtures.TestMiners[0]+" 000 20 11", listAsksOutput)
+
+	listAsksOutput = minerDaemon.RunSuccess("client", "list-asks", "--max-price", "10").ReadStdoutTrimNewlines()
+	assert.Equal("", listAsksOutput)
+
+	listAsksOutput = minerDaemon.RunSuccess("client", "list-asks", "--max-price", "20", "--sort", "expiry").ReadStdoutTrimNewlines()
+	assert.Equal(fixtures.TestMiners[0]+" 000 20 11", listAsksOutput)
+
+	minerDaemon.RunFail("cannot sort asks", "client", "list-asks", "--sort", "color")
 }
 
 func TestStorageDealsAfterRestart(t *testing.T) {
@@ -67,6 +82,53 @@ func TestStorageDealsAfterRestart(t *testing.T) {
 	minerDaemon.ConnectSuccess(clientDaemon)
 
 	assert.NotEmpty(clientDaemon.RunSuccess("client", "query-storage-deal", dealCid).ReadStdout())
+
+	// deal histories survive the restart
+	assert.Contains(clientDaemon.RunSuccess("client", "deal-history", dealCid).ReadStdout(), "unknown\taccepted\treported by miner")
+	assert.Contains(minerDaemon.RunSuccess("miner", "deal-history", dealCid).ReadStdout(), "unknown\taccepted\tproposal accepted")
+}
+
+func TestManualTransferDeal(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	require := require.New(t)
+
+	miner := th.NewDaemon(t,
+		th.WithMiner(fixtures.TestMiners[0]),
+		th.KeyFile(fixtures.KeyFilePaths()[0]),
+		th.DefaultAddress(fixtures.TestAddresses[0]),
+	).Start()
+	defer miner.ShutdownSuccess()
+
+	client := th.NewDaemon(t, th.KeyFile(fixtures.KeyFilePaths()[2]), th.DefaultAddress(fixtures.TestAddresses[2])).Start()
+	defer client.ShutdownSuccess()
+
+	miner.RunSuccess("mining start")
+	miner.UpdatePeerID()
+
+	miner.ConnectSuccess(client)
+
+	miner.MinerSetPrice(fixtures.TestMiners[0], fixtures.TestAddresses[0], "20", "10")
+	dataCid := client.RunWithStdin(strings.NewReader("SHIPPED ON DISKS"), "client", "import").ReadStdoutTrimNewlines()
+
+	proposeDealOutput := client.RunSuccess("client", "propose-storage-deal", "--manual-transfer", fixtures.TestMiners[0], dataCid, "0", "5").ReadStdoutTrimNewlines()
+	splitOnSpace := strings.Split(proposeDealOutput, " ")
+	dealCid := splitOnSpace[len(splitOnSpace)-1]
+
+	require.NoError(th.WaitForIt(50, 100*time.Millisecond, func() (bool, error) {
+		return strings.Contains(miner.RunSuccess("miner", "deal-history", dealCid).ReadStdout(), "awaiting data"), nil
+	}))
+
+	t.Run("rejects data that does not match the piece", func(t *testing.T) {
+		out := miner.RunWithStdin(strings.NewReader("SOMETHING ELSE"), "miner", "deals", "import", dealCid).ReadStderr()
+		assert.Contains(out, "does not match the piece of the deal")
+	})
+
+	t.Run("stages the imported data", func(t *testing.T) {
+		out := miner.RunWithStdin(strings.NewReader("SHIPPED ON DISKS"), "miner", "deals", "import", dealCid)
+		assert.Equal(dealCid, out.ReadStdoutTrimNewlines())
+		assert.Contains(miner.RunSuccess("miner", "deal-history", dealCid).ReadStdout(), "awaiting data\tstarted\toffline data imported")
+	})
 }
 
 func TestDuplicateDeals(t *testing.T) {
@@ -147,6 +209,61 @@ func TestDealWithSameDataAndDifferentMiners(t *testing.T) {
 	assert.Contains(secondDeal, "accepted")
 }
 
+func TestStoreReplicas(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	require := require.New(t)
+
+	miner1 := th.NewDaemon(t,
+		th.WithMiner(fixtures.TestMiners[0]),
+		th.KeyFile(fixtures.KeyFilePaths()[0]),
+		th.DefaultAddress(fixtures.TestAddresses[0]),
+	).Start()
+	defer miner1.ShutdownSuccess()
+
+	miner2 := th.NewDaemon(t,
+		th.KeyFile(fixtures.KeyFilePaths()[1]),
+		th.DefaultAddress(fixtures.TestAddresses[1]),
+	).Start()
+	defer miner2.ShutdownSuccess()
+
+	client := th.NewDaemon(t, th.KeyFile(fixtures.KeyFilePaths()[2]), th.DefaultAddress(fixtures.TestAddresses[2])).Start()
+	defer client.ShutdownSuccess()
+
+	miner1.RunSuccess("mining start")
+	miner1.UpdatePeerID()
+
+	miner1.ConnectSuccess(client)
+	miner2.ConnectSuccess(client)
+
+	miner2Addr := miner2.CreateMinerAddr(miner1, fixtures.TestAddresses[1])
+	miner2.UpdatePeerID()
+
+	miner2.RunSuccess("mining start")
+
+	miner1.MinerSetPrice(fixtures.TestMiners[0], fixtures.TestAddresses[0], "20", "10")
+	miner2.MinerSetPrice(miner2Addr.String(), fixtures.TestAddresses[1], "20", "10")
+
+	// wait for the client to see both asks
+	require.NoError(th.WaitForIt(100, 100*time.Millisecond, func() (bool, error) {
+		asks := client.RunSuccess("client", "list-asks").ReadStdoutTrimNewlines()
+		return len(strings.Split(asks, "\n")) == 2, nil
+	}))
+
+	dataCid := client.RunWithStdin(strings.NewReader("HODLHODLHODL"), "client", "import").ReadStdoutTrimNewlines()
+
+	order := client.RunSuccess("client", "store", "--replicas", "2", dataCid, "5").ReadStdoutTrimNewlines()
+	assert.Contains(order, "Replicas: 2 of 2")
+	assert.Contains(order, "Deal:     "+fixtures.TestMiners[0])
+	assert.Contains(order, "Deal:     "+miner2Addr.String())
+
+	// there are no other miners to take a third replica
+	client.RunFail("only 2 of 3 replicas were stored", "client", "store", "--replicas", "3", dataCid, "5")
+
+	order = client.RunSuccess("client", "query-storage-order", dataCid).ReadStdoutTrimNewlines()
+	assert.Contains(order, "Replicas: 2 of 3")
+}
+
 func TestVoucherPersistenceAndPayments(t *testing.T) {
 	t.Parallel()
 	assert := assert.New(t)
@@ -97,6 +97,7 @@ START RUNNING FILECOIN
 STORE AND RETRIEVE DATA
   go-filecoin client                 - Make deals, store data, retrieve data
   go-filecoin retrieval-client       - Manage retrieval client operations
+  go-filecoin transfers              - Inspect the transfers of deal data
 
 MINE
   go-filecoin miner                  - Manage a single miner actor
@@ -106,6 +107,7 @@ VIEW DATA STRUCTURES
   go-filecoin chain                  - Inspect the filecoin blockchain
   go-filecoin dag                    - Interact with IPLD DAG objects
   go-filecoin show                   - Get human-readable representations of filecoin objects
+  go-filecoin state                  - Inspect the filecoin state tree
 
 NETWORK COMMANDS
   go-filecoin bootstrap              - Interact with bootstrap addresses
@@ -166,7 +168,9 @@ var rootSubcmdsDaemon = map[string]*cmds.Command{
 	"ping":             pingCmd,
 	"retrieval-client": retrievalClientCmd,
 	"show":             showCmd,
+	"state":            stateCmd,
 	"swarm":            swarmCmd,
+	"transfers":        transfersCmd,
 	"version":          versionCmd,
 	"wallet":           walletCmd,
 }
@@ -296,6 +300,12 @@ func requiresDaemon(req *cmds.Request) bool {
 		return false
 	}
 
+	// chain replay reads the repo directly so it can be run against a
+	// stopped node.
+	if req.Command == chainReplayCmd {
+		return false
+	}
+
 	return true
 }
 
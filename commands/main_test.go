@@ -25,8 +25,12 @@ func TestRequiresDaemon(t *testing.T) {
 	reqWithoutDaemon, err := cmds.NewRequest(context.Background(), []string{}, nil, []string{"daemon"}, nil, daemonCmd)
 	assert.NoError(err)
 
+	reqReplay, err := cmds.NewRequest(context.Background(), []string{"chain", "replay"}, nil, []string{}, nil, chainReplayCmd)
+	assert.NoError(err)
+
 	assert.True(requiresDaemon(reqWithDaemon))
 	assert.False(requiresDaemon(reqWithoutDaemon))
+	assert.False(requiresDaemon(reqReplay))
 }
 
 func TestNoDaemonNoHang(t *testing.T) {
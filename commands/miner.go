@@ -1,19 +1,25 @@
 package commands
 
 import (
+	"encoding/base64"
 	"fmt"
 	"io"
 	"math/big"
 	"strconv"
 
+	ma "gx/ipfs/QmNTCey11oxhb1AxDnQBRHtdhap6Ctud872NjAYPYYXPuc/go-multiaddr"
+	"gx/ipfs/QmQmhotPUzVrMEWNK3x1R5jQ5ZHWyL7tVUrmRPjrBrvyCb/go-ipfs-files"
 	"gx/ipfs/QmQtQrtNioesAWtrx8csBvfY37gTe94d6wQ3VikZUjxD39/go-ipfs-cmds"
 	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
 	"gx/ipfs/QmTu65MVbemtUxJEWgsTtzv9Zv9P8rvmqNA4eG9TrTRGYc/go-libp2p-peer"
 	"gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
 	"gx/ipfs/Qmde5VP1qUkyQXKCfmEUA7bP64V2HAptbJ7phuPp7jXWwg/go-ipfs-cmdkit"
 
+	minerActor "github.com/filecoin-project/go-filecoin/actor/builtin/miner"
+	"github.com/filecoin-project/go-filecoin/actor/builtin/storagemarket"
 	"github.com/filecoin-project/go-filecoin/address"
 	"github.com/filecoin-project/go-filecoin/porcelain"
+	"github.com/filecoin-project/go-filecoin/protocol/storage"
 	"github.com/filecoin-project/go-filecoin/types"
 )
 
@@ -22,13 +28,19 @@ var minerCmd = &cmds.Command{
 		Tagline: "Manage a single miner actor",
 	},
 	Subcommands: map[string]*cmds.Command{
-		"create":        minerCreateCmd,
-		"add-ask":       minerAddAskCmd,
-		"owner":         minerOwnerCmd,
-		"pledge":        minerPledgeCmd,
-		"power":         minerPowerCmd,
-		"set-price":     minerSetPriceCmd,
-		"update-peerid": minerUpdatePeerIDCmd,
+		"create":            minerCreateCmd,
+		"deal-history":      minerDealHistoryCmd,
+		"deals":             minerDealsCmd,
+		"add-ask":           minerAddAskCmd,
+		"list":              minerListCmd,
+		"owner":             minerOwnerCmd,
+		"payments":          minerPaymentsCmd,
+		"pledge":            minerPledgeCmd,
+		"power":             minerPowerCmd,
+		"sectors":           minerSectorsCmd,
+		"set-price":         minerSetPriceCmd,
+		"update-multiaddrs": minerUpdateMultiaddrsCmd,
+		"update-peerid":     minerUpdatePeerIDCmd,
 	},
 }
 
@@ -56,6 +68,194 @@ var minerPledgeCmd = &cmds.Command{
 		re.Emit(str) // nolint: errcheck
 		return nil
 	},
+	Subcommands: map[string]*cmds.Command{
+		"add":      minerPledgeAddCmd,
+		"withdraw": minerPledgeWithdrawCmd,
+	},
+}
+
+type minerPledgeResult struct {
+	Cid     cid.Cid
+	GasUsed types.GasUnits
+	Preview bool
+}
+
+var minerPledgeAddCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Add <collateral> FIL to the collateral of <miner>",
+		ShortDescription: `Issues a new message to the network adding collateral to the miner. With
+--sectors the miner's pledge is also increased by that many sectors, in which
+case the miner's collateral must cover 0.001 FIL per pledged sector.`,
+	},
+	Arguments: []cmdkit.Argument{
+		cmdkit.StringArg("miner", true, false, "The miner address"),
+		cmdkit.StringArg("collateral", true, false, "The amount of collateral in FIL to be sent"),
+	},
+	Options: []cmdkit.Option{
+		cmdkit.StringOption("from", "Address to send from"),
+		cmdkit.UintOption("sectors", "Number of sectors to add to the pledge"),
+		priceOption,
+		limitOption,
+		previewOption,
+	},
+	Run: func(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment) error {
+		minerAddr, err := address.NewFromString(req.Arguments[0])
+		if err != nil {
+			return err
+		}
+
+		fromAddr, err := optionalAddr(req.Options["from"])
+		if err != nil {
+			return err
+		}
+
+		collateral, ok := types.NewAttoFILFromFILString(req.Arguments[1])
+		if !ok {
+			return ErrInvalidCollateral
+		}
+
+		method := "addCollateral"
+		var params []interface{}
+		if sectors, _ := req.Options["sectors"].(uint); sectors > 0 {
+			method = "increasePledge"
+			params = append(params, big.NewInt(int64(sectors)))
+		}
+
+		gasPrice, gasLimit, preview, err := parseGasOptions(req)
+		if err != nil {
+			return err
+		}
+
+		if preview {
+			usedGas, err := GetPorcelainAPI(env).MessagePreview(
+				req.Context,
+				fromAddr,
+				minerAddr,
+				method,
+				params...,
+			)
+			if err != nil {
+				return err
+			}
+			return re.Emit(&minerPledgeResult{
+				Cid:     cid.Cid{},
+				GasUsed: usedGas,
+				Preview: true,
+			})
+		}
+
+		c, err := GetPorcelainAPI(env).MessageSendWithDefaultAddress(
+			req.Context,
+			fromAddr,
+			minerAddr,
+			collateral,
+			gasPrice,
+			gasLimit,
+			method,
+			params...,
+		)
+		if err != nil {
+			return err
+		}
+
+		return re.Emit(&minerPledgeResult{
+			Cid:     c,
+			GasUsed: types.NewGasUnits(0),
+			Preview: false,
+		})
+	},
+	Type:     &minerPledgeResult{},
+	Encoders: minerPledgeResultEncoders,
+}
+
+var minerPledgeWithdrawCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Withdraw <amount> FIL of collateral from <miner> to its owner",
+		ShortDescription: `Issues a new message to the network withdrawing collateral from the miner.
+The collateral left must still cover 0.001 FIL per committed sector.`,
+	},
+	Arguments: []cmdkit.Argument{
+		cmdkit.StringArg("miner", true, false, "The miner address"),
+		cmdkit.StringArg("amount", true, false, "The amount of collateral in FIL to withdraw"),
+	},
+	Options: []cmdkit.Option{
+		cmdkit.StringOption("from", "Address to send from"),
+		priceOption,
+		limitOption,
+		previewOption,
+	},
+	Run: func(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment) error {
+		minerAddr, err := address.NewFromString(req.Arguments[0])
+		if err != nil {
+			return err
+		}
+
+		fromAddr, err := optionalAddr(req.Options["from"])
+		if err != nil {
+			return err
+		}
+
+		amount, ok := types.NewAttoFILFromFILString(req.Arguments[1])
+		if !ok {
+			return ErrInvalidAmount
+		}
+
+		gasPrice, gasLimit, preview, err := parseGasOptions(req)
+		if err != nil {
+			return err
+		}
+
+		if preview {
+			usedGas, err := GetPorcelainAPI(env).MessagePreview(
+				req.Context,
+				fromAddr,
+				minerAddr,
+				"withdrawBalance",
+				amount,
+			)
+			if err != nil {
+				return err
+			}
+			return re.Emit(&minerPledgeResult{
+				Cid:     cid.Cid{},
+				GasUsed: usedGas,
+				Preview: true,
+			})
+		}
+
+		c, err := GetPorcelainAPI(env).MessageSendWithDefaultAddress(
+			req.Context,
+			fromAddr,
+			minerAddr,
+			types.NewAttoFILFromFIL(0),
+			gasPrice,
+			gasLimit,
+			"withdrawBalance",
+			amount,
+		)
+		if err != nil {
+			return err
+		}
+
+		return re.Emit(&minerPledgeResult{
+			Cid:     c,
+			GasUsed: types.NewGasUnits(0),
+			Preview: false,
+		})
+	},
+	Type:     &minerPledgeResult{},
+	Encoders: minerPledgeResultEncoders,
+}
+
+var minerPledgeResultEncoders = cmds.EncoderMap{
+	cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, res *minerPledgeResult) error {
+		if res.Preview {
+			output := strconv.FormatUint(uint64(res.GasUsed), 10)
+			_, err := w.Write([]byte(output))
+			return err
+		}
+		return PrintString(w, res.Cid)
+	}),
 }
 
 // MinerCreateResult is the type returned when creating a miner.
@@ -351,6 +551,106 @@ var minerUpdatePeerIDCmd = &cmds.Command{
 	},
 }
 
+type minerUpdateMultiaddrsResult struct {
+	Cid     cid.Cid
+	GasUsed types.GasUnits
+	Preview bool
+}
+
+var minerUpdateMultiaddrsCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Change the multiaddrs that a miner advertises on chain",
+		ShortDescription: `Issues a new message to the network replacing the multiaddrs the miner can be
+dialed on. Clients use them to reach the miner without looking it up in the
+DHT. Passing no multiaddrs clears them.`,
+	},
+	Arguments: []cmdkit.Argument{
+		cmdkit.StringArg("miner", true, false, "Miner address to update multiaddrs for"),
+		cmdkit.StringArg("multiaddrs", false, true, "Multiaddrs the miner can be dialed on"),
+	},
+	Options: []cmdkit.Option{
+		cmdkit.StringOption("from", "Address to send from"),
+		priceOption,
+		limitOption,
+		previewOption,
+	},
+	Run: func(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment) error {
+		minerAddr, err := address.NewFromString(req.Arguments[0])
+		if err != nil {
+			return err
+		}
+
+		fromAddr, err := optionalAddr(req.Options["from"])
+		if err != nil {
+			return err
+		}
+
+		addrs := []ma.Multiaddr{}
+		for _, arg := range req.Arguments[1:] {
+			addr, err := ma.NewMultiaddr(arg)
+			if err != nil {
+				return errors.Wrapf(err, "invalid multiaddr %q", arg)
+			}
+			addrs = append(addrs, addr)
+		}
+
+		gasPrice, gasLimit, preview, err := parseGasOptions(req)
+		if err != nil {
+			return err
+		}
+
+		if preview {
+			usedGas, err := GetPorcelainAPI(env).MessagePreview(
+				req.Context,
+				fromAddr,
+				minerAddr,
+				"updateMultiaddrs",
+				addrs,
+			)
+			if err != nil {
+				return err
+			}
+
+			return re.Emit(&minerUpdateMultiaddrsResult{
+				Cid:     cid.Cid{},
+				GasUsed: usedGas,
+				Preview: true,
+			})
+		}
+
+		c, err := GetPorcelainAPI(env).MessageSendWithDefaultAddress(
+			req.Context,
+			fromAddr,
+			minerAddr,
+			nil,
+			gasPrice,
+			gasLimit,
+			"updateMultiaddrs",
+			addrs,
+		)
+		if err != nil {
+			return err
+		}
+
+		return re.Emit(&minerUpdateMultiaddrsResult{
+			Cid:     c,
+			GasUsed: types.NewGasUnits(0),
+			Preview: false,
+		})
+	},
+	Type: &minerUpdateMultiaddrsResult{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, res *minerUpdateMultiaddrsResult) error {
+			if res.Preview {
+				output := strconv.FormatUint(uint64(res.GasUsed), 10)
+				_, err := w.Write([]byte(output))
+				return err
+			}
+			return PrintString(w, res.Cid)
+		}),
+	},
+}
+
 type minerAddAskResult struct {
 	Cid     cid.Cid
 	GasUsed types.GasUnits
@@ -501,3 +801,201 @@ Values will be output as a ratio where the first number is the miner power and s
 		}),
 	},
 }
+
+var minerSectorsCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Inspect the sectors committed by a miner",
+	},
+	Subcommands: map[string]*cmds.Command{
+		"ls": minerSectorsLsCmd,
+	},
+}
+
+var minerSectorsLsCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "List the sectors committed by <miner>",
+		ShortDescription: `Lists the sectors committed by the given miner, one per line, showing the
+sector id, its replica commitment and the block height at which it expires.`,
+	},
+	Arguments: []cmdkit.Argument{
+		cmdkit.StringArg("miner", true, false, "The address of the miner"),
+	},
+	Run: func(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment) error {
+		minerAddr, err := address.NewFromString(req.Arguments[0])
+		if err != nil {
+			return err
+		}
+
+		sectors, err := GetPorcelainAPI(env).MinerGetSectors(req.Context, minerAddr)
+		if err != nil {
+			return err
+		}
+
+		for _, sector := range sectors {
+			if err := re.Emit(sector); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	Type: &minerActor.Sector{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, sector *minerActor.Sector) error {
+			expiration := "never"
+			if sector.Expiration != nil {
+				expiration = sector.Expiration.String()
+			}
+			commR := base64.StdEncoding.EncodeToString(sector.Commitments.CommR[:])
+			_, err := fmt.Fprintf(w, "%d\t%s\t%s\n", sector.ID, commR, expiration)
+			return err
+		}),
+	},
+}
+
+var minerListCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "List the miners registered with the storage market",
+		ShortDescription: `Lists every miner registered with the storage market, one per line, showing
+the miner address, its peer ID, its power in sectors and its declared sector
+size.`,
+	},
+	Run: func(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment) error {
+		miners, err := GetPorcelainAPI(env).MinerList(req.Context)
+		if err != nil {
+			return err
+		}
+
+		for _, info := range miners {
+			if err := re.Emit(info); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	Type: &storagemarket.MinerInfo{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, info *storagemarket.MinerInfo) error {
+			pid := "-"
+			if info.PeerID != "" {
+				pid = info.PeerID.Pretty()
+			}
+			sectorSize := "-"
+			if info.SectorSize != nil {
+				sectorSize = info.SectorSize.String()
+			}
+			_, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", info.Address, pid, info.Power, sectorSize)
+			return err
+		}),
+	},
+}
+
+var minerPaymentsCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "List the payment vouchers held by this node's storage miner",
+		ShortDescription: `Lists the payment vouchers the storage miner holds from its deals, one line
+per lane of each payment channel, showing the payer, the channel id, the lane,
+the channel eol, and the amounts redeemed, redeemable now, outstanding and
+pending redemption. Vouchers are redeemed automatically while mining.`,
+	},
+	Run: func(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment) error {
+		payments, err := GetAPI(env).Miner().Payments(req.Context)
+		if err != nil {
+			return err
+		}
+
+		for _, p := range payments {
+			if err := re.Emit(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	Type: &storage.ChannelPayments{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, p *storage.ChannelPayments) error {
+			eol := "-"
+			if p.Eol != nil {
+				eol = p.Eol.String()
+			}
+			_, err := fmt.Fprintf(w, "%s\t%s\t%d\t%s\tredeemed=%s\tredeemable=%s\toutstanding=%s\tpending=%s\n", p.Payer, p.Channel, p.Lane, eol, p.Redeemed, p.Redeemable, p.Outstanding, p.Pending)
+			return err
+		}),
+	},
+}
+
+var minerDealHistoryCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Show the state transitions of a deal made with this node's storage miner",
+		ShortDescription: `Lists the states the storage deal specified by the id moved through while the
+storage miner processed it, with the time of and reason for each transition.`,
+	},
+	Arguments: []cmdkit.Argument{
+		cmdkit.StringArg("id", true, false, "CID of deal to show the history of"),
+	},
+	Run: func(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment) error {
+		propcid, err := cid.Decode(req.Arguments[0])
+		if err != nil {
+			return err
+		}
+
+		history, err := GetAPI(env).Miner().DealHistory(req.Context, propcid)
+		if err != nil {
+			return err
+		}
+
+		return re.Emit(history)
+	},
+	Type:     []*storage.DealEvent{},
+	Encoders: dealHistoryEncoders,
+}
+
+var minerDealsCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Manage the storage deals made with this node's storage miner",
+	},
+	Subcommands: map[string]*cmds.Command{
+		"import": minerDealsImportCmd,
+	},
+}
+
+var minerDealsImportCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Import the data of a deal that was transferred offline",
+		ShortDescription: `Imports the data of a storage deal the client proposed with --manual-transfer
+and delivered out of band. The data must match the piece of the deal. Once
+imported, the storage miner stages the piece into a sector as it does for data
+fetched from the client.`,
+	},
+	Arguments: []cmdkit.Argument{
+		cmdkit.StringArg("proposal-cid", true, false, "CID of the deal to import the data of"),
+		cmdkit.FileArg("file", true, false, "Path to the data of the deal").EnableStdin(),
+	},
+	Run: func(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment) error {
+		propcid, err := cid.Decode(req.Arguments[0])
+		if err != nil {
+			return err
+		}
+
+		iter := req.Files.Entries()
+		if !iter.Next() {
+			return fmt.Errorf("no file given: %s", iter.Err())
+		}
+
+		fi, ok := iter.Node().(files.File)
+		if !ok {
+			return fmt.Errorf("given file was not a files.File")
+		}
+
+		if err := GetAPI(env).Miner().ImportDealData(req.Context, propcid, fi); err != nil {
+			return err
+		}
+
+		return re.Emit(propcid)
+	},
+	Type: cid.Cid{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, c cid.Cid) error {
+			return PrintString(w, c)
+		}),
+	},
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/filecoin-project/go-filecoin/types"
 	"io/ioutil"
 	"math/big"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -35,13 +36,19 @@ func TestMinerHelp(t *testing.T) {
 		t.Parallel()
 
 		expected := []string{
-			"miner add-ask <miner> <price> <expiry>  - DEPRECATED: Use set-price",
-			"miner create <pledge> <collateral>      - Create a new file miner with <pledge> sectors and <collateral> FIL",
-			"miner owner <miner>                     - Show the actor address of <miner>",
-			"miner pledge <miner>                    - View number of pledged sectors for <miner>",
-			"miner power <miner>                     - Get the power of a miner versus the total storage market power",
-			"miner set-price <storageprice> <expiry> - Set the minimum price for storage",
-			"miner update-peerid <address> <peerid>  - Change the libp2p identity that a miner is operating",
+			"miner add-ask <miner> <price> <expiry>            - DEPRECATED: Use set-price",
+			"miner create <pledge> <collateral>                - Create a new file miner with <pledge> sectors and <collateral> FIL",
+			"miner deal-history <id>                           - Show the state transitions of a deal made with this node's storage miner",
+			"miner deals                                       - Manage the storage deals made with this node's storage miner",
+			"miner list                                        - List the miners registered with the storage market",
+			"miner owner <miner>                               - Show the actor address of <miner>",
+			"miner payments                                    - List the payment vouchers held by this node's storage miner",
+			"miner pledge <miner>                              - View number of pledged sectors for <miner>",
+			"miner power <miner>                               - Get the power of a miner versus the total storage market power",
+			"miner sectors                                     - Inspect the sectors committed by a miner",
+			"miner set-price <storageprice> <expiry>           - Set the minimum price for storage",
+			"miner update-multiaddrs <miner> [<multiaddrs>]... - Change the multiaddrs that a miner advertises on chain",
+			"miner update-peerid <address> <peerid>            - Change the libp2p identity that a miner is operating",
 		}
 
 		result := runHelpSuccess(t, "miner", "--help")
@@ -166,6 +173,47 @@ func TestMinerPledge(t *testing.T) {
 	})
 }
 
+func TestMinerPledgeAddAndWithdraw(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	d1 := th.NewDaemon(t, th.WithMiner(fixtures.TestMiners[0]), th.KeyFile(fixtures.KeyFilePaths()[2])).Start()
+	defer d1.ShutdownSuccess()
+	d := th.NewDaemon(t, th.KeyFile(fixtures.KeyFilePaths()[2])).Start()
+	defer d.ShutdownSuccess()
+	d1.ConnectSuccess(d)
+
+	var minerAddr address.Address
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		miner := d.RunSuccess("miner", "create", "--from", fixtures.TestAddresses[2], "--price", "0", "--limit", "300", "100", "200")
+		addr, err := address.NewFromString(strings.Trim(miner.ReadStdout(), "\n"))
+		assert.NoError(err)
+		minerAddr = addr
+		wg.Done()
+	}()
+	d1.MineAndPropagate(time.Second, d)
+	wg.Wait()
+
+	d.RunSuccess("miner", "pledge", "add", minerAddr.String(), "1",
+		"--sectors", "100",
+		"--from", fixtures.TestAddresses[2],
+		"--price", "0",
+		"--limit", "300",
+	)
+	d1.MineAndPropagate(time.Second, d)
+	assert.Contains(d.RunSuccess("miner", "pledge", minerAddr.String()).ReadStdoutTrimNewlines(), "200")
+
+	d.RunSuccess("miner", "pledge", "withdraw", minerAddr.String(), "100",
+		"--from", fixtures.TestAddresses[2],
+		"--price", "0",
+		"--limit", "300",
+	)
+	d1.MineAndPropagate(time.Second, d)
+	assert.Equal("101", d.RunSuccess("wallet", "balance", minerAddr.String()).ReadStdoutTrimNewlines())
+}
+
 func TestMinerCreate(t *testing.T) {
 	t.Parallel()
 	assert := assert.New(t)
@@ -507,6 +555,75 @@ func TestMinerPower(t *testing.T) {
 	assert.Equal("3 / 6", power)
 }
 
+func TestMinerSectorsLs(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	fi, err := ioutil.TempFile("", "gengentest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = gengen.GenGenesisCar(testConfig, fi, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = fi.Close()
+
+	d := th.NewDaemon(t, th.GenesisFile(fi.Name())).Start()
+	defer d.ShutdownSuccess()
+
+	actorLsOutput := d.RunSuccess("actor", "ls")
+
+	scanner := bufio.NewScanner(strings.NewReader(actorLsOutput.ReadStdout()))
+	var addressStruct struct{ Address string }
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.Contains(line, "MinerActor") {
+			json.Unmarshal([]byte(line), &addressStruct)
+			break
+		}
+	}
+
+	lines := strings.Split(d.RunSuccess("miner", "sectors", "ls", addressStruct.Address).ReadStdoutTrimNewlines(), "\n")
+
+	// genesis miners are created with non-expiring sectors
+	assert.Len(lines, 3)
+	for _, line := range lines {
+		assert.True(strings.HasSuffix(line, "\tnever"), line)
+	}
+}
+
+func TestMinerList(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	require := require.New(t)
+
+	fi, err := ioutil.TempFile("", "gengentest")
+	require.NoError(err)
+
+	info, err := gengen.GenGenesisCar(testConfig, fi, 0)
+	require.NoError(err)
+
+	_ = fi.Close()
+
+	d := th.NewDaemon(t, th.GenesisFile(fi.Name())).Start()
+	defer d.ShutdownSuccess()
+
+	lines := strings.Split(d.RunSuccess("miner", "list").ReadStdoutTrimNewlines(), "\n")
+
+	// genesis miners are listed in the order they were created
+	require.Len(lines, len(info.Miners))
+	for i, line := range lines {
+		fields := strings.Split(line, "\t")
+		require.Len(fields, 4, line)
+		assert.Equal(info.Miners[i].Address.String(), fields[0])
+		assert.Equal(strconv.FormatUint(info.Miners[i].Power, 10), fields[2])
+		assert.Equal("-", fields[3])
+	}
+}
+
 var testConfig = &gengen.GenesisCfg{
 	Keys: 4,
 	PreAlloc: []string{
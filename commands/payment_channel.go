@@ -3,10 +3,13 @@ package commands
 import (
 	"fmt"
 	"io"
+	"math/big"
 	"strconv"
+	"strings"
 
 	"gx/ipfs/QmQtQrtNioesAWtrx8csBvfY37gTe94d6wQ3VikZUjxD39/go-ipfs-cmds"
 	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	"gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
 	cbor "gx/ipfs/QmcZLyosDwMKdB6NLRsiss9HXzDPhVhhRtPy67JFKTDQDX/go-ipld-cbor"
 	"gx/ipfs/Qmde5VP1qUkyQXKCfmEUA7bP64V2HAptbJ7phuPp7jXWwg/go-ipfs-cmdkit"
 	"gx/ipfs/QmekxXDhCxCJRNuzmHreuaT3BsuJcsjcXWNrtV9C8DRHtd/go-multibase"
@@ -21,13 +24,14 @@ var paymentChannelCmd = &cmds.Command{
 		Tagline: "Payment channel operations",
 	},
 	Subcommands: map[string]*cmds.Command{
-		"close":   closeCmd,
-		"create":  createChannelCmd,
-		"extend":  extendCmd,
-		"ls":      lsCmd,
-		"reclaim": reclaimCmd,
-		"redeem":  redeemCmd,
-		"voucher": voucherCmd,
+		"add-funds": addFundsCmd,
+		"close":     closeCmd,
+		"create":    createChannelCmd,
+		"extend":    extendCmd,
+		"ls":        lsCmd,
+		"reclaim":   reclaimCmd,
+		"redeem":    redeemCmd,
+		"voucher":   voucherCmd,
 	},
 }
 
@@ -181,8 +185,12 @@ var lsCmd = &cmds.Command{
 
 var voucherCmd = &cmds.Command{
 	Helptext: cmdkit.HelpText{
-		Tagline:          "Create a new voucher from a payment channel",
-		ShortDescription: `Generate a new signed payment voucher for the target of a payment channel.`,
+		Tagline: "Create a new voucher from a payment channel",
+		ShortDescription: `Generate a new signed payment voucher for the target of a payment channel.
+The amount of a voucher is the total paid on its lane, plus what was redeemed on
+the lanes it merges. Vouchers on a lane must be issued with increasing nonces.
+With --miner and --piece, the voucher may only be redeemed while the miner
+proves it stores the piece under a storage market deal.`,
 	},
 	Arguments: []cmdkit.Argument{
 		cmdkit.StringArg("channel", true, false, "Channel id of channel from which to create voucher"),
@@ -191,6 +199,11 @@ var voucherCmd = &cmds.Command{
 	Options: []cmdkit.Option{
 		cmdkit.StringOption("from", "Address for which to retrieve channels"),
 		cmdkit.StringOption("validat", "Smallest block height at which target can redeem"),
+		cmdkit.Uint64Option("lane", "Lane of the channel the voucher pays on").WithDefault(uint64(0)),
+		cmdkit.Uint64Option("nonce", "Nonce of the voucher on its lane").WithDefault(uint64(0)),
+		cmdkit.StringOption("merges", "Lanes merged into the voucher's lane, as comma separated lane:nonce pairs"),
+		cmdkit.StringOption("miner", "Address of the miner that must store the piece for the voucher to be redeemed"),
+		cmdkit.StringOption("piece", "Cid of the piece the miner must store for the voucher to be redeemed"),
 	},
 	Run: func(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment) error {
 		fromAddr, err := optionalAddr(req.Options["from"])
@@ -213,7 +226,19 @@ var voucherCmd = &cmds.Command{
 			return ErrInvalidAmount
 		}
 
-		voucher, err := GetAPI(env).Paych().Voucher(req.Context, fromAddr, channel, amount, validAt)
+		lane, _ := req.Options["lane"].(uint64)
+		nonce, _ := req.Options["nonce"].(uint64)
+		merges, err := parseMerges(req.Options["merges"])
+		if err != nil {
+			return err
+		}
+
+		condition, err := parsePieceCondition(req.Options["miner"], req.Options["piece"], validAt)
+		if err != nil {
+			return err
+		}
+
+		voucher, err := GetAPI(env).Paych().Voucher(req.Context, fromAddr, channel, amount, validAt, lane, nonce, merges, condition)
 		if err != nil {
 			return err
 		}
@@ -228,6 +253,64 @@ var voucherCmd = &cmds.Command{
 	},
 }
 
+// parseMerges parses merges given as comma separated lane:nonce pairs.
+func parseMerges(opt interface{}) ([]paymentbroker.Merge, error) {
+	str, _ := opt.(string)
+	if str == "" {
+		return nil, nil
+	}
+
+	var merges []paymentbroker.Merge
+	for _, pair := range strings.Split(str, ",") {
+		parts := strings.Split(pair, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid merge %q, expected lane:nonce", pair)
+		}
+		lane, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lane in merge %q", pair)
+		}
+		nonce, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid nonce in merge %q", pair)
+		}
+		merges = append(merges, paymentbroker.Merge{Lane: lane, Nonce: nonce})
+	}
+	return merges, nil
+}
+
+// parsePieceCondition parses the condition that the miner stores the piece at
+// the voucher's valid at height. It returns nil if neither is given.
+func parsePieceCondition(minerOpt, pieceOpt interface{}, validAt *types.BlockHeight) (*paymentbroker.Condition, error) {
+	if minerOpt == nil && pieceOpt == nil {
+		return nil, nil
+	}
+	if minerOpt == nil || pieceOpt == nil {
+		return nil, fmt.Errorf("conditioning a voucher on a piece requires both --miner and --piece")
+	}
+
+	miner, err := address.NewFromString(minerOpt.(string))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid miner address")
+	}
+	piece, err := cid.Decode(pieceOpt.(string))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid piece cid")
+	}
+
+	return paymentbroker.NewPieceInclusionCondition(miner, piece, validAt)
+}
+
+// dealConditionParams returns the params a redeemer supplies to the condition
+// of a voucher: the id of the storage market deal given with --deal, if any.
+func dealConditionParams(req *cmds.Request) []interface{} {
+	dealID, ok := req.Options["deal"].(uint64)
+	if !ok {
+		return nil
+	}
+	return []interface{}{new(big.Int).SetUint64(dealID)}
+}
+
 type redeemResult struct {
 	Cid     cid.Cid
 	GasUsed types.GasUnits
@@ -237,12 +320,18 @@ type redeemResult struct {
 var redeemCmd = &cmds.Command{
 	Helptext: cmdkit.HelpText{
 		Tagline: "Redeem a payment voucher against a payment channel",
+		ShortDescription: `Redeems a payment voucher. With --batch, every voucher given is redeemed by a
+single message, and vouchers that cannot be redeemed are skipped. Vouchers
+conditioned on a piece are redeemed by giving the id of the storage market deal
+for the piece with --deal.`,
 	},
 	Arguments: []cmdkit.Argument{
-		cmdkit.StringArg("voucher", true, false, "Base58 encoded signed voucher"),
+		cmdkit.StringArg("voucher", true, true, "Base58 encoded signed voucher"),
 	},
 	Options: []cmdkit.Option{
 		cmdkit.StringOption("from", "Address of the channel target"),
+		cmdkit.BoolOption("batch", "Redeem several vouchers in a single message"),
+		cmdkit.Uint64Option("deal", "Id of the storage market deal satisfying the voucher's condition"),
 		priceOption,
 		limitOption,
 		previewOption,
@@ -258,6 +347,19 @@ var redeemCmd = &cmds.Command{
 			return err
 		}
 
+		conditionParams := dealConditionParams(req)
+
+		batch, _ := req.Options["batch"].(bool)
+		if batch && conditionParams != nil {
+			return fmt.Errorf("--deal cannot be used with --batch")
+		}
+		if batch {
+			return redeemBatch(req, re, env, fromAddr, gasPrice, gasLimit, preview)
+		}
+		if len(req.Arguments) > 1 {
+			return fmt.Errorf("redeeming several vouchers requires --batch")
+		}
+
 		if preview {
 			_, cborVoucher, err := multibase.Decode(req.Arguments[0])
 			if err != nil {
@@ -269,13 +371,17 @@ var redeemCmd = &cmds.Command{
 			if err != nil {
 				return err
 			}
+			params, err := voucher.RedeemParams(conditionParams...)
+			if err != nil {
+				return err
+			}
 
 			usedGas, err := GetPorcelainAPI(env).MessagePreview(
 				req.Context,
 				fromAddr,
 				address.PaymentBrokerAddress,
 				"redeem",
-				voucher.Payer, &voucher.Channel, &voucher.Amount, &voucher.ValidAt, []byte(voucher.Signature),
+				params...,
 			)
 			if err != nil {
 				return err
@@ -287,7 +393,7 @@ var redeemCmd = &cmds.Command{
 			})
 		}
 
-		c, err := GetAPI(env).Paych().Redeem(req.Context, fromAddr, gasPrice, gasLimit, req.Arguments[0])
+		c, err := GetAPI(env).Paych().Redeem(req.Context, fromAddr, gasPrice, gasLimit, req.Arguments[0], conditionParams...)
 		if err != nil {
 			return err
 		}
@@ -311,6 +417,44 @@ var redeemCmd = &cmds.Command{
 	},
 }
 
+// redeemBatch redeems the vouchers given to the redeem command with a single
+// redeemMany message.
+func redeemBatch(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment, fromAddr address.Address, gasPrice types.AttoFIL, gasLimit types.GasUnits, preview bool) error {
+	if preview {
+		redemptions, err := paymentbroker.EncodeVoucherRedemptions(req.Arguments)
+		if err != nil {
+			return err
+		}
+
+		usedGas, err := GetPorcelainAPI(env).MessagePreview(
+			req.Context,
+			fromAddr,
+			address.PaymentBrokerAddress,
+			"redeemMany",
+			redemptions,
+		)
+		if err != nil {
+			return err
+		}
+		return re.Emit(&redeemResult{
+			Cid:     cid.Cid{},
+			GasUsed: usedGas,
+			Preview: true,
+		})
+	}
+
+	c, err := GetAPI(env).Paych().RedeemMany(req.Context, fromAddr, gasPrice, gasLimit, req.Arguments)
+	if err != nil {
+		return err
+	}
+
+	return re.Emit(&redeemResult{
+		Cid:     c,
+		GasUsed: types.NewGasUnits(0),
+		Preview: false,
+	})
+}
+
 type reclaimResult struct {
 	Cid     cid.Cid
 	GasUsed types.GasUnits
@@ -412,6 +556,7 @@ var closeCmd = &cmds.Command{
 	},
 	Options: []cmdkit.Option{
 		cmdkit.StringOption("from", "Address of the channel target"),
+		cmdkit.Uint64Option("deal", "Id of the storage market deal satisfying the voucher's condition"),
 		priceOption,
 		limitOption,
 		previewOption,
@@ -427,6 +572,8 @@ var closeCmd = &cmds.Command{
 			return err
 		}
 
+		conditionParams := dealConditionParams(req)
+
 		if preview {
 			_, cborVoucher, err := multibase.Decode(req.Arguments[0])
 			if err != nil {
@@ -438,13 +585,17 @@ var closeCmd = &cmds.Command{
 			if err != nil {
 				return err
 			}
+			params, err := voucher.RedeemParams(conditionParams...)
+			if err != nil {
+				return err
+			}
 
 			usedGas, err := GetPorcelainAPI(env).MessagePreview(
 				req.Context,
 				fromAddr,
 				address.PaymentBrokerAddress,
 				"close",
-				voucher.Payer, &voucher.Channel, &voucher.Amount, &voucher.ValidAt, []byte(voucher.Signature),
+				params...,
 			)
 			if err != nil {
 				return err
@@ -456,7 +607,7 @@ var closeCmd = &cmds.Command{
 			})
 		}
 
-		c, err := GetAPI(env).Paych().Close(req.Context, fromAddr, gasPrice, gasLimit, req.Arguments[0])
+		c, err := GetAPI(env).Paych().Close(req.Context, fromAddr, gasPrice, gasLimit, req.Arguments[0], conditionParams...)
 		if err != nil {
 			return err
 		}
@@ -577,3 +728,95 @@ var extendCmd = &cmds.Command{
 		}),
 	},
 }
+
+type addFundsResult struct {
+	Cid     cid.Cid
+	GasUsed types.GasUnits
+	Preview bool
+}
+
+var addFundsCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Add funds to a given channel without changing its lifetime",
+	},
+	Arguments: []cmdkit.Argument{
+		cmdkit.StringArg("channel", true, false, "Id of channel to add funds to"),
+		cmdkit.StringArg("amount", true, false, "Amount in FIL to add to the channel"),
+	},
+	Options: []cmdkit.Option{
+		cmdkit.StringOption("from", "Address of the channel creator"),
+		priceOption,
+		limitOption,
+		previewOption,
+	},
+	Run: func(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment) error {
+		fromAddr, err := optionalAddr(req.Options["from"])
+		if err != nil {
+			return err
+		}
+
+		channel, ok := types.NewChannelIDFromString(req.Arguments[0], 10)
+		if !ok {
+			return fmt.Errorf("invalid channel id")
+		}
+
+		amount, ok := types.NewAttoFILFromFILString(req.Arguments[1])
+		if !ok {
+			return ErrInvalidAmount
+		}
+
+		gasPrice, gasLimit, preview, err := parseGasOptions(req)
+		if err != nil {
+			return err
+		}
+
+		if preview {
+			usedGas, err := GetPorcelainAPI(env).MessagePreview(
+				req.Context,
+				fromAddr,
+				address.PaymentBrokerAddress,
+				"addFunds",
+				channel,
+			)
+			if err != nil {
+				return err
+			}
+			return re.Emit(&addFundsResult{
+				Cid:     cid.Cid{},
+				GasUsed: usedGas,
+				Preview: true,
+			})
+		}
+
+		c, err := GetPorcelainAPI(env).MessageSendWithDefaultAddress(
+			req.Context,
+			fromAddr,
+			address.PaymentBrokerAddress,
+			amount,
+			gasPrice,
+			gasLimit,
+			"addFunds",
+			channel,
+		)
+		if err != nil {
+			return err
+		}
+
+		return re.Emit(&addFundsResult{
+			Cid:     c,
+			GasUsed: types.NewGasUnits(0),
+			Preview: false,
+		})
+	},
+	Type: &addFundsResult{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, res *addFundsResult) error {
+			if res.Preview {
+				output := strconv.FormatUint(uint64(res.GasUsed), 10)
+				_, err := w.Write([]byte(output))
+				return err
+			}
+			return PrintString(w, res.Cid)
+		}),
+	},
+}
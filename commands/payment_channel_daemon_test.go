@@ -145,6 +145,72 @@ func TestPaymentChannelVoucherSuccess(t *testing.T) {
 	})
 }
 
+func TestPaymentChannelVoucherOnLane(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	payer, err := address.NewFromString(fixtures.TestAddresses[2])
+	require.NoError(err)
+	target, err := address.NewFromString(fixtures.TestAddresses[1])
+	require.NoError(err)
+
+	eol := types.NewBlockHeight(20)
+	amt := types.NewAttoFILFromFIL(10000)
+
+	daemonTestWithPaymentChannel(t, &payer, &target, amt, eol, func(d *th.TestDaemon, channelID *types.ChannelID) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		voucherString := th.RunSuccessFirstLine(d, "paych", "voucher", channelID.String(), "100",
+			"--from", payer.String(), "--lane", "1", "--nonce", "2", "--merges", "0:1,3:4")
+
+		voucher, err := paymentbroker.DecodeVoucher(voucherString)
+		require.NoError(err)
+
+		assert.Equal(uint64(1), voucher.Lane)
+		assert.Equal(uint64(2), voucher.Nonce)
+		assert.Equal([]paymentbroker.Merge{{Lane: 0, Nonce: 1}, {Lane: 3, Nonce: 4}}, voucher.Merges)
+		assert.True(paymentbroker.VerifyVoucherSignature(voucher))
+
+		d.RunFail("invalid merge", "paych", "voucher", channelID.String(), "100", "--from", payer.String(), "--merges", "0")
+	})
+}
+
+func TestPaymentChannelVoucherConditionedOnPiece(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	payer, err := address.NewFromString(fixtures.TestAddresses[2])
+	require.NoError(err)
+	target, err := address.NewFromString(fixtures.TestAddresses[1])
+	require.NoError(err)
+	miner, err := address.NewFromString(fixtures.TestMiners[0])
+	require.NoError(err)
+
+	eol := types.NewBlockHeight(20)
+	amt := types.NewAttoFILFromFIL(10000)
+	piece := types.SomeCid()
+
+	daemonTestWithPaymentChannel(t, &payer, &target, amt, eol, func(d *th.TestDaemon, channelID *types.ChannelID) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		voucherString := th.RunSuccessFirstLine(d, "paych", "voucher", channelID.String(), "100",
+			"--from", payer.String(), "--validat", "5", "--miner", miner.String(), "--piece", piece.String())
+
+		voucher, err := paymentbroker.DecodeVoucher(voucherString)
+		require.NoError(err)
+
+		expected, err := paymentbroker.NewPieceInclusionCondition(miner, piece, types.NewBlockHeight(5))
+		require.NoError(err)
+		assert.Equal(expected, voucher.Condition)
+
+		d.RunFail("requires both --miner and --piece", "paych", "voucher", channelID.String(), "100",
+			"--from", payer.String(), "--miner", miner.String())
+		d.RunFail("cannot be used with --batch", "paych", "redeem", voucherString, "--batch", "--deal", "1")
+	})
+}
+
 func TestPaymentChannelRedeemSuccess(t *testing.T) {
 	t.Parallel()
 	require := require.New(t)
@@ -178,6 +244,43 @@ func TestPaymentChannelRedeemSuccess(t *testing.T) {
 	})
 }
 
+func TestPaymentChannelRedeemBatchSuccess(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	payer, err := address.NewFromString(fixtures.TestAddresses[2])
+	require.NoError(err)
+	target, err := address.NewFromString(fixtures.TestAddresses[1])
+	require.NoError(err)
+
+	eol := types.NewBlockHeight(20)
+	amt := types.NewAttoFILFromFIL(10000)
+
+	targetDaemon := th.NewDaemon(
+		t,
+		th.WithMiner(fixtures.TestMiners[0]),
+		th.KeyFile(fixtures.KeyFilePaths()[1]),
+	).Start()
+	defer targetDaemon.ShutdownSuccess()
+
+	daemonTestWithPaymentChannel(t, &payer, &target, amt, eol, func(d *th.TestDaemon, channelID *types.ChannelID) {
+		assert := assert.New(t)
+
+		d.ConnectSuccess(targetDaemon)
+
+		first := createVoucherStr(t, d, channelID, types.NewAttoFILFromFIL(111), &payer, uint64(0))
+		second := th.RunSuccessFirstLine(d, "paych", "voucher", channelID.String(), "222",
+			"--from", payer.String(), "--validat", "0", "--lane", "1")
+
+		targetDaemon.RunFail("requires --batch", "paych", "redeem", first, second, "--from", target.String())
+
+		mustRedeemVouchers(t, targetDaemon, []string{first, second}, &target)
+
+		ls := listChannelsAsStrs(targetDaemon, &payer)[0]
+		assert.Equal(fmt.Sprintf("%v: target: %s, amt: 10000, amt redeemed: 333, eol: 20", channelID.String(), target.String()), ls)
+	})
+}
+
 func TestPaymentChannelRedeemTooEarlyFails(t *testing.T) {
 	t.Parallel()
 	require := require.New(t)
@@ -336,6 +439,31 @@ func TestPaymentChannelExtendSuccess(t *testing.T) {
 	})
 }
 
+func TestPaymentChannelAddFundsSuccess(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	payer, err := address.NewFromString(fixtures.TestAddresses[2])
+	require.NoError(err)
+	target, err := address.NewFromString(fixtures.TestAddresses[1])
+	require.NoError(err)
+
+	eol := types.NewBlockHeight(5)
+	amt := types.NewAttoFILFromFIL(2000)
+
+	daemonTestWithPaymentChannel(t, &payer, &target, amt, eol, func(d *th.TestDaemon, channelID *types.ChannelID) {
+		assert := assert.New(t)
+
+		args := []string{"paych", "add-funds"}
+		args = append(args, "--from", payer.String(), "--price", "0", "--limit", "300")
+		args = append(args, channelID.String(), "500")
+		mustRunMessage(t, d, args...)
+
+		lsStr := listChannelsAsStrs(d, &payer)[0]
+		assert.Equal(fmt.Sprintf("%v: target: %s, amt: 2500, amt redeemed: 0, eol: %s", channelID.String(), target.String(), eol.String()), lsStr)
+	})
+}
+
 func daemonTestWithPaymentChannel(t *testing.T, payerAddress *address.Address, targetAddress *address.Address, fundsToLock *types.AttoFIL, eol *types.BlockHeight, f func(*th.TestDaemon, *types.ChannelID)) {
 	assert := assert.New(t)
 
@@ -465,6 +593,41 @@ func mustRedeemVoucher(t *testing.T, d *th.TestDaemon, voucher string, targetAdd
 	wg.Wait()
 }
 
+func mustRedeemVouchers(t *testing.T, d *th.TestDaemon, vouchers []string, targetAddress *address.Address) {
+	args := append([]string{"paych", "redeem", "--batch"}, vouchers...)
+	args = append(args, "--from", targetAddress.String(), "--price", "0", "--limit", "600")
+
+	mustRunMessage(t, d, args...)
+}
+
+// mustRunMessage runs a command that sends a message, and mines a block
+// including it.
+func mustRunMessage(t *testing.T, d *th.TestDaemon, args ...string) {
+	require := require.New(t)
+
+	cmd := d.RunSuccess(args...)
+	messageCid, err := cid.Parse(strings.Trim(cmd.ReadStdout(), "\n"))
+	require.NoError(err)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		_ = d.RunSuccess("message", "wait",
+			"--return=false",
+			"--message=false",
+			"--receipt=false",
+			messageCid.String(),
+		)
+
+		wg.Done()
+	}()
+
+	d.RunSuccess("mining once")
+
+	wg.Wait()
+}
+
 func mustCloseChannel(t *testing.T, d *th.TestDaemon, voucher paymentbroker.PaymentVoucher, targetAddress *address.Address) {
 	require := require.New(t)
 
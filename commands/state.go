@@ -0,0 +1,114 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+
+	"gx/ipfs/QmQtQrtNioesAWtrx8csBvfY37gTe94d6wQ3VikZUjxD39/go-ipfs-cmds"
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	"gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
+	"gx/ipfs/Qmde5VP1qUkyQXKCfmEUA7bP64V2HAptbJ7phuPp7jXWwg/go-ipfs-cmdkit"
+
+	"github.com/filecoin-project/go-filecoin/state"
+)
+
+var stateCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Inspect the filecoin state tree",
+	},
+	Subcommands: map[string]*cmds.Command{
+		"diff": stateDiffCmd,
+	},
+}
+
+var stateDiffCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Show the differences between two state trees",
+		ShortDescription: `Compares the state trees rooted at <rootA> and <rootB> and reports the actors
+that were added, removed or changed between them. For changed actors the balance
+and nonce deltas and whether the code or head changed are shown. With --storage
+the storage of actors whose head changed is decoded and compared recursively.`,
+	},
+	Arguments: []cmdkit.Argument{
+		cmdkit.StringArg("rootA", true, false, "CID of the first state root"),
+		cmdkit.StringArg("rootB", true, false, "CID of the second state root"),
+	},
+	Options: []cmdkit.Option{
+		cmdkit.BoolOption("storage", "Recursively diff the decoded storage of changed actors"),
+	},
+	Run: func(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment) error {
+		rootA, err := cid.Decode(req.Arguments[0])
+		if err != nil {
+			return errors.Wrap(err, "invalid state root")
+		}
+		rootB, err := cid.Decode(req.Arguments[1])
+		if err != nil {
+			return errors.Wrap(err, "invalid state root")
+		}
+
+		withStorage, _ := req.Options["storage"].(bool)
+
+		diff, err := GetPorcelainAPI(env).StateDiff(req.Context, rootA, rootB, withStorage)
+		if err != nil {
+			return err
+		}
+
+		return re.Emit(diff)
+	},
+	Type: state.TreeDiff{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, diff *state.TreeDiff) error {
+			if diff.Empty() {
+				_, err := fmt.Fprintln(w, "state trees are identical")
+				return err
+			}
+			return writeTreeDiff(w, diff, "")
+		}),
+	},
+}
+
+// writeTreeDiff writes a line per added (+), removed (-) and changed (~)
+// actor, prefixing every line with indent.
+func writeTreeDiff(w io.Writer, diff *state.TreeDiff, indent string) error {
+	for _, ad := range diff.Added {
+		if _, err := fmt.Fprintf(w, "%s+ %s\t%s\n", indent, ad.Address, ad.After); err != nil {
+			return err
+		}
+	}
+	for _, ad := range diff.Removed {
+		if _, err := fmt.Fprintf(w, "%s- %s\t%s\n", indent, ad.Address, ad.Before); err != nil {
+			return err
+		}
+	}
+	for _, ad := range diff.Changed {
+		if _, err := fmt.Fprintf(w, "%s~ %s\n", indent, ad.Address); err != nil {
+			return err
+		}
+		if ad.BalanceDelta != nil {
+			if _, err := fmt.Fprintf(w, "%s    balance: %s -> %s (%s)\n", indent, ad.Before.Balance, ad.After.Balance, ad.BalanceDelta); err != nil {
+				return err
+			}
+		}
+		if ad.NonceDelta != 0 {
+			if _, err := fmt.Fprintf(w, "%s    nonce: %d -> %d (%+d)\n", indent, ad.Before.Nonce, ad.After.Nonce, ad.NonceDelta); err != nil {
+				return err
+			}
+		}
+		if ad.CodeChanged {
+			if _, err := fmt.Fprintf(w, "%s    code: %s -> %s\n", indent, ad.Before.Code, ad.After.Code); err != nil {
+				return err
+			}
+		}
+		if ad.HeadChanged {
+			if _, err := fmt.Fprintf(w, "%s    head: %s -> %s\n", indent, ad.Before.Head, ad.After.Head); err != nil {
+				return err
+			}
+		}
+		for _, sc := range ad.Storage {
+			if _, err := fmt.Fprintf(w, "%s    %s: %v -> %v\n", indent, sc.Path, sc.Before, sc.After); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package commands
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/filecoin-project/go-filecoin/fixtures"
+	"github.com/filecoin-project/go-filecoin/state"
+	th "github.com/filecoin-project/go-filecoin/testhelpers"
+	"github.com/filecoin-project/go-filecoin/types"
+
+	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/assert"
+	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/require"
+)
+
+func TestStateDiffDaemon(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	require := require.New(t)
+
+	d := th.NewDaemon(t, th.WithMiner(fixtures.TestMiners[0])).Start()
+	defer d.ShutdownSuccess()
+
+	genesisRoot := d.GetChainHead()[0].StateRoot.String()
+
+	minedBlockCidStr := th.RunSuccessFirstLine(d, "mining", "once")
+	blockJSON := th.RunSuccessFirstLine(d, "show", "block", minedBlockCidStr, "--enc", "json")
+	var minedBlock types.Block
+	require.NoError(json.Unmarshal([]byte(blockJSON), &minedBlock))
+	minedRoot := minedBlock.StateRoot.String()
+
+	out := d.RunSuccess("state", "diff", genesisRoot, genesisRoot).ReadStdoutTrimNewlines()
+	assert.Contains(out, "state trees are identical")
+
+	// mining a block pays the block reward, changing at least one balance
+	diffJSON := d.RunSuccess("state", "diff", genesisRoot, minedRoot, "--enc", "json").ReadStdoutTrimNewlines()
+	var diff state.TreeDiff
+	require.NoError(json.Unmarshal([]byte(diffJSON), &diff))
+	assert.False(diff.Empty())
+
+	d.RunFail("invalid state root", "state", "diff", "notacid", minedRoot)
+}
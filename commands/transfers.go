@@ -0,0 +1,60 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+
+	"gx/ipfs/QmQtQrtNioesAWtrx8csBvfY37gTe94d6wQ3VikZUjxD39/go-ipfs-cmds"
+	"gx/ipfs/Qmde5VP1qUkyQXKCfmEUA7bP64V2HAptbJ7phuPp7jXWwg/go-ipfs-cmdkit"
+
+	"github.com/filecoin-project/go-filecoin/protocol/transfer"
+)
+
+var transfersCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "Inspect the transfers of deal data",
+	},
+	Subcommands: map[string]*cmds.Command{
+		"ls": transfersLsCmd,
+	},
+}
+
+var transfersLsCmd = &cmds.Command{
+	Helptext: cmdkit.HelpText{
+		Tagline: "List the transfers of deal data since the node started",
+		ShortDescription: `Lists the transfers of deal data between this node and other nodes, one per
+line, showing the deal, whether the node sends or receives the data, the other
+node, the state of the transfer and the blocks and bytes transferred so far.
+The bytes per second transferred are limited by the dataTransfer.maxSendRate
+and dataTransfer.maxReceiveRate config values.`,
+	},
+	Run: func(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment) error {
+		transfers, err := GetAPI(env).Transfers().Ls(req.Context)
+		if err != nil {
+			return err
+		}
+
+		for _, prog := range transfers {
+			if err := re.Emit(prog); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	Type: &transfer.Progress{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, prog *transfer.Progress) error {
+			_, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", prog.Deal, prog.Direction, prog.Peer.Pretty(), formatTransferProgress(prog))
+			return err
+		}),
+	},
+}
+
+// formatTransferProgress describes how far the transfer got.
+func formatTransferProgress(prog *transfer.Progress) string {
+	s := fmt.Sprintf("%s\t%d/%d blocks\t%d/%d bytes", prog.State, prog.Blocks, prog.TotalBlocks, prog.Bytes, prog.TotalBytes)
+	if prog.Error != "" {
+		s += "\t" + prog.Error
+	}
+	return s
+}
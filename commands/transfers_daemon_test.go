@@ -0,0 +1,55 @@
+package commands
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/assert"
+	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/require"
+
+	"github.com/filecoin-project/go-filecoin/fixtures"
+	th "github.com/filecoin-project/go-filecoin/testhelpers"
+)
+
+func TestTransfersLs(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	require := require.New(t)
+
+	miner := th.NewDaemon(t,
+		th.WithMiner(fixtures.TestMiners[0]),
+		th.KeyFile(fixtures.KeyFilePaths()[0]),
+		th.DefaultAddress(fixtures.TestAddresses[0]),
+	).Start()
+	defer miner.ShutdownSuccess()
+
+	client := th.NewDaemon(t, th.KeyFile(fixtures.KeyFilePaths()[2]), th.DefaultAddress(fixtures.TestAddresses[2])).Start()
+	defer client.ShutdownSuccess()
+
+	assert.Empty(client.RunSuccess("transfers", "ls").ReadStdout())
+
+	miner.RunSuccess("mining start")
+	miner.UpdatePeerID()
+
+	miner.ConnectSuccess(client)
+
+	miner.MinerSetPrice(fixtures.TestMiners[0], fixtures.TestAddresses[0], "20", "10")
+	dataCid := client.RunWithStdin(strings.NewReader("TRANSFERRED BLOCK BY BLOCK"), "client", "import").ReadStdoutTrimNewlines()
+
+	proposeDealOutput := client.RunSuccess("client", "propose-storage-deal", fixtures.TestMiners[0], dataCid, "0", "5").ReadStdoutTrimNewlines()
+	splitOnSpace := strings.Split(proposeDealOutput, " ")
+	dealCid := splitOnSpace[len(splitOnSpace)-1]
+
+	require.NoError(th.WaitForIt(50, 100*time.Millisecond, func() (bool, error) {
+		return strings.Contains(client.RunSuccess("transfers", "ls").ReadStdout(), "completed"), nil
+	}))
+
+	sent := client.RunSuccess("transfers", "ls").ReadStdout()
+	assert.Contains(sent, dealCid+"\tsending\t"+miner.GetID()+"\tcompleted\t1/1 blocks")
+
+	received := miner.RunSuccess("transfers", "ls").ReadStdout()
+	assert.Contains(received, dealCid+"\treceiving\t"+client.GetID())
+
+	assert.Contains(client.RunSuccess("client", "query-storage-deal", dealCid).ReadStdout(), "Transfer: completed\t1/1 blocks")
+}
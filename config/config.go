@@ -8,6 +8,7 @@ import (
 	"reflect"
 	"regexp"
 	"strings"
+	"time"
 
 	"gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
 
@@ -17,13 +18,14 @@ import (
 
 // Config is an in memory representation of the filecoin configuration file
 type Config struct {
-	API       *APIConfig       `json:"api"`
-	Bootstrap *BootstrapConfig `json:"bootstrap"`
-	Datastore *DatastoreConfig `json:"datastore"`
-	Swarm     *SwarmConfig     `json:"swarm"`
-	Mining    *MiningConfig    `json:"mining"`
-	Wallet    *WalletConfig    `json:"wallet"`
-	Heartbeat *HeartbeatConfig `json:"heartbeat"`
+	API          *APIConfig          `json:"api"`
+	Bootstrap    *BootstrapConfig    `json:"bootstrap"`
+	Datastore    *DatastoreConfig    `json:"datastore"`
+	Swarm        *SwarmConfig        `json:"swarm"`
+	Mining       *MiningConfig       `json:"mining"`
+	Wallet       *WalletConfig       `json:"wallet"`
+	Heartbeat    *HeartbeatConfig    `json:"heartbeat"`
+	DataTransfer *DataTransferConfig `json:"dataTransfer"`
 }
 
 // APIConfig holds all configuration options related to the api.
@@ -60,7 +62,8 @@ type DatastoreConfig struct {
 // the given key and value are valid. Validators will only be run if a property
 // being set matches the name given in this map.
 var Validators = map[string]func(string, string) error{
-	"heartbeat.nickname": validateLettersOnly,
+	"heartbeat.nickname":                validateLettersOnly,
+	"mining.dealPolicy.rateLimitPeriod": validateDuration,
 }
 
 func newDefaultDatastoreConfig() *DatastoreConfig {
@@ -100,10 +103,12 @@ func newDefaultBootstrapConfig() *BootstrapConfig {
 
 // MiningConfig holds all configuration options related to mining.
 type MiningConfig struct {
-	MinerAddress            address.Address `json:"minerAddress"`
-	BlockSignerAddress      address.Address `json:"blockSignerAddress"`
-	AutoSealIntervalSeconds uint            `json:"autoSealIntervalSeconds"`
-	StoragePrice            *types.AttoFIL  `json:"storagePrice"`
+	MinerAddress            address.Address   `json:"minerAddress"`
+	BlockSignerAddress      address.Address   `json:"blockSignerAddress"`
+	WorkerAddress           address.Address   `json:"workerAddress"`
+	AutoSealIntervalSeconds uint              `json:"autoSealIntervalSeconds"`
+	StoragePrice            *types.AttoFIL    `json:"storagePrice"`
+	DealPolicy              *DealPolicyConfig `json:"dealPolicy"`
 }
 
 func newDefaultMiningConfig() *MiningConfig {
@@ -111,6 +116,52 @@ func newDefaultMiningConfig() *MiningConfig {
 		MinerAddress:            address.Address{},
 		AutoSealIntervalSeconds: 120,
 		StoragePrice:            types.NewZeroAttoFIL(),
+		DealPolicy:              newDefaultDealPolicyConfig(),
+	}
+}
+
+// DealPolicyConfig holds the rules a storage miner applies to the deals it
+// is proposed, on top of checking their price and payment. Zero values
+// disable a rule.
+type DealPolicyConfig struct {
+	// AllowedClients, if not empty, are the only clients the miner makes
+	// deals with.
+	AllowedClients []address.Address `json:"allowedClients"`
+	// DeniedClients are clients the miner makes no deals with.
+	DeniedClients []address.Address `json:"deniedClients"`
+
+	// MinPieceSize and MaxPieceSize bound the size of pieces in bytes.
+	MinPieceSize uint64 `json:"minPieceSize"`
+	MaxPieceSize uint64 `json:"maxPieceSize"`
+
+	// MinDuration and MaxDuration bound the duration of deals in blocks.
+	MinDuration uint64 `json:"minDuration"`
+	MaxDuration uint64 `json:"maxDuration"`
+
+	// MaxDealsPerClient limits how many deals the miner accepts from each
+	// client within RateLimitPeriod.
+	MaxDealsPerClient uint `json:"maxDealsPerClient"`
+	// RateLimitPeriod is the period deals are counted over.
+	// Golang duration units are accepted.
+	RateLimitPeriod string `json:"rateLimitPeriod"`
+
+	// MaxStagedBytes limits the bytes of the accepted deals that are not
+	// sealed yet.
+	MaxStagedBytes uint64 `json:"maxStagedBytes"`
+
+	// FilterCommand is a command and its arguments that is run for every
+	// proposal, with the proposal as JSON on its standard input. Proposals are
+	// rejected if it exits with a non-zero status, with its standard output
+	// as the reason.
+	FilterCommand []string `json:"filterCommand"`
+}
+
+func newDefaultDealPolicyConfig() *DealPolicyConfig {
+	return &DealPolicyConfig{
+		AllowedClients:  []address.Address{},
+		DeniedClients:   []address.Address{},
+		RateLimitPeriod: "24h",
+		FilterCommand:   []string{},
 	}
 }
 
@@ -148,17 +199,33 @@ func newDefaultHeartbeatConfig() *HeartbeatConfig {
 	}
 }
 
+// DataTransferConfig holds all configuration options related to the transfer
+// of deal data between nodes.
+type DataTransferConfig struct {
+	// MaxSendRate limits the bytes per second the node sends, over all of
+	// its transfers. Zero means no limit.
+	MaxSendRate uint64 `json:"maxSendRate"`
+	// MaxReceiveRate limits the bytes per second the node receives, over all
+	// of its transfers. Zero means no limit.
+	MaxReceiveRate uint64 `json:"maxReceiveRate"`
+}
+
+func newDefaultDataTransferConfig() *DataTransferConfig {
+	return &DataTransferConfig{}
+}
+
 // NewDefaultConfig returns a config object with all the fields filled out to
 // their default values
 func NewDefaultConfig() *Config {
 	return &Config{
-		API:       newDefaultAPIConfig(),
-		Bootstrap: newDefaultBootstrapConfig(),
-		Datastore: newDefaultDatastoreConfig(),
-		Swarm:     newDefaultSwarmConfig(),
-		Mining:    newDefaultMiningConfig(),
-		Wallet:    newDefaultWalletConfig(),
-		Heartbeat: newDefaultHeartbeatConfig(),
+		API:          newDefaultAPIConfig(),
+		Bootstrap:    newDefaultBootstrapConfig(),
+		Datastore:    newDefaultDatastoreConfig(),
+		Swarm:        newDefaultSwarmConfig(),
+		Mining:       newDefaultMiningConfig(),
+		Wallet:       newDefaultWalletConfig(),
+		Heartbeat:    newDefaultHeartbeatConfig(),
+		DataTransfer: newDefaultDataTransferConfig(),
 	}
 }
 
@@ -291,3 +358,16 @@ func validateLettersOnly(key string, value string) error {
 	}
 	return nil
 }
+
+// validateDuration validates that a given value is a duration string. If it
+// is not, an error is returned using the given key for the message.
+func validateDuration(key string, value string) error {
+	var duration string
+	if err := json.Unmarshal([]byte(value), &duration); err != nil {
+		return errors.Errorf(`"%s" must be a duration`, key)
+	}
+	if _, err := time.ParseDuration(duration); err != nil {
+		return errors.Errorf(`"%s" must be a duration: %s`, key, err)
+	}
+	return nil
+}
@@ -66,8 +66,21 @@ func TestWriteFile(t *testing.T) {
 	"mining": {
 		"minerAddress": "",
 		"blockSignerAddress": "",
+		"workerAddress": "",
 		"autoSealIntervalSeconds": 120,
-		"storagePrice": "0"
+		"storagePrice": "0",
+		"dealPolicy": {
+			"allowedClients": [],
+			"deniedClients": [],
+			"minPieceSize": 0,
+			"maxPieceSize": 0,
+			"minDuration": 0,
+			"maxDuration": 0,
+			"maxDealsPerClient": 0,
+			"rateLimitPeriod": "24h",
+			"maxStagedBytes": 0,
+			"filterCommand": []
+		}
 	},
 	"wallet": {
 		"defaultAddress": ""
@@ -77,6 +90,10 @@ func TestWriteFile(t *testing.T) {
 		"beatPeriod": "3s",
 		"reconnectPeriod": "10s",
 		"nickname": ""
+	},
+	"dataTransfer": {
+		"maxSendRate": 0,
+		"maxReceiveRate": 0
 	}
 }`,
 		string(content),
@@ -98,6 +115,16 @@ func TestSetRejectsInvalidNicks(t *testing.T) {
 	assert.Error(err)
 }
 
+func TestSetRejectsInvalidDurations(t *testing.T) {
+	assert := assert.New(t)
+	cfg := NewDefaultConfig()
+
+	assert.NoError(cfg.Set("mining.dealPolicy.rateLimitPeriod", `"1h30m"`))
+	assert.Equal("1h30m", cfg.Mining.DealPolicy.RateLimitPeriod)
+	assert.Error(cfg.Set("mining.dealPolicy.rateLimitPeriod", `"fortnight"`))
+	assert.Error(cfg.Set("mining.dealPolicy", `{"rateLimitPeriod": 10}`))
+}
+
 func TestConfigRoundtrip(t *testing.T) {
 	assert := assert.New(t)
 
@@ -8,14 +8,12 @@ import (
 	"math/big"
 	"strings"
 
-	"gx/ipfs/QmNf3wujpV2Y7Lnj2hy2UrmuX8bhMDStRHbnSLh7Ypf36h/go-hamt-ipld"
 	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
 	"gx/ipfs/QmRu7tiRnFk9mMPpVECQTBQJqXtmG132jJxA1w9A7TtpBz/go-ipfs-blockstore"
 	"gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
 	logging "gx/ipfs/QmbkT7eMTyXfpeyB3ZMxxcxg7XH8t6uXp49jqzz4HB7BGF/go-log"
 	"gx/ipfs/QmcTzQXRcU2vf8yX5EEboz1BSvWC7wWmeYAKVQmhp8WZYU/sha256-simd"
 
-	"github.com/filecoin-project/go-filecoin/actor/builtin"
 	"github.com/filecoin-project/go-filecoin/actor/builtin/miner"
 	"github.com/filecoin-project/go-filecoin/address"
 	"github.com/filecoin-project/go-filecoin/proofs"
@@ -77,9 +75,6 @@ type Expected struct {
 	// computation.
 	PwrTableView PowerTableView
 
-	// cstore is used for loading state trees during message running.
-	cstore *hamt.CborIpldStore
-
 	// bstore contains data referenced by actors within the state
 	// during message running.  Additionally bstore is used for
 	// accessing the power table.
@@ -97,9 +92,8 @@ type Expected struct {
 var _ Protocol = (*Expected)(nil)
 
 // NewExpected is the constructor for the Expected consenus.Protocol module.
-func NewExpected(cs *hamt.CborIpldStore, bs blockstore.Blockstore, processor Processor, pt PowerTableView, gCid cid.Cid, verifier proofs.Verifier) Protocol {
+func NewExpected(bs blockstore.Blockstore, processor Processor, pt PowerTableView, gCid cid.Cid, verifier proofs.Verifier) Protocol {
 	return &Expected{
-		cstore:       cs,
 		bstore:       bs,
 		processor:    processor,
 		PwrTableView: pt,
@@ -155,8 +149,13 @@ func (c *Expected) Weight(ctx context.Context, ts types.TipSet, pSt state.Tree)
 	if err != nil {
 		return uint64(0), err
 	}
+	h, err := ts.Height()
+	if err != nil {
+		return uint64(0), err
+	}
+	bh := types.NewBlockHeight(h)
 	// Each block in the tipset adds ECV + ECPrm * miner_power to parent weight.
-	totalBytes, err := c.PwrTableView.Total(ctx, pSt, c.bstore)
+	totalBytes, err := c.PwrTableView.Total(ctx, pSt, c.bstore, bh)
 	if err != nil {
 		return uint64(0), err
 	}
@@ -164,7 +163,7 @@ func (c *Expected) Weight(ctx context.Context, ts types.TipSet, pSt state.Tree)
 	floatECV := new(big.Float).SetInt64(int64(ECV))
 	floatECPrM := new(big.Float).SetInt64(int64(ECPrM))
 	for _, blk := range ts.ToSlice() {
-		minerBytes, err := c.PwrTableView.Miner(ctx, pSt, c.bstore, blk.Miner)
+		minerBytes, err := c.PwrTableView.Miner(ctx, pSt, c.bstore, blk.Miner, bh)
 		if err != nil {
 			return uint64(0), err
 		}
@@ -284,7 +283,7 @@ func (c *Expected) validateMining(ctx context.Context, st state.Tree, ts types.T
 		// the mined block.
 
 		// See https://github.com/filecoin-project/specs/blob/master/mining.md#ticket-checking
-		result, err := IsWinningTicket(ctx, c.bstore, c.PwrTableView, st, blk.Ticket, blk.Miner)
+		result, err := IsWinningTicket(ctx, c.bstore, c.PwrTableView, st, blk.Ticket, blk.Miner, types.NewBlockHeight(uint64(blk.Height)))
 		if err != nil {
 			return errors.Wrap(err, "can't check for winning ticket")
 		}
@@ -296,18 +295,19 @@ func (c *Expected) validateMining(ctx context.Context, st state.Tree, ts types.T
 	return nil
 }
 
-// IsWinningTicket fetches miner power & total power, returns true if it's a winning ticket, false if not,
+// IsWinningTicket fetches miner power & total power at the height of the block
+// being mined, returns true if it's a winning ticket, false if not,
 //    errors out if minerPower or totalPower can't be found.
 //    See https://github.com/filecoin-project/aq/issues/70 for an explanation of the math here.
 func IsWinningTicket(ctx context.Context, bs blockstore.Blockstore, ptv PowerTableView, st state.Tree,
-	ticket types.Signature, miner address.Address) (bool, error) {
+	ticket types.Signature, miner address.Address, bh *types.BlockHeight) (bool, error) {
 
-	totalPower, err := ptv.Total(ctx, st, bs)
+	totalPower, err := ptv.Total(ctx, st, bs, bh)
 	if err != nil {
 		return false, errors.Wrap(err, "Couldn't get totalPower")
 	}
 
-	minerPower, err := ptv.Miner(ctx, st, bs, miner)
+	minerPower, err := ptv.Miner(ctx, st, bs, miner, bh)
 	if err != nil {
 		return false, errors.Wrap(err, "Couldn't get minerPower")
 	}
@@ -366,22 +366,13 @@ func CreateTicket(proof proofs.PoStProof, minerAddr address.Address) []byte {
 // lead to successful state transitions.  An error is also returned if the node
 // faults while running aggregate state computation.
 func (c *Expected) runMessages(ctx context.Context, st state.Tree, vms vm.StorageMap, ts types.TipSet, ancestors []types.TipSet) (state.Tree, error) {
-	var cpySt state.Tree
-
 	// TODO: order blocks in the tipset by ticket
 	// TODO: don't process messages twice
 	for _, blk := range ts.ToSlice() {
-		cpyCid, err := st.Flush(ctx)
-		if err != nil {
-			return nil, errors.Wrap(err, "error validating block state")
-		}
-		// state copied so changes don't propagate between block validations
-		cpySt, err = state.LoadStateTree(ctx, c.cstore, cpyCid, builtin.Actors)
-		if err != nil {
-			return nil, errors.Wrap(err, "error validating block state")
-		}
+		// snapshot so changes don't propagate between block validations
+		rev := st.Snapshot()
 
-		receipts, err := c.processor.ProcessBlock(ctx, cpySt, vms, blk, ancestors)
+		receipts, err := c.processor.ProcessBlock(ctx, st, vms, blk, ancestors)
 		if err != nil {
 			return nil, errors.Wrap(err, "error validating block state")
 		}
@@ -390,16 +381,23 @@ func (c *Expected) runMessages(ctx context.Context, st state.Tree, vms vm.Storag
 			return nil, fmt.Errorf("found invalid message receipts: %v %v", receipts, blk.MessageReceipts)
 		}
 
-		outCid, err := cpySt.Flush(ctx)
+		outCid, err := st.Flush(ctx)
 		if err != nil {
 			return nil, errors.Wrap(err, "error validating block state")
 		}
 		if !outCid.Equals(blk.StateRoot) {
 			return nil, ErrStateRootMismatch
 		}
-	}
-	if len(ts) == 1 { // block validation state == aggregate parent state
-		return cpySt, nil
+
+		if len(ts) == 1 { // block validation state == aggregate parent state
+			if err := st.Release(rev); err != nil {
+				return nil, errors.Wrap(err, "error validating block state")
+			}
+			return st, nil
+		}
+		if err := st.Revert(rev); err != nil {
+			return nil, errors.Wrap(err, "error validating block state")
+		}
 	}
 	// multiblock tipsets require reapplying messages to get aggregate state
 	// NOTE: It is possible to optimize further by applying block validation
@@ -29,9 +29,9 @@ import (
 func TestNewExpected(t *testing.T) {
 	assert := assert.New(t)
 	t.Run("a new Expected can be created", func(t *testing.T) {
-		cst, bstore, verifier := setupCborBlockstoreProofs()
+		_, bstore, verifier := setupCborBlockstoreProofs()
 		ptv := testhelpers.NewTestPowerTableView(1, 5)
-		exp := consensus.NewExpected(cst, bstore, consensus.NewDefaultProcessor(), ptv, types.SomeCid(), verifier)
+		exp := consensus.NewExpected(bstore, consensus.NewDefaultProcessor(), ptv, types.SomeCid(), verifier)
 		assert.NotNil(exp)
 	})
 }
@@ -50,7 +50,7 @@ func TestExpected_NewValidTipSet(t *testing.T) {
 		genesisBlock, err := consensus.DefaultGenesis(cistore, bstore)
 		require.NoError(err)
 
-		exp := consensus.NewExpected(cistore, bstore, consensus.NewDefaultProcessor(), ptv, genesisBlock.Cid(), verifier)
+		exp := consensus.NewExpected(bstore, consensus.NewDefaultProcessor(), ptv, genesisBlock.Cid(), verifier)
 
 		pTipSet, err := exp.NewValidTipSet(ctx, []*types.Block{genesisBlock})
 		require.NoError(err)
@@ -85,7 +85,7 @@ func TestExpected_NewValidTipSet(t *testing.T) {
 		}
 		blocks[0].MessageReceipts = []*types.MessageReceipt{receipt}
 
-		exp := consensus.NewExpected(cistore, bstore, consensus.NewDefaultProcessor(), ptv, types.SomeCid(), verifier)
+		exp := consensus.NewExpected(bstore, consensus.NewDefaultProcessor(), ptv, types.SomeCid(), verifier)
 
 		tipSet, err := exp.NewValidTipSet(ctx, blocks)
 		assert.Error(err, "Foo")
@@ -133,7 +133,7 @@ func TestExpected_RunStateTransition_validateMining(t *testing.T) {
 		totalPower := uint64(1)
 
 		ptv := testhelpers.NewTestPowerTableView(minerPower, totalPower)
-		exp := consensus.NewExpected(cistore, bstore, testhelpers.NewTestProcessor(), ptv, genesisBlock.Cid(), verifier)
+		exp := consensus.NewExpected(bstore, testhelpers.NewTestProcessor(), ptv, genesisBlock.Cid(), verifier)
 
 		pTipSet, err := exp.NewValidTipSet(ctx, []*types.Block{genesisBlock})
 		require.NoError(err)
@@ -155,7 +155,7 @@ func TestExpected_RunStateTransition_validateMining(t *testing.T) {
 	t.Run("returns nil + mining error when IsWinningTicket fails due to miner power error", func(t *testing.T) {
 
 		ptv := NewFailingMinerTestPowerTableView(1, 5)
-		exp := consensus.NewExpected(cistore, bstore, consensus.NewDefaultProcessor(), ptv, types.SomeCid(), verifier)
+		exp := consensus.NewExpected(bstore, consensus.NewDefaultProcessor(), ptv, types.SomeCid(), verifier)
 
 		pTipSet, err := exp.NewValidTipSet(ctx, []*types.Block{genesisBlock})
 		require.NoError(err)
@@ -209,7 +209,7 @@ func TestIsWinningTicket(t *testing.T) {
 			ptv := testhelpers.NewTestPowerTableView(c.myPower, c.totalPower)
 			ticket := [sha256.Size]byte{}
 			ticket[0] = c.ticket
-			r, err := consensus.IsWinningTicket(ctx, bs, ptv, st, ticket[:], minerAddress)
+			r, err := consensus.IsWinningTicket(ctx, bs, ptv, st, ticket[:], minerAddress, types.NewBlockHeight(1))
 			assert.NoError(err)
 			assert.Equal(c.wins, r, "%+v", c)
 		}
@@ -232,7 +232,7 @@ func TestIsWinningTicket(t *testing.T) {
 		ptv1 := NewFailingTestPowerTableView(testCase.myPower, testCase.totalPower)
 		ticket := [sha256.Size]byte{}
 		ticket[0] = testCase.ticket
-		r, err := consensus.IsWinningTicket(ctx, bs, ptv1, st, ticket[:], minerAddress)
+		r, err := consensus.IsWinningTicket(ctx, bs, ptv1, st, ticket[:], minerAddress, types.NewBlockHeight(1))
 		assert.False(r)
 		assert.Equal(err.Error(), "Couldn't get totalPower: something went wrong with the total power")
 
@@ -242,7 +242,7 @@ func TestIsWinningTicket(t *testing.T) {
 		ptv2 := NewFailingMinerTestPowerTableView(testCase.myPower, testCase.totalPower)
 		ticket := [sha256.Size]byte{}
 		ticket[0] = testCase.ticket
-		r, err := consensus.IsWinningTicket(ctx, bs, ptv2, st, ticket[:], minerAddress)
+		r, err := consensus.IsWinningTicket(ctx, bs, ptv2, st, ticket[:], minerAddress, types.NewBlockHeight(1))
 		assert.False(r)
 		assert.Equal(err.Error(), "Couldn't get minerPower: something went wrong with the miner power")
 
@@ -302,15 +302,15 @@ func NewFailingTestPowerTableView(minerPower int64, totalPower int64) *FailingTe
 	return &FailingTestPowerTableView{uint64(minerPower), uint64(totalPower)}
 }
 
-func (tv *FailingTestPowerTableView) Total(ctx context.Context, st state.Tree, bstore blockstore.Blockstore) (uint64, error) {
+func (tv *FailingTestPowerTableView) Total(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, bh *types.BlockHeight) (uint64, error) {
 	return tv.totalPower, errors.New("something went wrong with the total power")
 }
 
-func (tv *FailingTestPowerTableView) Miner(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, mAddr address.Address) (uint64, error) {
+func (tv *FailingTestPowerTableView) Miner(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, mAddr address.Address, bh *types.BlockHeight) (uint64, error) {
 	return uint64(tv.minerPower), nil
 }
 
-func (tv *FailingTestPowerTableView) HasPower(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, mAddr address.Address) bool {
+func (tv *FailingTestPowerTableView) HasPower(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, mAddr address.Address, bh *types.BlockHeight) bool {
 	return true
 }
 
@@ -320,14 +320,14 @@ func NewFailingMinerTestPowerTableView(minerPower int64, totalPower int64) *Fail
 	return &FailingMinerTestPowerTableView{uint64(minerPower), uint64(totalPower)}
 }
 
-func (tv *FailingMinerTestPowerTableView) Total(ctx context.Context, st state.Tree, bstore blockstore.Blockstore) (uint64, error) {
+func (tv *FailingMinerTestPowerTableView) Total(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, bh *types.BlockHeight) (uint64, error) {
 	return tv.totalPower, nil
 }
 
-func (tv *FailingMinerTestPowerTableView) Miner(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, mAddr address.Address) (uint64, error) {
+func (tv *FailingMinerTestPowerTableView) Miner(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, mAddr address.Address, bh *types.BlockHeight) (uint64, error) {
 	return tv.minerPower, errors.New("something went wrong with the miner power")
 }
 
-func (tv *FailingMinerTestPowerTableView) HasPower(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, mAddr address.Address) bool {
+func (tv *FailingMinerTestPowerTableView) HasPower(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, mAddr address.Address, bh *types.BlockHeight) bool {
 	return true
 }
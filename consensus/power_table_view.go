@@ -9,23 +9,26 @@ import (
 
 	"github.com/filecoin-project/go-filecoin/address"
 	"github.com/filecoin-project/go-filecoin/state"
+	"github.com/filecoin-project/go-filecoin/types"
 	"github.com/filecoin-project/go-filecoin/vm"
 )
 
 // PowerTableView defines the set of functions used by the ChainManager to view
-// the power table encoded in the tipset's state tree
+// the power table encoded in the tipset's state tree. Power is viewed at the
+// height of the block being mined or validated on top of that state, as a
+// miner that stops proving its storage loses its power over time.
 type PowerTableView interface {
 	// Total returns the total bytes stored by all miners in the given
 	// state.
-	Total(ctx context.Context, st state.Tree, bstore blockstore.Blockstore) (uint64, error)
+	Total(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, bh *types.BlockHeight) (uint64, error)
 
 	// Miner returns the total bytes stored by the miner of the
 	// input address in the given state.
-	Miner(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, mAddr address.Address) (uint64, error)
+	Miner(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, mAddr address.Address, bh *types.BlockHeight) (uint64, error)
 
 	// HasPower returns true if the input address is associated with a
 	// miner that has storage power in the network.
-	HasPower(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, mAddr address.Address) bool
+	HasPower(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, mAddr address.Address, bh *types.BlockHeight) bool
 }
 
 // MarketView is the power table view used for running expected consensus in
@@ -39,9 +42,9 @@ var _ PowerTableView = &MarketView{}
 // value exceeds the max value of a uint64 this method errors.
 // TODO: uint64 has enough bits to express about 1 exabyte of total storage.
 // This should be increased for v1.
-func (v *MarketView) Total(ctx context.Context, st state.Tree, bstore blockstore.Blockstore) (uint64, error) {
+func (v *MarketView) Total(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, bh *types.BlockHeight) (uint64, error) {
 	vms := vm.NewStorageMap(bstore)
-	rets, ec, err := CallQueryMethod(ctx, st, vms, address.StorageMarketAddress, "getTotalStorage", []byte{}, address.Address{}, nil)
+	rets, ec, err := CallQueryMethod(ctx, st, vms, address.StorageMarketAddress, "getTotalStorage", []byte{}, address.Address{}, bh)
 	if err != nil {
 		return 0, err
 	}
@@ -61,9 +64,9 @@ func (v *MarketView) Total(ctx context.Context, st state.Tree, bstore blockstore
 // TODO: currently power is in sectors, figure out if & how it should be converted to bytes.
 // TODO: uint64 has enough bits to express about 1 exabyte.  This
 // should probably be increased for v1.
-func (v *MarketView) Miner(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, mAddr address.Address) (uint64, error) {
+func (v *MarketView) Miner(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, mAddr address.Address, bh *types.BlockHeight) (uint64, error) {
 	vms := vm.NewStorageMap(bstore)
-	rets, ec, err := CallQueryMethod(ctx, st, vms, mAddr, "getPower", []byte{}, address.Address{}, nil)
+	rets, ec, err := CallQueryMethod(ctx, st, vms, mAddr, "getPower", []byte{}, address.Address{}, bh)
 	if err != nil {
 		return 0, err
 	}
@@ -78,8 +81,8 @@ func (v *MarketView) Miner(ctx context.Context, st state.Tree, bstore blockstore
 
 // HasPower returns true if the provided address belongs to a miner with power
 // in the storage market
-func (v *MarketView) HasPower(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, mAddr address.Address) bool {
-	numBytes, err := v.Miner(ctx, st, bstore, mAddr)
+func (v *MarketView) HasPower(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, mAddr address.Address, bh *types.BlockHeight) bool {
+	numBytes, err := v.Miner(ctx, st, bstore, mAddr, bh)
 	if err != nil {
 		if state.IsActorNotFoundError(err) {
 			return false
@@ -101,7 +101,7 @@ func (p *DefaultProcessor) ProcessBlock(ctx context.Context, st state.Tree, vms
 	}()
 
 	// find miner's owner address
-	minerOwnerAddr, err := minerOwnerAddress(ctx, st, vms, blk.Miner)
+	minerOwnerAddr, err := MinerOwnerAddress(ctx, st, vms, blk.Miner)
 	if err != nil {
 		return nil, err
 	}
@@ -147,7 +147,7 @@ func (p *DefaultProcessor) ProcessTipSet(ctx context.Context, st state.Tree, vms
 	// consensus functions).
 	for _, blk := range tips {
 		// find miner's owner address
-		minerOwnerAddr, err := minerOwnerAddress(ctx, st, vms, blk.Miner)
+		minerOwnerAddr, err := MinerOwnerAddress(ctx, st, vms, blk.Miner)
 		if err != nil {
 			return &emptyRes, err
 		}
@@ -272,6 +272,9 @@ func (p *DefaultProcessor) ApplyMessage(ctx context.Context, st state.Tree, vms
 		log.Infof("[TIMER] DefaultProcessor.ApplyMessage CID: %s - elapsed time: %s", msgCid.String(), time.Since(applyMsgTimer).Round(time.Millisecond))
 	}()
 
+	// Snapshot the tree so that an unapplyable message leaves no trace in
+	// it, whatever was written on its behalf.
+	rev := st.Snapshot()
 	cachedStateTree := state.NewCachedStateTree(st)
 
 	r, err := p.attemptApplyMessage(ctx, cachedStateTree, vms, msg, bh, gasTracker, ancestors)
@@ -295,6 +298,13 @@ func (p *DefaultProcessor) ApplyMessage(ctx context.Context, st state.Tree, vms
 
 	// Reject invalid state transitions.
 	var executionError error
+	if isTemporaryError(err) || isPermanentError(err) {
+		if revertErr := st.Revert(rev); revertErr != nil {
+			return nil, errors.FaultErrorWrap(revertErr, "could not revert state tree")
+		}
+	} else if releaseErr := st.Release(rev); releaseErr != nil {
+		return nil, errors.FaultErrorWrap(releaseErr, "could not release state tree snapshot")
+	}
 	if isTemporaryError(err) {
 		return nil, errors.ApplyErrorTemporaryWrapf(err, "apply message failed")
 	} else if isPermanentError(err) {
@@ -626,8 +636,8 @@ func isPermanentError(err error) bool {
 		err == errGasAboveBlockLimit
 }
 
-// minerOwnerAddress finds the address of the owner of the given miner
-func minerOwnerAddress(ctx context.Context, st state.Tree, vms vm.StorageMap, minerAddr address.Address) (address.Address, error) {
+// MinerOwnerAddress finds the address of the owner of the given miner
+func MinerOwnerAddress(ctx context.Context, st state.Tree, vms vm.StorageMap, minerAddr address.Address) (address.Address, error) {
 	ret, code, err := CallQueryMethod(ctx, st, vms, minerAddr, "getOwner", []byte{}, address.Address{}, types.NewBlockHeight(0))
 	if err != nil {
 		return address.Address{}, errors.FaultErrorWrap(err, "could not get miner owner")
@@ -1107,3 +1107,41 @@ func mustCreateMiner(ctx context.Context, require *require.Assertions, st state.
 	require.NoError(err)
 	return stCid, miner
 }
+
+// BenchmarkApplyMessage applies a value transfer, which sets the sender and
+// the receiver within the snapshot isolating the message.
+func BenchmarkApplyMessage(b *testing.B) {
+	require := require.New(b)
+	ctx := context.Background()
+	cst := hamt.NewCborStore()
+	vms := th.VMStorage()
+	ki := types.MustGenerateKeyInfo(2, types.GenerateKeyInfoSeed())
+	mockSigner := types.NewMockSigner(ki)
+
+	addr1, addr2 := mockSigner.Addresses[0], mockSigner.Addresses[1]
+	_, st := requireMakeStateTree(require, cst, map[address.Address]*actor.Actor{
+		addr1: th.RequireNewAccountActor(require, types.NewAttoFILFromFIL(uint64(b.N)+1)),
+		addr2: th.RequireNewAccountActor(require, types.NewZeroAttoFIL()),
+	})
+
+	msgs := make([]*types.SignedMessage, b.N)
+	for i := range msgs {
+		msg := types.NewMessage(addr1, addr2, uint64(i), types.NewAttoFILFromFIL(1), "", nil)
+		smsg, err := types.NewSignedMessage(*msg, mockSigner, types.NewGasPrice(0), types.NewGasUnits(0))
+		require.NoError(err)
+		msgs[i] = smsg
+	}
+
+	processor := NewDefaultProcessor()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for _, smsg := range msgs {
+		res, err := processor.ApplyMessage(ctx, st, vms, smsg, addr2, types.NewBlockHeight(0), vm.NewGasTracker(), nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if res.ExecutionError != nil {
+			b.Fatal(res.ExecutionError)
+		}
+	}
+}
@@ -7,9 +7,12 @@ import (
 
 	"github.com/filecoin-project/go-filecoin/address"
 
+	ma "gx/ipfs/QmNTCey11oxhb1AxDnQBRHtdhap6Ctud872NjAYPYYXPuc/go-multiaddr"
+	pstore "gx/ipfs/QmRhFARzTHcFh8wUxwN5KvyTGq73FLC65EfFAhz8Ng7aGb/go-libp2p-peerstore"
 	"gx/ipfs/QmRu7tiRnFk9mMPpVECQTBQJqXtmG132jJxA1w9A7TtpBz/go-ipfs-blockstore"
 	"gx/ipfs/QmTu65MVbemtUxJEWgsTtzv9Zv9P8rvmqNA4eG9TrTRGYc/go-libp2p-peer"
 
+	"github.com/filecoin-project/go-filecoin/abi"
 	"github.com/filecoin-project/go-filecoin/chain"
 	"github.com/filecoin-project/go-filecoin/consensus"
 	"github.com/filecoin-project/go-filecoin/vm"
@@ -18,6 +21,7 @@ import (
 // PeerLookupService provides an interface through which callers look up a miner's libp2p identity by their Filecoin address.
 type PeerLookupService interface {
 	GetPeerIDByMinerAddress(context.Context, address.Address) (peer.ID, error)
+	GetPeerInfoByMinerAddress(context.Context, address.Address) (pstore.PeerInfo, error)
 }
 
 // ChainLookupService is a ChainManager-backed implementation of the PeerLookupService interface.
@@ -41,29 +45,61 @@ func NewChainLookupService(chain chain.ReadStore, queryMethodFromAddr func() (ad
 // GetPeerIDByMinerAddress attempts to get a miner's libp2p identity by loading the actor from the state tree and sending
 // it a "getPeerID" message. The MinerActor is currently the only type of actor which has a peer ID.
 func (c *ChainLookupService) GetPeerIDByMinerAddress(ctx context.Context, minerAddr address.Address) (peer.ID, error) {
+	retValue, err := c.query(ctx, minerAddr, "getPeerID")
+	if err != nil {
+		return peer.ID(""), err
+	}
+
+	pid, err := peer.IDFromBytes(retValue[0])
+	if err != nil {
+		return peer.ID(""), errors.Wrap(err, "could not decode to peer.ID from message-bytes")
+	}
+
+	return pid, nil
+}
+
+// GetPeerInfoByMinerAddress gets a miner's libp2p identity together with the multiaddrs the miner advertises on
+// chain, so that callers can dial the miner without finding its addresses through the DHT. Miners which have not
+// advertised any multiaddrs are returned with none.
+func (c *ChainLookupService) GetPeerInfoByMinerAddress(ctx context.Context, minerAddr address.Address) (pstore.PeerInfo, error) {
+	pid, err := c.GetPeerIDByMinerAddress(ctx, minerAddr)
+	if err != nil {
+		return pstore.PeerInfo{}, err
+	}
+
+	retValue, err := c.query(ctx, minerAddr, "getMultiaddrs")
+	if err != nil {
+		return pstore.PeerInfo{}, err
+	}
+
+	addrs, err := abi.Deserialize(retValue[0], abi.Multiaddrs)
+	if err != nil {
+		return pstore.PeerInfo{}, errors.Wrap(err, "could not decode multiaddrs from message-bytes")
+	}
+
+	return pstore.PeerInfo{ID: pid, Addrs: addrs.Val.([]ma.Multiaddr)}, nil
+}
+
+// query sends a query message to the miner actor in the latest state.
+func (c *ChainLookupService) query(ctx context.Context, minerAddr address.Address, method string) ([][]byte, error) {
 	st, err := c.chainReader.LatestState(ctx)
 	if err != nil {
-		return peer.ID(""), errors.Wrap(err, "failed to load state tree")
+		return nil, errors.Wrap(err, "failed to load state tree")
 	}
 	addr, err := c.queryMethodFromAddress()
 	if err != nil {
-		return peer.ID(""), errors.Wrap(err, "failed to obtain a default from-address")
+		return nil, errors.Wrap(err, "failed to obtain a default from-address")
 	}
 
 	vms := vm.NewStorageMap(c.bstore)
-	retValue, retCode, err := consensus.CallQueryMethod(ctx, st, vms, minerAddr, "getPeerID", []byte{}, addr, nil)
+	retValue, retCode, err := consensus.CallQueryMethod(ctx, st, vms, minerAddr, method, []byte{}, addr, nil)
 	if err != nil {
-		return peer.ID(""), errors.Wrapf(err, "failed to query local state tree(from %s, miner %s)", addr.String(), minerAddr.String())
+		return nil, errors.Wrapf(err, "failed to query local state tree(from %s, miner %s)", addr.String(), minerAddr.String())
 	}
 
 	if retCode != 0 {
-		return peer.ID(""), errors.Wrap(err, "non-zero status code from getPeerID")
+		return nil, errors.Errorf("non-zero status code %d from %s", retCode, method)
 	}
 
-	pid, err := peer.IDFromBytes(retValue[0])
-	if err != nil {
-		return peer.ID(""), errors.Wrap(err, "could not decode to peer.ID from message-bytes")
-	}
-
-	return pid, nil
+	return retValue, nil
 }
@@ -32,7 +32,14 @@ func (w *DefaultWorker) Generate(ctx context.Context,
 		return nil, errors.Wrap(err, "get state tree")
 	}
 
-	if !w.powerTable.HasPower(ctx, stateTree, w.blockstore, w.minerAddr) {
+	baseHeight, err := baseTipSet.Height()
+	if err != nil {
+		return nil, errors.Wrap(err, "get base tip set height")
+	}
+
+	blockHeight := baseHeight + nullBlockCount + 1
+
+	if !w.powerTable.HasPower(ctx, stateTree, w.blockstore, w.minerAddr, types.NewBlockHeight(blockHeight)) {
 		return nil, errors.Errorf("bad miner address, miner must store files before mining: %s", w.minerAddr)
 	}
 
@@ -41,13 +48,6 @@ func (w *DefaultWorker) Generate(ctx context.Context,
 		return nil, errors.Wrap(err, "get weight")
 	}
 
-	baseHeight, err := baseTipSet.Height()
-	if err != nil {
-		return nil, errors.Wrap(err, "get base tip set height")
-	}
-
-	blockHeight := baseHeight + nullBlockCount + 1
-
 	ancestors, err := w.getAncestors(ctx, baseTipSet, types.NewBlockHeight(blockHeight))
 	if err != nil {
 		return nil, errors.Wrap(err, "get base tip set ancestors")
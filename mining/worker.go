@@ -189,6 +189,14 @@ func (w *DefaultWorker) Mine(ctx context.Context, base types.TipSet, nullBlkCoun
 		return false
 	}
 
+	baseHeight, err := base.Height()
+	if err != nil {
+		log.Errorf("Worker.Mine couldn't get base tipset height: %s", err.Error())
+		outCh <- Output{Err: err}
+		return false
+	}
+	blockHeight := types.NewBlockHeight(baseHeight + uint64(nullBlkCount) + 1)
+
 	log.Debugf("Mining on tipset: %s, with %d null blocks.", base.String(), nullBlkCount)
 	if ctx.Err() != nil {
 		log.Warningf("Worker.Mine returning with ctx error %s", ctx.Err().Error())
@@ -219,7 +227,7 @@ func (w *DefaultWorker) Mine(ctx context.Context, base types.TipSet, nullBlkCoun
 
 	// TODO: Test the interplay of isWinningTicket() and createPoSTFunc()
 	// https://github.com/filecoin-project/go-filecoin/issues/1791
-	weHaveAWinner, err := consensus.IsWinningTicket(ctx, w.blockstore, w.powerTable, st, ticket, w.minerAddr)
+	weHaveAWinner, err := consensus.IsWinningTicket(ctx, w.blockstore, w.powerTable, st, ticket, w.minerAddr, blockHeight)
 
 	if err != nil {
 		log.Errorf("Worker.Mine couldn't compute ticket: %s", err.Error())
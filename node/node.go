@@ -59,6 +59,7 @@ import (
 	"github.com/filecoin-project/go-filecoin/protocol/hello"
 	"github.com/filecoin-project/go-filecoin/protocol/retrieval"
 	"github.com/filecoin-project/go-filecoin/protocol/storage"
+	"github.com/filecoin-project/go-filecoin/protocol/transfer"
 	"github.com/filecoin-project/go-filecoin/pubsub"
 	"github.com/filecoin-project/go-filecoin/repo"
 	"github.com/filecoin-project/go-filecoin/state"
@@ -114,11 +115,15 @@ type Node struct {
 	// Storage Market Interfaces
 	StorageMinerClient *storage.Client
 	StorageMiner       *storage.Miner
+	AskIndex           *storage.AskIndex
 
 	// Retrieval Interfaces
 	RetrievalClient *retrieval.Client
 	RetrievalMiner  *retrieval.Miner
 
+	// dataTransfer transfers the data of deals to and from other nodes.
+	dataTransfer *transfer.Manager
+
 	// Network Fields
 	BlockSub     pubsub.Subscription
 	MessageSub   pubsub.Subscription
@@ -377,9 +382,9 @@ func (nc *Config) Build(ctx context.Context) (*Node, error) {
 
 	var nodeConsensus consensus.Protocol
 	if nc.Verifier == nil {
-		nodeConsensus = consensus.NewExpected(&cstOffline, bs, processor, powerTable, genCid, &proofs.RustVerifier{})
+		nodeConsensus = consensus.NewExpected(bs, processor, powerTable, genCid, &proofs.RustVerifier{})
 	} else {
-		nodeConsensus = consensus.NewExpected(&cstOffline, bs, processor, powerTable, genCid, nc.Verifier)
+		nodeConsensus = consensus.NewExpected(bs, processor, powerTable, genCid, nc.Verifier)
 	}
 
 	// only the syncer gets the storage which is online connected
@@ -404,6 +409,7 @@ func (nc *Config) Build(ctx context.Context) (*Node, error) {
 	PorcelainAPI := porcelain.New(plumbing.New(&plumbing.APIDeps{
 		Chain:        chainReader,
 		Config:       cfg.NewConfig(nc.Repo),
+		CborStore:    &cstOffline,
 		MsgPool:      msgPool,
 		MsgPreviewer: msg.NewPreviewer(fcWallet, chainReader, &cstOffline, bs),
 		MsgQueryer:   msg.NewQueryer(nc.Repo, fcWallet, chainReader, &cstOffline, bs),
@@ -487,12 +493,16 @@ func (node *Node) Start(ctx context.Context) error {
 	}
 	node.HelloSvc = hello.New(node.Host(), node.ChainReader.GenesisCid(), syncCallBack, node.ChainReader.Head)
 
+	node.dataTransfer = transfer.NewManager(node.Host(), node.Blockstore, node.PorcelainAPI)
+
 	cni := storage.NewClientNodeImpl(dag.NewDAGService(node.BlockService()), node.Host(), node.GetBlockTime())
 	var err error
 	node.StorageMinerClient, err = storage.NewClient(cni, node.PorcelainAPI, node.Repo.DealsDatastore())
 	if err != nil {
 		return errors.Wrap(err, "Could not make new storage client")
 	}
+	node.dataTransfer.ValidatePulls(node.StorageMinerClient.ValidatePull)
+	node.AskIndex = storage.NewAskIndex(node.ChainReader, node.PorcelainAPI)
 
 	node.RetrievalClient = retrieval.NewClient(node)
 	node.RetrievalMiner = retrieval.NewMiner(node)
@@ -649,6 +659,7 @@ func (node *Node) handleNewHeaviestTipSet(ctx context.Context, head types.TipSet
 			if node.StorageMiner != nil {
 				node.StorageMiner.OnNewHeaviestTipSet(newHead)
 			}
+			node.AskIndex.OnNewHeaviestTipSet(newHead)
 			node.HeaviestTipSetHandled()
 		case <-ctx.Done():
 			return
@@ -840,11 +851,17 @@ func (node *Node) StartMining(ctx context.Context) error {
 					gasUnits := types.NewGasUnits(300)
 
 					val := result.SealingResult
+					workerAddr, err := node.StorageMiner.WorkerAddress()
+					if err != nil {
+						log.Errorf("failed to get worker address to commit sector with id %d: %s", val.SectorID, err)
+						continue
+					}
+
 					// This call can fail due to, e.g. nonce collisions. Our miners existence depends on this.
 					// We should deal with this, but MessageSendWithRetry is problematic.
-					_, err := node.PorcelainAPI.MessageSend(
+					_, err = node.PorcelainAPI.MessageSend(
 						node.miningCtx,
-						minerOwnerAddr,
+						workerAddr,
 						minerAddr,
 						nil,
 						gasPrice,
@@ -855,9 +872,10 @@ func (node *Node) StartMining(ctx context.Context) error {
 						val.CommR[:],
 						val.CommRStar[:],
 						val.Proof[:],
+						node.StorageMiner.SectorDealIDs(val),
 					)
 					if err != nil {
-						log.Errorf("failed to send commitSector message from %s to %s for sector with id %d: %s", minerOwnerAddr, minerAddr, val.SectorID, err)
+						log.Errorf("failed to send commitSector message from %s to %s for sector with id %d: %s", workerAddr, minerAddr, val.SectorID, err)
 						continue
 					}
 
@@ -1140,6 +1158,11 @@ func (node *Node) BlockService() bserv.BlockService {
 	return node.blockservice
 }
 
+// DataTransfer returns the nodes data transfer manager.
+func (node *Node) DataTransfer() *transfer.Manager {
+	return node.dataTransfer
+}
+
 // CborStore returns the nodes cborStore.
 func (node *Node) CborStore() *hamt.CborIpldStore {
 	return node.cborStore
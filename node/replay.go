@@ -0,0 +1,39 @@
+package node
+
+import (
+	"context"
+
+	"gx/ipfs/QmNf3wujpV2Y7Lnj2hy2UrmuX8bhMDStRHbnSLh7Ypf36h/go-hamt-ipld"
+	bstore "gx/ipfs/QmRu7tiRnFk9mMPpVECQTBQJqXtmG132jJxA1w9A7TtpBz/go-ipfs-blockstore"
+	"gx/ipfs/QmSz8kAe2JCKp2dWSG8gHSWnwSmne8YfRXTeK5HBmc9L7t/go-ipfs-exchange-offline"
+	"gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
+	bserv "gx/ipfs/QmZsGVGCqMCNzHLNMB6q4F6yyvomqf1VxwhJwSfgo1NGaF/go-blockservice"
+
+	"github.com/filecoin-project/go-filecoin/chain"
+	"github.com/filecoin-project/go-filecoin/consensus"
+	"github.com/filecoin-project/go-filecoin/proofs"
+	"github.com/filecoin-project/go-filecoin/repo"
+)
+
+// LoadReplayer builds a chain.Replayer over the chain and state stored in r
+// without starting a node.  It wires up consensus the same way Build does so
+// that replayed tipsets are validated exactly as the syncer validated them.
+func LoadReplayer(ctx context.Context, r repo.Repo) (*chain.Replayer, error) {
+	bs := bstore.NewBlockstore(r.Datastore())
+	cst := hamt.CborIpldStore{Blocks: bserv.New(bs, offline.Exchange(bs))}
+
+	genCid, err := readGenesisCid(r.Datastore())
+	if err != nil {
+		return nil, err
+	}
+
+	chainStore := chain.NewDefaultStore(r.ChainDatastore(), &cst, genCid)
+	if err := chainStore.Load(ctx); err != nil {
+		return nil, errors.Wrap(err, "failed to load chain")
+	}
+
+	processor := consensus.NewDefaultProcessor()
+	con := consensus.NewExpected(bs, processor, &consensus.MarketView{}, genCid, &proofs.RustVerifier{})
+
+	return chain.NewReplayer(chainStore, &cst, bs, con, processor), nil
+}
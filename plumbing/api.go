@@ -3,6 +3,7 @@ package plumbing
 import (
 	"context"
 
+	"gx/ipfs/QmNf3wujpV2Y7Lnj2hy2UrmuX8bhMDStRHbnSLh7Ypf36h/go-hamt-ipld"
 	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
 	"gx/ipfs/QmTu65MVbemtUxJEWgsTtzv9Zv9P8rvmqNA4eG9TrTRGYc/go-libp2p-peer"
 	logging "gx/ipfs/QmbkT7eMTyXfpeyB3ZMxxcxg7XH8t6uXp49jqzz4HB7BGF/go-log"
@@ -10,6 +11,7 @@ import (
 	"github.com/filecoin-project/go-filecoin/actor"
 	"github.com/filecoin-project/go-filecoin/address"
 	"github.com/filecoin-project/go-filecoin/chain"
+	"github.com/filecoin-project/go-filecoin/consensus"
 	"github.com/filecoin-project/go-filecoin/core"
 	"github.com/filecoin-project/go-filecoin/exec"
 	"github.com/filecoin-project/go-filecoin/plumbing/cfg"
@@ -17,7 +19,9 @@ import (
 	"github.com/filecoin-project/go-filecoin/plumbing/mthdsig"
 	"github.com/filecoin-project/go-filecoin/plumbing/ntwk"
 	"github.com/filecoin-project/go-filecoin/pubsub"
+	"github.com/filecoin-project/go-filecoin/state"
 	"github.com/filecoin-project/go-filecoin/types"
+	"github.com/filecoin-project/go-filecoin/vm"
 	"github.com/filecoin-project/go-filecoin/wallet"
 )
 
@@ -31,6 +35,7 @@ type API struct {
 
 	chain        chain.ReadStore
 	config       *cfg.Config
+	cst          *hamt.CborIpldStore
 	msgPool      *core.MessagePool
 	msgPreviewer *msg.Previewer
 	msgQueryer   *msg.Queryer
@@ -45,6 +50,7 @@ type API struct {
 type APIDeps struct {
 	Chain        chain.ReadStore
 	Config       *cfg.Config
+	CborStore    *hamt.CborIpldStore
 	MsgPool      *core.MessagePool
 	MsgPreviewer *msg.Previewer
 	MsgQueryer   *msg.Queryer
@@ -62,6 +68,7 @@ func New(deps *APIDeps) *API {
 
 		chain:        deps.Chain,
 		config:       deps.Config,
+		cst:          deps.CborStore,
 		msgPool:      deps.MsgPool,
 		msgPreviewer: deps.MsgPreviewer,
 		msgQueryer:   deps.MsgQueryer,
@@ -101,6 +108,25 @@ func (api *API) ChainHead(ctx context.Context) types.TipSet {
 	return api.chain.Head()
 }
 
+// ChainSampleRandomness samples the chain randomness for the tipset at
+// sampleHeight, as actors processing messages on top of the head do.
+func (api *API) ChainSampleRandomness(ctx context.Context, sampleHeight *types.BlockHeight) ([]byte, error) {
+	head := api.chain.Head()
+	h, err := head.Height()
+	if err != nil {
+		return nil, err
+	}
+	ancestors, err := chain.GetRecentAncestors(ctx, head, api.chain, types.NewBlockHeight(h+1), consensus.AncestorRoundsNeeded, consensus.LookBackParameter)
+	if err != nil {
+		return nil, err
+	}
+	vmCtx := vm.NewVMContext(vm.NewContextParams{
+		Ancestors: ancestors,
+		LookBack:  consensus.LookBackParameter,
+	})
+	return vmCtx.Rand(sampleHeight)
+}
+
 // ChainLs returns a channel of tipsets from head to genesis
 func (api *API) ChainLs(ctx context.Context) <-chan interface{} {
 	return api.chain.BlockHistory(ctx, api.chain.Head())
@@ -120,6 +146,13 @@ func (api *API) BlockGet(ctx context.Context, id cid.Cid) (*types.Block, error)
 	return api.chain.GetBlock(ctx, id)
 }
 
+// StateDiff compares the state trees rooted at the two given cids and reports
+// the actors that were added, removed or changed between them. If withStorage
+// is true the storage of changed actors is decoded and compared as well.
+func (api *API) StateDiff(ctx context.Context, rootA, rootB cid.Cid, withStorage bool) (*state.TreeDiff, error) {
+	return state.Diff(ctx, api.cst, rootA, rootB, withStorage)
+}
+
 // MessagePoolPending lists messages in the pool.
 func (api *API) MessagePoolPending() []*types.SignedMessage {
 	return api.msgPool.Pending()
@@ -5,9 +5,11 @@ import (
 	"math/big"
 
 	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	pstore "gx/ipfs/QmRhFARzTHcFh8wUxwN5KvyTGq73FLC65EfFAhz8Ng7aGb/go-libp2p-peerstore"
 	"gx/ipfs/QmTu65MVbemtUxJEWgsTtzv9Zv9P8rvmqNA4eG9TrTRGYc/go-libp2p-peer"
 
 	minerActor "github.com/filecoin-project/go-filecoin/actor/builtin/miner"
+	"github.com/filecoin-project/go-filecoin/actor/builtin/storagemarket"
 	"github.com/filecoin-project/go-filecoin/address"
 	"github.com/filecoin-project/go-filecoin/plumbing"
 	"github.com/filecoin-project/go-filecoin/types"
@@ -103,11 +105,26 @@ func (a *API) MinerGetOwnerAddress(ctx context.Context, minerAddr address.Addres
 	return MinerGetOwnerAddress(ctx, a, minerAddr)
 }
 
+// MinerGetSectors queries for all sectors committed by the given miner
+func (a *API) MinerGetSectors(ctx context.Context, minerAddr address.Address) ([]*minerActor.Sector, error) {
+	return MinerGetSectors(ctx, a, minerAddr)
+}
+
+// MinerList queries the storage market for the registry info of every miner
+func (a *API) MinerList(ctx context.Context) ([]*storagemarket.MinerInfo, error) {
+	return MinerList(ctx, a)
+}
+
 // MinerGetPeerID queries for the peer id of the given miner
 func (a *API) MinerGetPeerID(ctx context.Context, minerAddr address.Address) (peer.ID, error) {
 	return MinerGetPeerID(ctx, a, minerAddr)
 }
 
+// MinerGetPeerInfo queries for the peer id and multiaddrs of the given miner
+func (a *API) MinerGetPeerInfo(ctx context.Context, minerAddr address.Address) (pstore.PeerInfo, error) {
+	return MinerGetPeerInfo(ctx, a, minerAddr)
+}
+
 // MinerSetPrice configures the price of storage. See implementation for details.
 func (a *API) MinerSetPrice(ctx context.Context, from address.Address, miner address.Address, gasPrice types.AttoFIL, gasLimit types.GasUnits, price *types.AttoFIL, expiry *big.Int) (MinerSetPriceResponse, error) {
 	return MinerSetPrice(ctx, a, from, miner, gasPrice, gasLimit, price, expiry)
@@ -5,13 +5,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"math/big"
+	"sort"
 
+	ma "gx/ipfs/QmNTCey11oxhb1AxDnQBRHtdhap6Ctud872NjAYPYYXPuc/go-multiaddr"
 	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	pstore "gx/ipfs/QmRhFARzTHcFh8wUxwN5KvyTGq73FLC65EfFAhz8Ng7aGb/go-libp2p-peerstore"
 	"gx/ipfs/QmTu65MVbemtUxJEWgsTtzv9Zv9P8rvmqNA4eG9TrTRGYc/go-libp2p-peer"
 	"gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
 	cbor "gx/ipfs/QmcZLyosDwMKdB6NLRsiss9HXzDPhVhhRtPy67JFKTDQDX/go-ipld-cbor"
 
+	"github.com/filecoin-project/go-filecoin/abi"
 	minerActor "github.com/filecoin-project/go-filecoin/actor/builtin/miner"
+	"github.com/filecoin-project/go-filecoin/actor/builtin/storagemarket"
 	"github.com/filecoin-project/go-filecoin/address"
 	"github.com/filecoin-project/go-filecoin/exec"
 	"github.com/filecoin-project/go-filecoin/types"
@@ -249,3 +254,92 @@ func MinerGetPeerID(ctx context.Context, plumbing mgpidAPI, minerAddr address.Ad
 	}
 	return pid, nil
 }
+
+// mgpiAPI is the subset of the plumbing.API that MinerGetPeerInfo uses.
+type mgpiAPI interface {
+	MessageQuery(ctx context.Context, optFrom, to address.Address, method string, params ...interface{}) ([][]byte, *exec.FunctionSignature, error)
+}
+
+// MinerGetPeerInfo queries for the peer id of the given miner along with the
+// multiaddrs it advertises on chain
+func MinerGetPeerInfo(ctx context.Context, plumbing mgpiAPI, minerAddr address.Address) (pstore.PeerInfo, error) {
+	pid, err := MinerGetPeerID(ctx, plumbing, minerAddr)
+	if err != nil {
+		return pstore.PeerInfo{}, err
+	}
+
+	res, _, err := plumbing.MessageQuery(ctx, address.Address{}, minerAddr, "getMultiaddrs")
+	if err != nil {
+		return pstore.PeerInfo{}, err
+	}
+
+	addrs, err := abi.Deserialize(res[0], abi.Multiaddrs)
+	if err != nil {
+		return pstore.PeerInfo{}, errors.Wrap(err, "could not decode multiaddrs from message-bytes")
+	}
+	return pstore.PeerInfo{ID: pid, Addrs: addrs.Val.([]ma.Multiaddr)}, nil
+}
+
+// mgsAPI is the subset of the plumbing.API that MinerGetSectors uses.
+type mgsAPI interface {
+	MessageQuery(ctx context.Context, optFrom, to address.Address, method string, params ...interface{}) ([][]byte, *exec.FunctionSignature, error)
+}
+
+// MinerGetSectors queries for all sectors committed by the given miner,
+// ordered by sector id. Sectors are fetched a page at a time.
+func MinerGetSectors(ctx context.Context, plumbing mgsAPI, minerAddr address.Address) ([]*minerActor.Sector, error) {
+	res, _, err := plumbing.MessageQuery(ctx, address.Address{}, minerAddr, "getSectorCount")
+	if err != nil {
+		return nil, err
+	}
+	count := big.NewInt(0).SetBytes(res[0]).Uint64()
+
+	sectors := []*minerActor.Sector{}
+	for offset := uint64(0); offset < count; offset += minerActor.MaximumSectorPageSize {
+		res, _, err := plumbing.MessageQuery(ctx, address.Address{}, minerAddr, "getSectorsPage", new(big.Int).SetUint64(offset), big.NewInt(minerActor.MaximumSectorPageSize))
+		if err != nil {
+			return nil, err
+		}
+
+		var page []*minerActor.Sector
+		if err := cbor.DecodeInto(res[0], &page); err != nil {
+			return nil, errors.Wrap(err, "could not decode sectors")
+		}
+		sectors = append(sectors, page...)
+	}
+
+	sort.Slice(sectors, func(i, j int) bool { return sectors[i].ID < sectors[j].ID })
+	return sectors, nil
+}
+
+// mlAPI is the subset of the plumbing.API that MinerList uses.
+type mlAPI interface {
+	MessageQuery(ctx context.Context, optFrom, to address.Address, method string, params ...interface{}) ([][]byte, *exec.FunctionSignature, error)
+}
+
+// MinerList queries the storage market for the registry info of every miner,
+// in the order the miners were registered. Miners are fetched a page at a
+// time.
+func MinerList(ctx context.Context, plumbing mlAPI) ([]*storagemarket.MinerInfo, error) {
+	res, _, err := plumbing.MessageQuery(ctx, address.Address{}, address.StorageMarketAddress, "getMinerCount")
+	if err != nil {
+		return nil, err
+	}
+	count := big.NewInt(0).SetBytes(res[0]).Uint64()
+
+	miners := []*storagemarket.MinerInfo{}
+	for offset := uint64(0); offset < count; offset += storagemarket.MaximumMinerPageSize {
+		res, _, err := plumbing.MessageQuery(ctx, address.Address{}, address.StorageMarketAddress, "getMiners", new(big.Int).SetUint64(offset), big.NewInt(storagemarket.MaximumMinerPageSize))
+		if err != nil {
+			return nil, err
+		}
+
+		var page []*storagemarket.MinerInfo
+		if err := cbor.DecodeInto(res[0], &page); err != nil {
+			return nil, errors.Wrap(err, "could not decode miners")
+		}
+		miners = append(miners, page...)
+	}
+
+	return miners, nil
+}
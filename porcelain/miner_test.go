@@ -6,11 +6,14 @@ import (
 	"math/big"
 	"testing"
 
+	ma "gx/ipfs/QmNTCey11oxhb1AxDnQBRHtdhap6Ctud872NjAYPYYXPuc/go-multiaddr"
 	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
 	"gx/ipfs/QmTu65MVbemtUxJEWgsTtzv9Zv9P8rvmqNA4eG9TrTRGYc/go-libp2p-peer"
 	cbor "gx/ipfs/QmcZLyosDwMKdB6NLRsiss9HXzDPhVhhRtPy67JFKTDQDX/go-ipld-cbor"
 
+	"github.com/filecoin-project/go-filecoin/abi"
 	"github.com/filecoin-project/go-filecoin/actor/builtin/miner"
+	"github.com/filecoin-project/go-filecoin/actor/builtin/storagemarket"
 	"github.com/filecoin-project/go-filecoin/address"
 	"github.com/filecoin-project/go-filecoin/exec"
 	"github.com/filecoin-project/go-filecoin/plumbing/cfg"
@@ -385,6 +388,38 @@ func TestMinerGetPeerID(t *testing.T) {
 	assert.Equal(expected, id)
 }
 
+type minerGetPeerInfoPlumbing struct {
+	addrs []ma.Multiaddr
+}
+
+func (mgpi *minerGetPeerInfoPlumbing) MessageQuery(ctx context.Context, optFrom, to address.Address, method string, params ...interface{}) ([][]byte, *exec.FunctionSignature, error) {
+	switch method {
+	case "getPeerID":
+		return [][]byte{[]byte(requirePeerID())}, nil, nil
+	case "getMultiaddrs":
+		out, err := (&abi.Value{Type: abi.Multiaddrs, Val: mgpi.addrs}).Serialize()
+		return [][]byte{out}, nil, err
+	}
+	return nil, nil, errors.New("unexpected method " + method)
+}
+
+func TestMinerGetPeerInfo(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	addr, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/6000")
+	require.NoError(err)
+
+	info, err := MinerGetPeerInfo(context.Background(), &minerGetPeerInfoPlumbing{addrs: []ma.Multiaddr{addr}}, address.TestAddress2)
+	require.NoError(err)
+	assert.Equal(requirePeerID(), info.ID)
+	assert.Equal([]ma.Multiaddr{addr}, info.Addrs)
+
+	info, err = MinerGetPeerInfo(context.Background(), &minerGetPeerInfoPlumbing{}, address.TestAddress2)
+	require.NoError(err)
+	assert.Empty(info.Addrs)
+}
+
 type minerGetAskPlumbing struct{}
 
 func (mgop *minerGetAskPlumbing) MessageQuery(ctx context.Context, optFrom, to address.Address, method string, params ...interface{}) ([][]byte, *exec.FunctionSignature, error) {
@@ -411,6 +446,101 @@ func TestMinerGetAsk(t *testing.T) {
 	assert.Equal(big.NewInt(4), ask.ID)
 }
 
+type minerGetSectorsPlumbing struct {
+	sectors []*miner.Sector
+}
+
+func (mgsp *minerGetSectorsPlumbing) MessageQuery(ctx context.Context, optFrom, to address.Address, method string, params ...interface{}) ([][]byte, *exec.FunctionSignature, error) {
+	switch method {
+	case "getSectorCount":
+		return [][]byte{big.NewInt(int64(len(mgsp.sectors))).Bytes()}, nil, nil
+	case "getSectorsPage":
+		offset := params[0].(*big.Int).Uint64()
+		limit := params[1].(*big.Int).Uint64()
+		end := offset + limit
+		if end > uint64(len(mgsp.sectors)) {
+			end = uint64(len(mgsp.sectors))
+		}
+		out, err := cbor.DumpObject(mgsp.sectors[offset:end])
+		if err != nil {
+			panic("Could not encode sectors")
+		}
+		return [][]byte{out}, nil, nil
+	}
+	return nil, nil, errors.New("unexpected method " + method)
+}
+
+func TestMinerGetSectors(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	plumbing := &minerGetSectorsPlumbing{
+		sectors: []*miner.Sector{
+			{ID: 7, Expiration: types.NewBlockHeight(100), Index: 0},
+			{ID: 3, Index: 1},
+		},
+	}
+
+	sectors, err := MinerGetSectors(context.Background(), plumbing, address.TestAddress2)
+	require.NoError(err)
+	require.Len(sectors, 2)
+
+	assert.Equal(uint64(3), sectors[0].ID)
+	assert.Nil(sectors[0].Expiration)
+	assert.Equal(uint64(7), sectors[1].ID)
+	assert.Equal(types.NewBlockHeight(100), sectors[1].Expiration)
+}
+
+type minerListPlumbing struct {
+	miners []*storagemarket.MinerInfo
+}
+
+func (mlp *minerListPlumbing) MessageQuery(ctx context.Context, optFrom, to address.Address, method string, params ...interface{}) ([][]byte, *exec.FunctionSignature, error) {
+	if to != address.StorageMarketAddress {
+		return nil, nil, errors.New("unexpected actor " + to.String())
+	}
+	switch method {
+	case "getMinerCount":
+		return [][]byte{big.NewInt(int64(len(mlp.miners))).Bytes()}, nil, nil
+	case "getMiners":
+		offset := params[0].(*big.Int).Uint64()
+		limit := params[1].(*big.Int).Uint64()
+		end := offset + limit
+		if end > uint64(len(mlp.miners)) {
+			end = uint64(len(mlp.miners))
+		}
+		out, err := cbor.DumpObject(mlp.miners[offset:end])
+		if err != nil {
+			panic("Could not encode miners")
+		}
+		return [][]byte{out}, nil, nil
+	}
+	return nil, nil, errors.New("unexpected method " + method)
+}
+
+func TestMinerList(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	plumbing := &minerListPlumbing{
+		miners: []*storagemarket.MinerInfo{
+			{Address: address.TestAddress, PeerID: requirePeerID(), Power: big.NewInt(3), Index: 0},
+			{Address: address.TestAddress2, Power: big.NewInt(0), SectorSize: types.NewBytesAmount(1024), Index: 1},
+		},
+	}
+
+	miners, err := MinerList(context.Background(), plumbing)
+	require.NoError(err)
+	require.Len(miners, 2)
+
+	assert.Equal(address.TestAddress, miners[0].Address)
+	assert.Equal(requirePeerID(), miners[0].PeerID)
+	assert.Equal("3", miners[0].Power.String())
+	assert.Nil(miners[0].SectorSize)
+	assert.Equal(address.TestAddress2, miners[1].Address)
+	assert.Equal("1024", miners[1].SectorSize.String())
+}
+
 func requirePeerID() peer.ID {
 	id, err := peer.IDB58Decode("QmWbMozPyW6Ecagtxq7SXBXXLY5BNdP1GwHB2WoZCKMvcb")
 	if err != nil {
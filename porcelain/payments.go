@@ -53,6 +53,21 @@ type CreatePaymentsParams struct {
 
 	// GasLimit is the maximum amount of gas to be paid creating the payment channel.
 	GasLimit types.GasUnits
+
+	// Channel optionally selects an existing channel from From to To to make the payments from. The channel is
+	// extended by Value until ChannelExpiry, which must not be before its current eol. A new channel is created
+	// if Channel is nil.
+	Channel *types.ChannelID
+
+	// Lane is the lane of the channel the vouchers are issued on. Payments for different deals made from the same
+	// channel must use different lanes.
+	Lane uint64
+
+	// PieceRef optionally makes the payments conditional on the storage of the piece with this cid: each voucher
+	// can only be redeemed if the miner actor at MinerAddress holds the piece in a live sector since the voucher's
+	// ValidAt. The vouchers are unconditional if PieceRef is undefined.
+	PieceRef     cid.Cid
+	MinerAddress address.Address
 }
 
 // CreatePaymentsReturn collects relevant stats from the create payments process
@@ -102,16 +117,19 @@ func CreatePayments(ctx context.Context, plumbing cpPlumbing, config CreatePayme
 		CreatePaymentsParams: config,
 	}
 
-	// Create channel
+	// Create channel, or add the value of the payments to the existing one
+	method, params := "createChannel", []interface{}{config.To, &config.ChannelExpiry}
+	if config.Channel != nil {
+		method, params = "extend", []interface{}{config.Channel, &config.ChannelExpiry}
+	}
 	response.ChannelMsgCid, err = plumbing.MessageSend(ctx,
 		config.From,
 		address.PaymentBrokerAddress,
 		&config.Value,
 		config.GasPrice,
 		config.GasLimit,
-		"createChannel",
-		config.To,
-		&config.ChannelExpiry)
+		method,
+		params...)
 	if err != nil {
 		return response, err
 	}
@@ -119,10 +137,14 @@ func CreatePayments(ctx context.Context, plumbing cpPlumbing, config CreatePayme
 	// wait for response
 	err = plumbing.MessageWait(ctx, response.ChannelMsgCid, func(block *types.Block, message *types.SignedMessage, receipt *types.MessageReceipt) error {
 		if receipt.ExitCode != 0 {
-			return fmt.Errorf("createChannel failed %d", receipt.ExitCode)
+			return fmt.Errorf("%s failed %d", method, receipt.ExitCode)
 		}
 
-		response.Channel = types.NewChannelIDFromBytes(receipt.Return[0])
+		if config.Channel != nil {
+			response.Channel = config.Channel
+		} else {
+			response.Channel = types.NewChannelIDFromBytes(receipt.Return[0])
+		}
 		response.GasAttoFIL = receipt.GasAttoFIL
 		return nil
 	})
@@ -146,7 +168,7 @@ func CreatePayments(ctx context.Context, plumbing cpPlumbing, config CreatePayme
 		}
 
 		validAt := currentHeight.Add(types.NewBlockHeight(uint64(i+1) * config.PaymentInterval))
-		err = createPayment(ctx, plumbing, response, voucherAmount, validAt)
+		err = createPayment(ctx, plumbing, response, voucherAmount, validAt, uint64(i))
 		if err != nil {
 			return response, err
 		}
@@ -154,7 +176,7 @@ func CreatePayments(ctx context.Context, plumbing cpPlumbing, config CreatePayme
 
 	if voucherAmount.LessThan(&config.Value) {
 		validAt := currentHeight.Add(types.NewBlockHeight(config.Duration))
-		err = createPayment(ctx, plumbing, response, &config.Value, validAt)
+		err = createPayment(ctx, plumbing, response, &config.Value, validAt, uint64(len(response.Vouchers)))
 		if err != nil {
 			return response, err
 		}
@@ -163,14 +185,33 @@ func CreatePayments(ctx context.Context, plumbing cpPlumbing, config CreatePayme
 	return response, nil
 }
 
-func createPayment(ctx context.Context, plumbing cpPlumbing, response *CreatePaymentsReturn, amount *types.AttoFIL, validAt *types.BlockHeight) error {
+// createPayment creates the voucher with the given nonce on the payments' lane.
+// Each voucher supersedes the ones before it.
+func createPayment(ctx context.Context, plumbing cpPlumbing, response *CreatePaymentsReturn, amount *types.AttoFIL, validAt *types.BlockHeight, nonce uint64) error {
+	var condition *paymentbroker.Condition
+	if response.PieceRef.Defined() {
+		var err error
+		condition, err = paymentbroker.NewPieceInclusionCondition(response.MinerAddress, response.PieceRef, validAt)
+		if err != nil {
+			return err
+		}
+	}
+	encodedCondition, err := paymentbroker.EncodeCondition(condition)
+	if err != nil {
+		return err
+	}
+
 	ret, _, err := plumbing.MessageQuery(ctx,
 		response.From,
 		address.PaymentBrokerAddress,
 		"voucher",
 		response.Channel,
 		amount,
-		validAt)
+		validAt,
+		new(big.Int).SetUint64(response.Lane),
+		new(big.Int).SetUint64(nonce),
+		[]byte{},
+		encodedCondition)
 	if err != nil {
 		return err
 	}
@@ -180,7 +221,7 @@ func createPayment(ctx context.Context, plumbing cpPlumbing, response *CreatePay
 		return err
 	}
 
-	sig, err := paymentbroker.SignVoucher(&voucher.Channel, amount, validAt, voucher.Payer, plumbing)
+	sig, err := paymentbroker.SignVoucher(&voucher, plumbing)
 	if err != nil {
 		return err
 	}
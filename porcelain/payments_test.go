@@ -50,7 +50,9 @@ func newTestCreatePaymentsPlumbing() *paymentsTestPlumbing {
 		tipSets: []*types.TipSet{&tipSet},
 		messageSend: func(ctx context.Context, from, to address.Address, value *types.AttoFIL, gasPrice types.AttoFIL, gasLimit types.GasUnits, method string, params ...interface{}) (cid.Cid, error) {
 			payer = from
-			target = params[0].(address.Address)
+			if method == "createChannel" {
+				target = params[0].(address.Address)
+			}
 			return msgCid, nil
 		},
 		messageWait: func(ctx context.Context, msgCid cid.Cid, cb func(*types.Block, *types.SignedMessage, *types.MessageReceipt) error) error {
@@ -61,12 +63,20 @@ func newTestCreatePaymentsPlumbing() *paymentsTestPlumbing {
 			})
 		},
 		messageQuery: func(ctx context.Context, optFrom, to address.Address, method string, params ...interface{}) ([][]byte, *exec.FunctionSignature, error) {
+			condition, err := paymentbroker.DecodeCondition(params[6].([]byte))
+			if err != nil {
+				panic(err)
+			}
 			voucher := &paymentbroker.PaymentVoucher{
 				Channel: *channelID,
 				Payer:   payer,
 				Target:  target,
 				Amount:  *params[1].(*types.AttoFIL),
 				ValidAt: *params[2].(*types.BlockHeight),
+				Lane:    params[3].(*big.Int).Uint64(),
+				Nonce:   params[4].(*big.Int).Uint64(),
+
+				Condition: condition,
 			}
 			voucherBytes, err := actor.MarshalStorage(voucher)
 			if err != nil {
@@ -162,6 +172,10 @@ func TestCreatePayments(t *testing.T) {
 
 			sig := types.Signature([]byte("signature"))
 			assert.Equal(sig, voucher.Signature)
+
+			// vouchers are issued on lane 0 with increasing nonces
+			assert.Equal(uint64(0), voucher.Lane)
+			assert.Equal(uint64(i), voucher.Nonce)
 		}
 
 		// last payment should be for the full amount
@@ -169,6 +183,63 @@ func TestCreatePayments(t *testing.T) {
 		assert.Equal(config.From, paymentResponse.Vouchers[9].Payer)
 		assert.Equal(config.To, paymentResponse.Vouchers[9].Target)
 		assert.Equal(config.Value, paymentResponse.Vouchers[9].Amount)
+		assert.Equal(uint64(9), paymentResponse.Vouchers[9].Nonce)
+	})
+
+	t.Run("Extends an existing channel and pays on the given lane", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		plumbing := newTestCreatePaymentsPlumbing()
+		var sentMethod string
+		var sentParams []interface{}
+		send := plumbing.messageSend
+		plumbing.messageSend = func(ctx context.Context, from, to address.Address, value *types.AttoFIL, gasPrice types.AttoFIL, gasLimit types.GasUnits, method string, params ...interface{}) (cid.Cid, error) {
+			sentMethod, sentParams = method, params
+			return send(ctx, from, to, value, gasPrice, gasLimit, method, params...)
+		}
+		plumbing.messageWait = func(ctx context.Context, msgCid cid.Cid, cb func(*types.Block, *types.SignedMessage, *types.MessageReceipt) error) error {
+			return cb(nil, nil, &types.MessageReceipt{GasAttoFIL: types.NewAttoFILFromFIL(9)})
+		}
+
+		config := validPaymentsConfig()
+		config.Channel = types.NewChannelID(7)
+		config.Lane = 3
+		paymentResponse, err := CreatePayments(context.Background(), plumbing, config)
+		require.NoError(err)
+
+		assert.Equal("extend", sentMethod)
+		assert.Equal(config.Channel, sentParams[0])
+		assert.Equal(config.Channel, paymentResponse.Channel)
+
+		require.Len(paymentResponse.Vouchers, 10)
+		for _, voucher := range paymentResponse.Vouchers {
+			assert.Equal(uint64(3), voucher.Lane)
+		}
+	})
+
+	t.Run("Conditions payments on the storage of the piece", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		config := validPaymentsConfig()
+		paymentResponse, err := CreatePayments(context.Background(), newTestCreatePaymentsPlumbing(), config)
+		require.NoError(err)
+		for _, voucher := range paymentResponse.Vouchers {
+			assert.Nil(voucher.Condition)
+		}
+
+		config.PieceRef = types.SomeCid()
+		config.MinerAddress = address.NewForTestGetter()()
+		paymentResponse, err = CreatePayments(context.Background(), newTestCreatePaymentsPlumbing(), config)
+		require.NoError(err)
+
+		require.Len(paymentResponse.Vouchers, 10)
+		for _, voucher := range paymentResponse.Vouchers {
+			expected, err := paymentbroker.NewPieceInclusionCondition(config.MinerAddress, config.PieceRef, &voucher.ValidAt)
+			require.NoError(err)
+			assert.Equal(expected, voucher.Condition)
+		}
 	})
 
 	t.Run("Validates from", func(t *testing.T) {
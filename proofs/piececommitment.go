@@ -0,0 +1,83 @@
+package proofs
+
+import (
+	"crypto/sha256"
+	"io"
+
+	"gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
+)
+
+// GeneratePieceCommitment computes the commitment of the piece read from r.
+// The piece is split into leaves of CommitmentBytesLen bytes, the last one
+// padded with zeros, and the commitment is the root of the binary sha256
+// merkle tree over the leaves. Trees whose number of leaves is not a power of
+// two are padded with zero leaves.
+//
+// This is not the piece commitment of the sector builder, and it cannot be
+// checked against the CommD of the sector the piece is sealed into: the rust
+// proofs library does not export piece commitments yet, and it builds CommD
+// over the preprocessed bytes of the whole sector. Until it does, CommP only
+// binds the client and the miner to the same piece bytes. It should then be
+// replaced by the library's commitment.
+func GeneratePieceCommitment(r io.Reader) (CommP, error) {
+	var stack []subtree
+	var leaf [CommitmentBytesLen]byte
+	for {
+		n, err := io.ReadFull(r, leaf[:])
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return CommP{}, errors.Wrap(err, "failed to read piece")
+		}
+		for i := n; i < len(leaf); i++ {
+			leaf[i] = 0
+		}
+		stack = pushSubtree(stack, subtree{root: leaf, level: 0})
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	if len(stack) == 0 {
+		return CommP{}, nil
+	}
+
+	// pad the smallest subtrees with zero subtrees of their size until they
+	// merge into a single tree
+	for len(stack) > 1 {
+		top := stack[len(stack)-1]
+		stack = pushSubtree(stack, subtree{root: zeroSubtree(top.level), level: top.level})
+	}
+	return CommP(stack[0].root), nil
+}
+
+// subtree is the root of a complete merkle tree with 2^level leaves.
+type subtree struct {
+	root  [CommitmentBytesLen]byte
+	level int
+}
+
+// pushSubtree adds t to the stack of subtrees, whose levels decrease from
+// bottom to top, merging subtrees of the same level.
+func pushSubtree(stack []subtree, t subtree) []subtree {
+	for len(stack) > 0 && stack[len(stack)-1].level == t.level {
+		left := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		t = subtree{root: hashNodes(left.root, t.root), level: t.level + 1}
+	}
+	return append(stack, t)
+}
+
+// zeroSubtree returns the root of the tree with 2^level zero leaves.
+func zeroSubtree(level int) [CommitmentBytesLen]byte {
+	var root [CommitmentBytesLen]byte
+	for i := 0; i < level; i++ {
+		root = hashNodes(root, root)
+	}
+	return root
+}
+
+func hashNodes(left, right [CommitmentBytesLen]byte) [CommitmentBytesLen]byte {
+	return sha256.Sum256(append(left[:], right[:]...))
+}
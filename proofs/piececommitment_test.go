@@ -0,0 +1,45 @@
+package proofs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/assert"
+	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/require"
+)
+
+func TestGeneratePieceCommitment(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	commP := func(data []byte) CommP {
+		c, err := GeneratePieceCommitment(bytes.NewReader(data))
+		require.NoError(err)
+		return c
+	}
+	leaf := func(b byte) []byte {
+		return bytes.Repeat([]byte{b}, int(CommitmentBytesLen))
+	}
+	hash := func(left, right []byte) []byte {
+		h := sha256.Sum256(append(append([]byte{}, left...), right...))
+		return h[:]
+	}
+
+	// a single leaf is its own commitment
+	assert.Equal(leaf(1), commP(leaf(1))[:])
+
+	// the last leaf is padded with zeros
+	short := commP([]byte{1, 2, 3})
+	assert.Equal(append([]byte{1, 2, 3}, make([]byte, CommitmentBytesLen-3)...), short[:])
+
+	// three leaves are padded with a zero leaf
+	data := append(append(leaf(1), leaf(2)...), leaf(3)...)
+	want := hash(hash(leaf(1), leaf(2)), hash(leaf(3), leaf(0)))
+	assert.Equal(want, commP(data)[:])
+
+	// any change to the piece changes the commitment
+	changed := append([]byte{}, data...)
+	changed[len(changed)-1] = 4
+	assert.NotEqual(commP(data), commP(changed))
+}
@@ -77,6 +77,9 @@ type SectorSealResult struct {
 type PieceInfo struct {
 	Ref  cid.Cid `json:"ref"`
 	Size uint64  `json:"size"` // TODO: use BytesAmount
+
+	// CommP is the piece commitment the client proposed the piece with.
+	CommP proofs.CommP `json:"commP"`
 }
 
 // SealedSectorMetadata is a sector that has been sealed by the PoRep setup process
@@ -32,3 +32,8 @@ type CommD [CommitmentBytesLen]byte
 // CommRStar is a hash of intermediate layers. It is an output of the sector
 // sealing (PoRep) process.
 type CommRStar [CommitmentBytesLen]byte
+
+// CommP is the merkle root of the bytes of a piece. Clients include it in
+// their deal proposals so that miners can check they received the right data.
+// It is computed by GeneratePieceCommitment, not by the sector builder.
+type CommP [CommitmentBytesLen]byte
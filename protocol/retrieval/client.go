@@ -7,7 +7,7 @@ import (
 	"io/ioutil"
 
 	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
-	"gx/ipfs/QmTu65MVbemtUxJEWgsTtzv9Zv9P8rvmqNA4eG9TrTRGYc/go-libp2p-peer"
+	pstore "gx/ipfs/QmRhFARzTHcFh8wUxwN5KvyTGq73FLC65EfFAhz8Ng7aGb/go-libp2p-peerstore"
 	"gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
 	host "gx/ipfs/Qmd52WKRSwrBK5gUaJKawryZQ5by6UbNB8KVW2Zy6JtbyW/go-libp2p-host"
 
@@ -36,9 +36,12 @@ func NewClient(nd clientNode) *Client {
 	}
 }
 
-// RetrievePiece connects to a miner and transfers a piece of content.
-func (sc *Client) RetrievePiece(ctx context.Context, minerPeerID peer.ID, pieceCID cid.Cid) (io.ReadCloser, error) {
-	s, err := sc.node.Host().NewStream(ctx, minerPeerID, retrievalFreeProtocol)
+// RetrievePiece connects to a miner and transfers a piece of content. The
+// miner is dialed on the multiaddrs in minerPeer, if it has any.
+func (sc *Client) RetrievePiece(ctx context.Context, minerPeer pstore.PeerInfo, pieceCID cid.Cid) (io.ReadCloser, error) {
+	sc.node.Host().Peerstore().AddAddrs(minerPeer.ID, minerPeer.Addrs, pstore.TempAddrTTL)
+
+	s, err := sc.node.Host().NewStream(ctx, minerPeer.ID, retrievalFreeProtocol)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create stream to retrieval miner")
 	}
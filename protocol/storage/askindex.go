@@ -0,0 +1,355 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	"gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
+	cbor "gx/ipfs/QmcZLyosDwMKdB6NLRsiss9HXzDPhVhhRtPy67JFKTDQDX/go-ipld-cbor"
+
+	"github.com/filecoin-project/go-filecoin/actor/builtin/miner"
+	"github.com/filecoin-project/go-filecoin/actor/builtin/storagemarket"
+	"github.com/filecoin-project/go-filecoin/address"
+	"github.com/filecoin-project/go-filecoin/exec"
+	"github.com/filecoin-project/go-filecoin/porcelain"
+	"github.com/filecoin-project/go-filecoin/state"
+	"github.com/filecoin-project/go-filecoin/types"
+)
+
+const (
+	// SortAsksByPrice orders asks from cheapest to most expensive.
+	SortAsksByPrice = "price"
+	// SortAsksByExpiry orders asks from soonest to latest expiry.
+	SortAsksByExpiry = "expiry"
+	// SortAsksByPower orders asks from the most to the least powerful miner.
+	SortAsksByPower = "power"
+)
+
+// IndexedAsk is an open ask together with the state of the miner offering it.
+type IndexedAsk struct {
+	Miner  address.Address
+	ID     uint64
+	Price  *types.AttoFIL
+	Expiry *types.BlockHeight
+
+	// Power is the storage power of the miner.
+	Power *big.Int
+
+	// FreeSectors is the number of sectors the miner has pledged but not yet
+	// committed, which bounds how much more data it can take on.
+	FreeSectors uint64
+}
+
+// AskFilter selects asks from the index. Zero values match every ask.
+type AskFilter struct {
+	// MaxPrice excludes asks more expensive than it.
+	MaxPrice *types.AttoFIL
+
+	// MinFreeSectors excludes miners with less free pledged capacity.
+	MinFreeSectors uint64
+
+	// MinPower excludes miners with less storage power.
+	MinPower *big.Int
+
+	// SortBy is one of the SortAsksBy constants, and defaults to price.
+	SortBy string
+}
+
+type askIndexChain interface {
+	Head() types.TipSet
+	LatestState(ctx context.Context) (state.Tree, error)
+}
+
+type askIndexPorcelain interface {
+	MessageQuery(ctx context.Context, optFrom, to address.Address, method string, params ...interface{}) ([][]byte, *exec.FunctionSignature, error)
+}
+
+// AskIndex keeps the open asks of every miner in the storage market, so that
+// clients can search them without querying each miner actor in turn. It is
+// updated in the background every time a new heaviest tipset is processed,
+// only querying the miners whose actor state changed since the last update,
+// and searches are served from the last index built.
+type AskIndex struct {
+	chain        askIndexChain
+	porcelainAPI askIndexPorcelain
+
+	mu    sync.Mutex
+	asks  []*IndexedAsk
+	built bool
+
+	// updating is set while a background update runs, and stale when a new
+	// heaviest tipset arrived since it started.
+	updating bool
+	stale    bool
+
+	// updateMu serializes updates, which share miners: the asks of every
+	// miner indexed, along with the head of its actor they were read from.
+	updateMu sync.Mutex
+	miners   map[address.Address]*indexedMiner
+}
+
+type indexedMiner struct {
+	head cid.Cid
+	asks []*IndexedAsk
+}
+
+// NewAskIndex creates an empty ask index. It is built on the first call to
+// Update or Asks.
+func NewAskIndex(chain askIndexChain, porcelainAPI askIndexPorcelain) *AskIndex {
+	return &AskIndex{
+		chain:        chain,
+		porcelainAPI: porcelainAPI,
+		miners:       map[address.Address]*indexedMiner{},
+	}
+}
+
+// OnNewHeaviestTipSet is a callback called by node, everytime the latest head
+// is updated. It starts updating the index in the background, or has the
+// running update go again once it is done.
+func (ai *AskIndex) OnNewHeaviestTipSet(ts types.TipSet) {
+	ai.mu.Lock()
+	defer ai.mu.Unlock()
+
+	if ai.updating {
+		ai.stale = true
+		return
+	}
+	ai.updating = true
+	go ai.updateInBackground()
+}
+
+// updateInBackground updates the index until no new heaviest tipset arrived
+// during the last update.
+func (ai *AskIndex) updateInBackground() {
+	for {
+		if err := ai.Update(context.Background()); err != nil {
+			log.Errorf("failed to update ask index: %s", err)
+		}
+
+		ai.mu.Lock()
+		if !ai.stale {
+			ai.updating = false
+			ai.mu.Unlock()
+			return
+		}
+		ai.stale = false
+		ai.mu.Unlock()
+	}
+}
+
+// Update brings the index up to date with the latest chain state. Miners are
+// listed from the storage market, and only those whose actor head changed
+// since the last update are queried for their asks. Miners whose asks cannot
+// be read are left out of the index.
+func (ai *AskIndex) Update(ctx context.Context) error {
+	ai.updateMu.Lock()
+	defer ai.updateMu.Unlock()
+
+	st, err := ai.chain.LatestState(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to load state tree")
+	}
+	height, err := ai.headHeight()
+	if err != nil {
+		return err
+	}
+
+	infos, err := porcelain.MinerList(ctx, ai.porcelainAPI)
+	if err != nil {
+		return errors.Wrap(err, "failed to list miners")
+	}
+
+	asks := []*IndexedAsk{}
+	miners := make(map[address.Address]*indexedMiner, len(infos))
+	for _, info := range infos {
+		act, err := st.GetActor(ctx, info.Address)
+		if err != nil {
+			log.Warningf("leaving miner %s out of the ask index: %s", info.Address, err)
+			continue
+		}
+
+		m, ok := ai.miners[info.Address]
+		if !ok || !m.head.Equals(act.Head) {
+			minerAsks, err := ai.minerAsks(ctx, info)
+			if err != nil {
+				log.Warningf("leaving miner %s out of the ask index: %s", info.Address, err)
+				continue
+			}
+			m = &indexedMiner{head: act.Head, asks: minerAsks}
+		}
+
+		// asks expire without their miner's state changing
+		open := []*IndexedAsk{}
+		for _, ask := range m.asks {
+			if height == nil || height.LessThan(ask.Expiry) {
+				open = append(open, ask)
+			}
+		}
+		m = &indexedMiner{head: m.head, asks: open}
+
+		miners[info.Address] = m
+		asks = append(asks, m.asks...)
+	}
+	ai.miners = miners
+
+	ai.mu.Lock()
+	defer ai.mu.Unlock()
+	ai.asks = asks
+	ai.built = true
+	return nil
+}
+
+// headHeight returns the height of the chain head, or nil if there is none.
+func (ai *AskIndex) headHeight() (*types.BlockHeight, error) {
+	head := ai.chain.Head()
+	if len(head) == 0 {
+		return nil, nil
+	}
+	h, err := head.Height()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get head height")
+	}
+	return types.NewBlockHeight(h), nil
+}
+
+// Asks returns the indexed asks matching the filter, sorted as it requests.
+// They are read from the last index built, which is only built here if no
+// update completed yet.
+func (ai *AskIndex) Asks(ctx context.Context, filter AskFilter) ([]*IndexedAsk, error) {
+	less, err := askOrder(filter.SortBy)
+	if err != nil {
+		return nil, err
+	}
+
+	ai.mu.Lock()
+	built := ai.built
+	ai.mu.Unlock()
+	if !built {
+		if err := ai.Update(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	ai.mu.Lock()
+	defer ai.mu.Unlock()
+
+	out := []*IndexedAsk{}
+	for _, ask := range ai.asks {
+		if filter.MaxPrice != nil && ask.Price.GreaterThan(filter.MaxPrice) {
+			continue
+		}
+		if ask.FreeSectors < filter.MinFreeSectors {
+			continue
+		}
+		if filter.MinPower != nil && ask.Power.Cmp(filter.MinPower) < 0 {
+			continue
+		}
+		out = append(out, ask)
+	}
+
+	sort.SliceStable(out, func(i, j int) bool { return less(out[i], out[j]) })
+	return out, nil
+}
+
+// minerAsks reads the open asks of a miner along with its free capacity. The
+// power of the miner is the one the storage market registry records.
+func (ai *AskIndex) minerAsks(ctx context.Context, info *storagemarket.MinerInfo) ([]*IndexedAsk, error) {
+	minerAddr := info.Address
+	power := info.Power
+	if power == nil {
+		power = big.NewInt(0)
+	}
+	pledge, err := ai.queryInteger(ctx, minerAddr, "getPledge")
+	if err != nil {
+		return nil, err
+	}
+	sectorCount, err := ai.queryInteger(ctx, minerAddr, "getSectorCount")
+	if err != nil {
+		return nil, err
+	}
+
+	var freeSectors uint64
+	if pledge.Cmp(sectorCount) > 0 {
+		freeSectors = new(big.Int).Sub(pledge, sectorCount).Uint64()
+	}
+
+	ret, _, err := ai.porcelainAPI.MessageQuery(ctx, address.Address{}, minerAddr, "getAsks")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query asks")
+	}
+	var askIDs []uint64
+	if err := cbor.DecodeInto(ret[0], &askIDs); err != nil {
+		return nil, errors.Wrap(err, "failed to decode ask ids")
+	}
+
+	asks := make([]*IndexedAsk, 0, len(askIDs))
+	for _, id := range askIDs {
+		ret, _, err := ai.porcelainAPI.MessageQuery(ctx, address.Address{}, minerAddr, "getAsk", new(big.Int).SetUint64(id))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to query ask %d", id)
+		}
+		var ask miner.Ask
+		if err := cbor.DecodeInto(ret[0], &ask); err != nil {
+			return nil, errors.Wrapf(err, "failed to decode ask %d", id)
+		}
+
+		asks = append(asks, &IndexedAsk{
+			Miner:       minerAddr,
+			ID:          id,
+			Price:       ask.Price,
+			Expiry:      ask.Expiry,
+			Power:       power,
+			FreeSectors: freeSectors,
+		})
+	}
+	return asks, nil
+}
+
+func (ai *AskIndex) queryInteger(ctx context.Context, minerAddr address.Address, method string) (*big.Int, error) {
+	ret, _, err := ai.porcelainAPI.MessageQuery(ctx, address.Address{}, minerAddr, method)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query %s", method)
+	}
+	return new(big.Int).SetBytes(ret[0]), nil
+}
+
+// askOrder returns the ordering of asks named by sortBy. Ties are broken by
+// miner address and ask id so that listings are stable.
+func askOrder(sortBy string) (func(a, b *IndexedAsk) bool, error) {
+	tieBreak := func(a, b *IndexedAsk) bool {
+		if a.Miner != b.Miner {
+			return a.Miner.String() < b.Miner.String()
+		}
+		return a.ID < b.ID
+	}
+
+	switch sortBy {
+	case "", SortAsksByPrice:
+		return func(a, b *IndexedAsk) bool {
+			if !a.Price.Equal(b.Price) {
+				return a.Price.LessThan(b.Price)
+			}
+			return tieBreak(a, b)
+		}, nil
+	case SortAsksByExpiry:
+		return func(a, b *IndexedAsk) bool {
+			if !a.Expiry.Equal(b.Expiry) {
+				return a.Expiry.LessThan(b.Expiry)
+			}
+			return tieBreak(a, b)
+		}, nil
+	case SortAsksByPower:
+		return func(a, b *IndexedAsk) bool {
+			if c := a.Power.Cmp(b.Power); c != 0 {
+				return c > 0
+			}
+			return tieBreak(a, b)
+		}, nil
+	default:
+		return nil, fmt.Errorf("cannot sort asks by %q, expected one of %s, %s or %s", sortBy, SortAsksByPrice, SortAsksByExpiry, SortAsksByPower)
+	}
+}
@@ -0,0 +1,278 @@
+package storage
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"gx/ipfs/QmNf3wujpV2Y7Lnj2hy2UrmuX8bhMDStRHbnSLh7Ypf36h/go-hamt-ipld"
+	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/assert"
+	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/require"
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	"gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
+	cbor "gx/ipfs/QmcZLyosDwMKdB6NLRsiss9HXzDPhVhhRtPy67JFKTDQDX/go-ipld-cbor"
+
+	"github.com/filecoin-project/go-filecoin/actor"
+	"github.com/filecoin-project/go-filecoin/actor/builtin/miner"
+	"github.com/filecoin-project/go-filecoin/actor/builtin/storagemarket"
+	"github.com/filecoin-project/go-filecoin/address"
+	"github.com/filecoin-project/go-filecoin/exec"
+	"github.com/filecoin-project/go-filecoin/state"
+	"github.com/filecoin-project/go-filecoin/types"
+)
+
+func TestAskIndex(t *testing.T) {
+	ctx := context.Background()
+	addrGetter := address.NewForTestGetter()
+	cheap, pricey, broken := addrGetter(), addrGetter(), addrGetter()
+
+	api := &askIndexTestAPI{
+		st:       state.NewEmptyStateTree(hamt.NewCborStore()),
+		registry: []address.Address{cheap, pricey, broken},
+		queries:  map[address.Address]int{},
+		miners: map[address.Address]*askIndexTestMiner{
+			cheap: {
+				power: 10, pledge: 10, sectors: 10,
+				asks: []miner.Ask{
+					{ID: big.NewInt(0), Price: types.NewAttoFILFromFIL(2), Expiry: types.NewBlockHeight(50)},
+					{ID: big.NewInt(1), Price: types.NewAttoFILFromFIL(1), Expiry: types.NewBlockHeight(100)},
+				},
+			},
+			pricey: {
+				power: 100, pledge: 20, sectors: 5,
+				asks: []miner.Ask{
+					{ID: big.NewInt(0), Price: types.NewAttoFILFromFIL(5), Expiry: types.NewBlockHeight(20)},
+				},
+			},
+			broken: {},
+		},
+	}
+	for addr := range api.miners {
+		require.NoError(t, api.st.SetActor(ctx, addr, actor.NewActor(types.MinerActorCodeCid, types.NewZeroAttoFIL())))
+	}
+	require.NoError(t, api.st.SetActor(ctx, addrGetter(), actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())))
+
+	askKeys := func(asks []*IndexedAsk) []string {
+		var keys []string
+		for _, ask := range asks {
+			keys = append(keys, ask.Miner.String()+"/"+ask.Price.String())
+		}
+		return keys
+	}
+
+	t.Run("builds the index on first use and sorts by price", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		asks, err := NewAskIndex(api, api).Asks(ctx, AskFilter{})
+		require.NoError(err)
+		assert.Equal([]string{cheap.String() + "/1", cheap.String() + "/2", pricey.String() + "/5"}, askKeys(asks))
+
+		assert.Equal("100", asks[2].Power.String())
+		assert.Equal(uint64(15), asks[2].FreeSectors)
+		assert.Equal(uint64(0), asks[0].FreeSectors)
+	})
+
+	t.Run("filters by price, power and free sectors", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		index := NewAskIndex(api, api)
+		require.NoError(index.Update(ctx))
+
+		asks, err := index.Asks(ctx, AskFilter{MaxPrice: types.NewAttoFILFromFIL(2)})
+		require.NoError(err)
+		assert.Equal([]string{cheap.String() + "/1", cheap.String() + "/2"}, askKeys(asks))
+
+		asks, err = index.Asks(ctx, AskFilter{MinPower: big.NewInt(11)})
+		require.NoError(err)
+		assert.Equal([]string{pricey.String() + "/5"}, askKeys(asks))
+
+		asks, err = index.Asks(ctx, AskFilter{MinFreeSectors: 1})
+		require.NoError(err)
+		assert.Equal([]string{pricey.String() + "/5"}, askKeys(asks))
+	})
+
+	t.Run("sorts by expiry and power", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		index := NewAskIndex(api, api)
+
+		asks, err := index.Asks(ctx, AskFilter{SortBy: SortAsksByExpiry})
+		require.NoError(err)
+		assert.Equal([]string{pricey.String() + "/5", cheap.String() + "/2", cheap.String() + "/1"}, askKeys(asks))
+
+		asks, err = index.Asks(ctx, AskFilter{SortBy: SortAsksByPower})
+		require.NoError(err)
+		assert.Equal(pricey, asks[0].Miner)
+
+		_, err = index.Asks(ctx, AskFilter{SortBy: "color"})
+		assert.Error(err)
+	})
+
+	t.Run("picks up asks added after an update", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		index := NewAskIndex(api, api)
+		require.NoError(index.Update(ctx))
+
+		api.miners[pricey].asks = append(api.miners[pricey].asks, miner.Ask{ID: big.NewInt(1), Price: types.NewAttoFILFromFIL(3), Expiry: types.NewBlockHeight(20)})
+		api.setHead(require, pricey, types.SomeCid())
+		defer func() { api.miners[pricey].asks = api.miners[pricey].asks[:1] }()
+
+		// searches are served from the last index built
+		asks, err := index.Asks(ctx, AskFilter{})
+		require.NoError(err)
+		assert.Len(asks, 3)
+
+		index.OnNewHeaviestTipSet(nil)
+		waitForAskIndexUpdate(index)
+		asks, err = index.Asks(ctx, AskFilter{})
+		require.NoError(err)
+		assert.Len(asks, 4)
+	})
+
+	t.Run("only queries the miners whose actor changed", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		index := NewAskIndex(api, api)
+		require.NoError(index.Update(ctx))
+		cheapQueries, priceyQueries := api.queries[cheap], api.queries[pricey]
+
+		require.NoError(index.Update(ctx))
+		assert.Equal(cheapQueries, api.queries[cheap])
+		assert.Equal(priceyQueries, api.queries[pricey])
+
+		api.setHead(require, cheap, types.NewCidForTestGetter()())
+		require.NoError(index.Update(ctx))
+		assert.True(api.queries[cheap] > cheapQueries)
+		assert.Equal(priceyQueries, api.queries[pricey])
+	})
+
+	t.Run("drops the asks that expired since they were read", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		index := NewAskIndex(api, api)
+		require.NoError(index.Update(ctx))
+
+		head, err := types.NewTipSet(&types.Block{Height: 50})
+		require.NoError(err)
+		api.head = head
+		defer func() { api.head = nil }()
+
+		require.NoError(index.Update(ctx))
+		asks, err := index.Asks(ctx, AskFilter{})
+		require.NoError(err)
+		assert.Equal([]string{cheap.String() + "/1"}, askKeys(asks))
+	})
+
+	t.Run("does not wait for a running update", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		index := NewAskIndex(api, api)
+		require.NoError(index.Update(ctx))
+
+		index.updateMu.Lock()
+		defer index.updateMu.Unlock()
+		asks, err := index.Asks(ctx, AskFilter{})
+		require.NoError(err)
+		assert.Len(asks, 3)
+	})
+}
+
+// waitForAskIndexUpdate waits for the background update of the index to
+// complete.
+func waitForAskIndexUpdate(index *AskIndex) {
+	for {
+		index.mu.Lock()
+		updating := index.updating
+		index.mu.Unlock()
+		if !updating {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type askIndexTestMiner struct {
+	power, pledge, sectors int64
+	asks                   []miner.Ask
+}
+
+type askIndexTestAPI struct {
+	st       state.Tree
+	head     types.TipSet
+	registry []address.Address
+	miners   map[address.Address]*askIndexTestMiner
+
+	// queries counts the queries sent to every miner.
+	queries map[address.Address]int
+}
+
+func (api *askIndexTestAPI) Head() types.TipSet {
+	return api.head
+}
+
+func (api *askIndexTestAPI) LatestState(ctx context.Context) (state.Tree, error) {
+	return api.st, nil
+}
+
+// setHead changes the head of the miner's actor, as a message to it would.
+func (api *askIndexTestAPI) setHead(require *require.Assertions, minerAddr address.Address, head cid.Cid) {
+	act, err := api.st.GetActor(context.Background(), minerAddr)
+	require.NoError(err)
+	act.Head = head
+	require.NoError(api.st.SetActor(context.Background(), minerAddr, act))
+}
+
+func (api *askIndexTestAPI) MessageQuery(ctx context.Context, optFrom, to address.Address, method string, params ...interface{}) ([][]byte, *exec.FunctionSignature, error) {
+	if to == address.StorageMarketAddress {
+		switch method {
+		case "getMinerCount":
+			return [][]byte{big.NewInt(int64(len(api.registry))).Bytes()}, nil, nil
+		case "getMiners":
+			var infos []*storagemarket.MinerInfo
+			for _, addr := range api.registry {
+				infos = append(infos, &storagemarket.MinerInfo{Address: addr, Power: big.NewInt(api.miners[addr].power)})
+			}
+			out, err := cbor.DumpObject(infos)
+			return [][]byte{out}, nil, err
+		}
+		return nil, nil, errors.Errorf("unexpected method %s", method)
+	}
+
+	api.queries[to]++
+	m := api.miners[to]
+	if m.asks == nil {
+		return nil, nil, errors.New("miner unavailable")
+	}
+
+	switch method {
+	case "getPledge":
+		return [][]byte{big.NewInt(m.pledge).Bytes()}, nil, nil
+	case "getSectorCount":
+		return [][]byte{big.NewInt(m.sectors).Bytes()}, nil, nil
+	case "getAsks":
+		var ids []uint64
+		for _, ask := range m.asks {
+			ids = append(ids, ask.ID.Uint64())
+		}
+		out, err := cbor.DumpObject(ids)
+		return [][]byte{out}, nil, err
+	case "getAsk":
+		for _, ask := range m.asks {
+			if ask.ID.Cmp(params[0].(*big.Int)) == 0 {
+				out, err := cbor.DumpObject(ask)
+				return [][]byte{out}, nil, err
+			}
+		}
+		return nil, nil, errors.New("ask not found")
+	}
+	return nil, nil, errors.Errorf("unexpected method %s", method)
+}
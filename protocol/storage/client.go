@@ -9,6 +9,7 @@ import (
 
 	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
 	ipld "gx/ipfs/QmRL22E4paat7ky7vx9MLpR97JHHbFPrg3ytFQw6qp1y1s/go-ipld-format"
+	pstore "gx/ipfs/QmRhFARzTHcFh8wUxwN5KvyTGq73FLC65EfFAhz8Ng7aGb/go-libp2p-peerstore"
 	"gx/ipfs/QmTu65MVbemtUxJEWgsTtzv9Zv9P8rvmqNA4eG9TrTRGYc/go-libp2p-peer"
 	"gx/ipfs/QmUadX5EcvrBmxAV9sE7wUWtWSqxns5K84qKJBixmcT1w9/go-datastore"
 	"gx/ipfs/QmUadX5EcvrBmxAV9sE7wUWtWSqxns5K84qKJBixmcT1w9/go-datastore/query"
@@ -20,9 +21,11 @@ import (
 
 	"github.com/filecoin-project/go-filecoin/actor/builtin/miner"
 	"github.com/filecoin-project/go-filecoin/actor/builtin/paymentbroker"
+	"github.com/filecoin-project/go-filecoin/actor/builtin/storagemarket"
 	"github.com/filecoin-project/go-filecoin/address"
 	cbu "github.com/filecoin-project/go-filecoin/cborutil"
 	"github.com/filecoin-project/go-filecoin/porcelain"
+	"github.com/filecoin-project/go-filecoin/proofs"
 	"github.com/filecoin-project/go-filecoin/repo"
 	"github.com/filecoin-project/go-filecoin/types"
 	"github.com/filecoin-project/go-filecoin/util/convert"
@@ -57,7 +60,8 @@ const (
 
 type clientNode interface {
 	GetFileSize(context.Context, cid.Cid) (uint64, error)
-	MakeProtocolRequest(ctx context.Context, protocol protocol.ID, peer peer.ID, request interface{}, response interface{}) error
+	GetPieceCommitment(context.Context, cid.Cid) (proofs.CommP, error)
+	MakeProtocolRequest(ctx context.Context, protocol protocol.ID, peer pstore.PeerInfo, request interface{}, response interface{}) error
 	GetBlockTime() time.Duration
 }
 
@@ -67,7 +71,7 @@ type clientPorcelainAPI interface {
 	GetAndMaybeSetDefaultSenderAddress() (address.Address, error)
 	MinerGetAsk(ctx context.Context, minerAddr address.Address, askID uint64) (miner.Ask, error)
 	MinerGetOwnerAddress(ctx context.Context, minerAddr address.Address) (address.Address, error)
-	MinerGetPeerID(ctx context.Context, minerAddr address.Address) (peer.ID, error)
+	MinerGetPeerInfo(ctx context.Context, minerAddr address.Address) (pstore.PeerInfo, error)
 	types.Signer
 }
 
@@ -75,6 +79,27 @@ type clientDeal struct {
 	Miner    address.Address
 	Proposal *DealProposal
 	Response *DealResponse
+
+	// History records every state the client saw the deal move through.
+	History []*DealEvent
+}
+
+// transition moves the deal to the state the miner reported in resp,
+// recording the transition in its history.
+func (d *clientDeal) transition(resp *DealResponse) error {
+	reason := resp.Message
+	if reason == "" {
+		reason = "reported by miner"
+	}
+	event, err := clientDealStates.transition(d.Response, resp.State, reason)
+	if err != nil {
+		return err
+	}
+	d.History = append(d.History, event)
+	d.Response.Message = resp.Message
+	d.Response.ProofInfo = resp.ProofInfo
+	d.Response.Signature = resp.Signature
+	return nil
 }
 
 // Client is used to make deals directly with storage miners.
@@ -83,6 +108,15 @@ type Client struct {
 	dealsDs repo.Datastore
 	dealsLk sync.Mutex
 
+	// proposing holds the deals proposed to miners that did not respond
+	// yet. Miners pull the data of a deal as soon as they accept it.
+	proposing map[cid.Cid]*clientDeal
+
+	// storing holds the data of the storage orders being placed with
+	// miners. Orders are persisted next to the deals, see StoreReplicas.
+	storing  map[cid.Cid]bool
+	ordersLk sync.Mutex
+
 	node clientNode
 	api  clientPorcelainAPI
 }
@@ -94,10 +128,12 @@ func init() {
 // NewClient creates a new storage client.
 func NewClient(nd clientNode, api clientPorcelainAPI, dealsDs repo.Datastore) (*Client, error) {
 	smc := &Client{
-		deals:   make(map[cid.Cid]*clientDeal),
-		node:    nd,
-		api:     api,
-		dealsDs: dealsDs,
+		deals:     make(map[cid.Cid]*clientDeal),
+		proposing: make(map[cid.Cid]*clientDeal),
+		storing:   make(map[cid.Cid]bool),
+		node:      nd,
+		api:       api,
+		dealsDs:   dealsDs,
 	}
 	if err := smc.loadDeals(); err != nil {
 		return nil, errors.Wrap(err, "failed to load client deals")
@@ -105,8 +141,10 @@ func NewClient(nd clientNode, api clientPorcelainAPI, dealsDs repo.Datastore) (*
 	return smc, nil
 }
 
-// ProposeDeal is
-func (smc *Client) ProposeDeal(ctx context.Context, miner address.Address, data cid.Cid, askID uint64, duration uint64, allowDuplicates bool) (*DealResponse, error) {
+// ProposeDeal proposes a deal to store the data with the miner. If
+// manualTransfer is set the data is delivered to the miner out of band, and
+// the miner waits for it to be imported.
+func (smc *Client) ProposeDeal(ctx context.Context, miner address.Address, data cid.Cid, askID uint64, duration uint64, allowDuplicates, manualTransfer bool) (*DealResponse, error) {
 	ctx, cancel := context.WithTimeout(ctx, 4*smc.node.GetBlockTime())
 	defer cancel()
 	size, err := smc.node.GetFileSize(ctx, data)
@@ -114,6 +152,11 @@ func (smc *Client) ProposeDeal(ctx context.Context, miner address.Address, data
 		return nil, errors.Wrap(err, "failed to determine the size of the data")
 	}
 
+	commP, err := smc.node.GetPieceCommitment(ctx, data)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to compute the piece commitment of the data")
+	}
+
 	ask, err := smc.api.MinerGetAsk(ctx, miner, askID)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get ask price")
@@ -138,11 +181,13 @@ func (smc *Client) ProposeDeal(ctx context.Context, miner address.Address, data
 	totalPrice := price.MulBigInt(big.NewInt(int64(size * duration)))
 
 	proposal := &DealProposal{
-		PieceRef:     data,
-		Size:         types.NewBytesAmount(size),
-		TotalPrice:   totalPrice,
-		Duration:     duration,
-		MinerAddress: miner,
+		PieceRef:       data,
+		CommP:          commP,
+		Size:           types.NewBytesAmount(size),
+		TotalPrice:     totalPrice,
+		Duration:       duration,
+		MinerAddress:   miner,
+		ManualTransfer: manualTransfer,
 	}
 
 	if smc.isMaybeDupDeal(proposal) && !allowDuplicates {
@@ -159,6 +204,8 @@ func (smc *Client) ProposeDeal(ctx context.Context, miner address.Address, data
 		ChannelExpiry:   *chainHeight.Add(types.NewBlockHeight(duration + ChannelExpiryInterval)),
 		GasPrice:        *types.NewAttoFIL(big.NewInt(CreateChannelGasPrice)),
 		GasLimit:        types.NewGasUnits(CreateChannelGasLimit),
+		PieceRef:        data,
+		MinerAddress:    miner,
 	})
 	if err != nil {
 		return nil, errors.Wrap(err, "error creating payment")
@@ -170,19 +217,37 @@ func (smc *Client) ProposeDeal(ctx context.Context, miner address.Address, data
 	proposal.Payment.ChannelMsgCid = &cpResp.ChannelMsgCid
 	proposal.Payment.Vouchers = cpResp.Vouchers
 
+	proposal.MarketSignature, err = storagemarket.SignDealProposal(proposal.MarketProposal(), smc.api)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to sign storage market proposal")
+	}
+
 	signedProposal, err := proposal.NewSignedProposal(fromAddress, smc.api)
 	if err != nil {
 		return nil, err
 	}
 
 	// send proposal
-	pid, err := smc.api.MinerGetPeerID(ctx, miner)
+	minerPeer, err := smc.api.MinerGetPeerInfo(ctx, miner)
 	if err != nil {
 		return nil, err
 	}
 
+	proposalCid, err := convert.ToCid(&signedProposal.DealProposal)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get cid of proposal")
+	}
+	smc.dealsLk.Lock()
+	smc.proposing[proposalCid] = &clientDeal{Miner: miner, Proposal: &signedProposal.DealProposal}
+	smc.dealsLk.Unlock()
+	defer func() {
+		smc.dealsLk.Lock()
+		delete(smc.proposing, proposalCid)
+		smc.dealsLk.Unlock()
+	}()
+
 	var response DealResponse
-	err = smc.node.MakeProtocolRequest(ctx, makeDealProtocol, pid, signedProposal, &response)
+	err = smc.node.MakeProtocolRequest(ctx, makeDealProtocol, minerPeer, signedProposal, &response)
 	if err != nil {
 		return nil, errors.Wrap(err, "error sending proposal")
 	}
@@ -191,7 +256,7 @@ func (smc *Client) ProposeDeal(ctx context.Context, miner address.Address, data
 		return nil, errors.Wrap(err, "response check failed")
 	}
 
-	// Note: currently the miner requests the data out of band
+	// Note: the miner pulls the data with the transfer protocol, see ValidatePull
 
 	if err := smc.recordResponse(&response, miner, &signedProposal.DealProposal); err != nil {
 		return nil, errors.Wrap(err, "failed to track response")
@@ -215,11 +280,15 @@ func (smc *Client) recordResponse(resp *DealResponse, miner address.Address, p *
 		return fmt.Errorf("deal [%s] is already in progress", proposalCid.String())
 	}
 
-	smc.deals[proposalCid] = &clientDeal{
+	deal := &clientDeal{
 		Miner:    miner,
 		Proposal: p,
-		Response: resp,
+		Response: &DealResponse{ProposalCid: proposalCid},
+	}
+	if err := deal.transition(resp); err != nil {
+		return err
 	}
+	smc.deals[proposalCid] = deal
 	return smc.saveDeal(proposalCid)
 }
 
@@ -254,21 +323,82 @@ func (smc *Client) QueryDeal(ctx context.Context, proposalCid cid.Cid) (*DealRes
 		return nil, err
 	}
 
-	minerpid, err := smc.api.MinerGetPeerID(ctx, mineraddr)
+	minerPeer, err := smc.api.MinerGetPeerInfo(ctx, mineraddr)
 	if err != nil {
 		return nil, err
 	}
 
 	q := queryRequest{proposalCid}
 	var resp DealResponse
-	err = smc.node.MakeProtocolRequest(ctx, queryDealProtocol, minerpid, q, &resp)
+	err = smc.node.MakeProtocolRequest(ctx, queryDealProtocol, minerPeer, q, &resp)
 	if err != nil {
 		return nil, errors.Wrap(err, "error querying deal")
 	}
 
+	if err := smc.recordDealState(proposalCid, &resp); err != nil {
+		log.Errorf("failed to record state of deal %s: %s", proposalCid, err)
+	}
+
 	return &resp, nil
 }
 
+// recordDealState records the state the miner reported for the deal, if
+// it changed since we last heard about the deal.
+func (smc *Client) recordDealState(proposalCid cid.Cid, resp *DealResponse) error {
+	smc.dealsLk.Lock()
+	defer smc.dealsLk.Unlock()
+	deal := smc.deals[proposalCid]
+	if deal.Response.State == resp.State {
+		return nil
+	}
+	if err := deal.transition(resp); err != nil {
+		return err
+	}
+	return smc.saveDeal(proposalCid)
+}
+
+// ValidatePull allows the miner of a deal to pull the data of the deal,
+// unless the data is transferred offline.
+func (smc *Client) ValidatePull(ctx context.Context, p peer.ID, proposalCid cid.Cid, root cid.Cid) error {
+	smc.dealsLk.Lock()
+	deal, ok := smc.deals[proposalCid]
+	if !ok {
+		deal, ok = smc.proposing[proposalCid]
+	}
+	smc.dealsLk.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no such proposal by cid: %s", proposalCid)
+	}
+	if !deal.Proposal.PieceRef.Equals(root) {
+		return fmt.Errorf("%s is not the data of deal %s", root, proposalCid)
+	}
+	if deal.Proposal.ManualTransfer {
+		return fmt.Errorf("data of deal %s is transferred offline", proposalCid)
+	}
+
+	minerPeer, err := smc.api.MinerGetPeerInfo(ctx, deal.Miner)
+	if err != nil {
+		return errors.Wrap(err, "failed to get peer of miner")
+	}
+	if minerPeer.ID != p {
+		return fmt.Errorf("peer %s is not the miner of deal %s", p.Pretty(), proposalCid)
+	}
+	return nil
+}
+
+// DealHistory returns the state transitions the client saw the deal with the
+// given proposal cid make.
+func (smc *Client) DealHistory(proposalCid cid.Cid) ([]*DealEvent, error) {
+	smc.dealsLk.Lock()
+	defer smc.dealsLk.Unlock()
+	deal, ok := smc.deals[proposalCid]
+	if !ok {
+		return nil, fmt.Errorf("no such proposal by cid: %s", proposalCid)
+	}
+	return append([]*DealEvent{}, deal.History...), nil
+}
+
 func (smc *Client) loadDeals() error {
 	res, err := smc.dealsDs.Query(query.Query{
 		Prefix: "/" + clientDatastorePrefix,
@@ -367,9 +497,17 @@ func (cni *ClientNodeImpl) GetFileSize(ctx context.Context, c cid.Cid) (uint64,
 	return getFileSize(ctx, c, cni.dserv)
 }
 
+// GetPieceCommitment returns the piece commitment of the file referenced by 'c'
+func (cni *ClientNodeImpl) GetPieceCommitment(ctx context.Context, c cid.Cid) (proofs.CommP, error) {
+	return getPieceCommitment(ctx, c, cni.dserv)
+}
+
 // MakeProtocolRequest makes a request and expects a response from the host using the given protocol.
-func (cni *ClientNodeImpl) MakeProtocolRequest(ctx context.Context, protocol protocol.ID, peer peer.ID, request interface{}, response interface{}) error {
-	s, err := cni.host.NewStream(ctx, peer, protocol)
+// The peer is dialed on the multiaddrs in its PeerInfo, if it has any.
+func (cni *ClientNodeImpl) MakeProtocolRequest(ctx context.Context, protocol protocol.ID, peer pstore.PeerInfo, request interface{}, response interface{}) error {
+	cni.host.Peerstore().AddAddrs(peer.ID, peer.Addrs, pstore.TempAddrTTL)
+
+	s, err := cni.host.NewStream(ctx, peer.ID, protocol)
 	if err != nil {
 		if err == multistream.ErrNotSupported {
 			return errors.New("could not establish connection with peer. Peer does not support protocol")
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	pstore "gx/ipfs/QmRhFARzTHcFh8wUxwN5KvyTGq73FLC65EfFAhz8Ng7aGb/go-libp2p-peerstore"
 	"gx/ipfs/QmTu65MVbemtUxJEWgsTtzv9Zv9P8rvmqNA4eG9TrTRGYc/go-libp2p-peer"
 	"gx/ipfs/QmUadX5EcvrBmxAV9sE7wUWtWSqxns5K84qKJBixmcT1w9/go-datastore/query"
 	"gx/ipfs/QmZNkThpqfVXs9GNbexPrfBbXSLNYeKrE7jwFM2oqHbyqN/go-libp2p-protocol"
@@ -16,6 +17,7 @@ import (
 	"github.com/filecoin-project/go-filecoin/actor/builtin/paymentbroker"
 	"github.com/filecoin-project/go-filecoin/address"
 	"github.com/filecoin-project/go-filecoin/porcelain"
+	"github.com/filecoin-project/go-filecoin/proofs"
 	"github.com/filecoin-project/go-filecoin/repo"
 	"github.com/filecoin-project/go-filecoin/types"
 	"github.com/filecoin-project/go-filecoin/util/convert"
@@ -33,6 +35,12 @@ func TestProposeDeal(t *testing.T) {
 	cidCreator := types.NewCidForTestGetter()
 
 	var proposal *SignedDealProposal
+	var client *Client
+	var pullErr error
+
+	testAPI := newTestClientAPI(require)
+	minerPeer, err := testAPI.MinerGetPeerInfo(context.Background(), address.TestAddress)
+	require.NoError(err)
 
 	testNode := newTestClientNode(func(request interface{}) (interface{}, error) {
 		p, ok := request.(*SignedDealProposal)
@@ -41,6 +49,10 @@ func TestProposeDeal(t *testing.T) {
 
 		pcid, err := convert.ToCid(p.DealProposal)
 		require.NoError(err)
+
+		// the miner may pull the data before it responds
+		pullErr = client.ValidatePull(context.Background(), minerPeer.ID, pcid, p.PieceRef)
+
 		return &DealResponse{
 			State:       Accepted,
 			Message:     "OK",
@@ -48,10 +60,9 @@ func TestProposeDeal(t *testing.T) {
 		}, nil
 	})
 
-	testAPI := newTestClientAPI(require)
 	testRepo := repo.NewInMemoryRepo()
 
-	client, err := NewClient(testNode, testAPI, testRepo.DealsDs)
+	client, err = NewClient(testNode, testAPI, testRepo.DealsDs)
 	require.NoError(err)
 
 	dataCid := cidCreator()
@@ -59,14 +70,25 @@ func TestProposeDeal(t *testing.T) {
 	ctx := context.Background()
 	askID := uint64(67)
 	duration := uint64(10000)
-	dealResponse, err := client.ProposeDeal(ctx, minerAddr, dataCid, askID, duration, false)
+	dealResponse, err := client.ProposeDeal(ctx, minerAddr, dataCid, askID, duration, false, false)
 	require.NoError(err)
 
 	t.Run("and creates proposal from parameters", func(t *testing.T) {
 		assert.Equal(dataCid, proposal.PieceRef)
+		assert.Equal(proofs.CommP{1, 2, 3}, proposal.CommP)
 		assert.Equal(duration, proposal.Duration)
 		assert.Equal(minerAddr, proposal.MinerAddress)
 		assert.Equal(testSignature, proposal.Signature)
+		assert.False(proposal.ManualTransfer)
+	})
+
+	t.Run("and lets only the miner pull the data", func(t *testing.T) {
+		assert.NoError(pullErr)
+		assert.NoError(client.ValidatePull(ctx, minerPeer.ID, dealResponse.ProposalCid, dataCid))
+
+		assert.Error(client.ValidatePull(ctx, peer.ID("someone else"), dealResponse.ProposalCid, dataCid))
+		assert.Error(client.ValidatePull(ctx, minerPeer.ID, dealResponse.ProposalCid, cidCreator()))
+		assert.Error(client.ValidatePull(ctx, minerPeer.ID, cidCreator(), dataCid))
 	})
 
 	t.Run("and creates proposal with file size", func(t *testing.T) {
@@ -190,11 +212,11 @@ func (ctp *clientTestAPI) MinerGetOwnerAddress(ctx context.Context, minerAddr ad
 	return address.TestAddress, nil
 }
 
-func (ctp *clientTestAPI) MinerGetPeerID(ctx context.Context, minerAddr address.Address) (peer.ID, error) {
+func (ctp *clientTestAPI) MinerGetPeerInfo(ctx context.Context, minerAddr address.Address) (pstore.PeerInfo, error) {
 	id, err := peer.IDB58Decode("QmWbMozPyW6Ecagtxq7SXBXXLY5BNdP1GwHB2WoZCKMvcb")
 	ctp.require.NoError(err, "Could not create peer id")
 
-	return id, nil
+	return pstore.PeerInfo{ID: id}, nil
 }
 
 func (ctp *clientTestAPI) GetAndMaybeSetDefaultSenderAddress() (address.Address, error) {
@@ -224,7 +246,11 @@ func (tcn *testClientNode) GetFileSize(context.Context, cid.Cid) (uint64, error)
 	return 1000000000, nil
 }
 
-func (tcn *testClientNode) MakeProtocolRequest(ctx context.Context, protocol protocol.ID, peer peer.ID, request interface{}, response interface{}) error {
+func (tcn *testClientNode) GetPieceCommitment(context.Context, cid.Cid) (proofs.CommP, error) {
+	return proofs.CommP{1, 2, 3}, nil
+}
+
+func (tcn *testClientNode) MakeProtocolRequest(ctx context.Context, protocol protocol.ID, peer pstore.PeerInfo, request interface{}, response interface{}) error {
 	dealResponse := response.(*DealResponse)
 	res, err := tcn.responder(request)
 	if err != nil {
@@ -233,3 +259,55 @@ func (tcn *testClientNode) MakeProtocolRequest(ctx context.Context, protocol pro
 	*dealResponse = *res.(*DealResponse)
 	return nil
 }
+
+func TestClientDealHistory(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var state DealState
+	testNode := newTestClientNode(func(request interface{}) (interface{}, error) {
+		var proposalCid cid.Cid
+		switch r := request.(type) {
+		case *SignedDealProposal:
+			c, err := convert.ToCid(r.DealProposal)
+			require.NoError(err)
+			proposalCid = c
+		case queryRequest:
+			proposalCid = r.Cid
+		}
+		return &DealResponse{State: state, ProposalCid: proposalCid}, nil
+	})
+
+	testRepo := repo.NewInMemoryRepo()
+	client, err := NewClient(testNode, newTestClientAPI(require), testRepo.DealsDs)
+	require.NoError(err)
+
+	ctx := context.Background()
+	state = Accepted
+	resp, err := client.ProposeDeal(ctx, address.TestAddress2, types.NewCidForTestGetter()(), 0, 10000, false, false)
+	require.NoError(err)
+
+	// the client may see the deal skip states
+	state = Posted
+	_, err = client.QueryDeal(ctx, resp.ProposalCid)
+	require.NoError(err)
+	_, err = client.QueryDeal(ctx, resp.ProposalCid)
+	require.NoError(err)
+
+	// a state the deal can not move to is not recorded
+	state = Accepted
+	_, err = client.QueryDeal(ctx, resp.ProposalCid)
+	require.NoError(err)
+
+	// the history is persisted with the deal
+	client, err = NewClient(testNode, newTestClientAPI(require), testRepo.DealsDs)
+	require.NoError(err)
+	history, err := client.DealHistory(resp.ProposalCid)
+	require.NoError(err)
+	require.Len(history, 2)
+	assert.Equal(Unknown, history[0].From)
+	assert.Equal(Accepted, history[0].To)
+	assert.Equal(Accepted, history[1].From)
+	assert.Equal(Posted, history[1].To)
+	assert.Equal("reported by miner", history[1].Reason)
+}
@@ -1,11 +1,12 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"math/big"
-	"math/rand"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -13,8 +14,10 @@ import (
 	dag "gx/ipfs/QmNRAuGmvnVw8urHkUZQirhu42VTiZjVWASa2aTznEMmpP/go-merkledag"
 	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
 	"gx/ipfs/QmRDWTzVdbHXdtat7tVJ7YC7kRaW7rTZTEF79yykcLYa49/go-unixfs"
+	uio "gx/ipfs/QmRDWTzVdbHXdtat7tVJ7YC7kRaW7rTZTEF79yykcLYa49/go-unixfs/io"
 	ipld "gx/ipfs/QmRL22E4paat7ky7vx9MLpR97JHHbFPrg3ytFQw6qp1y1s/go-ipld-format"
 	inet "gx/ipfs/QmTGxDz2CjBucFzPNTiWwzQmTWdrBnzqbqrMucDYMsjuPb/go-libp2p-net"
+	"gx/ipfs/QmTu65MVbemtUxJEWgsTtzv9Zv9P8rvmqNA4eG9TrTRGYc/go-libp2p-peer"
 	"gx/ipfs/QmUadX5EcvrBmxAV9sE7wUWtWSqxns5K84qKJBixmcT1w9/go-datastore"
 	"gx/ipfs/QmUadX5EcvrBmxAV9sE7wUWtWSqxns5K84qKJBixmcT1w9/go-datastore/query"
 	"gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
@@ -27,11 +30,13 @@ import (
 	"github.com/filecoin-project/go-filecoin/abi"
 	"github.com/filecoin-project/go-filecoin/actor/builtin/miner"
 	"github.com/filecoin-project/go-filecoin/actor/builtin/paymentbroker"
+	"github.com/filecoin-project/go-filecoin/actor/builtin/storagemarket"
 	"github.com/filecoin-project/go-filecoin/address"
 	cbu "github.com/filecoin-project/go-filecoin/cborutil"
 	"github.com/filecoin-project/go-filecoin/exec"
 	"github.com/filecoin-project/go-filecoin/proofs"
 	"github.com/filecoin-project/go-filecoin/proofs/sectorbuilder"
+	"github.com/filecoin-project/go-filecoin/protocol/transfer"
 	"github.com/filecoin-project/go-filecoin/repo"
 	"github.com/filecoin-project/go-filecoin/types"
 	"github.com/filecoin-project/go-filecoin/util/convert"
@@ -46,10 +51,14 @@ const queryDealProtocol = protocol.ID("/fil/storage/qry/1.0.0")
 const submitPostGasPrice = 0
 const submitPostGasLimit = 300
 
+const publishDealGasPrice = 0
+const publishDealGasLimit = 300
+
 const waitForPaymentChannelDuration = 2 * time.Minute
 
 const minerDatastorePrefix = "miner"
 const dealsAwatingSealDatastorePrefix = "dealsAwaitingSeal"
+const sectorPiecesDatastorePrefix = "sectorPieces"
 
 // Miner represents a storage miner.
 type Miner struct {
@@ -66,21 +75,58 @@ type Miner struct {
 
 	dealsAwaitingSeal *dealsAwaitingSealStruct
 
+	// payments redeems the vouchers of the deals we made.
+	payments *paymentManager
+
 	porcelainAPI minerPorcelain
 	node         node
 
-	proposalAcceptor func(ctx context.Context, m *Miner, p *DealProposal) (*DealResponse, error)
+	proposalAcceptor func(ctx context.Context, m *Miner, client peer.ID, p *DealProposal) (*DealResponse, error)
 	proposalRejector func(ctx context.Context, m *Miner, p *DealProposal, reason string) (*DealResponse, error)
 }
 
 type storageDeal struct {
 	Proposal *DealProposal
 	Response *DealResponse
+
+	// Client is the peer that proposed the deal, which the data of the deal
+	// is pulled from.
+	Client peer.ID
+
+	// SectorID is the sector the piece of the deal was staged into. It is
+	// only meaningful once the deal reached the Staged state.
+	SectorID uint64
+
+	// PublishMsgCid is the message publishing the deal to the storage
+	// market, if it was sent. Once the message is in a block, Published is
+	// set and DealID is the id of the deal in the storage market.
+	PublishMsgCid *cid.Cid
+	Published     bool
+	DealID        uint64
+
+	// Staging is set before the piece of the deal is handed to the sector
+	// builder, and cleared once the sector it was staged into is recorded.
+	Staging bool
+
+	// History records every state the deal moved through.
+	History []*DealEvent
+}
+
+// transition moves the deal to the given state, recording the transition in
+// its history.
+func (d *storageDeal) transition(to DealState, reason string) error {
+	event, err := minerDealStates.transition(d.Response, to, reason)
+	if err != nil {
+		return err
+	}
+	d.History = append(d.History, event)
+	return nil
 }
 
 // minerPorcelain is the subset of the porcelain API that storage.Miner needs.
 type minerPorcelain interface {
 	ChainBlockHeight(ctx context.Context) (*types.BlockHeight, error)
+	ChainSampleRandomness(ctx context.Context, sampleHeight *types.BlockHeight) ([]byte, error)
 	ConfigGet(dottedPath string) (interface{}, error)
 
 	MessageSend(ctx context.Context, from, to address.Address, value *types.AttoFIL, gasPrice types.AttoFIL, gasLimit types.GasUnits, method string, params ...interface{}) (cid.Cid, error)
@@ -95,6 +141,7 @@ type node interface {
 	BlockHeight() (*types.BlockHeight, error)
 	GetBlockTime() time.Duration
 	BlockService() bserv.BlockService
+	DataTransfer() *transfer.Manager
 	Host() host.Host
 	SectorBuilder() sectorbuilder.SectorBuilder
 }
@@ -125,6 +172,7 @@ func NewMiner(ctx context.Context, minerAddr, minerOwnerAddr address.Address, nd
 		proposalAcceptor: acceptProposal,
 		proposalRejector: rejectProposal,
 	}
+	sm.payments = newPaymentManager(minerOwnerAddr, porcelainAPI, sm.dealPayments)
 
 	if err := sm.loadDealsAwaitingSeal(); err != nil {
 		return nil, errors.Wrap(err, "failed to load dealAwaitingSeal when creating miner")
@@ -139,6 +187,8 @@ func NewMiner(ctx context.Context, minerAddr, minerOwnerAddr address.Address, nd
 	nd.Host().SetStreamHandler(makeDealProtocol, sm.handleMakeDeal)
 	nd.Host().SetStreamHandler(queryDealProtocol, sm.handleQueryDeal)
 
+	sm.resumeStorageDeals(ctx)
+
 	return sm, nil
 }
 
@@ -152,7 +202,7 @@ func (sm *Miner) handleMakeDeal(s inet.Stream) {
 	}
 
 	ctx := context.Background()
-	resp, err := sm.receiveStorageProposal(ctx, &signedProposal)
+	resp, err := sm.receiveStorageProposal(ctx, s.Conn().RemotePeer(), &signedProposal)
 	if err != nil {
 		log.Errorf("failed to process proposal: %s", err)
 		return
@@ -163,8 +213,9 @@ func (sm *Miner) handleMakeDeal(s inet.Stream) {
 	}
 }
 
-// receiveStorageProposal is the entry point for the miner storage protocol
-func (sm *Miner) receiveStorageProposal(ctx context.Context, sp *SignedDealProposal) (*DealResponse, error) {
+// receiveStorageProposal is the entry point for the miner storage protocol.
+// The data of accepted deals is pulled from the client peer.
+func (sm *Miner) receiveStorageProposal(ctx context.Context, client peer.ID, sp *SignedDealProposal) (*DealResponse, error) {
 	// Validate deal signature
 	bdp, err := sp.DealProposal.Marshal()
 	if err != nil {
@@ -176,12 +227,26 @@ func (sm *Miner) receiveStorageProposal(ctx context.Context, sp *SignedDealPropo
 		return sm.proposalRejector(ctx, sm, p, fmt.Sprint("invalid deal signature"))
 	}
 
+	// Clients that predate piece commitments send none. Their deals are
+	// rejected rather than accepted unchecked, so they need to upgrade.
+	if p.CommP == (proofs.CommP{}) {
+		return sm.proposalRejector(ctx, sm, p, "proposal has no piece commitment")
+	}
+
+	if !storagemarket.VerifyDealProposalSignature(p.MarketProposal(), p.MarketSignature) {
+		return sm.proposalRejector(ctx, sm, p, "invalid storage market proposal signature")
+	}
+
 	if err := sm.validateDealPayment(ctx, p); err != nil {
 		return sm.proposalRejector(ctx, sm, p, err.Error())
 	}
 
+	if err := sm.checkDealPolicy(ctx, p); err != nil {
+		return sm.proposalRejector(ctx, sm, p, err.Error())
+	}
+
 	// Payment is valid, everything else checks out, let's accept this proposal
-	return sm.proposalAcceptor(ctx, sm, p)
+	return sm.proposalAcceptor(ctx, sm, client, p)
 }
 
 func (sm *Miner) validateDealPayment(ctx context.Context, p *DealProposal) error {
@@ -213,9 +278,26 @@ func (sm *Miner) validateDealPayment(ctx context.Context, p *DealProposal) error
 		return fmt.Errorf("miner account (%s) is not target of payment channel (%s)", sm.minerOwnerAddr.String(), channel.Target.String())
 	}
 
-	// confirm channel contains enough funds
-	if channel.Amount.LessThan(expectedPrice) {
-		return fmt.Errorf("payment channel does not contain enough funds (%s < %s)", channel.Amount.String(), expectedPrice.String())
+	// the vouchers of other deals on the channel pay on their own lanes, whose
+	// amounts are cumulative, so a lane can only back a single deal
+	held := sm.heldLanes(p.Payment.Payer, p.Payment.Channel)
+	if len(p.Payment.Vouchers) > 0 {
+		lane := p.Payment.Vouchers[0].Lane
+		if _, ok := held[lane]; ok {
+			return fmt.Errorf("payment channel lane %d already pays for another deal", lane)
+		}
+	}
+
+	// confirm channel contains enough funds, besides those owed to our other
+	// deals on the channel
+	available := channel.Amount.Sub(channel.AmountRedeemed)
+	for lane, amount := range held {
+		if redeemed := channel.Lane(lane).Redeemed; amount.GreaterThan(redeemed) {
+			available = available.Sub(amount.Sub(redeemed))
+		}
+	}
+	if available.LessThan(expectedPrice) {
+		return fmt.Errorf("payment channel does not contain enough funds (%s < %s)", available.String(), expectedPrice.String())
 	}
 
 	// start with current block height
@@ -237,12 +319,31 @@ func (sm *Miner) validateDealPayment(ctx context.Context, p *DealProposal) error
 	}
 
 	lastValidAt := expectedFirstPayment
+	lane := p.Payment.Vouchers[0].Lane
 	for _, v := range p.Payment.Vouchers {
 		// confirm signature is valid against expected actor and channel id
-		if !paymentbroker.VerifyVoucherSignature(p.Payment.Payer, p.Payment.Channel, &v.Amount, &v.ValidAt, v.Signature) {
+		if p.Payment.Channel == nil || v.Payer != p.Payment.Payer || !v.Channel.Equal(p.Payment.Channel) || !paymentbroker.VerifyVoucherSignature(v) {
 			return errors.New("invalid signature in voucher")
 		}
 
+		// the vouchers of a deal pay on a single lane, and may not merge other
+		// lanes whose redeemed amounts would count towards their own
+		if v.Lane != lane || len(v.Merges) > 0 {
+			return errors.New("payment vouchers must share a lane and carry no merges")
+		}
+
+		// a voucher may only be conditioned on the storage of the piece of
+		// the deal, which we prove
+		if v.Condition != nil {
+			expected, err := paymentbroker.NewPieceInclusionCondition(sm.minerAddr, p.PieceRef, &v.ValidAt)
+			if err != nil {
+				return err
+			}
+			if v.Condition.To != expected.To || v.Condition.Method != expected.Method || !bytes.Equal(v.Condition.Params, expected.Params) {
+				return errors.New("payment vouchers may only be conditioned on the inclusion of the piece of the deal")
+			}
+		}
+
 		// make sure voucher validAt is not spaced to far apart
 		expectedValidAt := lastValidAt.Add(types.NewBlockHeight(VoucherInterval))
 		if v.ValidAt.GreaterThan(expectedValidAt) {
@@ -276,6 +377,41 @@ func (sm *Miner) validateDealPayment(ctx context.Context, p *DealProposal) error
 	return nil
 }
 
+// heldLanes returns the highest amount of the vouchers we hold on every lane
+// of the given channel, for the deals whose vouchers we may redeem.
+func (sm *Miner) heldLanes(payer address.Address, channel *types.ChannelID) map[uint64]*types.AttoFIL {
+	lanes := map[uint64]*types.AttoFIL{}
+	for _, dp := range sm.dealPayments() {
+		for _, v := range dp.Vouchers {
+			if v.Payer != payer || channel == nil || !v.Channel.Equal(channel) {
+				continue
+			}
+			if amount, ok := lanes[v.Lane]; !ok || v.Amount.GreaterThan(amount) {
+				lanes[v.Lane] = &v.Amount
+			}
+		}
+	}
+	return lanes
+}
+
+// WorkerAddress returns the address the miner sends sector commitments and
+// PoSts from: the worker configured in mining.workerAddress, or the miner's
+// owner if no worker is configured.
+func (sm *Miner) WorkerAddress() (address.Address, error) {
+	worker, err := sm.porcelainAPI.ConfigGet("mining.workerAddress")
+	if err != nil {
+		return address.Address{}, err
+	}
+	workerAddr, ok := worker.(address.Address)
+	if !ok {
+		return address.Address{}, errors.New("Could not retrieve workerAddress from config")
+	}
+	if workerAddr.Empty() {
+		return sm.minerOwnerAddr, nil
+	}
+	return workerAddr, nil
+}
+
 func (sm *Miner) getStoragePrice() (*types.AttoFIL, error) {
 	storagePrice, err := sm.porcelainAPI.ConfigGet("mining.storagePrice")
 	if err != nil {
@@ -323,7 +459,7 @@ func (sm *Miner) getPaymentChannel(ctx context.Context, p *DealProposal) (*payme
 	return channel, nil
 }
 
-func acceptProposal(ctx context.Context, sm *Miner, p *DealProposal) (*DealResponse, error) {
+func acceptProposal(ctx context.Context, sm *Miner, client peer.ID, p *DealProposal) (*DealResponse, error) {
 	if sm.node.SectorBuilder() == nil {
 		return nil, errors.New("Mining disabled, can not process proposal")
 	}
@@ -334,21 +470,25 @@ func acceptProposal(ctx context.Context, sm *Miner, p *DealProposal) (*DealRespo
 	}
 
 	resp := &DealResponse{
-		State:       Accepted,
 		ProposalCid: proposalCid,
 		Signature:   types.Signature("signaturrreee"),
 	}
+	deal := &storageDeal{
+		Proposal: p,
+		Response: resp,
+		Client:   client,
+	}
+	if err := deal.transition(Accepted, "proposal accepted"); err != nil {
+		return nil, err
+	}
 
 	sm.dealsLk.Lock()
 	defer sm.dealsLk.Unlock()
 
-	sm.deals[proposalCid] = &storageDeal{
-		Proposal: p,
-		Response: resp,
-	}
+	sm.deals[proposalCid] = deal
 	if err := sm.saveDeal(proposalCid); err != nil {
-		sm.deals[proposalCid].Response.State = Failed
-		sm.deals[proposalCid].Response.Message = "Could not persist deal due to internal error"
+		deal.Response.Message = "Could not persist deal due to internal error"
+		deal.transition(Failed, err.Error()) // nolint: errcheck
 		return nil, errors.Wrap(err, "failed to save miner deal")
 	}
 
@@ -365,19 +505,22 @@ func rejectProposal(ctx context.Context, sm *Miner, p *DealProposal, reason stri
 	}
 
 	resp := &DealResponse{
-		State:       Rejected,
 		ProposalCid: proposalCid,
 		Message:     reason,
 		Signature:   types.Signature("signaturrreee"),
 	}
+	deal := &storageDeal{
+		Proposal: p,
+		Response: resp,
+	}
+	if err := deal.transition(Rejected, reason); err != nil {
+		return nil, err
+	}
 
 	sm.dealsLk.Lock()
 	defer sm.dealsLk.Unlock()
 
-	sm.deals[proposalCid] = &storageDeal{
-		Proposal: p,
-		Response: resp,
-	}
+	sm.deals[proposalCid] = deal
 	if err := sm.saveDeal(proposalCid); err != nil {
 		return nil, errors.Wrap(err, "failed to save miner deal")
 	}
@@ -385,68 +528,208 @@ func rejectProposal(ctx context.Context, sm *Miner, p *DealProposal, reason stri
 	return resp, nil
 }
 
+// dealPayments returns the payment vouchers of the deals we accepted and have
+// not failed.
+func (sm *Miner) dealPayments() []*dealPayments {
+	sm.dealsLk.Lock()
+	defer sm.dealsLk.Unlock()
+
+	var payments []*dealPayments
+	for _, d := range sm.deals {
+		switch d.Response.State {
+		case Unknown, Rejected, Failed:
+			continue
+		}
+		dp := &dealPayments{Vouchers: d.Proposal.Payment.Vouchers}
+		if d.Published {
+			dp.DealID = new(big.Int).SetUint64(d.DealID)
+		}
+		payments = append(payments, dp)
+	}
+	return payments
+}
+
+// Payments reports the payment vouchers held on every lane of the payment
+// channels of our deals.
+func (sm *Miner) Payments(ctx context.Context) ([]*ChannelPayments, error) {
+	height, err := sm.porcelainAPI.ChainBlockHeight(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get current block height")
+	}
+	return sm.payments.Payments(ctx, height)
+}
+
 func (sm *Miner) getStorageDeal(c cid.Cid) *storageDeal {
 	sm.dealsLk.Lock()
 	defer sm.dealsLk.Unlock()
 	return sm.deals[c]
 }
 
-func (sm *Miner) updateDealResponse(proposalCid cid.Cid, f func(*DealResponse)) error {
+// transitionDeal moves the deal to the given state, applies update to it
+// if update is not nil, and persists it.
+func (sm *Miner) transitionDeal(proposalCid cid.Cid, to DealState, reason string, update func(*storageDeal)) error {
 	sm.dealsLk.Lock()
 	defer sm.dealsLk.Unlock()
-	f(sm.deals[proposalCid].Response)
+	d := sm.deals[proposalCid]
+	if err := d.transition(to, reason); err != nil {
+		return err
+	}
+	if update != nil {
+		update(d)
+	}
 	err := sm.saveDeal(proposalCid)
 	if err != nil {
 		return errors.Wrap(err, "failed to store updated deal response in datastore")
 	}
 
-	log.Debugf("Miner.updateDealResponse(%s) - %d", proposalCid.String(), sm.deals[proposalCid].Response)
+	log.Debugf("Miner.transitionDeal(%s) - %s: %s", proposalCid.String(), to, reason)
 	return nil
 }
 
+// updateDeal applies update to the deal and persists it, without changing its
+// state.
+func (sm *Miner) updateDeal(proposalCid cid.Cid, update func(*storageDeal)) error {
+	sm.dealsLk.Lock()
+	defer sm.dealsLk.Unlock()
+	update(sm.deals[proposalCid])
+	if err := sm.saveDeal(proposalCid); err != nil {
+		return errors.Wrap(err, "failed to store updated deal in datastore")
+	}
+	return nil
+}
+
+// ImportDealData continues processing a deal whose data the client
+// transferred offline, once the data was imported into the node as dataCid.
+// It fails if the deal does not await offline data or if dataCid is not the
+// piece of the deal.
+func (sm *Miner) ImportDealData(proposalCid, dataCid cid.Cid) error {
+	sm.dealsLk.Lock()
+	d, ok := sm.deals[proposalCid]
+	var state DealState
+	if ok {
+		state = d.Response.State
+	}
+	sm.dealsLk.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no such deal: %s", proposalCid)
+	}
+	if state != AwaitingData {
+		return fmt.Errorf("deal %s is %s, not awaiting data", proposalCid, state)
+	}
+	if !dataCid.Equals(d.Proposal.PieceRef) {
+		return fmt.Errorf("imported data (%s) does not match the piece of the deal (%s)", dataCid, d.Proposal.PieceRef)
+	}
+
+	if err := sm.transitionDeal(proposalCid, Started, "offline data imported", nil); err != nil {
+		return err
+	}
+	go sm.processStorageDeal(proposalCid)
+	return nil
+}
+
+// DealHistory returns the state transitions of the deal with the given
+// proposal cid.
+func (sm *Miner) DealHistory(proposalCid cid.Cid) ([]*DealEvent, error) {
+	sm.dealsLk.Lock()
+	defer sm.dealsLk.Unlock()
+	d, ok := sm.deals[proposalCid]
+	if !ok {
+		return nil, fmt.Errorf("no such deal: %s", proposalCid)
+	}
+	return append([]*DealEvent{}, d.History...), nil
+}
+
+// processStorageDeal takes an accepted deal through transferring its data and
+// staging its piece into a sector. Each step is recorded in the deal's state
+// before it starts, so that resumeStorageDeals can pick the deal up again
+// if the miner restarts while it is being processed.
 func (sm *Miner) processStorageDeal(c cid.Cid) {
 	log.Debugf("Miner.processStorageDeal(%s)", c.String())
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	d := sm.getStorageDeal(c)
-	if d.Response.State != Accepted {
-		// TODO: handle resumption of deal processing across miner restarts
-		log.Error("attempted to process an already started deal")
+	if d.Response.State != Accepted && d.Response.State != Started {
+		log.Errorf("attempted to process deal %s in state %s", c, d.Response.State)
 		return
 	}
 
-	// 'Receive' the data, this could also be a truck full of hard drives. (TODO: proper abstraction)
-	// TODO: this is not a great way to do this. At least use a session
-	// Also, this needs to be fetched into a staging area for miners to prepare and seal in data
-	log.Debug("Miner.processStorageDeal - FetchGraph")
-	if err := dag.FetchGraph(ctx, d.Proposal.PieceRef, dag.NewDAGService(sm.node.BlockService())); err != nil {
-		log.Errorf("failed to fetch data: %s", err)
-		err := sm.updateDealResponse(c, func(resp *DealResponse) {
-			resp.Message = "Transfer failed"
-			resp.State = Failed
-			// TODO: signature?
+	fail := func(message, logerr string) {
+		log.Errorf(logerr)
+		err := sm.transitionDeal(c, Failed, logerr, func(d *storageDeal) {
+			d.Response.Message = message
 		})
 		if err != nil {
-			log.Errorf("could not update to deal to 'Failed' state: %s", err)
+			log.Errorf("could not update to deal to 'Failed' state in fail callback: %s", err)
 		}
+	}
+
+	// deals resumed after a restart may have started already
+	if d.Response.State == Accepted {
+		if d.Proposal.ManualTransfer {
+			if err := sm.transitionDeal(c, AwaitingData, "awaiting offline data", nil); err != nil {
+				log.Errorf("could not update deal to 'AwaitingData' state: %s", err)
+			}
+			return
+		}
+		if err := sm.transitionDeal(c, Started, "transferring data", nil); err != nil {
+			log.Errorf("could not update deal to 'Started' state: %s", err)
+		}
+	}
+
+	// Pull the data from the client. Data transferred offline was imported by
+	// ImportDealData already, so this finds it locally. A transfer resumed
+	// after a restart only fetches the blocks we do not have yet.
+	// TODO: this needs to be fetched into a staging area for miners to prepare and seal in data
+	log.Debug("Miner.processStorageDeal - Pull")
+	if err := sm.node.DataTransfer().Pull(ctx, d.Client, c, d.Proposal.PieceRef); err != nil {
+		// TODO: signature?
+		fail("Transfer failed", fmt.Sprintf("failed to fetch data: %s", err))
 		return
 	}
 
-	fail := func(message, logerr string) {
-		log.Errorf(logerr)
-		err := sm.updateDealResponse(c, func(resp *DealResponse) {
-			resp.Message = message
-			resp.State = Failed
-		})
+	log.Debug("Miner.processStorageDeal - verify piece commitment")
+	commP, err := getPieceCommitment(ctx, d.Proposal.PieceRef, dag.NewDAGService(sm.node.BlockService()))
+	if err != nil {
+		fail("Piece commitment could not be computed", fmt.Sprintf("failed to compute piece commitment: %s", err))
+		return
+	}
+	if commP != d.Proposal.CommP {
+		fail("Piece commitment mismatch", fmt.Sprintf("piece commitment of the data (%x) does not match the proposal (%x)", commP, d.Proposal.CommP))
+		return
+	}
+
+	log.Debug("Miner.processStorageDeal - publish")
+	if err := sm.publishDeal(ctx, c); err != nil {
+		fail("Deal could not be published", fmt.Sprintf("failed to publish deal: %s", err))
+		return
+	}
+
+	// The miner stopped after it handed the piece to the sector builder but
+	// before it recorded the sector, so the piece may be in a sector already.
+	// Rather than storing it twice, the deal awaits the seal of the sector
+	// the piece turns up in. Should the miner have stopped before the sector
+	// builder kept the piece, none does, and the storage market cancels the
+	// deal once it is not activated by its start-by height.
+	if d.Staging {
+		err := sm.transitionDeal(c, Staged, "piece staged before restart, awaiting its sector", nil)
 		if err != nil {
-			log.Errorf("could not update to deal to 'Failed' state in fail callback: %s", err)
+			log.Errorf("could update to 'Staged': %s", err)
 		}
+		sm.awaitPieceSeal(c, d.Proposal.PieceRef)
+		return
 	}
 
 	pi := &sectorbuilder.PieceInfo{
-		Ref:  d.Proposal.PieceRef,
-		Size: d.Proposal.Size.Uint64(),
+		Ref:   d.Proposal.PieceRef,
+		Size:  d.Proposal.Size.Uint64(),
+		CommP: d.Proposal.CommP,
+	}
+
+	if err := sm.updateDeal(c, func(d *storageDeal) { d.Staging = true }); err != nil {
+		fail("failed to submit seal proof", fmt.Sprintf("failed to record staging of piece: %s", err))
+		return
 	}
 
 	// There is a race here that requires us to use dealsAwaitingSeal below. If the
@@ -455,17 +738,15 @@ func (sm *Miner) processStorageDeal(c cid.Cid) {
 	// miss it. Hence, dealsAwaitingSealStruct. I'm told that sealing in practice is
 	// so slow that the race only exists in tests, but tests were flaky so
 	// we fixed it with dealsAwaitingSealStruct.
-	//
-	// Also, this pattern of not being able to set up book-keeping ahead of
-	// the call is inelegant.
 	sectorID, err := sm.node.SectorBuilder().AddPiece(ctx, pi)
 	if err != nil {
 		fail("failed to submit seal proof", fmt.Sprintf("failed to add piece: %s", err))
 		return
 	}
 
-	err = sm.updateDealResponse(c, func(resp *DealResponse) {
-		resp.State = Staged
+	err = sm.transitionDeal(c, Staged, fmt.Sprintf("piece staged into sector %d", sectorID), func(deal *storageDeal) {
+		deal.SectorID = sectorID
+		deal.Staging = false
 	})
 	if err != nil {
 		log.Errorf("could update to 'Staged': %s", err)
@@ -473,12 +754,155 @@ func (sm *Miner) processStorageDeal(c cid.Cid) {
 
 	// Careful: this might update state to success or failure so it should go after
 	// updating state to Staged.
+	sm.awaitSeal(c, sectorID)
+}
+
+// publishDeal publishes the deal to the storage market, unless it was already,
+// and records the id of the deal. The deal is activated by the commitment of
+// the sector holding its piece, and its id completes the piece inclusion
+// condition of its payment vouchers. A deal resumed after a restart waits for
+// the message that was sent to publish it.
+func (sm *Miner) publishDeal(ctx context.Context, c cid.Cid) error {
+	d := sm.getStorageDeal(c)
+	if d.Published {
+		return nil
+	}
+
+	msgCid := d.PublishMsgCid
+	if msgCid == nil {
+		proposalBytes, err := d.Proposal.MarketProposal().Marshal()
+		if err != nil {
+			return errors.Wrap(err, "failed to encode storage market proposal")
+		}
+		workerAddr, err := sm.WorkerAddress()
+		if err != nil {
+			return errors.Wrap(err, "failed to get worker address")
+		}
+		sent, err := sm.porcelainAPI.MessageSend(
+			ctx,
+			workerAddr,
+			address.StorageMarketAddress,
+			types.NewZeroAttoFIL(),
+			types.NewGasPrice(publishDealGasPrice),
+			types.NewGasUnits(publishDealGasLimit),
+			"publishDeal",
+			proposalBytes,
+			[]byte(d.Proposal.MarketSignature),
+		)
+		if err != nil {
+			return errors.Wrap(err, "failed to send publishDeal message")
+		}
+		msgCid = &sent
+		if err := sm.updateDeal(c, func(d *storageDeal) { d.PublishMsgCid = msgCid }); err != nil {
+			return err
+		}
+	}
+
+	var dealID uint64
+	err := sm.porcelainAPI.MessageWait(ctx, *msgCid, func(blk *types.Block, smsg *types.SignedMessage, receipt *types.MessageReceipt) error {
+		if receipt.ExitCode != uint8(0) {
+			return fmt.Errorf("publishDeal message %s failed with exit code %d", msgCid, receipt.ExitCode)
+		}
+		dealID = new(big.Int).SetBytes(receipt.Return[0]).Uint64()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return sm.updateDeal(c, func(d *storageDeal) {
+		d.Published = true
+		d.DealID = dealID
+	})
+}
+
+// awaitSeal records that the piece of the deal was staged into the sector,
+// so that the deal is updated once the sector is sealed and committed.
+func (sm *Miner) awaitSeal(c cid.Cid, sectorID uint64) {
 	sm.dealsAwaitingSeal.add(sectorID, c)
 	if err := sm.saveDealsAwaitingSeal(); err != nil {
 		log.Errorf("could not save deal awaiting seal: %s", err)
 	}
 }
 
+// awaitPieceSeal records that the piece of the deal was staged into a sector
+// that is not known, so that the deal is updated once a sector holding the
+// piece is sealed and committed.
+func (sm *Miner) awaitPieceSeal(c cid.Cid, pieceRef cid.Cid) {
+	sm.dealsAwaitingSeal.addPiece(pieceRef, c)
+	if err := sm.saveDealsAwaitingSeal(); err != nil {
+		log.Errorf("could not save deal awaiting seal: %s", err)
+	}
+}
+
+// resumeStorageDeals picks up the deals that were being processed when the
+// miner last stopped. Deals that were accepted or transferring data are
+// processed again. Staged deals wait for their sector to be committed, unless
+// the commitment made it to the chain while the miner was down.
+func (sm *Miner) resumeStorageDeals(ctx context.Context) {
+	var processing, staged []cid.Cid
+	sm.dealsLk.Lock()
+	for c, d := range sm.deals {
+		switch d.Response.State {
+		case Accepted, Started:
+			processing = append(processing, c)
+		case Staged:
+			staged = append(staged, c)
+		}
+	}
+	sm.dealsLk.Unlock()
+
+	if len(processing) > 0 && sm.node.SectorBuilder() == nil {
+		log.Errorf("mining disabled, can not resume %d deals", len(processing))
+		processing = nil
+	}
+	for _, c := range processing {
+		log.Infof("resuming processing of deal %s", c)
+		go sm.processStorageDeal(c)
+	}
+
+	if len(staged) == 0 {
+		return
+	}
+	commitments, err := sm.getSectorCommitments(ctx)
+	if err != nil {
+		log.Errorf("could not check sector commitments of staged deals: %s", err)
+	}
+	for _, c := range staged {
+		sm.resumeStagedDeal(c, commitments)
+	}
+}
+
+func (sm *Miner) resumeStagedDeal(c cid.Cid, commitments map[string]types.Commitments) {
+	// the sector of the deal is not known, it awaits its piece instead
+	if d := sm.getStorageDeal(c); d.Staging {
+		if !sm.dealsAwaitingSeal.awaitsPiece(c) {
+			sm.awaitPieceSeal(c, d.Proposal.PieceRef)
+		}
+		return
+	}
+
+	sectorID, awaiting := sm.dealsAwaitingSeal.sectorOf(c)
+	if !awaiting {
+		sectorID = sm.getStorageDeal(c).SectorID
+	}
+
+	if comm, ok := commitments[strconv.FormatUint(sectorID, 10)]; ok {
+		sm.onCommitSuccess(c, &sectorbuilder.SealedSectorMetadata{
+			SectorID:  sectorID,
+			CommD:     comm.CommD,
+			CommR:     comm.CommR,
+			CommRStar: comm.CommRStar,
+		})
+		return
+	}
+
+	// The miner stopped before it recorded the deal's sector.
+	if !awaiting {
+		sm.awaitSeal(c, sectorID)
+	}
+}
+
 // dealsAwaitingSealStruct is a container for keeping track of which sectors have
 // pieces from which deals. We need it to accommodate a race condition where
 // a sector commit message is added to chain before we can add the sector/deal
@@ -488,6 +912,9 @@ type dealsAwaitingSealStruct struct {
 	l sync.Mutex
 	// Maps from sector id to the deal cids with pieces in the sector.
 	SectorsToDeals map[uint64][]cid.Cid
+	// Maps from piece cid to the deal cids whose piece was staged into a
+	// sector that is not known.
+	PiecesToDeals map[string][]cid.Cid
 	// Maps from sector id to sector.
 	SuccessfulSectors map[uint64]*sectorbuilder.SealedSectorMetadata
 	// Maps from sector id to seal failure error string.
@@ -500,6 +927,7 @@ type dealsAwaitingSealStruct struct {
 func (sm *Miner) loadDealsAwaitingSeal() error {
 	sm.dealsAwaitingSeal = &dealsAwaitingSealStruct{
 		SectorsToDeals:    make(map[uint64][]cid.Cid),
+		PiecesToDeals:     make(map[string][]cid.Cid),
 		SuccessfulSectors: make(map[uint64]*sectorbuilder.SealedSectorMetadata),
 		FailedSectors:     make(map[uint64]string),
 	}
@@ -557,6 +985,56 @@ func (dealsAwaitingSeal *dealsAwaitingSealStruct) add(sectorID uint64, dealCid c
 	}
 }
 
+// addPiece records that the deal awaits the seal of whichever sector holds the
+// piece.
+func (dealsAwaitingSeal *dealsAwaitingSealStruct) addPiece(pieceRef cid.Cid, dealCid cid.Cid) {
+	dealsAwaitingSeal.l.Lock()
+	defer dealsAwaitingSeal.l.Unlock()
+
+	for sectorID, sector := range dealsAwaitingSeal.SuccessfulSectors {
+		if sectorHasPiece(sector, pieceRef) {
+			dealsAwaitingSeal.onSuccess(dealCid, sector)
+			// Same as in add().
+			delete(dealsAwaitingSeal.SuccessfulSectors, sectorID)
+			return
+		}
+	}
+
+	key := pieceRef.String()
+	dealsAwaitingSeal.PiecesToDeals[key] = append(dealsAwaitingSeal.PiecesToDeals[key], dealCid)
+}
+
+// awaitsPiece returns whether the deal awaits the seal of the sector holding
+// its piece.
+func (dealsAwaitingSeal *dealsAwaitingSealStruct) awaitsPiece(dealCid cid.Cid) bool {
+	dealsAwaitingSeal.l.Lock()
+	defer dealsAwaitingSeal.l.Unlock()
+
+	for _, deals := range dealsAwaitingSeal.PiecesToDeals {
+		for _, c := range deals {
+			if c.Equals(dealCid) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sectorOf returns the sector the deal awaits the seal of, if any.
+func (dealsAwaitingSeal *dealsAwaitingSealStruct) sectorOf(dealCid cid.Cid) (uint64, bool) {
+	dealsAwaitingSeal.l.Lock()
+	defer dealsAwaitingSeal.l.Unlock()
+
+	for sectorID, deals := range dealsAwaitingSeal.SectorsToDeals {
+		for _, c := range deals {
+			if c.Equals(dealCid) {
+				return sectorID, true
+			}
+		}
+	}
+	return 0, false
+}
+
 func (dealsAwaitingSeal *dealsAwaitingSealStruct) success(sector *sectorbuilder.SealedSectorMetadata) {
 	dealsAwaitingSeal.l.Lock()
 	defer dealsAwaitingSeal.l.Unlock()
@@ -567,6 +1045,24 @@ func (dealsAwaitingSeal *dealsAwaitingSealStruct) success(sector *sectorbuilder.
 		dealsAwaitingSeal.onSuccess(dealCid, sector)
 	}
 	delete(dealsAwaitingSeal.SectorsToDeals, sector.SectorID)
+
+	for _, piece := range sector.Pieces {
+		key := piece.Ref.String()
+		for _, dealCid := range dealsAwaitingSeal.PiecesToDeals[key] {
+			dealsAwaitingSeal.onSuccess(dealCid, sector)
+		}
+		delete(dealsAwaitingSeal.PiecesToDeals, key)
+	}
+}
+
+// sectorHasPiece returns whether the piece was sealed into the sector.
+func sectorHasPiece(sector *sectorbuilder.SealedSectorMetadata, pieceRef cid.Cid) bool {
+	for _, piece := range sector.Pieces {
+		if piece.Ref.Equals(pieceRef) {
+			return true
+		}
+	}
+	return false
 }
 
 func (dealsAwaitingSeal *dealsAwaitingSealStruct) fail(sectorID uint64, message string) {
@@ -591,6 +1087,9 @@ func (sm *Miner) OnCommitmentAddedToChain(sector *sectorbuilder.SealedSectorMeta
 		errMsg := fmt.Sprintf("failed sealing sector: %d", sectorID)
 		sm.dealsAwaitingSeal.fail(sector.SectorID, errMsg)
 	} else {
+		if err := sm.recordPieceCommitments(sector); err != nil {
+			log.Errorf("failed recording piece commitments of sector %d: %s", sectorID, err)
+		}
 		sm.dealsAwaitingSeal.success(sector)
 	}
 	if err := sm.saveDealsAwaitingSeal(); err != nil {
@@ -599,10 +1098,115 @@ func (sm *Miner) OnCommitmentAddedToChain(sector *sectorbuilder.SealedSectorMeta
 	}
 }
 
+// completeDeals moves the posted deals that the storage market settled up to
+// their expiration to Complete, and fails those whose sector was terminated.
+func (sm *Miner) completeDeals(ctx context.Context) {
+	sm.dealsLk.Lock()
+	posted := map[cid.Cid]uint64{}
+	for c, d := range sm.deals {
+		if d.Response.State == Posted && d.Published {
+			posted[c] = d.DealID
+		}
+	}
+	sm.dealsLk.Unlock()
+
+	for c, dealID := range posted {
+		ret, _, err := sm.porcelainAPI.MessageQuery(ctx, address.Address{}, address.StorageMarketAddress, "getDeal", new(big.Int).SetUint64(dealID))
+		if err != nil {
+			log.Errorf("failed to query storage market deal %d: %s", dealID, err)
+			continue
+		}
+		var deal storagemarket.Deal
+		if err := cbor.DecodeInto(ret[0], &deal); err != nil {
+			log.Errorf("failed to decode storage market deal %d: %s", dealID, err)
+			continue
+		}
+		if !deal.Completed() {
+			continue
+		}
+
+		if deal.TerminatedAt != nil {
+			reason := fmt.Sprintf("sector %d was terminated before storage market deal %d ended", deal.SectorID, dealID)
+			err := sm.transitionDeal(c, Failed, reason, func(d *storageDeal) {
+				d.Response.Message = "sector terminated"
+			})
+			if err != nil {
+				log.Errorf("could not update deal to 'Failed' state: %s", err)
+			}
+			continue
+		}
+		if err := sm.transitionDeal(c, Complete, fmt.Sprintf("storage market deal %d ended", dealID), nil); err != nil {
+			log.Errorf("could not update deal to 'Complete' state: %s", err)
+		}
+	}
+}
+
+// SectorDealIDs returns the storage market ids of the deals whose pieces were
+// staged into the sector, which the commitment of the sector activates.
+func (sm *Miner) SectorDealIDs(sector *sectorbuilder.SealedSectorMetadata) []uint64 {
+	sm.dealsLk.Lock()
+	defer sm.dealsLk.Unlock()
+
+	dealIDs := []uint64{}
+	for _, d := range sm.deals {
+		if d.Response.State != Staged || !d.Published {
+			continue
+		}
+		// deals resumed while staging their piece only know it is in the sector
+		if (d.Staging && sectorHasPiece(sector, d.Proposal.PieceRef)) || (!d.Staging && d.SectorID == sector.SectorID) {
+			dealIDs = append(dealIDs, d.DealID)
+		}
+	}
+	sort.Slice(dealIDs, func(i, j int) bool { return dealIDs[i] < dealIDs[j] })
+	return dealIDs
+}
+
+// recordPieceCommitments records the piece commitments of the deals whose
+// pieces the sector contains against its pieces, and persists the pieces of
+// the sector. The sector builder only knows the pieces by their cid.
+func (sm *Miner) recordPieceCommitments(sector *sectorbuilder.SealedSectorMetadata) error {
+	sm.dealsLk.Lock()
+	for _, piece := range sector.Pieces {
+		for _, deal := range sm.deals {
+			if deal.Proposal.PieceRef.Equals(piece.Ref) {
+				piece.CommP = deal.Proposal.CommP
+				break
+			}
+		}
+	}
+	sm.dealsLk.Unlock()
+
+	marshalledPieces, err := json.Marshal(sector.Pieces)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal sector pieces")
+	}
+	key := datastore.KeyWithNamespaces([]string{sectorPiecesDatastorePrefix, strconv.FormatUint(sector.SectorID, 10)})
+	if err := sm.dealsDs.Put(key, marshalledPieces); err != nil {
+		return errors.Wrap(err, "could not save sector pieces")
+	}
+	return nil
+}
+
+// SectorPieces returns the pieces of a committed sector with the piece
+// commitments their deals were proposed with.
+func (sm *Miner) SectorPieces(sectorID uint64) ([]*sectorbuilder.PieceInfo, error) {
+	key := datastore.KeyWithNamespaces([]string{sectorPiecesDatastorePrefix, strconv.FormatUint(sectorID, 10)})
+	marshalledPieces, err := sm.dealsDs.Get(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not load pieces of sector %d", sectorID)
+	}
+	var pieces []*sectorbuilder.PieceInfo
+	if err := json.Unmarshal(marshalledPieces, &pieces); err != nil {
+		return nil, errors.Wrapf(err, "could not unmarshal pieces of sector %d", sectorID)
+	}
+	return pieces, nil
+}
+
 func (sm *Miner) onCommitSuccess(dealCid cid.Cid, sector *sectorbuilder.SealedSectorMetadata) {
-	err := sm.updateDealResponse(dealCid, func(resp *DealResponse) {
-		resp.State = Posted
-		resp.ProofInfo = &ProofInfo{
+	err := sm.transitionDeal(dealCid, Posted, fmt.Sprintf("sector %d committed", sector.SectorID), func(d *storageDeal) {
+		d.SectorID = sector.SectorID
+		d.Staging = false
+		d.Response.ProofInfo = &ProofInfo{
 			SectorID: sector.SectorID,
 			CommR:    sector.CommR[:],
 			CommD:    sector.CommD[:],
@@ -614,38 +1218,26 @@ func (sm *Miner) onCommitSuccess(dealCid cid.Cid, sector *sectorbuilder.SealedSe
 }
 
 func (sm *Miner) onCommitFail(dealCid cid.Cid, message string) {
-	err := sm.updateDealResponse(dealCid, func(resp *DealResponse) {
-		resp.Message = message
-		resp.State = Failed
+	err := sm.transitionDeal(dealCid, Failed, message, func(d *storageDeal) {
+		d.Response.Message = message
 	})
-	log.Errorf("commit failure but could not update to deal 'Failed' state: %s", err)
+	if err != nil {
+		log.Errorf("commit failure but could not update to deal 'Failed' state: %s", err)
+	}
 }
 
 // OnNewHeaviestTipSet is a callback called by node, everytime the the latest head is updated.
-// It is used to check if we are in a new proving period and need to trigger PoSt submission.
+// It is used to redeem payment vouchers that are due, to complete deals that ended, and to check
+// if we are in a new proving period and need to trigger PoSt submission.
 func (sm *Miner) OnNewHeaviestTipSet(ts types.TipSet) {
 	ctx := context.Background()
 
-	rets, sig, err := sm.porcelainAPI.MessageQuery(
-		ctx,
-		address.Address{},
-		sm.minerAddr,
-		"getSectorCommitments",
-	)
-	if err != nil {
-		log.Errorf("failed to call query method getSectorCommitments: %s", err)
-		return
-	}
+	sm.payments.OnNewHeaviestTipSet(ts)
+	sm.completeDeals(ctx)
 
-	commitmentsVal, err := abi.Deserialize(rets[0], sig.Return[0])
+	commitments, err := sm.getSectorCommitments(ctx)
 	if err != nil {
-		log.Errorf("failed to convert returned ABI value: %s", err)
-		return
-	}
-
-	commitments, ok := commitmentsVal.Val.(map[string]types.Commitments)
-	if !ok {
-		log.Errorf("failed to convert returned ABI value to miner.Commitments")
+		log.Errorf("failed to get sector commitments: %s", err)
 		return
 	}
 
@@ -664,6 +1256,8 @@ func (sm *Miner) OnNewHeaviestTipSet(ts types.TipSet) {
 			sectorID:  n,
 		})
 	}
+	// the miner actor verifies commitments in ascending sector id order
+	sort.Slice(inputs, func(i, j int) bool { return inputs[i].sectorID < inputs[j].sectorID })
 
 	if len(inputs) == 0 {
 		// no sector sealed, nothing to do
@@ -694,18 +1288,68 @@ func (sm *Miner) OnNewHeaviestTipSet(ts types.TipSet) {
 	provingPeriodEnd := provingPeriodStart.Add(miner.ProvingPeriodBlocks)
 
 	if h.GreaterEqual(provingPeriodStart) {
-		if h.LessThan(provingPeriodEnd) {
-			// we are in a new proving period, lets get this post going
-			sm.postInProcess = provingPeriodStart
-			go sm.submitPoSt(provingPeriodStart, provingPeriodEnd, inputs)
-		} else {
-			// we are too late
-			// TODO: figure out faults and payments here
-			log.Errorf("too late start=%s  end=%s current=%s", provingPeriodStart, provingPeriodEnd, h)
+		if h.GreaterEqual(provingPeriodEnd.Add(miner.GracePeriodBlocks)) {
+			// Too late to avoid being slashed, but submitting restarts the
+			// proving period so the miner can regain its power.
+			log.Errorf("missed proving period start=%s end=%s current=%s, power will be slashed", provingPeriodStart, provingPeriodEnd, h)
+		} else if h.GreaterEqual(provingPeriodEnd) {
+			log.Warningf("late for proving period start=%s end=%s current=%s, collateral will be charged", provingPeriodStart, provingPeriodEnd, h)
 		}
+
+		seed, err := sm.getPoStChallengeSeed(ctx, provingPeriodStart)
+		if err != nil {
+			// the randomness of the proving period start is only sampled
+			// once the chain grew past it, try again with a later tipset
+			log.Debugf("PoSt challenge is not available yet: %s", err)
+			return
+		}
+
+		sm.postInProcess = provingPeriodStart
+		go sm.submitPoSt(provingPeriodStart, provingPeriodEnd, seed, inputs)
 	}
 }
 
+// getSectorCommitments pages through the commitments of all sectors the miner
+// actor has committed.
+func (sm *Miner) getSectorCommitments(ctx context.Context) (map[string]types.Commitments, error) {
+	res, _, err := sm.porcelainAPI.MessageQuery(ctx, address.Address{}, sm.minerAddr, "getSectorCount")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to call query method getSectorCount")
+	}
+	count := big.NewInt(0).SetBytes(res[0]).Uint64()
+
+	commitments := map[string]types.Commitments{}
+	for offset := uint64(0); offset < count; offset += miner.MaximumSectorPageSize {
+		rets, sig, err := sm.porcelainAPI.MessageQuery(
+			ctx,
+			address.Address{},
+			sm.minerAddr,
+			"getSectorCommitmentsPage",
+			new(big.Int).SetUint64(offset),
+			big.NewInt(miner.MaximumSectorPageSize),
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to call query method getSectorCommitmentsPage")
+		}
+
+		commitmentsVal, err := abi.Deserialize(rets[0], sig.Return[0])
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to convert returned ABI value")
+		}
+
+		page, ok := commitmentsVal.Val.(map[string]types.Commitments)
+		if !ok {
+			return nil, errors.New("failed to convert returned ABI value to miner.Commitments")
+		}
+
+		for k, v := range page {
+			commitments[k] = v
+		}
+	}
+
+	return commitments, nil
+}
+
 func (sm *Miner) getProvingPeriodStart() (*types.BlockHeight, error) {
 	res, _, err := sm.porcelainAPI.MessageQuery(
 		context.Background(),
@@ -720,6 +1364,16 @@ func (sm *Miner) getProvingPeriodStart() (*types.BlockHeight, error) {
 	return types.NewBlockHeightFromBytes(res[0]), nil
 }
 
+// getPoStChallengeSeed derives the challenge of the proving period starting
+// at start from the chain, as the miner actor does to verify the PoSt.
+func (sm *Miner) getPoStChallengeSeed(ctx context.Context, start *types.BlockHeight) (proofs.PoStChallengeSeed, error) {
+	randomness, err := sm.porcelainAPI.ChainSampleRandomness(ctx, start)
+	if err != nil {
+		return proofs.PoStChallengeSeed{}, err
+	}
+	return miner.PoStChallengeSeed(randomness), nil
+}
+
 // generatePoSt creates the required PoSt, given a list of sector ids and
 // matching seeds. It returns the Snark Proof for the PoSt, and a list of
 // sectors that faulted, if there were any faults.
@@ -736,26 +1390,37 @@ func (sm *Miner) generatePoSt(commRs []proofs.CommR, challenge proofs.PoStChalle
 	return res.Proof, res.Faults, nil
 }
 
-func (sm *Miner) submitPoSt(start, end *types.BlockHeight, inputs []generatePostInput) {
-	// TODO: real seed generation
-	seed := proofs.PoStChallengeSeed{}
-	if _, err := rand.Read(seed[:]); err != nil {
-		panic(err)
+// faultySectorIDs maps the faults reported by the sector builder, which are
+// indices into the commitments the PoSt was generated for, to the ids of the
+// sectors committed at those indices. Indices matching no committed sector
+// are dropped, as the miner actor rejects PoSts declaring unknown sectors.
+func faultySectorIDs(inputs []generatePostInput, faults []uint64) []uint64 {
+	sectorIDs := []uint64{}
+	for _, fault := range faults {
+		if fault >= uint64(len(inputs)) {
+			log.Warningf("dropping fault %d, which matches no committed sector", fault)
+			continue
+		}
+		sectorIDs = append(sectorIDs, inputs[fault].sectorID)
 	}
+	return sectorIDs
+}
 
+func (sm *Miner) submitPoSt(start, end *types.BlockHeight, seed proofs.PoStChallengeSeed, inputs []generatePostInput) {
 	commRs := make([]proofs.CommR, len(inputs))
 	for i, input := range inputs {
 		commRs[i] = input.commR
 	}
 
-	proof, faults, err := sm.generatePoSt(commRs, seed)
+	proof, faultIndices, err := sm.generatePoSt(commRs, seed)
 	if err != nil {
 		log.Errorf("failed to generate PoSts: %s", err)
 		return
 	}
+	faults := faultySectorIDs(inputs, faultIndices)
 	if len(faults) != 0 {
+		// faulty sectors are declared with the PoSt and lose their power
 		log.Warningf("some faults when generating PoSt: %v", faults)
-		// TODO: proper fault handling
 	}
 
 	height, err := sm.node.BlockHeight()
@@ -771,9 +1436,9 @@ func (sm *Miner) submitPoSt(start, end *types.BlockHeight, inputs []generatePost
 	}
 
 	if height.GreaterEqual(end) {
-		// TODO: we are too late, figure out faults and decide if we want to still submit
-		log.Errorf("PoSt generation was too slow height=%s end=%s", height, end)
-		return
+		// The miner actor still accepts the PoSt during the grace period, at a
+		// penalty, and uses a later one to restart the proving period.
+		log.Warningf("PoSt generation was too slow height=%s end=%s", height, end)
 	}
 
 	// TODO: figure out a more sensible timeout
@@ -784,7 +1449,13 @@ func (sm *Miner) submitPoSt(start, end *types.BlockHeight, inputs []generatePost
 	gasPrice := types.NewGasPrice(submitPostGasPrice)
 	gasLimit := types.NewGasUnits(submitPostGasLimit)
 
-	_, err = sm.porcelainAPI.MessageSend(ctx, sm.minerOwnerAddr, sm.minerAddr, types.ZeroAttoFIL, gasPrice, gasLimit, "submitPoSt", proof[:])
+	workerAddr, err := sm.WorkerAddress()
+	if err != nil {
+		log.Errorf("failed to submit PoSt: %s", err)
+		return
+	}
+
+	_, err = sm.porcelainAPI.MessageSend(ctx, workerAddr, sm.minerAddr, types.ZeroAttoFIL, gasPrice, gasLimit, "submitPoSt", proof[:], faults, start)
 	if err != nil {
 		log.Errorf("failed to submit PoSt: %s", err)
 		return
@@ -840,6 +1511,20 @@ func getFileSize(ctx context.Context, c cid.Cid, dserv ipld.DAGService) (uint64,
 	}
 }
 
+// getPieceCommitment computes the piece commitment of the file referenced by
+// 'c', over the bytes that are added to a sector.
+func getPieceCommitment(ctx context.Context, c cid.Cid, dserv ipld.DAGService) (proofs.CommP, error) {
+	fnode, err := dserv.Get(ctx, c)
+	if err != nil {
+		return proofs.CommP{}, err
+	}
+	r, err := uio.NewDagReader(ctx, fnode, dserv)
+	if err != nil {
+		return proofs.CommP{}, err
+	}
+	return proofs.GeneratePieceCommitment(r)
+}
+
 func (sm *Miner) loadDeals() error {
 	res, err := sm.dealsDs.Query(query.Query{
 		Prefix: "/" + minerDatastorePrefix,
@@ -1,25 +1,46 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"io"
+	"math/big"
+	"sync"
 	"testing"
+	"time"
 
+	dag "gx/ipfs/QmNRAuGmvnVw8urHkUZQirhu42VTiZjVWASa2aTznEMmpP/go-merkledag"
 	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
-
+	bstore "gx/ipfs/QmRu7tiRnFk9mMPpVECQTBQJqXtmG132jJxA1w9A7TtpBz/go-ipfs-blockstore"
+	offline "gx/ipfs/QmSz8kAe2JCKp2dWSG8gHSWnwSmne8YfRXTeK5HBmc9L7t/go-ipfs-exchange-offline"
+	"gx/ipfs/QmTu65MVbemtUxJEWgsTtzv9Zv9P8rvmqNA4eG9TrTRGYc/go-libp2p-peer"
+	"gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
+	bserv "gx/ipfs/QmZsGVGCqMCNzHLNMB6q4F6yyvomqf1VxwhJwSfgo1NGaF/go-blockservice"
+	"gx/ipfs/QmcNGX5RaxPPCYwa6yGXM1EcUbrreTTinixLcYGmMwf1sx/go-libp2p/p2p/net/mock"
+	cbor "gx/ipfs/QmcZLyosDwMKdB6NLRsiss9HXzDPhVhhRtPy67JFKTDQDX/go-ipld-cbor"
+	"gx/ipfs/Qmd52WKRSwrBK5gUaJKawryZQ5by6UbNB8KVW2Zy6JtbyW/go-libp2p-host"
+
+	"github.com/filecoin-project/go-filecoin/abi"
 	"github.com/filecoin-project/go-filecoin/actor"
+	"github.com/filecoin-project/go-filecoin/actor/builtin/miner"
 	"github.com/filecoin-project/go-filecoin/actor/builtin/paymentbroker"
+	"github.com/filecoin-project/go-filecoin/actor/builtin/storagemarket"
 	"github.com/filecoin-project/go-filecoin/address"
 	"github.com/filecoin-project/go-filecoin/exec"
 	"github.com/filecoin-project/go-filecoin/plumbing/cfg"
+	"github.com/filecoin-project/go-filecoin/proofs"
 	"github.com/filecoin-project/go-filecoin/proofs/sectorbuilder"
+	"github.com/filecoin-project/go-filecoin/protocol/transfer"
 	"github.com/filecoin-project/go-filecoin/repo"
 	"github.com/filecoin-project/go-filecoin/types"
+	"github.com/filecoin-project/go-filecoin/util/convert"
 	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/assert"
 	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/require"
 )
 
 var (
 	defaultAmountInc = uint64(1773)
+	testClientPeer   = peer.ID("client")
 )
 
 func TestReceiveStorageProposal(t *testing.T) {
@@ -35,7 +56,7 @@ func TestReceiveStorageProposal(t *testing.T) {
 		miner := Miner{
 			porcelainAPI:   porcelainAPI,
 			minerOwnerAddr: porcelainAPI.targetAddress,
-			proposalAcceptor: func(ctx context.Context, m *Miner, p *DealProposal) (*DealResponse, error) {
+			proposalAcceptor: func(ctx context.Context, m *Miner, client peer.ID, p *DealProposal) (*DealResponse, error) {
 				accepted = true
 				return &DealResponse{State: Accepted}, nil
 			},
@@ -49,7 +70,7 @@ func TestReceiveStorageProposal(t *testing.T) {
 		vouchers := testPaymentVouchers(porcelainAPI, VoucherInterval, defaultAmountInc)
 		proposal := testSignedDealProposal(porcelainAPI, vouchers, porcelainAPI.targetAddress)
 
-		_, err := miner.receiveStorageProposal(context.Background(), proposal)
+		_, err := miner.receiveStorageProposal(context.Background(), testClientPeer, proposal)
 		require.NoError(err)
 
 		assert.True(accepted, "Proposal has been accepted")
@@ -66,7 +87,7 @@ func TestReceiveStorageProposal(t *testing.T) {
 		// configure storage price
 		porcelainAPI.config.Set("mining.storagePrice", `".0005"`)
 
-		res, err := miner.receiveStorageProposal(context.Background(), proposal)
+		res, err := miner.receiveStorageProposal(context.Background(), testClientPeer, proposal)
 		require.NoError(err)
 
 		assert.Equal(Rejected, res.State)
@@ -81,7 +102,7 @@ func TestReceiveStorageProposal(t *testing.T) {
 
 		porcelainAPI.noChannels = true
 
-		res, err := miner.receiveStorageProposal(context.Background(), proposal)
+		res, err := miner.receiveStorageProposal(context.Background(), testClientPeer, proposal)
 		require.NoError(err)
 
 		assert.Equal(Rejected, res.State)
@@ -96,7 +117,7 @@ func TestReceiveStorageProposal(t *testing.T) {
 
 		miner.minerOwnerAddr = address.TestAddress
 
-		res, err := miner.receiveStorageProposal(context.Background(), proposal)
+		res, err := miner.receiveStorageProposal(context.Background(), testClientPeer, proposal)
 		require.NoError(err)
 
 		assert.Equal(Rejected, res.State)
@@ -110,7 +131,7 @@ func TestReceiveStorageProposal(t *testing.T) {
 		porcelainAPI, miner, proposal := defaultMinerTestSetup(require, VoucherInterval, defaultAmountInc)
 		porcelainAPI.channelEol = types.NewBlockHeight(1200)
 
-		res, err := miner.receiveStorageProposal(context.Background(), proposal)
+		res, err := miner.receiveStorageProposal(context.Background(), testClientPeer, proposal)
 		require.NoError(err)
 
 		assert.Equal(Rejected, res.State)
@@ -124,7 +145,7 @@ func TestReceiveStorageProposal(t *testing.T) {
 		porcelainAPI, miner, _ := defaultMinerTestSetup(require, VoucherInterval, defaultAmountInc)
 		proposal := testSignedDealProposal(porcelainAPI, []*paymentbroker.PaymentVoucher{}, porcelainAPI.targetAddress)
 
-		res, err := miner.receiveStorageProposal(context.Background(), proposal)
+		res, err := miner.receiveStorageProposal(context.Background(), testClientPeer, proposal)
 		require.NoError(err)
 
 		assert.Equal(Rejected, res.State)
@@ -141,13 +162,33 @@ func TestReceiveStorageProposal(t *testing.T) {
 		invalidSigVouchers[0].Signature = types.Signature([]byte{})
 		proposal := testSignedDealProposal(porcelainAPI, invalidSigVouchers, porcelainAPI.targetAddress)
 
-		res, err := miner.receiveStorageProposal(context.Background(), proposal)
+		res, err := miner.receiveStorageProposal(context.Background(), testClientPeer, proposal)
 		require.NoError(err)
 
 		assert.Equal(Rejected, res.State)
 		assert.Contains(res.Message, "invalid signature in voucher")
 	})
 
+	t.Run("Rejects proposals with vouchers on several lanes", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		porcelainAPI, miner, _ := defaultMinerTestSetup(require, VoucherInterval, defaultAmountInc)
+
+		vouchers := testPaymentVouchers(porcelainAPI, VoucherInterval, defaultAmountInc)
+		vouchers[3].Lane = 1
+		signature, err := paymentbroker.SignVoucher(vouchers[3], porcelainAPI.signer)
+		require.NoError(err)
+		vouchers[3].Signature = signature
+		proposal := testSignedDealProposal(porcelainAPI, vouchers, porcelainAPI.targetAddress)
+
+		res, err := miner.receiveStorageProposal(context.Background(), testClientPeer, proposal)
+		require.NoError(err)
+
+		assert.Equal(Rejected, res.State)
+		assert.Contains(res.Message, "must share a lane")
+	})
+
 	t.Run("Rejects proposals with when payments start too late", func(t *testing.T) {
 		assert := assert.New(t)
 		require := require.New(t)
@@ -160,7 +201,7 @@ func TestReceiveStorageProposal(t *testing.T) {
 			testPaymentVouchers(porcelainAPI, VoucherInterval, defaultAmountInc),
 			porcelainAPI.targetAddress)
 
-		res, err := miner.receiveStorageProposal(context.Background(), proposal)
+		res, err := miner.receiveStorageProposal(context.Background(), testClientPeer, proposal)
 		require.NoError(err)
 
 		assert.Equal(Rejected, res.State)
@@ -178,7 +219,7 @@ func TestReceiveStorageProposal(t *testing.T) {
 			testPaymentVouchers(porcelainAPI, VoucherInterval+15, defaultAmountInc),
 			porcelainAPI.targetAddress)
 
-		res, err := miner.receiveStorageProposal(context.Background(), proposal)
+		res, err := miner.receiveStorageProposal(context.Background(), testClientPeer, proposal)
 		require.NoError(err)
 
 		assert.Equal(Rejected, res.State)
@@ -195,7 +236,7 @@ func TestReceiveStorageProposal(t *testing.T) {
 			testPaymentVouchers(porcelainAPI, VoucherInterval, 1),
 			porcelainAPI.targetAddress)
 
-		res, err := miner.receiveStorageProposal(context.Background(), proposal)
+		res, err := miner.receiveStorageProposal(context.Background(), testClientPeer, proposal)
 		require.NoError(err)
 
 		assert.Equal(Rejected, res.State)
@@ -209,12 +250,135 @@ func TestReceiveStorageProposal(t *testing.T) {
 		_, miner, proposal := defaultMinerTestSetup(require, VoucherInterval, defaultAmountInc)
 		proposal.Signature = []byte{'0', '0', '0'}
 
-		res, err := miner.receiveStorageProposal(context.Background(), proposal)
+		res, err := miner.receiveStorageProposal(context.Background(), testClientPeer, proposal)
 		require.NoError(err)
 
 		assert.Equal(Rejected, res.State)
 		assert.Equal("invalid deal signature", res.Message)
 	})
+
+	t.Run("Rejects proposals without piece commitment", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		porcelainAPI, miner, proposal := defaultMinerTestSetup(require, VoucherInterval, defaultAmountInc)
+		proposal.CommP = proofs.CommP{}
+		proposal, err := proposal.DealProposal.NewSignedProposal(porcelainAPI.payerAddress, porcelainAPI.signer)
+		require.NoError(err)
+
+		res, err := miner.receiveStorageProposal(context.Background(), testClientPeer, proposal)
+		require.NoError(err)
+
+		assert.Equal(Rejected, res.State)
+		assert.Equal("proposal has no piece commitment", res.Message)
+	})
+
+	t.Run("Rejects proposals without storage market signature", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		porcelainAPI, miner, proposal := defaultMinerTestSetup(require, VoucherInterval, defaultAmountInc)
+		proposal.MarketSignature = nil
+		proposal, err := proposal.DealProposal.NewSignedProposal(porcelainAPI.payerAddress, porcelainAPI.signer)
+		require.NoError(err)
+
+		res, err := miner.receiveStorageProposal(context.Background(), testClientPeer, proposal)
+		require.NoError(err)
+
+		assert.Equal(Rejected, res.State)
+		assert.Equal("invalid storage market proposal signature", res.Message)
+	})
+
+	t.Run("Rejects proposals paying on a lane of another deal", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		porcelainAPI, miner, proposal := defaultMinerTestSetup(require, VoucherInterval, defaultAmountInc)
+		other := testSignedDealProposal(porcelainAPI, testPaymentVouchers(porcelainAPI, VoucherInterval, defaultAmountInc), porcelainAPI.targetAddress)
+		miner.deals = map[cid.Cid]*storageDeal{
+			types.SomeCid(): {Proposal: &other.DealProposal, Response: &DealResponse{State: Staged}},
+		}
+
+		res, err := miner.receiveStorageProposal(context.Background(), testClientPeer, proposal)
+		require.NoError(err)
+		assert.Equal(Rejected, res.State)
+		assert.Equal("payment channel lane 0 already pays for another deal", res.Message)
+
+		// the lanes of failed deals are no longer redeemed
+		miner.deals[types.SomeCid()].Response.State = Failed
+		res, err = miner.receiveStorageProposal(context.Background(), testClientPeer, proposal)
+		require.NoError(err)
+		assert.Equal(Accepted, res.State)
+	})
+
+	t.Run("Rejects proposals the channel can not pay besides other deals", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		// the channel holds 100000, of which the other deal is owed 98000
+		porcelainAPI, miner, proposal := defaultMinerTestSetup(require, VoucherInterval, defaultAmountInc)
+		vouchers := testPaymentVouchers(porcelainAPI, VoucherInterval, 9800)
+		for _, v := range vouchers {
+			v.Lane = 1
+		}
+		other := testSignedDealProposal(porcelainAPI, vouchers, porcelainAPI.targetAddress)
+		miner.deals = map[cid.Cid]*storageDeal{
+			types.SomeCid(): {Proposal: &other.DealProposal, Response: &DealResponse{State: Posted}},
+		}
+
+		res, err := miner.receiveStorageProposal(context.Background(), testClientPeer, proposal)
+		require.NoError(err)
+		assert.Equal(Rejected, res.State)
+		assert.Equal("payment channel does not contain enough funds (2000 < 2500)", res.Message)
+
+		// what the other deal redeemed left the channel either way
+		porcelainAPI.laneRedeemed = map[uint64]*types.AttoFIL{1: types.NewAttoFILFromFIL(1000)}
+		res, err = miner.receiveStorageProposal(context.Background(), testClientPeer, proposal)
+		require.NoError(err)
+		assert.Equal("payment channel does not contain enough funds (2000 < 2500)", res.Message)
+
+		miner.deals[types.SomeCid()].Response.State = Failed
+		res, err = miner.receiveStorageProposal(context.Background(), testClientPeer, proposal)
+		require.NoError(err)
+		assert.Equal(Accepted, res.State)
+	})
+
+	t.Run("Accepts only vouchers conditioned on the inclusion of the piece", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		porcelainAPI, miner, _ := defaultMinerTestSetup(require, VoucherInterval, defaultAmountInc)
+		miner.minerAddr = address.TestAddress
+		pieceRef := types.SomeCid()
+
+		conditionedProposal := func(conditionFor address.Address) *SignedDealProposal {
+			vouchers := testPaymentVouchers(porcelainAPI, VoucherInterval, defaultAmountInc)
+			for _, v := range vouchers {
+				condition, err := paymentbroker.NewPieceInclusionCondition(conditionFor, pieceRef, &v.ValidAt)
+				require.NoError(err)
+				v.Condition = condition
+				v.Signature, err = paymentbroker.SignVoucher(v, porcelainAPI.signer)
+				require.NoError(err)
+			}
+			proposal := testSignedDealProposal(porcelainAPI, vouchers, porcelainAPI.targetAddress)
+			proposal.PieceRef = pieceRef
+			marketSignature, err := storagemarket.SignDealProposal(proposal.MarketProposal(), porcelainAPI.signer)
+			require.NoError(err)
+			proposal.MarketSignature = marketSignature
+			signed, err := proposal.DealProposal.NewSignedProposal(porcelainAPI.payerAddress, porcelainAPI.signer)
+			require.NoError(err)
+			return signed
+		}
+
+		res, err := miner.receiveStorageProposal(context.Background(), testClientPeer, conditionedProposal(miner.minerAddr))
+		require.NoError(err)
+		assert.Equal(Accepted, res.State)
+
+		res, err = miner.receiveStorageProposal(context.Background(), testClientPeer, conditionedProposal(address.TestAddress2))
+		require.NoError(err)
+		assert.Equal(Rejected, res.State)
+		assert.Contains(res.Message, "conditioned on the inclusion of the piece of the deal")
+	})
 }
 
 func TestDealsAwaitingSeal(t *testing.T) {
@@ -356,6 +520,14 @@ type minerTestPorcelain struct {
 	blockHeight   *types.BlockHeight
 	channelEol    *types.BlockHeight
 	paymentStart  *types.BlockHeight
+	commitments   map[string]types.Commitments
+	marketDeals   map[uint64]*storagemarket.Deal
+
+	// postParams are the parameters of the last submitPoSt message sent.
+	postParams []interface{}
+
+	// laneRedeemed are the amounts redeemed on the lanes of the channel.
+	laneRedeemed map[uint64]*types.AttoFIL
 
 	require *require.Assertions
 }
@@ -391,20 +563,45 @@ func newMinerTestPorcelain(require *require.Assertions) *minerTestPorcelain {
 }
 
 func (mtp *minerTestPorcelain) MessageSend(ctx context.Context, from, to address.Address, val *types.AttoFIL, gasPrice types.AttoFIL, gasLimit types.GasUnits, method string, params ...interface{}) (cid.Cid, error) {
-	return cid.Cid{}, nil
+	if method == "submitPoSt" {
+		mtp.postParams = params
+	}
+	return types.SomeCid(), nil
 }
 
 func (mtp *minerTestPorcelain) MessageQuery(ctx context.Context, optFrom, to address.Address, method string, params ...interface{}) ([][]byte, *exec.FunctionSignature, error) {
+	switch method {
+	case "getSectorCount":
+		return [][]byte{big.NewInt(int64(len(mtp.commitments))).Bytes()}, nil, nil
+	case "getSectorCommitmentsPage":
+		commitments, err := (&abi.Value{Type: abi.CommitmentsMap, Val: mtp.commitments}).Serialize()
+		mtp.require.NoError(err)
+		return [][]byte{commitments}, &exec.FunctionSignature{Return: []abi.Type{abi.CommitmentsMap}}, nil
+	case "getDeal":
+		deal, ok := mtp.marketDeals[params[0].(*big.Int).Uint64()]
+		if !ok {
+			return nil, nil, storagemarket.Errors[storagemarket.ErrUnknownDeal]
+		}
+		dealBytes, err := cbor.DumpObject(deal)
+		mtp.require.NoError(err)
+		return [][]byte{dealBytes}, nil, nil
+	}
+
 	channels := map[string]*paymentbroker.PaymentChannel{}
 
 	if !mtp.noChannels {
 		id := mtp.channelID.KeyString()
-		channels[id] = &paymentbroker.PaymentChannel{
+		channel := &paymentbroker.PaymentChannel{
 			Target:         mtp.targetAddress,
 			Amount:         types.NewAttoFILFromFIL(100000),
 			AmountRedeemed: types.NewAttoFILFromFIL(0),
 			Eol:            mtp.channelEol,
 		}
+		for lane, redeemed := range mtp.laneRedeemed {
+			channel.Lane(lane).Redeemed = redeemed
+			channel.AmountRedeemed = channel.AmountRedeemed.Add(redeemed)
+		}
+		channels[id] = channel
 	}
 
 	channelsBytes, err := actor.MarshalStorage(channels)
@@ -420,6 +617,13 @@ func (mtp *minerTestPorcelain) ChainBlockHeight(ctx context.Context) (*types.Blo
 	return mtp.blockHeight, nil
 }
 
+func (mtp *minerTestPorcelain) ChainSampleRandomness(ctx context.Context, sampleHeight *types.BlockHeight) ([]byte, error) {
+	if sampleHeight.GreaterThan(mtp.blockHeight) {
+		return nil, errors.New("sample height is not in the chain yet")
+	}
+	return sampleHeight.Bytes(), nil
+}
+
 func (mtp *minerTestPorcelain) MessageWait(ctx context.Context, msgCid cid.Cid, cb func(*types.Block, *types.SignedMessage, *types.MessageReceipt) error) error {
 	return nil
 }
@@ -428,7 +632,7 @@ func newTestMiner(api *minerTestPorcelain) *Miner {
 	return &Miner{
 		porcelainAPI:   api,
 		minerOwnerAddr: api.targetAddress,
-		proposalAcceptor: func(ctx context.Context, m *Miner, p *DealProposal) (*DealResponse, error) {
+		proposalAcceptor: func(ctx context.Context, m *Miner, client peer.ID, p *DealProposal) (*DealResponse, error) {
 			return &DealResponse{State: Accepted}, nil
 		},
 		proposalRejector: func(ctx context.Context, m *Miner, p *DealProposal, reason string) (*DealResponse, error) {
@@ -454,17 +658,17 @@ func testPaymentVouchers(porcelainAPI *minerTestPorcelain, voucherInterval int,
 	for i := 0; i < 10; i++ {
 		validAt := porcelainAPI.paymentStart.Add(types.NewBlockHeight(uint64((i + 1) * voucherInterval)))
 		amount := types.NewAttoFILFromFIL(uint64(i+1) * amountInc)
-		signature, err := paymentbroker.SignVoucher(porcelainAPI.channelID, amount, validAt, porcelainAPI.payerAddress, porcelainAPI.signer)
-		porcelainAPI.require.NoError(err, "could not sign valid proposal")
-
 		vouchers[i] = &paymentbroker.PaymentVoucher{
-			Channel:   *porcelainAPI.channelID,
-			Payer:     porcelainAPI.payerAddress,
-			Target:    porcelainAPI.targetAddress,
-			Amount:    *amount,
-			ValidAt:   *validAt,
-			Signature: signature,
+			Channel: *porcelainAPI.channelID,
+			Payer:   porcelainAPI.payerAddress,
+			Target:  porcelainAPI.targetAddress,
+			Amount:  *amount,
+			ValidAt: *validAt,
+			Nonce:   uint64(i),
 		}
+		signature, err := paymentbroker.SignVoucher(vouchers[i], porcelainAPI.signer)
+		porcelainAPI.require.NoError(err, "could not sign valid proposal")
+		vouchers[i].Signature = signature
 	}
 	return vouchers
 
@@ -474,6 +678,7 @@ func testSignedDealProposal(porcelainAPI *minerTestPorcelain, vouchers []*paymen
 	proposal := &DealProposal{
 		MinerAddress: porcelainAPI.targetAddress,
 		PieceRef:     types.NewCidForTestGetter()(),
+		CommP:        proofs.CommP{1},
 		TotalPrice:   types.NewAttoFILFromFIL(2500),
 		Size:         types.NewBytesAmount(1000),
 		Duration:     10000,
@@ -486,7 +691,530 @@ func testSignedDealProposal(porcelainAPI *minerTestPorcelain, vouchers []*paymen
 		},
 	}
 
+	marketSignature, err := storagemarket.SignDealProposal(proposal.MarketProposal(), porcelainAPI.signer)
+	porcelainAPI.require.NoError(err)
+	proposal.MarketSignature = marketSignature
+
 	signedProposal, err := proposal.NewSignedProposal(porcelainAPI.payerAddress, porcelainAPI.signer)
 	porcelainAPI.require.NoError(err)
 	return signedProposal
 }
+
+func TestWorkerAddress(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	porcelainAPI := newMinerTestPorcelain(require)
+	miner := newTestMiner(porcelainAPI)
+
+	// proofs are sent from the owner unless a worker is configured
+	workerAddr, err := miner.WorkerAddress()
+	require.NoError(err)
+	assert.Equal(porcelainAPI.targetAddress, workerAddr)
+
+	require.NoError(porcelainAPI.config.Set("mining.workerAddress", `"`+address.TestAddress2.String()+`"`))
+	workerAddr, err = miner.WorkerAddress()
+	require.NoError(err)
+	assert.Equal(address.TestAddress2, workerAddr)
+}
+
+func TestPoStChallengeSeed(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	porcelainAPI := newMinerTestPorcelain(require)
+	sm := newTestMiner(porcelainAPI)
+
+	// the challenge is derived from the chain's randomness at the start of
+	// the proving period, as the miner actor does when verifying the PoSt
+	start := types.NewBlockHeight(700)
+	seed, err := sm.getPoStChallengeSeed(context.Background(), start)
+	require.NoError(err)
+	assert.Equal(miner.PoStChallengeSeed(start.Bytes()), seed)
+
+	// and is not available before the chain reaches it
+	_, err = sm.getPoStChallengeSeed(context.Background(), types.NewBlockHeight(800))
+	assert.Error(err)
+}
+
+func TestSubmitPoStFaults(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	porcelainAPI := newMinerTestPorcelain(require)
+	nd := newMinerTestNode(require)
+	sm := newTestMiner(porcelainAPI)
+	sm.node = nd
+
+	// the sector builder reports faults as indices into the commitments, the
+	// last of which matches no sector
+	nd.sectorBuilder.faults = []uint64{0, 2, 3}
+	inputs := []generatePostInput{{sectorID: 3}, {sectorID: 7}, {sectorID: 9}}
+
+	start := types.NewBlockHeight(0)
+	sm.submitPoSt(start, start.Add(miner.ProvingPeriodBlocks), proofs.PoStChallengeSeed{}, inputs)
+
+	require.Len(porcelainAPI.postParams, 3)
+	assert.Equal([]uint64{3, 9}, porcelainAPI.postParams[1])
+	assert.Equal(start, porcelainAPI.postParams[2])
+}
+
+func TestMinerResumesDeals(t *testing.T) {
+	ctx := context.Background()
+
+	// restart creates a miner from the deals persisted in r, as the node does
+	// when it starts mining after a restart.
+	restart := func(require *require.Assertions, r *repo.MemRepo, nd *minerTestNode, api *minerTestPorcelain) *Miner {
+		miner, err := NewMiner(ctx, address.TestAddress, api.targetAddress, nd, r.DealsDatastore(), api)
+		require.NoError(err)
+		return miner
+	}
+
+	// persistDeal stores the deal as a miner that stopped while processing it
+	// left it.
+	persistDeal := func(require *require.Assertions, r *repo.MemRepo, proposal *DealProposal, state DealState, sectorID uint64) cid.Cid {
+		proposalCid, err := convert.ToCid(proposal)
+		require.NoError(err)
+
+		miner := &Miner{
+			deals: map[cid.Cid]*storageDeal{
+				proposalCid: {
+					Proposal: proposal,
+					Response: &DealResponse{State: state, ProposalCid: proposalCid},
+					SectorID: sectorID,
+				},
+			},
+			dealsDs: r.DealsDatastore(),
+		}
+		require.NoError(miner.saveDeal(proposalCid))
+		return proposalCid
+	}
+
+	newProposal := func(api *minerTestPorcelain, pieceRef cid.Cid, duration uint64) *DealProposal {
+		vouchers := testPaymentVouchers(api, VoucherInterval, defaultAmountInc)
+		proposal := testSignedDealProposal(api, vouchers, api.targetAddress).DealProposal
+		proposal.PieceRef = pieceRef
+		proposal.Duration = duration
+		return &proposal
+	}
+
+	// newPieceProposal proposes to store the piece, with its piece commitment.
+	newPieceProposal := func(require *require.Assertions, api *minerTestPorcelain, piece *dag.RawNode, duration uint64) *DealProposal {
+		proposal := newProposal(api, piece.Cid(), duration)
+		commP, err := proofs.GeneratePieceCommitment(bytes.NewReader(piece.RawData()))
+		require.NoError(err)
+		proposal.CommP = commP
+		return proposal
+	}
+
+	dealState := func(miner *Miner, proposalCid cid.Cid) DealState {
+		miner.dealsLk.Lock()
+		defer miner.dealsLk.Unlock()
+		return miner.deals[proposalCid].Response.State
+	}
+
+	// waitForDealState waits until the deal reached the state and, when it is
+	// Staged, until the deal awaits the seal of its sector.
+	waitForDealState := func(require *require.Assertions, miner *Miner, proposalCid cid.Cid, state DealState) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			_, awaiting := miner.dealsAwaitingSeal.sectorOf(proposalCid)
+			if dealState(miner, proposalCid) == state && (state != Staged || awaiting) {
+				return
+			}
+			require.True(time.Now().Before(deadline), "deal did not reach state %s, it is %s", state, dealState(miner, proposalCid))
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	t.Run("processes accepted and transferring deals again", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		r := repo.NewInMemoryRepo()
+		api := newMinerTestPorcelain(require)
+		nd := newMinerTestNode(require)
+
+		piece := dag.NewRawNode([]byte("resumed piece"))
+		require.NoError(nd.blockService.AddBlock(piece))
+		accepted := persistDeal(require, r, newPieceProposal(require, api, piece, 100), Accepted, 0)
+		started := persistDeal(require, r, newPieceProposal(require, api, piece, 200), Started, 0)
+
+		miner := restart(require, r, nd, api)
+		waitForDealState(require, miner, accepted, Staged)
+		waitForDealState(require, miner, started, Staged)
+		assert.Len(nd.sectorBuilder.addedPieces(), 2)
+
+		sectorID, ok := miner.dealsAwaitingSeal.sectorOf(accepted)
+		require.True(ok)
+		assert.Equal(nd.sectorBuilder.sectorID, sectorID)
+
+		// staged deals wait for their sector without being staged again
+		miner = restart(require, r, nd, api)
+		assert.Len(nd.sectorBuilder.addedPieces(), 2)
+		assert.Equal(Staged, dealState(miner, accepted))
+
+		sector := &sectorbuilder.SealedSectorMetadata{
+			SectorID: sectorID,
+			Pieces:   []*sectorbuilder.PieceInfo{{Ref: piece.Cid()}},
+		}
+		miner.OnCommitmentAddedToChain(sector, nil)
+		assert.Equal(Posted, dealState(miner, accepted))
+		assert.Equal(Posted, dealState(miner, started))
+
+		// the sector records the piece commitment of the deals
+		commP := newPieceProposal(require, api, piece, 100).CommP
+		assert.Equal(commP, sector.Pieces[0].CommP)
+
+		// and the record survives a restart
+		miner = restart(require, r, nd, api)
+		pieces, err := miner.SectorPieces(sectorID)
+		require.NoError(err)
+		require.Len(pieces, 1)
+		assert.True(piece.Cid().Equals(pieces[0].Ref))
+		assert.Equal(commP, pieces[0].CommP)
+	})
+
+	t.Run("fails deals whose data does not match the piece commitment", func(t *testing.T) {
+		require := require.New(t)
+
+		r := repo.NewInMemoryRepo()
+		api := newMinerTestPorcelain(require)
+		nd := newMinerTestNode(require)
+
+		piece := dag.NewRawNode([]byte("committed piece"))
+		require.NoError(nd.blockService.AddBlock(piece))
+		proposal := newPieceProposal(require, api, piece, 100)
+		proposal.CommP[0]++
+		started := persistDeal(require, r, proposal, Started, 0)
+
+		miner := restart(require, r, nd, api)
+		waitForDealState(require, miner, started, Failed)
+		assert.Equal(t, "Piece commitment mismatch", miner.Query(ctx, started).Message)
+		assert.Empty(t, nd.sectorBuilder.addedPieces())
+	})
+
+	t.Run("fails resumed deals whose data cannot be fetched", func(t *testing.T) {
+		require := require.New(t)
+
+		r := repo.NewInMemoryRepo()
+		api := newMinerTestPorcelain(require)
+		nd := newMinerTestNode(require)
+
+		missing := dag.NewRawNode([]byte("missing piece"))
+		started := persistDeal(require, r, newProposal(api, missing.Cid(), 100), Started, 0)
+
+		miner := restart(require, r, nd, api)
+		waitForDealState(require, miner, started, Failed)
+		assert.Empty(t, nd.sectorBuilder.addedPieces())
+	})
+
+	t.Run("awaits the seal of staged deals", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		r := repo.NewInMemoryRepo()
+		api := newMinerTestPorcelain(require)
+		nd := newMinerTestNode(require)
+
+		// the miner stopped before it recorded the sector the deal awaits
+		staged := persistDeal(require, r, newProposal(api, types.NewCidForTestGetter()(), 100), Staged, 7)
+
+		miner := restart(require, r, nd, api)
+		sectorID, ok := miner.dealsAwaitingSeal.sectorOf(staged)
+		require.True(ok)
+		assert.Equal(uint64(7), sectorID)
+
+		miner.OnCommitmentAddedToChain(&sectorbuilder.SealedSectorMetadata{SectorID: 7}, nil)
+		assert.Equal(Posted, dealState(miner, staged))
+	})
+
+	t.Run("completes staged deals committed while the miner was stopped", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		r := repo.NewInMemoryRepo()
+		api := newMinerTestPorcelain(require)
+		api.commitments = map[string]types.Commitments{
+			"7": {CommD: proofs.CommD{1}, CommR: proofs.CommR{2}, CommRStar: proofs.CommRStar{3}},
+		}
+		nd := newMinerTestNode(require)
+
+		staged := persistDeal(require, r, newProposal(api, types.NewCidForTestGetter()(), 100), Staged, 0)
+		awaiting := &Miner{dealsDs: r.DealsDatastore()}
+		require.NoError(awaiting.loadDealsAwaitingSeal())
+		awaiting.dealsAwaitingSeal.add(7, staged)
+		require.NoError(awaiting.saveDealsAwaitingSeal())
+
+		miner := restart(require, r, nd, api)
+		resp := miner.Query(ctx, staged)
+		assert.Equal(Posted, resp.State)
+		require.NotNil(resp.ProofInfo)
+		assert.Equal(uint64(7), resp.ProofInfo.SectorID)
+		assert.Equal([]byte{2}, resp.ProofInfo.CommR[:1])
+	})
+
+	t.Run("does not stage a piece again if the miner stopped while staging it", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		r := repo.NewInMemoryRepo()
+		api := newMinerTestPorcelain(require)
+		nd := newMinerTestNode(require)
+
+		piece := dag.NewRawNode([]byte("staging piece"))
+		require.NoError(nd.blockService.AddBlock(piece))
+		staging := persistDeal(require, r, newPieceProposal(require, api, piece, 100), Started, 0)
+		stopped := &Miner{dealsDs: r.DealsDatastore()}
+		require.NoError(stopped.loadDeals())
+		stopped.deals[staging].Staging = true
+		require.NoError(stopped.saveDeal(staging))
+
+		miner := restart(require, r, nd, api)
+		deadline := time.Now().Add(5 * time.Second)
+		for !miner.dealsAwaitingSeal.awaitsPiece(staging) {
+			require.True(time.Now().Before(deadline), "deal does not await its piece")
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(Staged, dealState(miner, staging))
+		assert.Empty(nd.sectorBuilder.addedPieces())
+
+		// the deal still awaits its piece after another restart
+		miner = restart(require, r, nd, api)
+		assert.True(miner.dealsAwaitingSeal.awaitsPiece(staging))
+
+		sector := &sectorbuilder.SealedSectorMetadata{
+			SectorID: 3,
+			Pieces:   []*sectorbuilder.PieceInfo{{Ref: piece.Cid()}},
+		}
+		assert.Len(miner.SectorDealIDs(sector), 1)
+		miner.OnCommitmentAddedToChain(sector, nil)
+		resp := miner.Query(ctx, staging)
+		assert.Equal(Posted, resp.State)
+		require.NotNil(resp.ProofInfo)
+		assert.Equal(uint64(3), resp.ProofInfo.SectorID)
+	})
+
+	t.Run("stages manually transferred deals once their data is imported", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		r := repo.NewInMemoryRepo()
+		api := newMinerTestPorcelain(require)
+		nd := newMinerTestNode(require)
+
+		piece := dag.NewRawNode([]byte("offline piece"))
+		proposal := newPieceProposal(require, api, piece, 100)
+		proposal.ManualTransfer = true
+		manual := persistDeal(require, r, proposal, Accepted, 0)
+
+		miner := restart(require, r, nd, api)
+		waitForDealState(require, miner, manual, AwaitingData)
+		assert.Empty(nd.sectorBuilder.addedPieces())
+
+		// deals await their data across restarts
+		miner = restart(require, r, nd, api)
+		assert.Equal(AwaitingData, dealState(miner, manual))
+
+		other := dag.NewRawNode([]byte("other piece"))
+		err := miner.ImportDealData(manual, other.Cid())
+		require.Error(err)
+		assert.Contains(err.Error(), "does not match the piece of the deal")
+
+		require.NoError(nd.blockService.AddBlock(piece))
+		require.NoError(miner.ImportDealData(manual, piece.Cid()))
+		waitForDealState(require, miner, manual, Staged)
+		assert.Equal([]cid.Cid{piece.Cid()}, nd.sectorBuilder.addedPieces())
+
+		err = miner.ImportDealData(manual, piece.Cid())
+		require.Error(err)
+		assert.Contains(err.Error(), "not awaiting data")
+
+		assert.Error(miner.ImportDealData(types.NewCidForTestGetter()(), piece.Cid()))
+	})
+}
+
+// minerTestNode provides a miner with an offline block service and a sector
+// builder that only records the pieces added to it.
+type minerTestNode struct {
+	host          host.Host
+	blockService  bserv.BlockService
+	dataTransfer  *transfer.Manager
+	sectorBuilder *minerTestSectorBuilder
+	config        *cfg.Config
+}
+
+func newMinerTestNode(require *require.Assertions) *minerTestNode {
+	mn, err := mocknet.WithNPeers(context.Background(), 1)
+	require.NoError(err)
+
+	bs := bstore.NewBlockstore(repo.NewInMemoryRepo().Datastore())
+	nd := &minerTestNode{
+		host:          mn.Hosts()[0],
+		blockService:  bserv.New(bs, offline.Exchange(bs)),
+		sectorBuilder: &minerTestSectorBuilder{sectorID: 1},
+		config:        cfg.NewConfig(repo.NewInMemoryRepo()),
+	}
+	nd.dataTransfer = transfer.NewManager(nd.host, bs, nd)
+	return nd
+}
+
+func (nd *minerTestNode) ConfigGet(dottedPath string) (interface{}, error) {
+	return nd.config.Get(dottedPath)
+}
+
+func (nd *minerTestNode) DataTransfer() *transfer.Manager {
+	return nd.dataTransfer
+}
+
+func (nd *minerTestNode) BlockHeight() (*types.BlockHeight, error) {
+	return types.NewBlockHeight(0), nil
+}
+
+func (nd *minerTestNode) GetBlockTime() time.Duration {
+	return time.Second
+}
+
+func (nd *minerTestNode) BlockService() bserv.BlockService {
+	return nd.blockService
+}
+
+func (nd *minerTestNode) Host() host.Host {
+	return nd.host
+}
+
+func (nd *minerTestNode) SectorBuilder() sectorbuilder.SectorBuilder {
+	return nd.sectorBuilder
+}
+
+type minerTestSectorBuilder struct {
+	lk       sync.Mutex
+	pieces   []cid.Cid
+	sectorID uint64
+	faults   []uint64
+}
+
+func (sb *minerTestSectorBuilder) addedPieces() []cid.Cid {
+	sb.lk.Lock()
+	defer sb.lk.Unlock()
+	return append([]cid.Cid{}, sb.pieces...)
+}
+
+func (sb *minerTestSectorBuilder) AddPiece(ctx context.Context, pi *sectorbuilder.PieceInfo) (uint64, error) {
+	sb.lk.Lock()
+	defer sb.lk.Unlock()
+	sb.pieces = append(sb.pieces, pi.Ref)
+	return sb.sectorID, nil
+}
+
+func (sb *minerTestSectorBuilder) ReadPieceFromSealedSector(pieceCid cid.Cid) (io.Reader, error) {
+	return nil, nil
+}
+
+func (sb *minerTestSectorBuilder) SealAllStagedSectors(ctx context.Context) error {
+	return nil
+}
+
+func (sb *minerTestSectorBuilder) SectorSealResults() <-chan sectorbuilder.SectorSealResult {
+	return nil
+}
+
+func (sb *minerTestSectorBuilder) GetMaxUserBytesPerStagedSector() (uint64, error) {
+	return 0, nil
+}
+
+func (sb *minerTestSectorBuilder) GeneratePoST(sectorbuilder.GeneratePoSTRequest) (sectorbuilder.GeneratePoSTResponse, error) {
+	return sectorbuilder.GeneratePoSTResponse{Faults: sb.faults}, nil
+}
+
+func (sb *minerTestSectorBuilder) Close() error {
+	return nil
+}
+
+func TestMinerCompletesDeals(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	api := newMinerTestPorcelain(require)
+	ended := func(terminatedAt *types.BlockHeight) *storagemarket.Deal {
+		return &storagemarket.Deal{
+			Proposal:     storagemarket.DealProposal{Duration: 100},
+			ActivatedAt:  types.NewBlockHeight(10),
+			TerminatedAt: terminatedAt,
+			PaidUntil:    types.NewBlockHeight(110),
+		}
+	}
+	api.marketDeals = map[uint64]*storagemarket.Deal{
+		0: ended(nil),
+		1: {Proposal: storagemarket.DealProposal{Duration: 100}, ActivatedAt: types.NewBlockHeight(10), PaidUntil: types.NewBlockHeight(60)},
+		2: ended(types.NewBlockHeight(50)),
+	}
+
+	newCid := types.NewCidForTestGetter()
+	miner := &Miner{porcelainAPI: api, deals: map[cid.Cid]*storageDeal{}, dealsDs: repo.NewInMemoryRepo().DealsDatastore()}
+	postDeal := func(dealID uint64) cid.Cid {
+		c := newCid()
+		miner.deals[c] = &storageDeal{
+			Proposal:  &DealProposal{},
+			Response:  &DealResponse{State: Posted, ProposalCid: c},
+			Published: true,
+			DealID:    dealID,
+		}
+		return c
+	}
+	completed, active, terminated := postDeal(0), postDeal(1), postDeal(2)
+
+	miner.completeDeals(context.Background())
+
+	assert.Equal(Complete, miner.Query(context.Background(), completed).State)
+	assert.Equal(Posted, miner.Query(context.Background(), active).State)
+	resp := miner.Query(context.Background(), terminated)
+	assert.Equal(Failed, resp.State)
+	assert.Equal("sector terminated", resp.Message)
+}
+
+func TestMinerDealHistory(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	r := repo.NewInMemoryRepo()
+	proposalCid := types.NewCidForTestGetter()()
+	miner := &Miner{
+		deals: map[cid.Cid]*storageDeal{
+			proposalCid: {
+				Proposal: &DealProposal{},
+				Response: &DealResponse{ProposalCid: proposalCid},
+			},
+		},
+		dealsDs: r.DealsDatastore(),
+	}
+
+	require.NoError(miner.transitionDeal(proposalCid, Accepted, "proposal accepted", nil))
+	require.NoError(miner.transitionDeal(proposalCid, Started, "transferring data", nil))
+
+	// deals can not skip states
+	assert.Error(miner.transitionDeal(proposalCid, Posted, "sector 1 committed", nil))
+	assert.Equal(Started, miner.Query(context.Background(), proposalCid).State)
+
+	require.NoError(miner.transitionDeal(proposalCid, Failed, "failed to fetch data", func(d *storageDeal) {
+		d.Response.Message = "Transfer failed"
+	}))
+
+	// failed deals are final
+	assert.Error(miner.transitionDeal(proposalCid, Staged, "piece staged into sector 1", nil))
+
+	// the history is persisted with the deal
+	require.NoError(miner.loadDeals())
+	history, err := miner.DealHistory(proposalCid)
+	require.NoError(err)
+	require.Len(history, 3)
+	assert.Equal(Unknown, history[0].From)
+	assert.Equal(Accepted, history[0].To)
+	assert.Equal(Started, history[2].From)
+	assert.Equal(Failed, history[2].To)
+	assert.Equal("failed to fetch data", history[2].Reason)
+	assert.NotZero(history[2].Time)
+
+	_, err = miner.DealHistory(types.NewCidForTestGetter()())
+	assert.Error(err)
+}
@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	"gx/ipfs/QmUadX5EcvrBmxAV9sE7wUWtWSqxns5K84qKJBixmcT1w9/go-datastore"
+	"gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
+	cbor "gx/ipfs/QmcZLyosDwMKdB6NLRsiss9HXzDPhVhhRtPy67JFKTDQDX/go-ipld-cbor"
+
+	"github.com/filecoin-project/go-filecoin/address"
+)
+
+const orderDatastorePrefix = "order"
+
+// StorageOrder is a request to store data with several independent miners.
+// It tracks the deal made with each miner holding a replica of the data, and
+// the miners that were asked for a replica but did not take it.
+type StorageOrder struct {
+	Data     cid.Cid
+	Replicas uint64
+	Duration uint64
+
+	Deals      []*OrderDeal
+	Rejections []*OrderRejection
+}
+
+// OrderDeal is a deal a miner accepted to store a replica of an order.
+type OrderDeal struct {
+	Miner       address.Address
+	ProposalCid cid.Cid
+}
+
+// OrderRejection records why a miner did not take a replica of an order.
+type OrderRejection struct {
+	Miner  address.Address
+	Reason string
+}
+
+func init() {
+	cbor.RegisterCborType(StorageOrder{})
+	cbor.RegisterCborType(OrderDeal{})
+	cbor.RegisterCborType(OrderRejection{})
+}
+
+// hasMiner returns true if the miner already holds a replica of the order.
+func (o *StorageOrder) hasMiner(miner address.Address) bool {
+	for _, d := range o.Deals {
+		if d.Miner == miner {
+			return true
+		}
+	}
+	return false
+}
+
+// StoreReplicas stores the data with the given number of miners, picked in
+// order from the asks, at most one deal per miner. Deals are proposed in
+// parallel, and every miner that rejects a proposal is replaced by the next
+// miner in the asks. The replicas are tracked as one storage order for the
+// data: storing the same data again tops up the existing order, so an order
+// that could not be completed is finished by retrying with new asks.
+func (smc *Client) StoreReplicas(ctx context.Context, data cid.Cid, asks []*IndexedAsk, replicas uint64, duration uint64, manualTransfer bool) (*StorageOrder, error) {
+	if replicas == 0 {
+		return nil, errors.New("an order needs at least one replica")
+	}
+
+	smc.ordersLk.Lock()
+	if smc.storing[data] {
+		smc.ordersLk.Unlock()
+		return nil, fmt.Errorf("%s is already being stored", data)
+	}
+	smc.storing[data] = true
+	order, err := smc.loadOrder(data)
+	smc.ordersLk.Unlock()
+	defer func() {
+		smc.ordersLk.Lock()
+		delete(smc.storing, data)
+		smc.ordersLk.Unlock()
+	}()
+	if err != nil {
+		return nil, err
+	}
+	if order == nil {
+		order = &StorageOrder{Data: data}
+	}
+	order.Replicas = replicas
+	order.Duration = duration
+
+	// a miner is only ever asked for one replica
+	var candidates []*IndexedAsk
+	seen := map[address.Address]bool{}
+	for _, ask := range asks {
+		if seen[ask.Miner] || order.hasMiner(ask.Miner) {
+			continue
+		}
+		seen[ask.Miner] = true
+		candidates = append(candidates, ask)
+	}
+
+	type proposalResult struct {
+		miner address.Address
+		resp  *DealResponse
+		err   error
+	}
+	results := make(chan proposalResult)
+	inFlight := uint64(0)
+	propose := func() bool {
+		if len(candidates) == 0 {
+			return false
+		}
+		ask := candidates[0]
+		candidates = candidates[1:]
+		inFlight++
+		go func() {
+			resp, err := smc.ProposeDeal(ctx, ask.Miner, data, ask.ID, duration, false, manualTransfer)
+			results <- proposalResult{miner: ask.Miner, resp: resp, err: err}
+		}()
+		return true
+	}
+
+	for i := uint64(len(order.Deals)); i < replicas; i++ {
+		if !propose() {
+			break
+		}
+	}
+	for inFlight > 0 {
+		res := <-results
+		inFlight--
+
+		if res.err != nil {
+			log.Infof("miner %s did not take a replica of %s: %s", res.miner, data, res.err)
+			order.Rejections = append(order.Rejections, &OrderRejection{Miner: res.miner, Reason: res.err.Error()})
+			propose()
+		} else {
+			order.Deals = append(order.Deals, &OrderDeal{Miner: res.miner, ProposalCid: res.resp.ProposalCid})
+		}
+
+		smc.ordersLk.Lock()
+		err := smc.saveOrder(order)
+		smc.ordersLk.Unlock()
+		if err != nil {
+			log.Errorf("failed to save storage order for %s: %s", data, err)
+		}
+	}
+
+	if uint64(len(order.Deals)) < replicas {
+		return order, fmt.Errorf("only %d of %d replicas were stored, not enough miners took the deal", len(order.Deals), replicas)
+	}
+	return order, nil
+}
+
+// StorageOrder returns the storage order for the data.
+func (smc *Client) StorageOrder(data cid.Cid) (*StorageOrder, error) {
+	smc.ordersLk.Lock()
+	defer smc.ordersLk.Unlock()
+	order, err := smc.loadOrder(data)
+	if err != nil {
+		return nil, err
+	}
+	if order == nil {
+		return nil, fmt.Errorf("no storage order for %s", data)
+	}
+	return order, nil
+}
+
+// loadOrder reads the storage order for the data, returning nil if there is
+// none.
+func (smc *Client) loadOrder(data cid.Cid) (*StorageOrder, error) {
+	datum, err := smc.dealsDs.Get(orderKey(data))
+	if err == datastore.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read storage order from datastore")
+	}
+
+	var order StorageOrder
+	if err := cbor.DecodeInto(datum, &order); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal storage order")
+	}
+	return &order, nil
+}
+
+func (smc *Client) saveOrder(order *StorageOrder) error {
+	datum, err := cbor.DumpObject(order)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal storage order")
+	}
+	if err := smc.dealsDs.Put(orderKey(order.Data), datum); err != nil {
+		return errors.Wrap(err, "could not save storage order to disk")
+	}
+	return nil
+}
+
+func orderKey(data cid.Cid) datastore.Key {
+	return datastore.KeyWithNamespaces([]string{orderDatastorePrefix, data.String()})
+}
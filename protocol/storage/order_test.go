@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-filecoin/address"
+	"github.com/filecoin-project/go-filecoin/repo"
+	"github.com/filecoin-project/go-filecoin/types"
+	"github.com/filecoin-project/go-filecoin/util/convert"
+	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/assert"
+	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/require"
+)
+
+func TestStoreReplicas(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	addressCreator := address.NewForTestGetter()
+	minerA, minerB, minerC, minerD := addressCreator(), addressCreator(), addressCreator(), addressCreator()
+
+	// miner B rejects every deal
+	testNode := newTestClientNode(func(request interface{}) (interface{}, error) {
+		p := request.(*SignedDealProposal)
+		pcid, err := convert.ToCid(p.DealProposal)
+		require.NoError(err)
+		if p.MinerAddress == minerB {
+			return &DealResponse{State: Rejected, Message: "no space", ProposalCid: pcid}, nil
+		}
+		return &DealResponse{State: Accepted, ProposalCid: pcid}, nil
+	})
+
+	testRepo := repo.NewInMemoryRepo()
+	client, err := NewClient(testNode, newTestClientAPI(require), testRepo.DealsDs)
+	require.NoError(err)
+
+	asks := []*IndexedAsk{
+		{Miner: minerA, ID: 0},
+		{Miner: minerA, ID: 1},
+		{Miner: minerB, ID: 0},
+		{Miner: minerC, ID: 0},
+		{Miner: minerD, ID: 0},
+	}
+	assertMiners := func(order *StorageOrder, miners ...address.Address) {
+		require.Len(order.Deals, len(miners))
+		for _, m := range miners {
+			assert.True(order.hasMiner(m), "%s holds no replica", m)
+		}
+	}
+
+	ctx := context.Background()
+	cidCreator := types.NewCidForTestGetter()
+	data := cidCreator()
+
+	// the rejected replica is placed with the next miner
+	order, err := client.StoreReplicas(ctx, data, asks, 2, 10000, false)
+	require.NoError(err)
+	assertMiners(order, minerA, minerC)
+	require.Len(order.Rejections, 1)
+	assert.Equal(minerB, order.Rejections[0].Miner)
+	assert.Contains(order.Rejections[0].Reason, "no space")
+
+	// the order is persisted with the deals of its replicas
+	client, err = NewClient(testNode, newTestClientAPI(require), testRepo.DealsDs)
+	require.NoError(err)
+	order, err = client.StorageOrder(data)
+	require.NoError(err)
+	assert.Equal(uint64(2), order.Replicas)
+	assertMiners(order, minerA, minerC)
+	for _, d := range order.Deals {
+		_, err := client.DealHistory(d.ProposalCid)
+		assert.NoError(err)
+	}
+
+	// storing the data again tops up the order with new miners
+	order, err = client.StoreReplicas(ctx, data, asks, 3, 10000, false)
+	require.NoError(err)
+	assertMiners(order, minerA, minerC, minerD)
+
+	// and fails when there are not enough miners to take the replicas
+	order, err = client.StoreReplicas(ctx, data, asks, 4, 10000, false)
+	assert.EqualError(err, "only 3 of 4 replicas were stored, not enough miners took the deal")
+	assert.Len(order.Deals, 3)
+
+	_, err = client.StorageOrder(cidCreator())
+	assert.Error(err)
+}
@@ -0,0 +1,454 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	"gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
+	cbor "gx/ipfs/QmcZLyosDwMKdB6NLRsiss9HXzDPhVhhRtPy67JFKTDQDX/go-ipld-cbor"
+
+	"github.com/filecoin-project/go-filecoin/actor/builtin/paymentbroker"
+	"github.com/filecoin-project/go-filecoin/address"
+	"github.com/filecoin-project/go-filecoin/exec"
+	"github.com/filecoin-project/go-filecoin/types"
+)
+
+const (
+	// PaymentRedeemInterval is the minimum number of blocks between two
+	// redemptions on the same lane. Vouchers that become valid in between are
+	// covered by a single redemption of the best of them, saving gas.
+	PaymentRedeemInterval = 3 * VoucherInterval
+
+	// PaymentRedeemMargin is the number of blocks before the eol of a channel
+	// from which the best voucher held on it is redeemed without waiting for
+	// the redeem interval.
+	PaymentRedeemMargin = ChannelExpiryInterval / 2
+)
+
+// TODO: replace this with a queries to pick reasonable gas price and limits.
+const redeemVoucherGasPrice = 0
+
+// redeemVoucherGasLimit is the gas limit of a redemption, per voucher redeemed.
+const redeemVoucherGasLimit = 300
+
+const waitForRedemptionDuration = 10 * time.Minute
+
+// ChannelPayments reports the vouchers a miner holds on one lane of a payment
+// channel.
+type ChannelPayments struct {
+	Payer   address.Address
+	Channel *types.ChannelID
+	Lane    uint64
+
+	// Eol is the block height at which the payer may reclaim the funds of the
+	// channel, or nil if the channel cannot be found on chain.
+	Eol *types.BlockHeight
+
+	// Vouchers is the number of vouchers held on the lane.
+	Vouchers int
+
+	// Redeemed is the amount redeemed on the lane.
+	Redeemed *types.AttoFIL
+
+	// Redeemable is the amount redeeming the best voucher valid at the current
+	// block height would add to Redeemed.
+	Redeemable *types.AttoFIL
+
+	// Outstanding is the amount the vouchers held add to Redeemed once all of
+	// them are valid.
+	Outstanding *types.AttoFIL
+
+	// Pending is the amount of the redemption sent but not yet included in a
+	// block, if any.
+	Pending *types.AttoFIL
+}
+
+type paymentManagerPorcelain interface {
+	MessageSend(ctx context.Context, from, to address.Address, value *types.AttoFIL, gasPrice types.AttoFIL, gasLimit types.GasUnits, method string, params ...interface{}) (cid.Cid, error)
+	MessageQuery(ctx context.Context, optFrom, to address.Address, method string, params ...interface{}) ([][]byte, *exec.FunctionSignature, error)
+	MessageWait(ctx context.Context, msgCid cid.Cid, cb func(*types.Block, *types.SignedMessage, *types.MessageReceipt) error) error
+}
+
+// dealPayments are the payment vouchers of a deal. DealID is the id of the
+// deal in the storage market, or nil if the deal is not published yet. It
+// completes the piece inclusion condition of the vouchers, if they have one.
+type dealPayments struct {
+	Vouchers []*paymentbroker.PaymentVoucher
+	DealID   *big.Int
+}
+
+// paymentManager redeems the vouchers clients pay a miner with. Vouchers are
+// not stored by the manager: they are read from the miner's deals every time
+// a new heaviest tipset is processed, and what has been redeemed is read from
+// the chain. For every lane, the best voucher valid at the current block
+// height is redeemed once it adds to what has been redeemed, at most every
+// PaymentRedeemInterval blocks unless the channel is within
+// PaymentRedeemMargin blocks of its eol or no better voucher is held. The
+// vouchers due at the same height are redeemed by a single message.
+type paymentManager struct {
+	// target is the address vouchers pay to, and redemptions are sent from.
+	target       address.Address
+	porcelainAPI paymentManagerPorcelain
+
+	// payments returns the vouchers of every deal the miner may redeem.
+	payments func() []*dealPayments
+
+	mu           sync.Mutex
+	pending      map[string]*pendingRedemption
+	lastRedeemed map[string]*types.BlockHeight
+}
+
+type pendingRedemption struct {
+	amount *types.AttoFIL
+	msgCid cid.Cid
+}
+
+// laneVouchers are the vouchers held on a lane along with the chain state of
+// their channel.
+type laneVouchers struct {
+	key      string
+	payer    address.Address
+	channel  *types.ChannelID
+	lane     uint64
+	vouchers []*paymentbroker.PaymentVoucher
+
+	// deal is the deal the vouchers pay for, and dealIDs the storage market
+	// id of the deal each voucher was received with, nil if it is not
+	// published yet.
+	deal    *dealPayments
+	dealIDs map[*paymentbroker.PaymentVoucher]*big.Int
+
+	// mixed is true if vouchers of several deals were received on the lane.
+	mixed bool
+
+	// state is the state of the channel, or nil if it cannot be found.
+	state *paymentbroker.PaymentChannel
+}
+
+func newPaymentManager(target address.Address, porcelainAPI paymentManagerPorcelain, payments func() []*dealPayments) *paymentManager {
+	return &paymentManager{
+		target:       target,
+		porcelainAPI: porcelainAPI,
+		payments:     payments,
+		pending:      map[string]*pendingRedemption{},
+		lastRedeemed: map[string]*types.BlockHeight{},
+	}
+}
+
+// OnNewHeaviestTipSet redeems the vouchers that are due at the height of the
+// new head.
+func (pm *paymentManager) OnNewHeaviestTipSet(ts types.TipSet) {
+	height, err := ts.Height()
+	if err != nil {
+		log.Errorf("failed to get block height: %s", err)
+		return
+	}
+
+	if err := pm.redeem(context.Background(), types.NewBlockHeight(height)); err != nil {
+		log.Errorf("failed to redeem payment vouchers: %s", err)
+	}
+}
+
+// redeem redeems the best voucher of every lane that has one due at the given
+// block height, with a single redeemMany message.
+func (pm *paymentManager) redeem(ctx context.Context, height *types.BlockHeight) error {
+	lanes, err := pm.lanes(ctx)
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	var vouchers []*paymentbroker.PaymentVoucher
+	var redemptions []*paymentbroker.Redemption
+	for _, l := range lanes {
+		if l.state == nil {
+			log.Warningf("holding vouchers for unknown payment channel %s of %s", l.channel, l.payer)
+			continue
+		}
+		if height.GreaterEqual(l.state.Eol) {
+			continue
+		}
+		if l.mixed {
+			log.Warningf("not redeeming lane %d of payment channel %s of %s, it holds vouchers of several deals", l.lane, l.channel, l.payer)
+			continue
+		}
+
+		best := l.best(height)
+		if best == nil || best.Amount.LessEqual(pm.redeemedOrPending(l, best)) {
+			continue
+		}
+		if !pm.due(l, best, height) {
+			continue
+		}
+
+		var conditionParams []interface{}
+		if best.Condition != nil {
+			conditionParams = append(conditionParams, l.dealIDs[best])
+		}
+		redemption, err := paymentbroker.NewRedemption(best, conditionParams...)
+		if err != nil {
+			log.Errorf("failed to encode voucher on lane %d of payment channel %s: %s", l.lane, l.channel, err)
+			continue
+		}
+		keys = append(keys, l.key)
+		vouchers = append(vouchers, best)
+		redemptions = append(redemptions, redemption)
+	}
+
+	if len(redemptions) == 0 {
+		return nil
+	}
+
+	encoded, err := paymentbroker.EncodeRedemptions(redemptions)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode redemptions")
+	}
+
+	msgCid, err := pm.porcelainAPI.MessageSend(
+		ctx,
+		pm.target,
+		address.PaymentBrokerAddress,
+		types.NewZeroAttoFIL(),
+		types.NewGasPrice(redeemVoucherGasPrice),
+		types.NewGasUnits(redeemVoucherGasLimit*uint64(len(redemptions))),
+		"redeemMany",
+		encoded,
+	)
+	if err != nil {
+		return errors.Wrap(err, "failed to send redemptions")
+	}
+
+	pm.mu.Lock()
+	for i, key := range keys {
+		pm.pending[key] = &pendingRedemption{amount: &vouchers[i].Amount, msgCid: msgCid}
+		pm.lastRedeemed[key] = height
+	}
+	pm.mu.Unlock()
+
+	go pm.waitForRedemption(keys, msgCid)
+
+	return nil
+}
+
+// due returns true if the best voucher of the lane should be redeemed at the
+// given block height rather than left to accumulate with later ones.
+func (pm *paymentManager) due(l *laneVouchers, best *paymentbroker.PaymentVoucher, height *types.BlockHeight) bool {
+	if l.state.Eol.Sub(height).LessEqual(types.NewBlockHeight(PaymentRedeemMargin)) {
+		return true
+	}
+	if best.Amount.Equal(&l.last().Amount) {
+		return true
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	last, ok := pm.lastRedeemed[l.key]
+	return !ok || height.Sub(last).GreaterEqual(types.NewBlockHeight(PaymentRedeemInterval))
+}
+
+// redeemedOrPending returns the amount redeeming the voucher builds on, or the
+// amount of the redemption in flight on the lane if that is larger.
+func (pm *paymentManager) redeemedOrPending(l *laneVouchers, v *paymentbroker.PaymentVoucher) *types.AttoFIL {
+	redeemed := l.redeemedBefore(v)
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if p, ok := pm.pending[l.key]; ok && p.amount.GreaterThan(redeemed) {
+		return p.amount
+	}
+	return redeemed
+}
+
+// waitForRedemption clears the pending redemptions of the given lanes once
+// the message redeeming them is included in a block, or could not be found in
+// time.
+func (pm *paymentManager) waitForRedemption(keys []string, msgCid cid.Cid) {
+	ctx, cancel := context.WithTimeout(context.Background(), waitForRedemptionDuration)
+	defer cancel()
+
+	err := pm.porcelainAPI.MessageWait(ctx, msgCid, func(blk *types.Block, smsg *types.SignedMessage, receipt *types.MessageReceipt) error {
+		if receipt.ExitCode != uint8(0) {
+			return fmt.Errorf("redeem message %s failed with exit code %d", msgCid, receipt.ExitCode)
+		}
+
+		var codes []uint8
+		if err := cbor.DecodeInto(receipt.Return[0], &codes); err != nil {
+			return errors.Wrapf(err, "failed to decode results of redeem message %s", msgCid)
+		}
+		for i, code := range codes {
+			if code != 0 && i < len(keys) {
+				log.Errorf("failed to redeem voucher on lane %s with exit code %d", keys[i], code)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("failed to redeem vouchers: %s", err)
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	for _, key := range keys {
+		if p, ok := pm.pending[key]; ok && p.msgCid.Equals(msgCid) {
+			delete(pm.pending, key)
+		}
+	}
+}
+
+// Payments reports the vouchers held on every lane at the given block height.
+func (pm *paymentManager) Payments(ctx context.Context, height *types.BlockHeight) ([]*ChannelPayments, error) {
+	lanes, err := pm.lanes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	out := make([]*ChannelPayments, 0, len(lanes))
+	for _, l := range lanes {
+		report := &ChannelPayments{
+			Payer:       l.payer,
+			Channel:     l.channel,
+			Lane:        l.lane,
+			Vouchers:    len(l.vouchers),
+			Redeemed:    types.NewZeroAttoFIL(),
+			Redeemable:  types.NewZeroAttoFIL(),
+			Outstanding: types.NewZeroAttoFIL(),
+			Pending:     types.NewZeroAttoFIL(),
+		}
+		if l.state != nil {
+			report.Eol = l.state.Eol
+			report.Redeemed = l.state.Lane(l.lane).Redeemed
+		}
+		if best := l.best(height); best != nil && best.Amount.GreaterThan(l.redeemedBefore(best)) {
+			report.Redeemable = best.Amount.Sub(l.redeemedBefore(best))
+		}
+		if last := l.last(); last.Amount.GreaterThan(l.redeemedBefore(last)) {
+			report.Outstanding = last.Amount.Sub(l.redeemedBefore(last))
+		}
+		if p, ok := pm.pending[l.key]; ok && p.amount.GreaterThan(report.Redeemed) {
+			report.Pending = p.amount.Sub(report.Redeemed)
+		}
+		out = append(out, report)
+	}
+	return out, nil
+}
+
+// lanes groups the vouchers held by lane, and looks up the state of their
+// channels. Lanes are ordered by payer, channel and lane.
+func (pm *paymentManager) lanes(ctx context.Context) ([]*laneVouchers, error) {
+	byKey := map[string]*laneVouchers{}
+	for _, dp := range pm.payments() {
+		for _, v := range dp.Vouchers {
+			// the id of the deal completes the piece inclusion condition of
+			// the voucher, so it cannot be redeemed before the deal is
+			// published
+			if v.Condition != nil && dp.DealID == nil {
+				continue
+			}
+
+			key := fmt.Sprintf("%s/%s/%d", v.Payer, v.Channel.KeyString(), v.Lane)
+			l, ok := byKey[key]
+			if !ok {
+				channel := v.Channel
+				l = &laneVouchers{
+					key:     key,
+					payer:   v.Payer,
+					channel: &channel,
+					lane:    v.Lane,
+					deal:    dp,
+					dealIDs: map[*paymentbroker.PaymentVoucher]*big.Int{},
+				}
+				byKey[key] = l
+			}
+			if l.deal != dp {
+				l.mixed = true
+			}
+			l.vouchers = append(l.vouchers, v)
+			l.dealIDs[v] = dp.DealID
+		}
+	}
+
+	channels := map[address.Address]map[string]*paymentbroker.PaymentChannel{}
+	lanes := make([]*laneVouchers, 0, len(byKey))
+	for _, l := range byKey {
+		payerChannels, ok := channels[l.payer]
+		if !ok {
+			var err error
+			payerChannels, err = pm.paymentChannels(ctx, l.payer)
+			if err != nil {
+				return nil, err
+			}
+			channels[l.payer] = payerChannels
+		}
+		l.state = payerChannels[l.channel.KeyString()]
+
+		sort.Slice(l.vouchers, func(i, j int) bool {
+			if !l.vouchers[i].Amount.Equal(&l.vouchers[j].Amount) {
+				return l.vouchers[i].Amount.LessThan(&l.vouchers[j].Amount)
+			}
+			return l.vouchers[i].Nonce < l.vouchers[j].Nonce
+		})
+		lanes = append(lanes, l)
+	}
+
+	sort.Slice(lanes, func(i, j int) bool {
+		if lanes[i].payer != lanes[j].payer {
+			return lanes[i].payer.String() < lanes[j].payer.String()
+		}
+		if !lanes[i].channel.Equal(lanes[j].channel) {
+			return lanes[i].channel.LessThan(lanes[j].channel)
+		}
+		return lanes[i].lane < lanes[j].lane
+	})
+	return lanes, nil
+}
+
+func (pm *paymentManager) paymentChannels(ctx context.Context, payer address.Address) (map[string]*paymentbroker.PaymentChannel, error) {
+	ret, _, err := pm.porcelainAPI.MessageQuery(ctx, address.Address{}, address.PaymentBrokerAddress, "ls", payer)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query payment channels of %s", payer)
+	}
+
+	var channels map[string]*paymentbroker.PaymentChannel
+	if err := cbor.DecodeInto(ret[0], &channels); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode payment channels of %s", payer)
+	}
+	return channels, nil
+}
+
+// best returns the voucher with the highest amount valid at the given block
+// height, or nil if none is.
+func (l *laneVouchers) best(height *types.BlockHeight) *paymentbroker.PaymentVoucher {
+	for i := len(l.vouchers) - 1; i >= 0; i-- {
+		if l.vouchers[i].ValidAt.LessEqual(height) {
+			return l.vouchers[i]
+		}
+	}
+	return nil
+}
+
+// redeemedBefore returns the amount the voucher is redeemed against: the
+// amount redeemed on the lane, plus the amounts redeemed on the lanes the
+// voucher merges, which the payment broker counts towards its amount.
+func (l *laneVouchers) redeemedBefore(v *paymentbroker.PaymentVoucher) *types.AttoFIL {
+	if l.state == nil {
+		return types.NewZeroAttoFIL()
+	}
+	redeemed := l.state.Lane(l.lane).Redeemed
+	for _, merge := range v.Merges {
+		redeemed = redeemed.Add(l.state.Lane(merge.Lane).Redeemed)
+	}
+	return redeemed
+}
+
+// last returns the voucher with the highest amount.
+func (l *laneVouchers) last() *paymentbroker.PaymentVoucher {
+	return l.vouchers[len(l.vouchers)-1]
+}
@@ -0,0 +1,286 @@
+package storage
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/assert"
+	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/require"
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	"gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
+	cbor "gx/ipfs/QmcZLyosDwMKdB6NLRsiss9HXzDPhVhhRtPy67JFKTDQDX/go-ipld-cbor"
+
+	"github.com/filecoin-project/go-filecoin/abi"
+	"github.com/filecoin-project/go-filecoin/actor/builtin/paymentbroker"
+	"github.com/filecoin-project/go-filecoin/address"
+	"github.com/filecoin-project/go-filecoin/exec"
+	"github.com/filecoin-project/go-filecoin/types"
+)
+
+func TestPaymentManager(t *testing.T) {
+	ctx := context.Background()
+	addrGetter := address.NewForTestGetter()
+	target, payer := addrGetter(), addrGetter()
+
+	voucher := func(channel, amount, validAt, nonce uint64) *paymentbroker.PaymentVoucher {
+		return &paymentbroker.PaymentVoucher{
+			Channel: *types.NewChannelID(channel),
+			Payer:   payer,
+			Target:  target,
+			Amount:  *types.NewAttoFILFromFIL(amount),
+			ValidAt: *types.NewBlockHeight(validAt),
+			Nonce:   nonce,
+		}
+	}
+
+	newTestPaymentManager := func(eol uint64, vouchers ...*paymentbroker.PaymentVoucher) (*paymentManager, *paymentManagerTestAPI) {
+		api := &paymentManagerTestAPI{
+			channels: map[string]*paymentbroker.PaymentChannel{
+				types.NewChannelID(1).KeyString(): {
+					Target:         target,
+					Amount:         types.NewAttoFILFromFIL(1000),
+					AmountRedeemed: types.NewZeroAttoFIL(),
+					Eol:            types.NewBlockHeight(eol),
+				},
+			},
+			newCid: types.NewCidForTestGetter(),
+			mined:  make(chan struct{}),
+		}
+		return newPaymentManager(target, api, func() []*dealPayments { return []*dealPayments{{Vouchers: vouchers}} }), api
+	}
+
+	t.Run("redeems the best valid voucher and batches later ones", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		pm, api := newTestPaymentManager(6000, voucher(1, 100, 10, 0), voucher(1, 200, 1010, 1), voucher(1, 300, 2010, 2), voucher(1, 400, 4010, 3))
+		defer close(api.mined)
+
+		require.NoError(pm.redeem(ctx, types.NewBlockHeight(5)))
+		assert.Empty(api.redeemed)
+
+		require.NoError(pm.redeem(ctx, types.NewBlockHeight(10)))
+		assert.Equal([]string{"100"}, api.redeemed)
+
+		// nothing new is valid while the redemption is pending
+		require.NoError(pm.redeem(ctx, types.NewBlockHeight(11)))
+		assert.Len(api.redeemed, 1)
+
+		// later vouchers wait for the redeem interval
+		api.redeem(1, 100)
+		require.NoError(pm.redeem(ctx, types.NewBlockHeight(2010)))
+		assert.Len(api.redeemed, 1)
+
+		require.NoError(pm.redeem(ctx, types.NewBlockHeight(10+PaymentRedeemInterval)))
+		assert.Equal([]string{"100", "300"}, api.redeemed)
+	})
+
+	t.Run("redeems before the channel eol", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		pm, api := newTestPaymentManager(2500, voucher(1, 100, 10, 0), voucher(1, 200, 1010, 1), voucher(1, 300, 5000, 2))
+		defer close(api.mined)
+
+		require.NoError(pm.redeem(ctx, types.NewBlockHeight(10)))
+		require.NoError(pm.redeem(ctx, types.NewBlockHeight(1010)))
+		assert.Equal([]string{"100"}, api.redeemed)
+
+		require.NoError(pm.redeem(ctx, types.NewBlockHeight(2500-PaymentRedeemMargin)))
+		assert.Equal([]string{"100", "200"}, api.redeemed)
+
+		// the voucher can no longer be redeemed once the channel reached its eol
+		require.NoError(pm.redeem(ctx, types.NewBlockHeight(5000)))
+		assert.Len(api.redeemed, 2)
+	})
+
+	t.Run("redeems the last voucher without waiting", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		pm, api := newTestPaymentManager(6000, voucher(1, 100, 10, 0), voucher(1, 200, 1010, 1))
+		defer close(api.mined)
+
+		require.NoError(pm.redeem(ctx, types.NewBlockHeight(10)))
+		require.NoError(pm.redeem(ctx, types.NewBlockHeight(1010)))
+		assert.Equal([]string{"100", "200"}, api.redeemed)
+	})
+
+	t.Run("redeems the vouchers due together with a single message", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		pm, api := newTestPaymentManager(6000, voucher(1, 100, 10, 0), voucher(2, 50, 10, 0), voucher(2, 80, 1010, 1))
+		defer close(api.mined)
+		api.channels[types.NewChannelID(2).KeyString()] = &paymentbroker.PaymentChannel{
+			Target:         target,
+			Amount:         types.NewAttoFILFromFIL(1000),
+			AmountRedeemed: types.NewZeroAttoFIL(),
+			Eol:            types.NewBlockHeight(6000),
+		}
+
+		require.NoError(pm.redeem(ctx, types.NewBlockHeight(10)))
+		assert.Equal([]string{"100", "50"}, api.redeemed)
+		assert.Equal(1, api.messages)
+	})
+
+	t.Run("supplies the deal id to conditional vouchers", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		conditional := voucher(1, 100, 10, 0)
+		condition, err := paymentbroker.NewPieceInclusionCondition(addrGetter(), types.SomeCid(), &conditional.ValidAt)
+		require.NoError(err)
+		conditional.Condition = condition
+
+		pm, api := newTestPaymentManager(6000, conditional)
+		defer close(api.mined)
+		payments := &dealPayments{Vouchers: []*paymentbroker.PaymentVoucher{conditional}}
+		pm.payments = func() []*dealPayments { return []*dealPayments{payments} }
+
+		// the voucher cannot be redeemed before the deal is published
+		require.NoError(pm.redeem(ctx, types.NewBlockHeight(10)))
+		assert.Empty(api.redeemed)
+
+		payments.DealID = big.NewInt(5)
+		require.NoError(pm.redeem(ctx, types.NewBlockHeight(10)))
+		assert.Equal([]string{"100"}, api.redeemed)
+
+		expected, err := abi.ToEncodedValues(big.NewInt(5))
+		require.NoError(err)
+		assert.Equal([][]byte{expected}, api.conditionParams)
+	})
+
+	t.Run("does not redeem lanes holding vouchers of several deals", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		pm, api := newTestPaymentManager(6000)
+		defer close(api.mined)
+		pm.payments = func() []*dealPayments {
+			return []*dealPayments{
+				{Vouchers: []*paymentbroker.PaymentVoucher{voucher(1, 100, 10, 0)}, DealID: big.NewInt(5)},
+				{Vouchers: []*paymentbroker.PaymentVoucher{voucher(1, 200, 10, 1)}, DealID: big.NewInt(6)},
+			}
+		}
+
+		require.NoError(pm.redeem(ctx, types.NewBlockHeight(10)))
+		assert.Empty(api.redeemed)
+
+		// the lane is still reported
+		payments, err := pm.Payments(ctx, types.NewBlockHeight(10))
+		require.NoError(err)
+		require.Len(payments, 1)
+		assert.Equal(2, payments[0].Vouchers)
+	})
+
+	t.Run("counts what was redeemed on merged lanes", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		merging := func(amount, nonce uint64) *paymentbroker.PaymentVoucher {
+			v := voucher(1, amount, 10, nonce)
+			v.Lane = 1
+			v.Merges = []paymentbroker.Merge{{Lane: 0, Nonce: 1}}
+			return v
+		}
+
+		pm, api := newTestPaymentManager(6000, merging(100, 0))
+		defer close(api.mined)
+		api.redeem(1, 100)
+
+		// the voucher adds nothing to the amount redeemed on the merged lane
+		require.NoError(pm.redeem(ctx, types.NewBlockHeight(10)))
+		assert.Empty(api.redeemed)
+
+		payments, err := pm.Payments(ctx, types.NewBlockHeight(10))
+		require.NoError(err)
+		require.Len(payments, 1)
+		assert.Equal(types.NewZeroAttoFIL(), payments[0].Redeemable)
+
+		pm.payments = func() []*dealPayments {
+			return []*dealPayments{{Vouchers: []*paymentbroker.PaymentVoucher{merging(100, 0), merging(150, 1)}}}
+		}
+		require.NoError(pm.redeem(ctx, types.NewBlockHeight(10)))
+		assert.Equal([]string{"150"}, api.redeemed)
+	})
+
+	t.Run("reports outstanding value", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		pm, api := newTestPaymentManager(6000, voucher(1, 100, 10, 0), voucher(1, 200, 1010, 1), voucher(1, 300, 2010, 2), voucher(2, 50, 10, 0))
+		defer close(api.mined)
+
+		require.NoError(pm.redeem(ctx, types.NewBlockHeight(10)))
+		api.redeem(1, 50)
+
+		payments, err := pm.Payments(ctx, types.NewBlockHeight(1010))
+		require.NoError(err)
+		require.Len(payments, 2)
+
+		p := payments[0]
+		assert.True(types.NewChannelID(1).Equal(p.Channel))
+		assert.Equal(payer, p.Payer)
+		assert.Equal(3, p.Vouchers)
+		assert.Equal(types.NewBlockHeight(6000), p.Eol)
+		assert.Equal(types.NewAttoFILFromFIL(50), p.Redeemed)
+		assert.Equal(types.NewAttoFILFromFIL(150), p.Redeemable)
+		assert.Equal(types.NewAttoFILFromFIL(250), p.Outstanding)
+		assert.Equal(types.NewAttoFILFromFIL(50), p.Pending)
+
+		// vouchers on channels that cannot be found are reported without eol
+		assert.True(types.NewChannelID(2).Equal(payments[1].Channel))
+		assert.Nil(payments[1].Eol)
+		assert.Equal(types.NewAttoFILFromFIL(50), payments[1].Outstanding)
+	})
+}
+
+type paymentManagerTestAPI struct {
+	channels        map[string]*paymentbroker.PaymentChannel
+	redeemed        []string
+	conditionParams [][]byte
+	messages        int
+	newCid          func() cid.Cid
+	mined           chan struct{}
+}
+
+// redeem records amount as redeemed on lane 0 of the channel.
+func (api *paymentManagerTestAPI) redeem(channel, amount uint64) {
+	api.channels[types.NewChannelID(channel).KeyString()].Lane(0).Redeemed = types.NewAttoFILFromFIL(amount)
+}
+
+func (api *paymentManagerTestAPI) MessageSend(ctx context.Context, from, to address.Address, value *types.AttoFIL, gasPrice types.AttoFIL, gasLimit types.GasUnits, method string, params ...interface{}) (cid.Cid, error) {
+	if to != address.PaymentBrokerAddress || method != "redeemMany" {
+		return cid.Undef, errors.Errorf("unexpected message %s to %s", method, to)
+	}
+	redemptions, err := paymentbroker.DecodeRedemptions(params[0].([]byte))
+	if err != nil {
+		return cid.Undef, err
+	}
+	for _, redemption := range redemptions {
+		api.redeemed = append(api.redeemed, redemption.Voucher.Amount.String())
+		if redemption.Voucher.Condition != nil {
+			api.conditionParams = append(api.conditionParams, redemption.ConditionParams)
+		}
+	}
+	api.messages++
+	return api.newCid(), nil
+}
+
+func (api *paymentManagerTestAPI) MessageQuery(ctx context.Context, optFrom, to address.Address, method string, params ...interface{}) ([][]byte, *exec.FunctionSignature, error) {
+	if method != "ls" {
+		return nil, nil, errors.Errorf("unexpected method %s", method)
+	}
+	out, err := cbor.DumpObject(api.channels)
+	return [][]byte{out}, nil, err
+}
+
+func (api *paymentManagerTestAPI) MessageWait(ctx context.Context, msgCid cid.Cid, cb func(*types.Block, *types.SignedMessage, *types.MessageReceipt) error) error {
+	select {
+	case <-api.mined:
+	case <-ctx.Done():
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
+
+	"github.com/filecoin-project/go-filecoin/address"
+	"github.com/filecoin-project/go-filecoin/config"
+)
+
+// dealFilterTimeout is how long the deal filter command may take to decide
+// on a proposal.
+const dealFilterTimeout = 10 * time.Second
+
+// checkDealPolicy applies the rules configured in mining.dealPolicy to the
+// proposal. The error it returns explains why the proposal is rejected.
+func (sm *Miner) checkDealPolicy(ctx context.Context, p *DealProposal) error {
+	val, err := sm.porcelainAPI.ConfigGet("mining.dealPolicy")
+	if err != nil {
+		return err
+	}
+	policy, ok := val.(*config.DealPolicyConfig)
+	if !ok {
+		return errors.New("Could not retrieve dealPolicy from config")
+	}
+
+	client := p.Payment.Payer
+	if containsAddress(policy.DeniedClients, client) || (len(policy.AllowedClients) > 0 && !containsAddress(policy.AllowedClients, client)) {
+		return fmt.Errorf("miner does not make deals with client %s", client)
+	}
+
+	size := p.Size.Uint64()
+	if size < policy.MinPieceSize {
+		return fmt.Errorf("piece size (%d) is less than the minimum of %d bytes", size, policy.MinPieceSize)
+	}
+	if policy.MaxPieceSize > 0 && size > policy.MaxPieceSize {
+		return fmt.Errorf("piece size (%d) is more than the maximum of %d bytes", size, policy.MaxPieceSize)
+	}
+
+	if p.Duration < policy.MinDuration {
+		return fmt.Errorf("duration (%d) is less than the minimum of %d blocks", p.Duration, policy.MinDuration)
+	}
+	if policy.MaxDuration > 0 && p.Duration > policy.MaxDuration {
+		return fmt.Errorf("duration (%d) is more than the maximum of %d blocks", p.Duration, policy.MaxDuration)
+	}
+
+	if policy.MaxDealsPerClient > 0 {
+		period, err := time.ParseDuration(policy.RateLimitPeriod)
+		if err != nil {
+			return errors.Wrap(err, "invalid deal rate limit period")
+		}
+		if sm.recentDeals(client, time.Now().Add(-period)) >= policy.MaxDealsPerClient {
+			return fmt.Errorf("client %s reached the limit of %d deals per %s", client, policy.MaxDealsPerClient, policy.RateLimitPeriod)
+		}
+	}
+
+	if policy.MaxStagedBytes > 0 && sm.unsealedBytes()+size > policy.MaxStagedBytes {
+		return fmt.Errorf("miner can not stage more than %d bytes", policy.MaxStagedBytes)
+	}
+
+	if len(policy.FilterCommand) > 0 {
+		return runDealFilter(ctx, policy.FilterCommand, p)
+	}
+
+	return nil
+}
+
+// recentDeals counts the deals the client made with us that were accepted
+// since the given time.
+func (sm *Miner) recentDeals(client address.Address, since time.Time) uint {
+	sm.dealsLk.Lock()
+	defer sm.dealsLk.Unlock()
+
+	var count uint
+	for _, d := range sm.deals {
+		if d.Proposal.Payment.Payer != client {
+			continue
+		}
+		for _, e := range d.History {
+			if e.To == Accepted && e.Time >= since.Unix() {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// unsealedBytes sums the sizes of the deals we accepted whose pieces are not
+// sealed yet.
+func (sm *Miner) unsealedBytes() uint64 {
+	sm.dealsLk.Lock()
+	defer sm.dealsLk.Unlock()
+
+	var total uint64
+	for _, d := range sm.deals {
+		switch d.Response.State {
+		case Accepted, AwaitingData, Started, Staged:
+			total += d.Proposal.Size.Uint64()
+		}
+	}
+	return total
+}
+
+// runDealFilter runs the deal filter command with the proposal as JSON on
+// its standard input. The proposal is rejected if the command exits with a
+// non-zero status, with the command's output as the reason.
+func runDealFilter(ctx context.Context, command []string, p *DealProposal) error {
+	proposal, err := json.Marshal(p)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal proposal for deal filter")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dealFilterTimeout)
+	defer cancel()
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...) // #nosec
+	cmd.Stdin = bytes.NewReader(proposal)
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			if reason := strings.TrimSpace(out.String()); reason != "" {
+				return errors.New(reason)
+			}
+			return errors.New("proposal rejected by deal filter")
+		}
+		log.Errorf("failed to run deal filter %q: %s", command, err)
+		return errors.Wrap(err, "deal filter failed")
+	}
+	return nil
+}
+
+func containsAddress(addrs []address.Address, addr address.Address) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/assert"
+	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/require"
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+
+	"github.com/filecoin-project/go-filecoin/address"
+	"github.com/filecoin-project/go-filecoin/types"
+)
+
+func TestDealPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	// propose configures the policy with the given settings and returns the
+	// response to the default proposal, of 1000 bytes for 10000 blocks.
+	propose := func(t *testing.T, settings map[string]string) *DealResponse {
+		require := require.New(t)
+
+		porcelainAPI, miner, proposal := defaultMinerTestSetup(require, VoucherInterval, defaultAmountInc)
+		for key, value := range settings {
+			require.NoError(porcelainAPI.config.Set("mining.dealPolicy."+key, value))
+		}
+
+		res, err := miner.receiveStorageProposal(ctx, testClientPeer, proposal)
+		require.NoError(err)
+		return res
+	}
+
+	t.Run("accepts proposals by default", func(t *testing.T) {
+		assert.Equal(t, Accepted, propose(t, nil).State)
+	})
+
+	t.Run("rejects denied clients", func(t *testing.T) {
+		assert := assert.New(t)
+
+		porcelainAPI := newMinerTestPorcelain(require.New(t))
+		res := propose(t, map[string]string{"deniedClients": `["` + porcelainAPI.payerAddress.String() + `"]`})
+		assert.Equal(Rejected, res.State)
+		assert.Equal("miner does not make deals with client "+porcelainAPI.payerAddress.String(), res.Message)
+
+		res = propose(t, map[string]string{"allowedClients": `["` + address.TestAddress.String() + `"]`})
+		assert.Equal(Rejected, res.State)
+
+		res = propose(t, map[string]string{"allowedClients": `["` + porcelainAPI.payerAddress.String() + `"]`})
+		assert.Equal(Accepted, res.State)
+	})
+
+	t.Run("bounds piece size and duration", func(t *testing.T) {
+		assert := assert.New(t)
+
+		res := propose(t, map[string]string{"maxPieceSize": "999"})
+		assert.Equal(Rejected, res.State)
+		assert.Equal("piece size (1000) is more than the maximum of 999 bytes", res.Message)
+
+		res = propose(t, map[string]string{"minPieceSize": "1001"})
+		assert.Equal("piece size (1000) is less than the minimum of 1001 bytes", res.Message)
+
+		res = propose(t, map[string]string{"maxDuration": "5000"})
+		assert.Equal("duration (10000) is more than the maximum of 5000 blocks", res.Message)
+
+		res = propose(t, map[string]string{"minDuration": "20000"})
+		assert.Equal("duration (10000) is less than the minimum of 20000 blocks", res.Message)
+
+		res = propose(t, map[string]string{"minPieceSize": "1000", "maxPieceSize": "1000", "minDuration": "10000", "maxDuration": "10000"})
+		assert.Equal(Accepted, res.State)
+	})
+
+	t.Run("rejects filtered proposals with the filter's reason", func(t *testing.T) {
+		assert := assert.New(t)
+
+		res := propose(t, map[string]string{"filterCommand": `["sh", "-c", "grep -q PieceRef && echo not today && exit 1"]`})
+		assert.Equal(Rejected, res.State)
+		assert.Equal("not today", res.Message)
+
+		res = propose(t, map[string]string{"filterCommand": `["false"]`})
+		assert.Equal("proposal rejected by deal filter", res.Message)
+
+		res = propose(t, map[string]string{"filterCommand": `["true"]`})
+		assert.Equal(Accepted, res.State)
+	})
+
+	t.Run("limits deals per client and staged bytes", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		porcelainAPI, miner, proposal := defaultMinerTestSetup(require, VoucherInterval, defaultAmountInc)
+		newCid := types.NewCidForTestGetter()
+
+		// the other deals pay on another channel
+		other := proposal.DealProposal
+		other.Payment.Vouchers = testPaymentVouchers(porcelainAPI, VoucherInterval, defaultAmountInc)
+		for _, v := range other.Payment.Vouchers {
+			v.Channel = *types.NewChannelID(74)
+		}
+		deal := func(state DealState, acceptedAt time.Time) *storageDeal {
+			return &storageDeal{
+				Proposal: &other,
+				Response: &DealResponse{State: state},
+				History:  []*DealEvent{{From: Unknown, To: Accepted, Time: acceptedAt.Unix()}},
+			}
+		}
+		miner.deals = map[cid.Cid]*storageDeal{
+			newCid(): deal(Posted, time.Now().Add(-time.Minute)),
+			newCid(): deal(Staged, time.Now().Add(-2*time.Hour)),
+		}
+
+		require.NoError(porcelainAPI.config.Set("mining.dealPolicy.maxDealsPerClient", "1"))
+		require.NoError(porcelainAPI.config.Set("mining.dealPolicy.rateLimitPeriod", `"1h"`))
+		res, err := miner.receiveStorageProposal(ctx, testClientPeer, proposal)
+		require.NoError(err)
+		assert.Equal("client "+porcelainAPI.payerAddress.String()+" reached the limit of 1 deals per 1h", res.Message)
+
+		require.NoError(porcelainAPI.config.Set("mining.dealPolicy.maxDealsPerClient", "2"))
+		res, err = miner.receiveStorageProposal(ctx, testClientPeer, proposal)
+		require.NoError(err)
+		assert.Equal(Accepted, res.State)
+
+		// only the staged deal is not sealed yet
+		require.NoError(porcelainAPI.config.Set("mining.dealPolicy.maxStagedBytes", "1999"))
+		res, err = miner.receiveStorageProposal(ctx, testClientPeer, proposal)
+		require.NoError(err)
+		assert.Equal("miner can not stage more than 1999 bytes", res.Message)
+
+		require.NoError(porcelainAPI.config.Set("mining.dealPolicy.maxStagedBytes", "2000"))
+		res, err = miner.receiveStorageProposal(ctx, testClientPeer, proposal)
+		require.NoError(err)
+		assert.Equal(Accepted, res.State)
+	})
+}
@@ -1,6 +1,9 @@
 package storage
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 // DealState signifies the state of a deal
 type DealState int
@@ -24,12 +27,16 @@ const (
 	// Posted means the deal has been posted to the blockchain
 	Posted
 
-	// Complete means the deal is complete
-	// TODO: distinguish this from 'Posted'
+	// Complete means the deal ended and the storage market settled it up to
+	// its expiration
 	Complete
 
 	// Staged means that the data in the deal has been staged into a sector
 	Staged
+
+	// AwaitingData means the deal was accepted and the miner waits for the
+	// data to be imported from an offline transfer
+	AwaitingData
 )
 
 func (s DealState) String() string {
@@ -50,7 +57,78 @@ func (s DealState) String() string {
 		return "complete"
 	case Staged:
 		return "staged"
+	case AwaitingData:
+		return "awaiting data"
 	default:
 		return fmt.Sprintf("<unrecognized %d>", s)
 	}
 }
+
+// DealEvent records a transition of a deal from one state to another.
+type DealEvent struct {
+	// From is the state the deal was in before the transition.
+	From DealState
+
+	// To is the state the deal moved to.
+	To DealState
+
+	// Time is when the transition happened, in seconds since the unix epoch.
+	Time int64
+
+	// Reason explains why the deal moved to the new state.
+	Reason string
+}
+
+// dealStateMachine lists the states deals may move to from each state.
+// States without an entry are final.
+type dealStateMachine map[DealState][]DealState
+
+// minerDealStates are the transitions the miner makes while processing a
+// deal.
+var minerDealStates = dealStateMachine{
+	Unknown:      {Accepted, Rejected},
+	Accepted:     {Started, AwaitingData, Failed},
+	AwaitingData: {Started, Failed},
+	Started:      {Staged, Failed},
+	Staged:       {Posted, Failed},
+	Posted:       {Complete, Failed},
+}
+
+// clientDealStates are the transitions the client observes. It only learns
+// about the state of a deal when it queries the miner, so it may see a deal
+// skip states.
+var clientDealStates = dealStateMachine{
+	Unknown:      {Accepted, Rejected},
+	Accepted:     {Started, AwaitingData, Staged, Posted, Complete, Failed},
+	AwaitingData: {Started, Staged, Posted, Complete, Failed},
+	Started:      {Staged, Posted, Complete, Failed},
+	Staged:       {Posted, Complete, Failed},
+	Posted:       {Complete, Failed},
+}
+
+func (m dealStateMachine) canTransition(from, to DealState) bool {
+	for _, s := range m[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transition moves the deal response to the given state and returns the
+// event recording the transition. It fails if deals may not move to the
+// state from the one the response is in.
+func (m dealStateMachine) transition(resp *DealResponse, to DealState, reason string) (*DealEvent, error) {
+	if !m.canTransition(resp.State, to) {
+		return nil, fmt.Errorf("deal %s can not move from %s to %s", resp.ProposalCid, resp.State, to)
+	}
+
+	event := &DealEvent{
+		From:   resp.State,
+		To:     to,
+		Time:   time.Now().Unix(),
+		Reason: reason,
+	}
+	resp.State = to
+	return event, nil
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/filecoin-project/go-filecoin/actor/builtin/paymentbroker"
 	"github.com/filecoin-project/go-filecoin/address"
+	"github.com/filecoin-project/go-filecoin/proofs"
 	. "github.com/filecoin-project/go-filecoin/protocol/storage"
 	"github.com/filecoin-project/go-filecoin/types"
 	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/require"
@@ -36,9 +37,12 @@ func TestSerializeProposal(t *testing.T) {
 	p.Payment.Vouchers = []*paymentbroker.PaymentVoucher{voucher}
 	v, _ := cid.Decode("QmcrriCMhjb5ZWzmPNxmP53px47tSPcXBNaMtLdgcKFJYk")
 	p.PieceRef = v
+	p.CommP = proofs.CommP{1, 2, 3}
 	chunk, err := cbor.DumpObject(p)
 	require.NoError(err)
 
-	err = cbor.DecodeInto(chunk, &DealProposal{})
+	var decoded DealProposal
+	err = cbor.DecodeInto(chunk, &decoded)
 	require.NoError(err)
+	require.Equal(p.CommP, decoded.CommP)
 }
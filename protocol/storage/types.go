@@ -2,10 +2,12 @@ package storage
 
 import (
 	"github.com/filecoin-project/go-filecoin/actor/builtin/paymentbroker"
+	"github.com/filecoin-project/go-filecoin/actor/builtin/storagemarket"
 	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
 	cbor "gx/ipfs/QmcZLyosDwMKdB6NLRsiss9HXzDPhVhhRtPy67JFKTDQDX/go-ipld-cbor"
 
 	"github.com/filecoin-project/go-filecoin/address"
+	"github.com/filecoin-project/go-filecoin/proofs"
 	"github.com/filecoin-project/go-filecoin/types"
 )
 
@@ -15,6 +17,7 @@ func init() {
 	cbor.RegisterCborType(SignedDealProposal{})
 	cbor.RegisterCborType(DealResponse{})
 	cbor.RegisterCborType(ProofInfo{})
+	cbor.RegisterCborType(DealEvent{})
 	cbor.RegisterCborType(queryRequest{})
 }
 
@@ -45,6 +48,10 @@ type DealProposal struct {
 	// PieceRef is the cid of the piece being stored
 	PieceRef cid.Cid
 
+	// CommP is the piece commitment of the piece being stored, which the
+	// miner checks the data it receives against
+	CommP proofs.CommP
+
 	// Size is the total number of bytes the proposal is asking to store
 	Size *types.BytesAmount
 
@@ -61,6 +68,30 @@ type DealProposal struct {
 	// will use to pay the miner. It should be verifiable by the
 	// miner using on-chain information.
 	Payment PaymentInfo
+
+	// ManualTransfer is set if the client delivers the data to the miner
+	// out of band, e.g. on disks, instead of the miner fetching it.
+	ManualTransfer bool
+
+	// MarketSignature is the payer's signature over the storage market
+	// proposal of the deal, which the miner publishes the deal with.
+	MarketSignature types.Signature
+}
+
+// MarketProposal returns the proposal the miner publishes the deal to the
+// storage market with. The deal is paid for through the payment channel, so
+// nothing is locked in the storage market escrows: the published deal records
+// which sector holds the piece, which the payment vouchers are conditioned on.
+func (dp *DealProposal) MarketProposal() *storagemarket.DealProposal {
+	return &storagemarket.DealProposal{
+		PieceRef:   dp.PieceRef,
+		Size:       dp.Size,
+		Client:     dp.Payment.Payer,
+		Miner:      dp.MinerAddress,
+		Price:      types.NewZeroAttoFIL(),
+		Collateral: types.NewZeroAttoFIL(),
+		Duration:   dp.Duration,
+	}
 }
 
 // Unmarshal a DealProposal from bytes.
@@ -0,0 +1,17 @@
+// Package transfer implements a protocol to transfer the data of deals
+// between two nodes, block by block, on its own streams instead of bitswap.
+// The data is pulled by the node receiving it. It works on high level like
+// this:
+//
+// 1. RECEIVER opens a /fil/transfer/pull/0.0.0 stream to SENDER
+// 2. RECEIVER sends a TransferRequest naming the deal, the root of the DAG to transfer and the number of blocks it has already
+// 3. SENDER validates the request and answers with a TransferResponse, with Status set to Accepted if the transfer may proceed
+// 4. SENDER sends the blocks of the DAG in depth-first order as TransferBlocks, starting at the offset of the first block RECEIVER does not have
+// 5. SENDER closes the stream once all blocks were sent
+//
+// Both nodes walk the DAG in the same order, so a transfer that was
+// interrupted resumes where it stopped: RECEIVER counts the blocks it stored
+// already and SENDER skips that many blocks. Transfers report their progress
+// while they run, and the bytes sent and received by all transfers of a node
+// are limited by the rates in its dataTransfer config.
+package transfer
@@ -0,0 +1,52 @@
+package transfer
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// limiter limits the bytes per second shared by several transfers. Each
+// transfer reserves the time its bytes take at the limited rate and waits
+// until the bytes reserved before it went through.
+type limiter struct {
+	lk   sync.Mutex
+	rate uint64
+	next time.Time
+}
+
+// setRate changes the limit to rate bytes per second, zero meaning no limit.
+func (l *limiter) setRate(rate uint64) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	l.rate = rate
+}
+
+// wait blocks until n more bytes may go through.
+func (l *limiter) wait(ctx context.Context, n int) error {
+	l.lk.Lock()
+	if l.rate == 0 {
+		l.lk.Unlock()
+		return nil
+	}
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(time.Duration(uint64(n) * uint64(time.Second) / l.rate))
+	l.lk.Unlock()
+
+	delay := time.Until(at)
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
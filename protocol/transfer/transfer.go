@@ -0,0 +1,528 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	ipld "gx/ipfs/QmRL22E4paat7ky7vx9MLpR97JHHbFPrg3ytFQw6qp1y1s/go-ipld-format"
+	bstore "gx/ipfs/QmRu7tiRnFk9mMPpVECQTBQJqXtmG132jJxA1w9A7TtpBz/go-ipfs-blockstore"
+	inet "gx/ipfs/QmTGxDz2CjBucFzPNTiWwzQmTWdrBnzqbqrMucDYMsjuPb/go-libp2p-net"
+	"gx/ipfs/QmTu65MVbemtUxJEWgsTtzv9Zv9P8rvmqNA4eG9TrTRGYc/go-libp2p-peer"
+	"gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
+	blocks "gx/ipfs/QmWoXtvgC8inqFkAATB7cp2Dax7XBi9VDvSg9RCCZufmRk/go-block-format"
+	"gx/ipfs/QmZNkThpqfVXs9GNbexPrfBbXSLNYeKrE7jwFM2oqHbyqN/go-libp2p-protocol"
+	logging "gx/ipfs/QmbkT7eMTyXfpeyB3ZMxxcxg7XH8t6uXp49jqzz4HB7BGF/go-log"
+	host "gx/ipfs/Qmd52WKRSwrBK5gUaJKawryZQ5by6UbNB8KVW2Zy6JtbyW/go-libp2p-host"
+
+	cbu "github.com/filecoin-project/go-filecoin/cborutil"
+	"github.com/filecoin-project/go-filecoin/config"
+)
+
+var log = logging.Logger("/fil/transfer")
+
+const pullProtocol = protocol.ID("/fil/transfer/pull/0.0.0")
+
+// BlockChunkSize is the most data of a block sent in a single TransferBlock.
+// It needs to be less than cborutil.MaxMessageSize for reads to succeed.
+const BlockChunkSize = 64 << 10
+
+// maxBlockSize is the size of the largest block a node receives.
+const maxBlockSize = 2 << 20
+
+// Validator decides whether the node takes part in a transfer requested by
+// peer p. It returns why not if it does not.
+type Validator func(ctx context.Context, p peer.ID, deal cid.Cid, root cid.Cid) error
+
+type configAPI interface {
+	ConfigGet(dottedPath string) (interface{}, error)
+}
+
+// Manager runs the transfers of a node and keeps track of their progress.
+type Manager struct {
+	host host.Host
+	bs   bstore.Blockstore
+	api  configAPI
+
+	sendLimiter    limiter
+	receiveLimiter limiter
+
+	validatorsLk sync.Mutex
+	validatePull Validator
+
+	transfersLk sync.Mutex
+	transfers   map[cid.Cid]*Progress
+}
+
+// NewManager creates a Manager that transfers the blocks of bs and binds the
+// handling function to the pull protocol. The node rejects all pulls other
+// nodes request until a validator is set.
+func NewManager(h host.Host, bs bstore.Blockstore, api configAPI) *Manager {
+	m := &Manager{
+		host:      h,
+		bs:        bs,
+		api:       api,
+		transfers: make(map[cid.Cid]*Progress),
+	}
+
+	h.SetStreamHandler(pullProtocol, m.handlePull)
+
+	return m
+}
+
+// ValidatePulls sets the function that decides which pulls the node sends
+// data for.
+func (m *Manager) ValidatePulls(v Validator) {
+	m.validatorsLk.Lock()
+	defer m.validatorsLk.Unlock()
+	m.validatePull = v
+}
+
+// Pull fetches the DAG below root for the deal from peer p. Blocks the node
+// has already are not fetched again, so a Pull of data that is available
+// locally returns without contacting p.
+func (m *Manager) Pull(ctx context.Context, p peer.ID, deal cid.Cid, root cid.Cid) error {
+	m.updateLimits()
+
+	r, err := m.resumeReceive(root)
+	if err != nil {
+		return err
+	}
+	m.start(deal, root, p, Receiving, r.offset, r.bytes)
+	if r.done {
+		m.update(deal, func(prog *Progress) {
+			prog.TotalBlocks = r.offset
+			prog.TotalBytes = r.bytes
+		})
+		return m.finish(deal, nil)
+	}
+
+	s, err := m.host.NewStream(ctx, p, pullProtocol)
+	if err != nil {
+		return m.finish(deal, errors.Wrap(err, "failed to open transfer stream"))
+	}
+	defer s.Close() // nolint: errcheck
+	defer resetOnCancel(ctx, s)()
+
+	req := TransferRequest{
+		Deal:   deal,
+		Root:   root,
+		Offset: r.offset,
+	}
+	if err := cbu.NewMsgWriter(s).WriteMsg(&req); err != nil {
+		return m.finish(deal, errors.Wrap(err, "failed to write transfer request"))
+	}
+
+	reader := cbu.NewMsgReader(s)
+	var resp TransferResponse
+	if err := reader.ReadMsg(&resp); err != nil {
+		return m.finish(deal, errors.Wrap(err, "failed to read transfer response"))
+	}
+	if resp.Status != Accepted {
+		return m.finish(deal, fmt.Errorf("transfer rejected by peer: %s", resp.Message))
+	}
+	m.update(deal, func(prog *Progress) {
+		prog.TotalBlocks = resp.Blocks
+		prog.TotalBytes = resp.Bytes
+	})
+
+	return m.finish(deal, m.receive(ctx, reader, deal, r))
+}
+
+// Transfers returns the progress of the transfers of the node, in the order
+// they started.
+func (m *Manager) Transfers() []*Progress {
+	m.transfersLk.Lock()
+	defer m.transfersLk.Unlock()
+
+	var transfers []*Progress
+	for _, prog := range m.transfers {
+		p := *prog
+		transfers = append(transfers, &p)
+	}
+	sort.Slice(transfers, func(i, j int) bool {
+		if transfers[i].Started != transfers[j].Started {
+			return transfers[i].Started < transfers[j].Started
+		}
+		return transfers[i].Deal.String() < transfers[j].Deal.String()
+	})
+	return transfers
+}
+
+// Progress returns the progress of the last transfer for the deal, false if
+// there was none.
+func (m *Manager) Progress(deal cid.Cid) (*Progress, bool) {
+	m.transfersLk.Lock()
+	defer m.transfersLk.Unlock()
+
+	prog, ok := m.transfers[deal]
+	if !ok {
+		return nil, false
+	}
+	p := *prog
+	return &p, true
+}
+
+func (m *Manager) handlePull(s inet.Stream) {
+	defer s.Close() // nolint: errcheck
+	ctx := context.Background()
+
+	var req TransferRequest
+	if err := cbu.NewMsgReader(s).ReadMsg(&req); err != nil {
+		log.Errorf("failed to read pull request: %s", err)
+		return
+	}
+
+	m.validatorsLk.Lock()
+	validate := m.validatePull
+	m.validatorsLk.Unlock()
+
+	resp := TransferResponse{Status: Accepted}
+	err := errors.New("node does not send data")
+	if validate != nil {
+		err = validate(ctx, s.Conn().RemotePeer(), req.Deal, req.Root)
+	}
+	if err == nil {
+		resp.Blocks, resp.Bytes, err = m.dagSize(req.Root)
+	}
+	if err != nil {
+		resp = TransferResponse{Status: Rejected, Message: err.Error()}
+	}
+	if err := cbu.NewMsgWriter(s).WriteMsg(&resp); err != nil {
+		log.Warningf("failed to write response to pull of deal %s: %s", req.Deal, err)
+		return
+	}
+	if resp.Status != Accepted {
+		return
+	}
+
+	m.updateLimits()
+	m.start(req.Deal, req.Root, s.Conn().RemotePeer(), Sending, 0, 0)
+	m.update(req.Deal, func(prog *Progress) {
+		prog.TotalBlocks = resp.Blocks
+		prog.TotalBytes = resp.Bytes
+	})
+	if err := m.finish(req.Deal, m.send(ctx, s, req.Deal, req.Root, req.Offset)); err != nil {
+		log.Warningf("failed to send data of deal %s: %s", req.Deal, err)
+	}
+}
+
+// send writes the blocks of the DAG below root to w, skipping the first
+// offset blocks.
+func (m *Manager) send(ctx context.Context, w io.Writer, deal cid.Cid, root cid.Cid, offset uint64) error {
+	writer := cbu.NewMsgWriter(w)
+	walk := newWalker(root)
+	for i := uint64(0); ; i++ {
+		c, ok := walk.next()
+		if !ok {
+			return nil
+		}
+		blk, err := m.bs.Get(c)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get block %s", c)
+		}
+		if err := walk.visit(blk); err != nil {
+			return err
+		}
+
+		data := blk.RawData()
+		if i >= offset {
+			for start := 0; start < len(data) || start == 0; start += BlockChunkSize {
+				end := start + BlockChunkSize
+				if end > len(data) {
+					end = len(data)
+				}
+				if err := m.sendLimiter.wait(ctx, end-start); err != nil {
+					return err
+				}
+				msg := TransferBlock{
+					Cid:  c,
+					Size: uint64(len(data)),
+					Data: data[start:end],
+				}
+				if err := writer.WriteMsg(&msg); err != nil {
+					return errors.Wrap(err, "failed to write block")
+				}
+			}
+		}
+
+		m.update(deal, func(prog *Progress) {
+			prog.Blocks = i + 1
+			prog.Bytes += uint64(len(data))
+		})
+	}
+}
+
+// receiveState is where a transfer of a DAG to this node resumes: the walk
+// over the blocks the node has, stopped at the first block it misses.
+type receiveState struct {
+	walk    *walker
+	pending cid.Cid
+	done    bool
+
+	offset uint64
+	bytes  uint64
+}
+
+// resumeReceive walks the blocks below root the node has already, up to the
+// first block it misses.
+func (m *Manager) resumeReceive(root cid.Cid) (*receiveState, error) {
+	r := &receiveState{walk: newWalker(root)}
+	if err := r.advance(m.bs); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// advance moves the walk on to the next block the node does not have. It is
+// only used before the transfer starts: the sender skips the blocks counted
+// by offset and can not tell which later blocks the node has, so it sends
+// all of them.
+func (r *receiveState) advance(bs bstore.Blockstore) error {
+	for {
+		c, ok := r.walk.next()
+		if !ok {
+			r.done = true
+			return nil
+		}
+		has, err := bs.Has(c)
+		if err != nil {
+			return err
+		}
+		if !has {
+			r.pending = c
+			return nil
+		}
+		blk, err := bs.Get(c)
+		if err != nil {
+			return err
+		}
+		if err := r.walk.visit(blk); err != nil {
+			return err
+		}
+		r.offset++
+		r.bytes += uint64(len(blk.RawData()))
+	}
+}
+
+// next moves the walk on to the next block, which the sender sends whether
+// or not the node has it.
+func (r *receiveState) next() {
+	c, ok := r.walk.next()
+	if !ok {
+		r.done = true
+		return
+	}
+	r.pending = c
+}
+
+// receive reads the blocks of the DAG from reader and stores them, dropping
+// the blocks the node has already. It fails if a block is not the next block
+// of the walk, if its data does not match its cid, or if the sender stops
+// before all blocks were received.
+func (m *Manager) receive(ctx context.Context, reader *cbu.MsgReader, deal cid.Cid, r *receiveState) error {
+	var data []byte
+	for {
+		var msg TransferBlock
+		if err := reader.ReadMsg(&msg); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return errors.Wrap(err, "failed to read block")
+		}
+		if err := m.receiveLimiter.wait(ctx, len(msg.Data)); err != nil {
+			return err
+		}
+
+		if r.done || !msg.Cid.Equals(r.pending) {
+			return fmt.Errorf("received unexpected block %s", msg.Cid)
+		}
+		data = append(data, msg.Data...)
+		if msg.Size > maxBlockSize || uint64(len(data)) > msg.Size {
+			return fmt.Errorf("block %s is too large", msg.Cid)
+		}
+		if uint64(len(data)) < msg.Size {
+			continue
+		}
+
+		blk, err := newVerifiedBlock(data, msg.Cid)
+		if err != nil {
+			return err
+		}
+		data = nil
+		has, err := m.bs.Has(blk.Cid())
+		if err != nil {
+			return err
+		}
+		if !has {
+			if err := m.bs.Put(blk); err != nil {
+				return errors.Wrap(err, "failed to store block")
+			}
+		}
+		if err := r.walk.visit(blk); err != nil {
+			return err
+		}
+		r.offset++
+		r.bytes += uint64(len(blk.RawData()))
+		r.next()
+
+		m.update(deal, func(prog *Progress) {
+			prog.Blocks = r.offset
+			prog.Bytes = r.bytes
+		})
+	}
+
+	if !r.done {
+		return fmt.Errorf("transfer ended before block %s was received", r.pending)
+	}
+	return nil
+}
+
+// newVerifiedBlock creates a block from data, checking that the data hashes
+// to c.
+func newVerifiedBlock(data []byte, c cid.Cid) (blocks.Block, error) {
+	actual, err := c.Prefix().Sum(data)
+	if err != nil {
+		return nil, err
+	}
+	if !actual.Equals(c) {
+		return nil, fmt.Errorf("data of block %s does not match its cid", c)
+	}
+	return blocks.NewBlockWithCid(data, c)
+}
+
+// dagSize counts the blocks and bytes of the DAG below root. It fails if the
+// node does not have all of them.
+func (m *Manager) dagSize(root cid.Cid) (uint64, uint64, error) {
+	var count, size uint64
+	walk := newWalker(root)
+	for {
+		c, ok := walk.next()
+		if !ok {
+			return count, size, nil
+		}
+		blk, err := m.bs.Get(c)
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "failed to get block %s", c)
+		}
+		if err := walk.visit(blk); err != nil {
+			return 0, 0, err
+		}
+		count++
+		size += uint64(len(blk.RawData()))
+	}
+}
+
+// updateLimits applies the rates in the dataTransfer config.
+func (m *Manager) updateLimits() {
+	val, err := m.api.ConfigGet("dataTransfer")
+	if err != nil {
+		log.Errorf("could not read dataTransfer config: %s", err)
+		return
+	}
+	cfg, ok := val.(*config.DataTransferConfig)
+	if !ok {
+		log.Errorf("could not retrieve dataTransfer from config")
+		return
+	}
+	m.sendLimiter.setRate(cfg.MaxSendRate)
+	m.receiveLimiter.setRate(cfg.MaxReceiveRate)
+}
+
+// start records a new transfer for the deal.
+func (m *Manager) start(deal cid.Cid, root cid.Cid, p peer.ID, dir Direction, blocks uint64, bytes uint64) {
+	prog := &Progress{
+		Deal:      deal,
+		Root:      root,
+		Peer:      p,
+		Direction: dir,
+		State:     Ongoing,
+		Blocks:    blocks,
+		Bytes:     bytes,
+		Started:   time.Now().Unix(),
+	}
+
+	m.transfersLk.Lock()
+	defer m.transfersLk.Unlock()
+	m.transfers[deal] = prog
+}
+
+func (m *Manager) update(deal cid.Cid, f func(*Progress)) {
+	m.transfersLk.Lock()
+	defer m.transfersLk.Unlock()
+	if prog, ok := m.transfers[deal]; ok {
+		f(prog)
+	}
+}
+
+// finish records the end of the transfer for the deal and returns err.
+func (m *Manager) finish(deal cid.Cid, err error) error {
+	m.update(deal, func(prog *Progress) {
+		if err != nil {
+			prog.State = Failed
+			prog.Error = err.Error()
+			return
+		}
+		prog.State = Completed
+	})
+	return err
+}
+
+// resetOnCancel resets s when ctx is cancelled, so that reads and writes on
+// it return. The returned function stops watching ctx.
+func resetOnCancel(ctx context.Context, s inet.Stream) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Reset() // nolint: errcheck
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// walker walks a DAG depth-first, visiting each block once. The sender and
+// the receiver of a transfer walk the DAG the same way, so that they agree
+// on the order of its blocks.
+type walker struct {
+	stack []cid.Cid
+	seen  map[cid.Cid]bool
+}
+
+func newWalker(root cid.Cid) *walker {
+	return &walker{
+		stack: []cid.Cid{root},
+		seen:  make(map[cid.Cid]bool),
+	}
+}
+
+// next returns the next block to visit, false once all blocks were visited.
+func (w *walker) next() (cid.Cid, bool) {
+	for len(w.stack) > 0 {
+		c := w.stack[len(w.stack)-1]
+		w.stack = w.stack[:len(w.stack)-1]
+		if !w.seen[c] {
+			w.seen[c] = true
+			return c, true
+		}
+	}
+	return cid.Undef, false
+}
+
+// visit queues the blocks blk links to.
+func (w *walker) visit(blk blocks.Block) error {
+	nd, err := ipld.Decode(blk)
+	if err != nil {
+		return errors.Wrapf(err, "failed to decode block %s", blk.Cid())
+	}
+	links := nd.Links()
+	for i := len(links) - 1; i >= 0; i-- {
+		w.stack = append(w.stack, links[i].Cid)
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	dag "gx/ipfs/QmNRAuGmvnVw8urHkUZQirhu42VTiZjVWASa2aTznEMmpP/go-merkledag"
+	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/assert"
+	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/require"
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	imp "gx/ipfs/QmRDWTzVdbHXdtat7tVJ7YC7kRaW7rTZTEF79yykcLYa49/go-unixfs/importer"
+	ipld "gx/ipfs/QmRL22E4paat7ky7vx9MLpR97JHHbFPrg3ytFQw6qp1y1s/go-ipld-format"
+	bstore "gx/ipfs/QmRu7tiRnFk9mMPpVECQTBQJqXtmG132jJxA1w9A7TtpBz/go-ipfs-blockstore"
+	offline "gx/ipfs/QmSz8kAe2JCKp2dWSG8gHSWnwSmne8YfRXTeK5HBmc9L7t/go-ipfs-exchange-offline"
+	"gx/ipfs/QmTu65MVbemtUxJEWgsTtzv9Zv9P8rvmqNA4eG9TrTRGYc/go-libp2p-peer"
+	"gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
+	chunk "gx/ipfs/QmXivYDjgMqNQXbEQVC7TMuZnRADCa71ABQUQxWPZPTLbd/go-ipfs-chunker"
+	bserv "gx/ipfs/QmZsGVGCqMCNzHLNMB6q4F6yyvomqf1VxwhJwSfgo1NGaF/go-blockservice"
+	"gx/ipfs/QmcNGX5RaxPPCYwa6yGXM1EcUbrreTTinixLcYGmMwf1sx/go-libp2p/p2p/net/mock"
+
+	"github.com/filecoin-project/go-filecoin/plumbing/cfg"
+	"github.com/filecoin-project/go-filecoin/repo"
+	"github.com/filecoin-project/go-filecoin/types"
+)
+
+func TestTransfer(t *testing.T) {
+	ctx := context.Background()
+	deal := types.NewCidForTestGetter()()
+
+	acceptAll := func(ctx context.Context, p peer.ID, deal cid.Cid, root cid.Cid) error {
+		return nil
+	}
+
+	t.Run("pulls a DAG and reports the progress on both nodes", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		sender, receiver := newTransferTestNodes(require)
+		sender.manager.ValidatePulls(acceptAll)
+		root := sender.importData(require, 64<<10, 1<<10)
+
+		require.NoError(receiver.manager.Pull(ctx, sender.id, deal, root))
+		assert.Equal(sender.dagBlocks(require, root), receiver.dagBlocks(require, root))
+
+		received, ok := receiver.manager.Progress(deal)
+		require.True(ok)
+		assert.Equal(Receiving, received.Direction)
+		assert.Equal(Completed, received.State)
+		assert.Equal(sender.id, received.Peer)
+		assert.Equal(root, received.Root)
+		assert.True(received.TotalBlocks > 64)
+		assert.Equal(received.TotalBlocks, received.Blocks)
+		assert.Equal(received.TotalBytes, received.Bytes)
+
+		require.NoError(waitForState(sender.manager, deal, Completed))
+		sent, _ := sender.manager.Progress(deal)
+		assert.Equal(Sending, sent.Direction)
+		assert.Equal(receiver.id, sent.Peer)
+		assert.Equal(received.TotalBytes, sent.Bytes)
+		assert.Len(sender.manager.Transfers(), 1)
+	})
+
+	t.Run("splits blocks larger than a message", func(t *testing.T) {
+		require := require.New(t)
+
+		sender, receiver := newTransferTestNodes(require)
+		sender.manager.ValidatePulls(acceptAll)
+		root := sender.importData(require, 3*BlockChunkSize, 2*BlockChunkSize)
+
+		require.NoError(receiver.manager.Pull(ctx, sender.id, deal, root))
+		assert.Equal(t, sender.dagBlocks(require, root), receiver.dagBlocks(require, root))
+	})
+
+	t.Run("resumes after the blocks the receiver has", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		sender, receiver := newTransferTestNodes(require)
+		sender.manager.ValidatePulls(acceptAll)
+		root := sender.importData(require, 64<<10, 1<<10)
+
+		// the receiver stored the first blocks before the transfer broke off
+		blocks := sender.dagBlocks(require, root)
+		for _, c := range blocks[:10] {
+			blk, err := sender.bs.Get(c)
+			require.NoError(err)
+			require.NoError(receiver.bs.Put(blk))
+		}
+
+		r, err := receiver.manager.resumeReceive(root)
+		require.NoError(err)
+		assert.Equal(uint64(10), r.offset)
+		assert.Equal(blocks[10], r.pending)
+
+		require.NoError(receiver.manager.Pull(ctx, sender.id, deal, root))
+		assert.Equal(blocks, receiver.dagBlocks(require, root))
+	})
+
+	t.Run("does not contact the peer for data the node has", func(t *testing.T) {
+		require := require.New(t)
+
+		node, _ := newTransferTestNodes(require)
+		root := node.importData(require, 4<<10, 1<<10)
+
+		require.NoError(node.manager.Pull(ctx, peer.ID("unknown"), deal, root))
+		prog, _ := node.manager.Progress(deal)
+		assert.Equal(t, Completed, prog.State)
+	})
+
+	t.Run("rejects transfers the validators do not allow", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		sender, receiver := newTransferTestNodes(require)
+		root := sender.importData(require, 4<<10, 1<<10)
+
+		err := receiver.manager.Pull(ctx, sender.id, deal, root)
+		require.Error(err)
+		assert.Contains(err.Error(), "node does not send data")
+
+		sender.manager.ValidatePulls(func(ctx context.Context, p peer.ID, deal cid.Cid, root cid.Cid) error {
+			return errors.New("no deal with you")
+		})
+		err = receiver.manager.Pull(ctx, sender.id, deal, root)
+		require.Error(err)
+		assert.Contains(err.Error(), "no deal with you")
+
+		prog, _ := receiver.manager.Progress(deal)
+		assert.Equal(Failed, prog.State)
+		assert.Contains(prog.Error, "no deal with you")
+	})
+
+	t.Run("accepts blocks the receiver has past the first one it misses", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		sender, receiver := newTransferTestNodes(require)
+		sender.manager.ValidatePulls(acceptAll)
+		root := sender.importData(require, 64<<10, 1<<10)
+
+		// the receiver has blocks scattered over the DAG, e.g. from a partial
+		// fetch or from data sharing chunks with this one
+		blocks := sender.dagBlocks(require, root)
+		for _, c := range []cid.Cid{blocks[0], blocks[5], blocks[6], blocks[len(blocks)-1]} {
+			blk, err := sender.bs.Get(c)
+			require.NoError(err)
+			require.NoError(receiver.bs.Put(blk))
+		}
+
+		r, err := receiver.manager.resumeReceive(root)
+		require.NoError(err)
+		assert.Equal(uint64(1), r.offset)
+
+		require.NoError(receiver.manager.Pull(ctx, sender.id, deal, root))
+		assert.Equal(blocks, receiver.dagBlocks(require, root))
+
+	})
+
+	t.Run("limits the receive rate", func(t *testing.T) {
+		require := require.New(t)
+
+		sender, receiver := newTransferTestNodes(require)
+		sender.manager.ValidatePulls(acceptAll)
+		root := sender.importData(require, 32<<10, 1<<10)
+		require.NoError(receiver.config.Set("dataTransfer.maxReceiveRate", "64000"))
+
+		start := time.Now()
+		require.NoError(receiver.manager.Pull(ctx, sender.id, deal, root))
+		assert.True(t, time.Since(start) > 400*time.Millisecond, "transfer took %s", time.Since(start))
+	})
+
+	t.Run("rejects data that does not match its cid", func(t *testing.T) {
+		blk := dag.NewRawNode([]byte("some data"))
+		_, err := newVerifiedBlock([]byte("other data"), blk.Cid())
+		assert.Error(t, err)
+
+		verified, err := newVerifiedBlock(blk.RawData(), blk.Cid())
+		require.NoError(t, err)
+		assert.Equal(t, blk.Cid(), verified.Cid())
+	})
+}
+
+type transferTestNode struct {
+	id      peer.ID
+	bs      bstore.Blockstore
+	config  *cfg.Config
+	manager *Manager
+}
+
+// ConfigGet lets the node's config serve the manager.
+func (nd *transferTestNode) ConfigGet(dottedPath string) (interface{}, error) {
+	return nd.config.Get(dottedPath)
+}
+
+func newTransferTestNodes(require *require.Assertions) (*transferTestNode, *transferTestNode) {
+	mn, err := mocknet.FullMeshConnected(context.Background(), 2)
+	require.NoError(err)
+
+	var nodes []*transferTestNode
+	for _, h := range mn.Hosts() {
+		nd := &transferTestNode{
+			id:     h.ID(),
+			bs:     bstore.NewBlockstore(repo.NewInMemoryRepo().Datastore()),
+			config: cfg.NewConfig(repo.NewInMemoryRepo()),
+		}
+		nd.manager = NewManager(h, nd.bs, nd)
+		nodes = append(nodes, nd)
+	}
+	return nodes[0], nodes[1]
+}
+
+// importData adds size random bytes to the node, split into blocks of
+// blockSize bytes, and returns the root of the DAG.
+func (nd *transferTestNode) importData(require *require.Assertions, size int, blockSize int64) cid.Cid {
+	data := make([]byte, size)
+	rand.Read(data) // nolint: gosec
+
+	ds := dag.NewDAGService(bserv.New(nd.bs, offline.Exchange(nd.bs)))
+	root, err := imp.BuildDagFromReader(ipld.NewBufferedDAG(context.Background(), ds), chunk.NewSizeSplitter(bytes.NewReader(data), blockSize))
+	require.NoError(err)
+	return root.Cid()
+}
+
+// dagBlocks lists the blocks below root the node has, in transfer order.
+func (nd *transferTestNode) dagBlocks(require *require.Assertions, root cid.Cid) []cid.Cid {
+	var cids []cid.Cid
+	walk := newWalker(root)
+	for {
+		c, ok := walk.next()
+		if !ok {
+			return cids
+		}
+		blk, err := nd.bs.Get(c)
+		require.NoError(err)
+		require.NoError(walk.visit(blk))
+		cids = append(cids, c)
+	}
+}
+
+// waitForState waits for the transfer of the deal, which the other node
+// started, to reach the state.
+func waitForState(m *Manager, deal cid.Cid, state State) error {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if prog, ok := m.Progress(deal); ok && prog.State == state {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return errors.Errorf("transfer of deal %s did not reach state %s", deal, state)
+}
@@ -0,0 +1,131 @@
+package transfer
+
+import (
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	"gx/ipfs/QmTu65MVbemtUxJEWgsTtzv9Zv9P8rvmqNA4eG9TrTRGYc/go-libp2p-peer"
+	cbor "gx/ipfs/QmcZLyosDwMKdB6NLRsiss9HXzDPhVhhRtPy67JFKTDQDX/go-ipld-cbor"
+)
+
+func init() {
+	cbor.RegisterCborType(TransferRequest{})
+	cbor.RegisterCborType(TransferResponse{})
+	cbor.RegisterCborType(TransferBlock{})
+}
+
+// TransferStatus communicates whether a node agrees to a transfer.
+type TransferStatus int
+
+const (
+	// Unset is the default status
+	Unset = TransferStatus(iota)
+
+	// Rejected means the node does not take part in the transfer
+	Rejected
+
+	// Accepted means the transfer proceeds
+	Accepted
+)
+
+// TransferRequest asks a node to send the DAG below Root for a
+// deal.
+type TransferRequest struct {
+	Deal cid.Cid
+	Root cid.Cid
+
+	// Offset is the number of blocks the receiver has already.
+	Offset uint64
+}
+
+// TransferResponse answers a TransferRequest.
+type TransferResponse struct {
+	Status  TransferStatus
+	Message string
+
+	// Blocks and Bytes are the size of the DAG.
+	Blocks uint64
+	Bytes  uint64
+}
+
+// TransferBlock carries a block of the transferred DAG. Blocks larger than
+// BlockChunkSize are sent as several TransferBlocks, each with the cid and
+// size of the block and a part of its data.
+type TransferBlock struct {
+	Cid  cid.Cid
+	Size uint64
+	Data []byte
+}
+
+// Direction tells whether a node sends or receives the data of a transfer.
+type Direction int
+
+const (
+	// Sending is the direction of transfers the node sends data for
+	Sending = Direction(iota)
+
+	// Receiving is the direction of transfers the node receives data for
+	Receiving
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Sending:
+		return "sending"
+	case Receiving:
+		return "receiving"
+	default:
+		return "<invalid>"
+	}
+}
+
+// State is the state of a transfer.
+type State int
+
+const (
+	// Ongoing means data is being transferred
+	Ongoing = State(iota)
+
+	// Completed means all data was transferred
+	Completed
+
+	// Failed means the transfer stopped before all data was transferred
+	Failed
+)
+
+func (s State) String() string {
+	switch s {
+	case Ongoing:
+		return "ongoing"
+	case Completed:
+		return "completed"
+	case Failed:
+		return "failed"
+	default:
+		return "<invalid>"
+	}
+}
+
+// Progress describes a transfer and how far it got.
+type Progress struct {
+	Deal      cid.Cid
+	Root      cid.Cid
+	Peer      peer.ID
+	Direction Direction
+	State     State
+
+	// Error is why the transfer failed.
+	Error string
+
+	// Blocks and Bytes count the data the receiver has, including the data
+	// it had before the transfer started.
+	Blocks uint64
+	Bytes  uint64
+
+	// TotalBlocks and TotalBytes are the size of the DAG, once the sender
+	// told it.
+	TotalBlocks uint64
+	TotalBytes  uint64
+
+	// Started is when the transfer started, in seconds since the unix
+	// epoch.
+	Started int64
+}
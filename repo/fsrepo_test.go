@@ -47,8 +47,21 @@ const (
 	"mining": {
 		"minerAddress": "",
 		"blockSignerAddress": "",
+		"workerAddress": "",
 		"autoSealIntervalSeconds": 120,
-		"storagePrice": "0"
+		"storagePrice": "0",
+		"dealPolicy": {
+			"allowedClients": [],
+			"deniedClients": [],
+			"minPieceSize": 0,
+			"maxPieceSize": 0,
+			"minDuration": 0,
+			"maxDuration": 0,
+			"maxDealsPerClient": 0,
+			"rateLimitPeriod": "24h",
+			"maxStagedBytes": 0,
+			"filterCommand": []
+		}
 	},
 	"wallet": {
 		"defaultAddress": ""
@@ -58,6 +71,10 @@ const (
 		"beatPeriod": "3s",
 		"reconnectPeriod": "10s",
 		"nickname": ""
+	},
+	"dataTransfer": {
+		"maxSendRate": 0,
+		"maxReceiveRate": 0
 	}
 }`
 )
@@ -2,6 +2,8 @@ package state
 
 import (
 	"context"
+	"fmt"
+
 	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
 
 	"github.com/filecoin-project/go-filecoin/actor"
@@ -14,6 +16,9 @@ import (
 type CachedTree struct {
 	st    Tree
 	cache map[address.Address]*actor.Actor
+
+	// snapshots holds copies of the cached actors taken by Snapshot.
+	snapshots []map[address.Address]actor.Actor
 }
 
 // NewCachedStateTree returns a initialized empty CachedTree
@@ -59,6 +64,60 @@ func (t *CachedTree) GetOrCreateActor(ctx context.Context, address address.Addre
 	return actor, nil
 }
 
+// Snapshot records the state of the cached actors so that later changes can
+// be undone with Revert.  Only the actors read so far are copied; actors
+// loaded after the snapshot are simply dropped from the cache on revert.
+func (t *CachedTree) Snapshot() RevID {
+	snap := make(map[address.Address]actor.Actor, len(t.cache))
+	for addr, act := range t.cache {
+		snap[addr] = *act
+	}
+	t.snapshots = append(t.snapshots, snap)
+	return RevID(len(t.snapshots) - 1)
+}
+
+// Revert restores the cached actors to their state when snapshot rev was
+// taken and discards rev and all later snapshots.  Actors are restored in
+// place so pointers handed out before the snapshot stay valid.
+func (t *CachedTree) Revert(rev RevID) error {
+	if rev < 0 || int(rev) >= len(t.snapshots) {
+		return fmt.Errorf("invalid cached tree snapshot %d", rev)
+	}
+
+	snap := t.snapshots[rev]
+	for addr, act := range t.cache {
+		saved, ok := snap[addr]
+		if !ok {
+			delete(t.cache, addr)
+			continue
+		}
+		*act = saved
+	}
+
+	t.discardSnapshots(rev)
+	return nil
+}
+
+// Release discards the snapshot rev and all later snapshots, keeping the
+// changes made to the cached actors since.
+func (t *CachedTree) Release(rev RevID) error {
+	if rev < 0 || int(rev) >= len(t.snapshots) {
+		return fmt.Errorf("invalid cached tree snapshot %d", rev)
+	}
+
+	t.discardSnapshots(rev)
+	return nil
+}
+
+// discardSnapshots drops rev and all later snapshots, letting their copies
+// of the cache be collected.
+func (t *CachedTree) discardSnapshots(rev RevID) {
+	for i := int(rev); i < len(t.snapshots); i++ {
+		t.snapshots[i] = nil
+	}
+	t.snapshots = t.snapshots[:rev]
+}
+
 // Commit takes all the cached actors and sets them into the underlying cache.
 func (t *CachedTree) Commit(ctx context.Context) error {
 	for addr, actor := range t.cache {
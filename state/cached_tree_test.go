@@ -117,3 +117,61 @@ func requireCid(t *testing.T, data string) cid.Cid {
 	require.NoError(t, err)
 	return id
 }
+
+func TestCachedStateSnapshotRevert(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	cst := hamt.NewCborStore()
+	ctx := context.Background()
+
+	underlying := NewEmptyStateTree(cst)
+	tree := NewCachedStateTree(underlying)
+
+	addrGetter := address.NewForTestGetter()
+	addr1, addr2 := addrGetter(), addrGetter()
+	require.NoError(underlying.SetActor(ctx, addr1, actor.NewActor(types.AccountActorCodeCid, types.NewAttoFILFromFIL(10))))
+	require.NoError(underlying.SetActor(ctx, addr2, actor.NewActor(types.AccountActorCodeCid, types.NewAttoFILFromFIL(20))))
+
+	act1, err := tree.GetActor(ctx, addr1)
+	require.NoError(err)
+
+	rev := tree.Snapshot()
+
+	// change an actor cached before the snapshot and load another
+	act1.IncNonce()
+	act1.Balance = act1.Balance.Add(types.NewAttoFILFromFIL(5))
+	act2, err := tree.GetActor(ctx, addr2)
+	require.NoError(err)
+	act2.IncNonce()
+
+	inner := tree.Snapshot()
+	act1.IncNonce()
+	require.NoError(tree.Revert(inner))
+	assert.Equal(uint64(1), uint64(act1.Nonce))
+
+	require.NoError(tree.Revert(rev))
+
+	// act1 is restored in place, act2 is dropped from the cache
+	assert.Equal(uint64(0), uint64(act1.Nonce))
+	assert.Equal(types.NewAttoFILFromFIL(10), act1.Balance)
+	cAct1, err := tree.GetActor(ctx, addr1)
+	require.NoError(err)
+	assert.True(act1 == cAct1)
+	cAct2, err := tree.GetActor(ctx, addr2)
+	require.NoError(err)
+	assert.Equal(uint64(0), uint64(cAct2.Nonce))
+
+	// reverted snapshots are discarded
+	assert.Error(tree.Revert(inner))
+	assert.Error(tree.Revert(rev))
+
+	// released snapshots keep the changes made since
+	rev = tree.Snapshot()
+	act1.IncNonce()
+	inner = tree.Snapshot()
+	require.NoError(tree.Release(rev))
+	assert.Empty(tree.snapshots)
+	assert.Equal(uint64(1), uint64(act1.Nonce))
+	assert.Error(tree.Revert(inner))
+	assert.Error(tree.Release(rev))
+}
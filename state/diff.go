@@ -0,0 +1,369 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"gx/ipfs/QmNf3wujpV2Y7Lnj2hy2UrmuX8bhMDStRHbnSLh7Ypf36h/go-hamt-ipld"
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	"gx/ipfs/QmRu7tiRnFk9mMPpVECQTBQJqXtmG132jJxA1w9A7TtpBz/go-ipfs-blockstore"
+	"gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
+	bserv "gx/ipfs/QmZsGVGCqMCNzHLNMB6q4F6yyvomqf1VxwhJwSfgo1NGaF/go-blockservice"
+	cbor "gx/ipfs/QmcZLyosDwMKdB6NLRsiss9HXzDPhVhhRtPy67JFKTDQDX/go-ipld-cbor"
+
+	"github.com/filecoin-project/go-filecoin/actor"
+	"github.com/filecoin-project/go-filecoin/address"
+	"github.com/filecoin-project/go-filecoin/types"
+)
+
+// TreeDiff describes the differences between two state trees. Each slice is
+// sorted by address.
+type TreeDiff struct {
+	Added   []*ActorDiff `json:"added"`
+	Removed []*ActorDiff `json:"removed"`
+	Changed []*ActorDiff `json:"changed"`
+}
+
+// Empty returns true if the two state trees hold identical actors.
+func (d *TreeDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// ActorDiff describes how the actor at a single address differs between two
+// state trees. Before is nil for added actors and After is nil for removed
+// actors. The deltas are only set for actors present in both trees.
+type ActorDiff struct {
+	Address address.Address `json:"address"`
+	Before  *actor.Actor    `json:"before,omitempty"`
+	After   *actor.Actor    `json:"after,omitempty"`
+
+	BalanceDelta *types.AttoFIL `json:"balanceDelta,omitempty"`
+	NonceDelta   int64          `json:"nonceDelta,omitempty"`
+	CodeChanged  bool           `json:"codeChanged,omitempty"`
+	HeadChanged  bool           `json:"headChanged,omitempty"`
+
+	// Storage lists the differences found in the decoded actor storage. It is
+	// only populated when requested and the actor's head changed.
+	Storage []*StorageChange `json:"storage,omitempty"`
+}
+
+// StorageChange is a single difference found between two versions of an
+// actor's storage. Path locates the value within the decoded storage, Before
+// and After hold the differing values (nil when absent).
+type StorageChange struct {
+	Path   string      `json:"path"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// Diff compares the state trees rooted at rootA and rootB. Both HAMTs are
+// walked together and subtrees with identical links are skipped, so the cost
+// is proportional to the size of the difference rather than the size of the
+// trees. If withStorage is true, the storage of every actor whose head
+// changed is decoded and recursively compared, following links.
+func Diff(ctx context.Context, store *hamt.CborIpldStore, rootA, rootB cid.Cid, withStorage bool) (*TreeDiff, error) {
+	diff := &TreeDiff{}
+	if rootA.Equals(rootB) {
+		return diff, nil
+	}
+
+	nodeA, err := hamt.LoadNode(ctx, store, rootA)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load state root %s", rootA)
+	}
+	nodeB, err := hamt.LoadNode(ctx, store, rootB)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load state root %s", rootB)
+	}
+
+	actorsA := map[string]*actor.Actor{}
+	actorsB := map[string]*actor.Actor{}
+	if err := diffNodes(ctx, store, nodeA, nodeB, actorsA, actorsB); err != nil {
+		return nil, err
+	}
+
+	for key, before := range actorsA {
+		addr, err := address.NewFromString(key)
+		if err != nil {
+			return nil, err
+		}
+
+		after, ok := actorsB[key]
+		if !ok {
+			diff.Removed = append(diff.Removed, &ActorDiff{Address: addr, Before: before})
+			continue
+		}
+
+		ad, err := diffActors(ctx, store, addr, before, after, withStorage)
+		if err != nil {
+			return nil, err
+		}
+		if ad != nil {
+			diff.Changed = append(diff.Changed, ad)
+		}
+	}
+
+	for key, after := range actorsB {
+		if _, ok := actorsA[key]; ok {
+			continue
+		}
+		addr, err := address.NewFromString(key)
+		if err != nil {
+			return nil, err
+		}
+		diff.Added = append(diff.Added, &ActorDiff{Address: addr, After: after})
+	}
+
+	sortActorDiffs(diff.Added)
+	sortActorDiffs(diff.Removed)
+	sortActorDiffs(diff.Changed)
+
+	return diff, nil
+}
+
+// diffNodes walks two hamt nodes in parallel, collecting the actors of every
+// slot whose contents may differ into actorsA and actorsB respectively. Actors
+// collected on both sides may still be identical; diffActors filters those.
+func diffNodes(ctx context.Context, store *hamt.CborIpldStore, a, b *hamt.Node, actorsA, actorsB map[string]*actor.Actor) error {
+	width := a.Bitfield.BitLen()
+	if b.Bitfield.BitLen() > width {
+		width = b.Bitfield.BitLen()
+	}
+
+	for i := 0; i < width; i++ {
+		pa := pointerAt(a, i)
+		pb := pointerAt(b, i)
+
+		if pa != nil && pb != nil && pa.Link.Defined() && pb.Link.Defined() {
+			if pa.Link.Equals(pb.Link) {
+				continue
+			}
+
+			na, err := hamt.LoadNode(ctx, store, pa.Link)
+			if err != nil {
+				return err
+			}
+			nb, err := hamt.LoadNode(ctx, store, pb.Link)
+			if err != nil {
+				return err
+			}
+			if err := diffNodes(ctx, store, na, nb, actorsA, actorsB); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := collectPointer(ctx, store, pa, actorsA); err != nil {
+			return err
+		}
+		if err := collectPointer(ctx, store, pb, actorsB); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pointerAt returns the pointer stored for the given bit position of the
+// node's bitfield, or nil if the slot is empty.
+func pointerAt(nd *hamt.Node, bit int) *hamt.Pointer {
+	if nd.Bitfield.Bit(bit) == 0 {
+		return nil
+	}
+
+	idx := 0
+	for i := 0; i < bit; i++ {
+		idx += int(nd.Bitfield.Bit(i))
+	}
+	return nd.Pointers[idx]
+}
+
+// collectPointer adds every actor reachable from the pointer to actors.
+func collectPointer(ctx context.Context, store *hamt.CborIpldStore, p *hamt.Pointer, actors map[string]*actor.Actor) error {
+	if p == nil {
+		return nil
+	}
+
+	if p.Link.Defined() {
+		nd, err := hamt.LoadNode(ctx, store, p.Link)
+		if err != nil {
+			return err
+		}
+		return forEachActor(ctx, store, nd, func(addr address.Address, a *actor.Actor) error {
+			actors[addr.String()] = a
+			return nil
+		})
+	}
+
+	for _, kv := range p.KVs {
+		var a actor.Actor
+		if err := hackTransferObject(kv.Value, &a); err != nil {
+			return err
+		}
+		actors[kv.Key] = &a
+	}
+	return nil
+}
+
+// diffActors compares two versions of the actor at addr. It returns nil if
+// they are identical.
+func diffActors(ctx context.Context, store *hamt.CborIpldStore, addr address.Address, before, after *actor.Actor, withStorage bool) (*ActorDiff, error) {
+	ad := &ActorDiff{
+		Address:     addr,
+		Before:      before,
+		After:       after,
+		NonceDelta:  int64(after.Nonce) - int64(before.Nonce),
+		CodeChanged: !before.Code.Equals(after.Code),
+		HeadChanged: !before.Head.Equals(after.Head),
+	}
+
+	balanceBefore, balanceAfter := before.Balance, after.Balance
+	if balanceBefore == nil {
+		balanceBefore = types.NewZeroAttoFIL()
+	}
+	if balanceAfter == nil {
+		balanceAfter = types.NewZeroAttoFIL()
+	}
+	if !balanceBefore.Equal(balanceAfter) {
+		ad.BalanceDelta = balanceAfter.Sub(balanceBefore)
+	}
+
+	if ad.BalanceDelta == nil && ad.NonceDelta == 0 && !ad.CodeChanged && !ad.HeadChanged {
+		return nil, nil
+	}
+
+	if withStorage && ad.HeadChanged {
+		changes, err := diffStorage(ctx, store, "", before.Head, after.Head)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to diff storage of actor %s", addr)
+		}
+		ad.Storage = changes
+	}
+
+	return ad, nil
+}
+
+// loadStorageLink loads and decodes the target of a storage link. It returns
+// false if the block is missing or can not be decoded.
+func loadStorageLink(ctx context.Context, store *hamt.CborIpldStore, c cid.Cid) (interface{}, bool, error) {
+	blk, err := store.Blocks.GetBlock(ctx, c)
+	if err == bserv.ErrNotFound || err == blockstore.ErrNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "failed to load storage link %s", c)
+	}
+
+	var v interface{}
+	if err := cbor.DecodeInto(blk.RawData(), &v); err != nil {
+		return nil, false, nil
+	}
+	return v, true, nil
+}
+
+// diffStorage recursively compares two decoded storage values. Links that
+// differ are loaded and their targets compared in turn. Links whose targets
+// are missing or not cbor are reported as changed themselves, any other error
+// loading them fails the diff.
+func diffStorage(ctx context.Context, store *hamt.CborIpldStore, path string, a, b interface{}) ([]*StorageChange, error) {
+	if path == "" {
+		path = "/"
+	}
+
+	ca, aIsCid := a.(cid.Cid)
+	cb, bIsCid := b.(cid.Cid)
+	if aIsCid && bIsCid {
+		if ca.Equals(cb) {
+			return nil, nil
+		}
+		if !ca.Defined() || !cb.Defined() {
+			return []*StorageChange{{Path: path, Before: a, After: b}}, nil
+		}
+
+		va, aLoaded, err := loadStorageLink(ctx, store, ca)
+		if err != nil {
+			return nil, err
+		}
+		vb, bLoaded, err := loadStorageLink(ctx, store, cb)
+		if err != nil {
+			return nil, err
+		}
+		if !aLoaded || !bLoaded {
+			return []*StorageChange{{Path: path, Before: a, After: b}}, nil
+		}
+		return diffStorage(ctx, store, path, va, vb)
+	}
+
+	ma, aIsMap := a.(map[string]interface{})
+	mb, bIsMap := b.(map[string]interface{})
+	if aIsMap && bIsMap {
+		keys := map[string]struct{}{}
+		for k := range ma {
+			keys[k] = struct{}{}
+		}
+		for k := range mb {
+			keys[k] = struct{}{}
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+
+		var changes []*StorageChange
+		for _, k := range sorted {
+			sub, err := diffStorage(ctx, store, joinPath(path, k), ma[k], mb[k])
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, sub...)
+		}
+		return changes, nil
+	}
+
+	la, aIsList := a.([]interface{})
+	lb, bIsList := b.([]interface{})
+	if aIsList && bIsList {
+		n := len(la)
+		if len(lb) > n {
+			n = len(lb)
+		}
+
+		var changes []*StorageChange
+		for i := 0; i < n; i++ {
+			var ea, eb interface{}
+			if i < len(la) {
+				ea = la[i]
+			}
+			if i < len(lb) {
+				eb = lb[i]
+			}
+			sub, err := diffStorage(ctx, store, joinPath(path, fmt.Sprintf("%d", i)), ea, eb)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, sub...)
+		}
+		return changes, nil
+	}
+
+	if reflect.DeepEqual(a, b) {
+		return nil, nil
+	}
+	return []*StorageChange{{Path: path, Before: a, After: b}}, nil
+}
+
+func joinPath(path, elem string) string {
+	if path == "/" {
+		return path + elem
+	}
+	return path + "/" + elem
+}
+
+func sortActorDiffs(diffs []*ActorDiff) {
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Address.String() < diffs[j].Address.String()
+	})
+}
@@ -0,0 +1,231 @@
+package state
+
+import (
+	"context"
+	"testing"
+
+	"gx/ipfs/QmNf3wujpV2Y7Lnj2hy2UrmuX8bhMDStRHbnSLh7Ypf36h/go-hamt-ipld"
+	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/assert"
+	"gx/ipfs/QmPVkJMTeRC6iBByPWdrRkD3BE5UXsj5HPzb4kPqL186mS/testify/require"
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	"gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
+	block "gx/ipfs/QmWoXtvgC8inqFkAATB7cp2Dax7XBi9VDvSg9RCCZufmRk/go-block-format"
+
+	"github.com/filecoin-project/go-filecoin/actor"
+	"github.com/filecoin-project/go-filecoin/address"
+	"github.com/filecoin-project/go-filecoin/types"
+)
+
+func TestDiff(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	// setup populates a tree with enough actors to force the hamt to link to
+	// sub nodes, and returns the tree and the addresses of its actors.
+	setup := func(require *require.Assertions, cst *hamt.CborIpldStore) (Tree, []address.Address) {
+		st := NewEmptyStateTree(cst)
+		addrGetter := address.NewForTestGetter()
+
+		var addrs []address.Address
+		for i := 0; i < 100; i++ {
+			addr := addrGetter()
+			act := actor.NewActor(types.AccountActorCodeCid, types.NewAttoFILFromFIL(uint64(i)))
+			require.NoError(st.SetActor(ctx, addr, act))
+			addrs = append(addrs, addr)
+		}
+		return st, addrs
+	}
+
+	t.Run("identical roots have no differences", func(t *testing.T) {
+		t.Parallel()
+		require := require.New(t)
+		cst := hamt.NewCborStore()
+
+		st, _ := setup(require, cst)
+		root, err := st.Flush(ctx)
+		require.NoError(err)
+
+		diff, err := Diff(ctx, cst, root, root, false)
+		require.NoError(err)
+		assert.True(t, diff.Empty())
+	})
+
+	t.Run("reports added, removed and changed actors", func(t *testing.T) {
+		t.Parallel()
+		assert := assert.New(t)
+		require := require.New(t)
+		cst := hamt.NewCborStore()
+
+		st, addrs := setup(require, cst)
+		rootA, err := st.Flush(ctx)
+		require.NoError(err)
+
+		// change balance and nonce
+		changed := MustGetActor(st, addrs[3])
+		changed.Balance = changed.Balance.Add(types.NewAttoFILFromFIL(10))
+		changed.IncNonce()
+		changed.IncNonce()
+		require.NoError(st.SetActor(ctx, addrs[3], changed))
+
+		// change code
+		recoded := MustGetActor(st, addrs[7])
+		recoded.Code = types.MinerActorCodeCid
+		require.NoError(st.SetActor(ctx, addrs[7], recoded))
+
+		// remove an actor
+		require.NoError(st.(*tree).root.Delete(ctx, addrs[11].String()))
+
+		// add an actor
+		added := address.NewForTestGetter()
+		for i := 0; i < 100; i++ {
+			added()
+		}
+		newAddr := added()
+		require.NoError(st.SetActor(ctx, newAddr, actor.NewActor(types.AccountActorCodeCid, types.NewAttoFILFromFIL(5))))
+
+		rootB, err := st.Flush(ctx)
+		require.NoError(err)
+
+		diff, err := Diff(ctx, cst, rootA, rootB, false)
+		require.NoError(err)
+
+		require.Len(diff.Added, 1)
+		assert.Equal(newAddr, diff.Added[0].Address)
+		assert.Nil(diff.Added[0].Before)
+
+		require.Len(diff.Removed, 1)
+		assert.Equal(addrs[11], diff.Removed[0].Address)
+		assert.Nil(diff.Removed[0].After)
+
+		require.Len(diff.Changed, 2)
+		byAddr := map[address.Address]*ActorDiff{}
+		for _, ad := range diff.Changed {
+			byAddr[ad.Address] = ad
+		}
+
+		assert.Equal(types.NewAttoFILFromFIL(10), byAddr[addrs[3]].BalanceDelta)
+		assert.Equal(int64(2), byAddr[addrs[3]].NonceDelta)
+		assert.False(byAddr[addrs[3]].CodeChanged)
+
+		assert.True(byAddr[addrs[7]].CodeChanged)
+		assert.Nil(byAddr[addrs[7]].BalanceDelta)
+
+		// and in reverse
+		diff, err = Diff(ctx, cst, rootB, rootA, false)
+		require.NoError(err)
+		require.Len(diff.Added, 1)
+		assert.Equal(addrs[11], diff.Added[0].Address)
+		require.Len(diff.Removed, 1)
+		assert.Equal(newAddr, diff.Removed[0].Address)
+	})
+
+	t.Run("recursively diffs actor storage", func(t *testing.T) {
+		t.Parallel()
+		assert := assert.New(t)
+		require := require.New(t)
+		cst := hamt.NewCborStore()
+
+		st, addrs := setup(require, cst)
+
+		inner, err := cst.Put(ctx, map[string]interface{}{"count": 1, "name": "inner"})
+		require.NoError(err)
+		headA, err := cst.Put(ctx, map[string]interface{}{"inner": inner, "flag": true})
+		require.NoError(err)
+
+		act := MustGetActor(st, addrs[0])
+		act.Head = headA
+		require.NoError(st.SetActor(ctx, addrs[0], act))
+		rootA, err := st.Flush(ctx)
+		require.NoError(err)
+
+		inner, err = cst.Put(ctx, map[string]interface{}{"count": 2, "name": "inner"})
+		require.NoError(err)
+		headB, err := cst.Put(ctx, map[string]interface{}{"inner": inner, "flag": true, "extra": "x"})
+		require.NoError(err)
+
+		act.Head = headB
+		require.NoError(st.SetActor(ctx, addrs[0], act))
+		rootB, err := st.Flush(ctx)
+		require.NoError(err)
+
+		diff, err := Diff(ctx, cst, rootA, rootB, false)
+		require.NoError(err)
+		require.Len(diff.Changed, 1)
+		assert.True(diff.Changed[0].HeadChanged)
+		assert.Empty(diff.Changed[0].Storage)
+
+		diff, err = Diff(ctx, cst, rootA, rootB, true)
+		require.NoError(err)
+		require.Len(diff.Changed, 1)
+
+		changes := diff.Changed[0].Storage
+		require.Len(changes, 2)
+		assert.Equal("/extra", changes[0].Path)
+		assert.Nil(changes[0].Before)
+		assert.Equal("x", changes[0].After)
+		assert.Equal("/inner/count", changes[1].Path)
+	})
+
+	t.Run("reports links that cannot be loaded as changed", func(t *testing.T) {
+		t.Parallel()
+		assert := assert.New(t)
+		require := require.New(t)
+		cst := hamt.NewCborStore()
+
+		st, addrs := setup(require, cst)
+
+		missing := types.SomeCid()
+		headA, err := cst.Put(ctx, map[string]interface{}{"inner": missing})
+		require.NoError(err)
+
+		act := MustGetActor(st, addrs[0])
+		act.Head = headA
+		require.NoError(st.SetActor(ctx, addrs[0], act))
+		rootA, err := st.Flush(ctx)
+		require.NoError(err)
+
+		inner, err := cst.Put(ctx, map[string]interface{}{"count": 1})
+		require.NoError(err)
+		headB, err := cst.Put(ctx, map[string]interface{}{"inner": inner})
+		require.NoError(err)
+
+		act.Head = headB
+		require.NoError(st.SetActor(ctx, addrs[0], act))
+		rootB, err := st.Flush(ctx)
+		require.NoError(err)
+
+		diff, err := Diff(ctx, cst, rootA, rootB, true)
+		require.NoError(err)
+		require.Len(diff.Changed, 1)
+
+		changes := diff.Changed[0].Storage
+		require.Len(changes, 1)
+		assert.Equal("/inner", changes[0].Path)
+		assert.Equal(missing, changes[0].Before)
+		assert.Equal(inner, changes[0].After)
+
+		// other errors loading a link fail the diff
+		failing := &hamt.CborIpldStore{Blocks: &failingBlocks{blockGetter: cst.Blocks, fail: inner}}
+		_, err = Diff(ctx, failing, rootA, rootB, true)
+		assert.Error(err)
+	})
+}
+
+type blockGetter interface {
+	GetBlock(context.Context, cid.Cid) (block.Block, error)
+	AddBlock(block.Block) error
+}
+
+// failingBlocks fails to get the block fail, as a broken blockstore would.
+type failingBlocks struct {
+	blockGetter
+	fail cid.Cid
+}
+
+func (fb *failingBlocks) GetBlock(ctx context.Context, c cid.Cid) (block.Block, error) {
+	if c.Equals(fb.fail) {
+		return nil, errors.New("failed to read block")
+	}
+	return fb.blockGetter.GetBlock(ctx, c)
+}
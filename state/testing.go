@@ -96,6 +96,21 @@ func (m *MockStateTree) GetOrCreateActor(ctx context.Context, address address.Ad
 	return creator()
 }
 
+// Snapshot implements StateTree.Snapshot
+func (m *MockStateTree) Snapshot() RevID {
+	return 0
+}
+
+// Revert implements StateTree.Revert
+func (m *MockStateTree) Revert(rev RevID) error {
+	return nil
+}
+
+// Release implements StateTree.Release
+func (m *MockStateTree) Release(rev RevID) error {
+	return nil
+}
+
 // ForEachActor implements StateTree.ForEachActor
 func (m *MockStateTree) ForEachActor(ctx context.Context, walkFn ActorWalkFn) error {
 	panic("Do not call me")
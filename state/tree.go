@@ -23,6 +23,23 @@ type tree struct {
 	store *hamt.CborIpldStore
 
 	builtinActors map[cid.Cid]exec.ExecutableActor
+
+	// journal records the previous value of every actor set while a
+	// snapshot is open, so that Revert can undo changes in place.
+	journal []journalEntry
+	// snapshots holds, for each open snapshot, the length of the journal
+	// when it was taken.  The RevID of a snapshot is its index.
+	snapshots []int
+	// journaled maps the key of every journaled actor to the index of its
+	// last journal entry.
+	journaled map[string]int
+}
+
+// journalEntry is the value an actor had before it was changed.  prev is nil
+// if there was no actor at the address.
+type journalEntry struct {
+	key  string
+	prev *actor.Actor
 }
 
 // RevID identifies a snapshot of the StateTree.
@@ -43,6 +60,16 @@ type Tree interface {
 	ForEachActor(ctx context.Context, walkFn ActorWalkFn) error
 
 	GetBuiltinActorCode(c cid.Cid) (exec.ExecutableActor, error)
+
+	// Snapshot marks the current state so that later changes can be undone
+	// with Revert.  Snapshots nest: reverting to a snapshot also discards
+	// every snapshot taken after it.
+	Snapshot() RevID
+	// Revert undoes all changes made since the given snapshot was taken.
+	Revert(rev RevID) error
+	// Release keeps the changes made since the given snapshot was taken and
+	// discards it along with every snapshot taken after it.
+	Release(rev RevID) error
 }
 
 var _ Tree = &tree{}
@@ -174,12 +201,93 @@ func (t *tree) GetOrCreateActor(ctx context.Context, address address.Address, cr
 // SetActor sets the memory slot at address 'a' to the given actor.
 // This operation can overwrite existing actors at that address.
 func (t *tree) SetActor(ctx context.Context, a address.Address, act *actor.Actor) error {
+	if len(t.snapshots) > 0 {
+		if err := t.recordPrevious(ctx, a); err != nil {
+			return errors.Wrap(err, "setting actor in state tree failed")
+		}
+	}
 	if err := t.root.Set(ctx, a.String(), act); err != nil {
 		return errors.Wrap(err, "setting actor in state tree failed")
 	}
 	return nil
 }
 
+// recordPrevious appends the current actor at a to the journal, unless it
+// was journaled since the last snapshot was taken: reverting to any open
+// snapshot restores that earlier value already.
+func (t *tree) recordPrevious(ctx context.Context, a address.Address) error {
+	key := a.String()
+	if i, ok := t.journaled[key]; ok && i >= t.snapshots[len(t.snapshots)-1] && i < len(t.journal) && t.journal[i].key == key {
+		return nil
+	}
+
+	prev, err := t.GetActor(ctx, a)
+	if IsActorNotFoundError(err) {
+		prev = nil
+	} else if err != nil {
+		return err
+	}
+	if t.journaled == nil {
+		t.journaled = map[string]int{}
+	}
+	t.journaled[key] = len(t.journal)
+	t.journal = append(t.journal, journalEntry{key: key, prev: prev})
+	return nil
+}
+
+// Snapshot marks the current state of the tree.  Rather than copying the
+// hamt, the tree journals the previous value of every actor set from now on
+// and Revert undoes the journaled changes in reverse order.  Because the hamt
+// is canonical, the reverted tree has the same root as before the snapshot.
+// Snapshots that are not reverted must be released, as the journal is kept
+// while any snapshot is open.
+func (t *tree) Snapshot() RevID {
+	t.snapshots = append(t.snapshots, len(t.journal))
+	return RevID(len(t.snapshots) - 1)
+}
+
+// Revert restores the actors changed since the snapshot rev was taken and
+// discards rev and all later snapshots.
+func (t *tree) Revert(rev RevID) error {
+	if rev < 0 || int(rev) >= len(t.snapshots) {
+		return fmt.Errorf("invalid state tree snapshot %d", rev)
+	}
+
+	mark := t.snapshots[rev]
+	for i := len(t.journal) - 1; i >= mark; i-- {
+		entry := t.journal[i]
+		var err error
+		if entry.prev == nil {
+			err = t.root.Delete(context.Background(), entry.key)
+		} else {
+			err = t.root.Set(context.Background(), entry.key, entry.prev)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to revert actor %s", entry.key)
+		}
+	}
+
+	t.journal = t.journal[:mark]
+	t.snapshots = t.snapshots[:rev]
+	return nil
+}
+
+// Release discards the snapshot rev and all later snapshots, keeping the
+// changes made since. The journal is dropped once no snapshots remain, so
+// that setting actors stops recording their previous values.
+func (t *tree) Release(rev RevID) error {
+	if rev < 0 || int(rev) >= len(t.snapshots) {
+		return fmt.Errorf("invalid state tree snapshot %d", rev)
+	}
+
+	t.snapshots = t.snapshots[:rev]
+	if len(t.snapshots) == 0 {
+		t.journal = nil
+		t.journaled = nil
+	}
+	return nil
+}
+
 // ForEachActor calls walkFn for each actor in the state tree
 func (t *tree) ForEachActor(ctx context.Context, walkFn ActorWalkFn) error {
 	return forEachActor(ctx, t.store, t.root, walkFn)
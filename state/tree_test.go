@@ -143,3 +143,179 @@ func TestGetAllActors(t *testing.T) {
 	assert.Equal(actor.Nonce, found.Nonce)
 	assert.Equal(actor.Balance, found.Balance)
 }
+
+func TestStateSnapshotRevert(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx := context.Background()
+	cst := hamt.NewCborStore()
+	tree := newEmptyStateTree(cst)
+
+	addrGetter := address.NewForTestGetter()
+	var addrs []address.Address
+	for i := 0; i < 50; i++ {
+		addr := addrGetter()
+		require.NoError(tree.SetActor(ctx, addr, actor.NewActor(types.AccountActorCodeCid, types.NewAttoFILFromFIL(uint64(i)))))
+		addrs = append(addrs, addr)
+	}
+	root, err := tree.Flush(ctx)
+	require.NoError(err)
+
+	rev := tree.Snapshot()
+
+	changed := MustGetActor(tree, addrs[0])
+	changed.IncNonce()
+	MustSetActor(tree, addrs[0], changed)
+	newAddr := addrGetter()
+	MustSetActor(tree, newAddr, actor.NewActor(types.AccountActorCodeCid, nil))
+	changedRoot := MustFlush(tree)
+	assert.NotEqual(root, changedRoot)
+
+	inner := tree.Snapshot()
+	changed.IncNonce()
+	MustSetActor(tree, addrs[0], changed)
+	journaled := len(tree.journal)
+
+	// an actor set again since the last snapshot is journaled once
+	changed.IncNonce()
+	MustSetActor(tree, addrs[0], changed)
+	assert.Len(tree.journal, journaled)
+
+	require.NoError(tree.Revert(inner))
+	assert.Equal(changedRoot, MustFlush(tree))
+
+	require.NoError(tree.Revert(rev))
+	assert.Equal(root, MustFlush(tree))
+	assert.Equal(uint64(0), uint64(MustGetActor(tree, addrs[0]).Nonce))
+	_, err = tree.GetActor(ctx, newAddr)
+	assert.True(IsActorNotFoundError(err))
+
+	// reverted snapshots are discarded
+	assert.Error(tree.Revert(inner))
+	assert.Error(tree.Revert(rev))
+}
+
+func TestStateSnapshotRelease(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx := context.Background()
+	cst := hamt.NewCborStore()
+	tree := newEmptyStateTree(cst)
+
+	addrGetter := address.NewForTestGetter()
+	addr := addrGetter()
+	require.NoError(tree.SetActor(ctx, addr, actor.NewActor(types.AccountActorCodeCid, types.NewAttoFILFromFIL(1))))
+
+	rev := tree.Snapshot()
+	changed := MustGetActor(tree, addr)
+	changed.IncNonce()
+	MustSetActor(tree, addr, changed)
+
+	inner := tree.Snapshot()
+	newAddr := addrGetter()
+	MustSetActor(tree, newAddr, actor.NewActor(types.AccountActorCodeCid, nil))
+
+	// releasing an inner snapshot keeps the journal for the outer one
+	require.NoError(tree.Release(inner))
+	assert.Len(tree.journal, 2)
+	assert.Error(tree.Revert(inner))
+
+	// releasing the last snapshot keeps the changes and drops the journal
+	require.NoError(tree.Release(rev))
+	assert.Empty(tree.journal)
+	assert.Empty(tree.snapshots)
+	assert.Equal(uint64(1), uint64(MustGetActor(tree, addr).Nonce))
+	_, err := tree.GetActor(ctx, newAddr)
+	assert.NoError(err)
+
+	// and later changes are no longer journaled
+	MustSetActor(tree, addr, changed)
+	assert.Empty(tree.journal)
+	assert.Error(tree.Release(rev))
+}
+
+// setupBenchmarkTree returns a flushed tree with enough actors to span
+// several hamt nodes.
+func setupBenchmarkTree(b *testing.B) (Tree, *hamt.CborIpldStore, []address.Address) {
+	ctx := context.Background()
+	cst := hamt.NewCborStore()
+	tree := NewEmptyStateTree(cst)
+
+	addrGetter := address.NewForTestGetter()
+	var addrs []address.Address
+	for i := 0; i < 1000; i++ {
+		addr := addrGetter()
+		if err := tree.SetActor(ctx, addr, actor.NewActor(types.AccountActorCodeCid, types.NewAttoFILFromFIL(uint64(i)))); err != nil {
+			b.Fatal(err)
+		}
+		addrs = append(addrs, addr)
+	}
+	if _, err := tree.Flush(ctx); err != nil {
+		b.Fatal(err)
+	}
+	return tree, cst, addrs
+}
+
+// touchActors changes a handful of actors, as processing a block would.
+func touchActors(b *testing.B, tree Tree, addrs []address.Address) {
+	for _, addr := range addrs[:10] {
+		act := MustGetActor(tree, addr)
+		act.IncNonce()
+		if err := tree.SetActor(context.Background(), addr, act); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkIsolationFlushReload isolates changes by flushing the tree and
+// loading a copy from the store, as block validation used to.
+func BenchmarkIsolationFlushReload(b *testing.B) {
+	ctx := context.Background()
+	tree, cst, addrs := setupBenchmarkTree(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		root, err := tree.Flush(ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+		cpy, err := LoadStateTree(ctx, cst, root, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		touchActors(b, cpy, addrs)
+	}
+}
+
+// BenchmarkIsolationSnapshotRelease isolates changes with a snapshot that is
+// released afterwards, keeping the changes, as for a successful message.
+func BenchmarkIsolationSnapshotRelease(b *testing.B) {
+	tree, _, addrs := setupBenchmarkTree(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rev := tree.Snapshot()
+		touchActors(b, tree, addrs)
+		if err := tree.Release(rev); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkIsolationSnapshotRevert isolates changes with a snapshot that is
+// reverted afterwards.
+func BenchmarkIsolationSnapshotRevert(b *testing.B) {
+	tree, _, addrs := setupBenchmarkTree(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rev := tree.Snapshot()
+		touchActors(b, tree, addrs)
+		if err := tree.Revert(rev); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -13,6 +13,7 @@ import (
 	cid "gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
 	"gx/ipfs/QmRu7tiRnFk9mMPpVECQTBQJqXtmG132jJxA1w9A7TtpBz/go-ipfs-blockstore"
 
+	"strconv"
 	"testing"
 )
 
@@ -24,17 +25,17 @@ type TestView struct{}
 var _ consensus.PowerTableView = &TestView{}
 
 // Total always returns 1.
-func (tv *TestView) Total(ctx context.Context, st state.Tree, bstore blockstore.Blockstore) (uint64, error) {
+func (tv *TestView) Total(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, bh *types.BlockHeight) (uint64, error) {
 	return uint64(1), nil
 }
 
 // Miner always returns 1.
-func (tv *TestView) Miner(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, mAddr address.Address) (uint64, error) {
+func (tv *TestView) Miner(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, mAddr address.Address, bh *types.BlockHeight) (uint64, error) {
 	return uint64(1), nil
 }
 
 // HasPower always returns true.
-func (tv *TestView) HasPower(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, mAddr address.Address) bool {
+func (tv *TestView) HasPower(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, mAddr address.Address, bh *types.BlockHeight) bool {
 	return true
 }
 
@@ -46,6 +47,32 @@ func RequireNewTipSet(require *require.Assertions, blks ...*types.Block) types.T
 	return ts
 }
 
+// RequireRandomnessAncestors returns the ancestors a message needs for actors
+// to sample the chain randomness of sampleHeight: tipsets from sampleHeight to
+// sampleHeight+consensus.LookBackParameter, newest first, each with a ticket
+// of its height.
+func RequireRandomnessAncestors(require *require.Assertions, sampleHeight uint64) []types.TipSet {
+	var heights []uint64
+	for i := uint64(0); i <= consensus.LookBackParameter; i++ {
+		heights = append(heights, sampleHeight+consensus.LookBackParameter-i)
+	}
+	return RequireTipSetsAtHeights(require, heights...)
+}
+
+// RequireTipSetsAtHeights returns a tipset for each of the heights, in the
+// same order, each with a ticket of its height. Heights left out are null
+// rounds.
+func RequireTipSetsAtHeights(require *require.Assertions, heights ...uint64) []types.TipSet {
+	var tipsets []types.TipSet
+	for _, h := range heights {
+		blk := types.NewBlockForTest(nil, 0)
+		blk.Height = types.Uint64(h)
+		blk.Ticket = []byte(strconv.FormatUint(h, 10))
+		tipsets = append(tipsets, RequireNewTipSet(require, blk))
+	}
+	return tipsets
+}
+
 // RequireTipSetAdd adds a block to the provided tipset and requires that this
 // does not error.
 func RequireTipSetAdd(require *require.Assertions, blk *types.Block, ts types.TipSet) {
@@ -63,17 +90,17 @@ func NewTestPowerTableView(minerPower uint64, totalPower uint64) *TestPowerTable
 }
 
 // Total always returns value that was supplied to NewTestPowerTableView.
-func (tv *TestPowerTableView) Total(ctx context.Context, st state.Tree, bstore blockstore.Blockstore) (uint64, error) {
+func (tv *TestPowerTableView) Total(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, bh *types.BlockHeight) (uint64, error) {
 	return tv.totalPower, nil
 }
 
 // Miner always returns value that was supplied to NewTestPowerTableView.
-func (tv *TestPowerTableView) Miner(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, mAddr address.Address) (uint64, error) {
+func (tv *TestPowerTableView) Miner(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, mAddr address.Address, bh *types.BlockHeight) (uint64, error) {
 	return tv.minerPower, nil
 }
 
 // HasPower always returns true.
-func (tv *TestPowerTableView) HasPower(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, mAddr address.Address) bool {
+func (tv *TestPowerTableView) HasPower(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, mAddr address.Address, bh *types.BlockHeight) bool {
 	return true
 }
 
@@ -146,13 +173,19 @@ func (ms testSigner) SignBytes(data []byte, addr address.Address) (types.Signatu
 
 // ApplyTestMessage sends a message directly to the vm, bypassing message validation
 func ApplyTestMessage(st state.Tree, store vm.StorageMap, msg *types.Message, bh *types.BlockHeight) (*consensus.ApplicationResult, error) {
+	return ApplyTestMessageWithAncestors(st, store, msg, bh, nil)
+}
+
+// ApplyTestMessageWithAncestors sends a message directly to the vm, bypassing
+// message validation, with the ancestors actors sample chain randomness from.
+func ApplyTestMessageWithAncestors(st state.Tree, store vm.StorageMap, msg *types.Message, bh *types.BlockHeight, ancestors []types.TipSet) (*consensus.ApplicationResult, error) {
 	smsg, err := types.NewSignedMessage(*msg, testSigner{}, types.NewGasPrice(0), types.NewGasUnits(300))
 	if err != nil {
 		panic(err)
 	}
 
 	ta := newTestApplier()
-	return newMessageApplier(smsg, ta, st, store, bh, address.Address{})
+	return newMessageApplier(smsg, ta, st, store, bh, address.Address{}, ancestors)
 }
 
 // ApplyTestMessageWithGas uses the TestBlockRewarder but the default SignedMessageValidator
@@ -164,12 +197,12 @@ func ApplyTestMessageWithGas(st state.Tree, store vm.StorageMap, msg *types.Mess
 		panic(err)
 	}
 	applier := consensus.NewConfiguredProcessor(consensus.NewDefaultMessageValidator(), consensus.NewDefaultBlockRewarder())
-	return newMessageApplier(smsg, applier, st, store, bh, minerOwner)
+	return newMessageApplier(smsg, applier, st, store, bh, minerOwner, nil)
 }
 
 func newMessageApplier(smsg *types.SignedMessage, processor *consensus.DefaultProcessor, st state.Tree, storageMap vm.StorageMap,
-	bh *types.BlockHeight, minerOwner address.Address) (*consensus.ApplicationResult, error) {
-	amr, err := processor.ApplyMessagesAndPayRewards(context.Background(), st, storageMap, []*types.SignedMessage{smsg}, minerOwner, bh, nil)
+	bh *types.BlockHeight, minerOwner address.Address, ancestors []types.TipSet) (*consensus.ApplicationResult, error) {
+	amr, err := processor.ApplyMessagesAndPayRewards(context.Background(), st, storageMap, []*types.SignedMessage{smsg}, minerOwner, bh, ancestors)
 
 	if len(amr.Results) > 0 {
 		return amr.Results[0], err
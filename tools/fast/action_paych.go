@@ -29,6 +29,22 @@ func (f *Filecoin) PaychCreate(ctx context.Context,
 	return out, nil
 }
 
+// PaychAddFunds runs the `paych add-funds` command against the filecoin process.
+func (f *Filecoin) PaychAddFunds(ctx context.Context, channel *types.ChannelID, amount *types.AttoFIL, options ...ActionOption) (cid.Cid, error) {
+	var out cid.Cid
+	args := []string{"go-filecoin", "paych", "add-funds", channel.String(), amount.String()}
+
+	for _, option := range options {
+		args = append(args, option()...)
+	}
+
+	if err := f.RunCmdJSONWithStdin(ctx, nil, &out, args...); err != nil {
+		return cid.Undef, err
+	}
+
+	return out, nil
+}
+
 // PaychClose runs the `paych close` command against the filecoin process.
 func (f *Filecoin) PaychClose(ctx context.Context, voucher string, options ...ActionOption) (cid.Cid, error) {
 	var out cid.Cid
@@ -22,7 +22,7 @@ func ImportAndStore(ctx context.Context, client *fast.Filecoin, ask api.Ask, dat
 	}
 
 	// Client makes a deal
-	deal, err := client.ClientProposeStorageDeal(ctx, dcid, ask.Miner, ask.ID, 10, false)
+	deal, err := client.ClientProposeStorageDeal(ctx, dcid, ask.Miner, ask.ID, 10, false, false)
 	if err != nil {
 		return cid.Undef, nil, err
 	}
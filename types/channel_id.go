@@ -75,6 +75,11 @@ func (z *ChannelID) Equal(y *ChannelID) bool {
 	return z.val.Cmp(y.val) == 0
 }
 
+// LessThan returns true if z < y
+func (z *ChannelID) LessThan(y *ChannelID) bool {
+	return z.val.Cmp(y.val) < 0
+}
+
 // String returns a string version of the ID
 func (z *ChannelID) String() string {
 	return z.val.String()
@@ -174,10 +174,19 @@ func (ctx *Context) Send(to address.Address, method string, value *types.AttoFIL
 	}
 	innerCtx := NewVMContext(innerParams)
 
+	// Roll back whatever the callee changed if the call fails, so a caller
+	// that handles the error does not observe partial state.
+	rev := ctx.state.Snapshot()
 	out, ret, err := deps.Send(context.Background(), innerCtx)
 	if err != nil {
+		if revertErr := ctx.state.Revert(rev); revertErr != nil {
+			return nil, 1, errors.FaultErrorWrap(revertErr, "failed to revert state after failed send")
+		}
 		return nil, ret, err
 	}
+	if err := ctx.state.Release(rev); err != nil {
+		return nil, 1, errors.FaultErrorWrap(err, "failed to release state snapshot after send")
+	}
 
 	return out, ret, nil
 }
@@ -244,12 +253,14 @@ func (ctx *Context) CreateNewActor(addr address.Address, code cid.Cid, initializ
 
 // Rand samples the chain randomness for the tipset at the given height.  The
 // tipset providing randomness for the tipset at sampleHeight is guaranteed to
-// be in ancestors, and Rand will return a fault error if it is not.
+// be in ancestors, and Rand will return a fault error if it is not.  If
+// sampleHeight is a null round the randomness of the nearest tipset before it
+// is sampled, so that every height the chain has reached can be sampled.
 func (ctx *Context) Rand(sampleHeight *types.BlockHeight) ([]byte, error) {
 	sampleIndex := -1
-	var firstHeight uint64
+	var firstHeight, sampledHeight uint64
+	reached := false
 	for i := 0; i < len(ctx.ancestors); i++ {
-
 		height, err := ctx.ancestors[i].Height()
 		if err != nil {
 			return nil, errors.FaultErrorWrap(err, "Error sampling randomness from chain")
@@ -257,13 +268,18 @@ func (ctx *Context) Rand(sampleHeight *types.BlockHeight) ([]byte, error) {
 		if i == 0 {
 			firstHeight = height
 		}
-		if types.NewBlockHeight(height).Equal(sampleHeight) {
+		h := types.NewBlockHeight(height)
+		if !h.LessThan(sampleHeight) {
+			reached = true
+		}
+		if h.LessEqual(sampleHeight) && (sampleIndex == -1 || height > sampledHeight) {
 			sampleIndex = i
-			break
+			sampledHeight = height
 		}
 	}
-	// Fault if a tipset of this height does not exist in ancestors.
-	if sampleIndex == -1 {
+	// Fault if the chain in ancestors has not reached sampleHeight, or has no
+	// tipset at or before it.
+	if sampleIndex == -1 || !reached {
 		return nil, errors.NewFaultError("rand sample height out of range")
 	}
 
@@ -330,7 +330,7 @@ func TestVMContextRand(t *testing.T) {
 		assert.Equal([]byte(strconv.Itoa(7)), r)
 	})
 
-	t.Run("faults with height out of range", func(t *testing.T) {
+	t.Run("samples the tipset before a null round", func(t *testing.T) {
 		// edit ancestors to include null blocks
 		baseBlock := ancestors[len(ancestors)-2].ToSlice()[0]
 		afterNull := types.NewBlockForTest(baseBlock, uint64(0))
@@ -343,8 +343,13 @@ func TestVMContextRand(t *testing.T) {
 		}
 
 		ctx := NewVMContext(vmCtxParams)
-		_, err := ctx.Rand(types.NewBlockHeight(uint64(22))) // null block here
-		assert.Error(err)
+		r, err := ctx.Rand(types.NewBlockHeight(uint64(22))) // null block here
+		assert.NoError(err)
+		assert.Equal([]byte(strconv.Itoa(16)), r)
+
+		r, err = ctx.Rand(types.NewBlockHeight(uint64(19)))
+		assert.NoError(err)
+		assert.Equal([]byte(strconv.Itoa(16)), r)
 
 		_, err = ctx.Rand(types.NewBlockHeight(uint64(30))) // ancestors all lower height
 		assert.Error(err)